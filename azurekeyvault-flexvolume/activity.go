@@ -0,0 +1,147 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Policies for the objects disabled, expired or not yet active
+const (
+	// InactiveObjectsFail fails the mount
+	InactiveObjectsFail = "fail"
+	// InactiveObjectsSkip skips the objects, recording them in the mount report
+	InactiveObjectsSkip = "skip"
+	// InactiveObjectsWarn mounts expired and not yet active objects with a warning. Disabled objects
+	// can't be read, so they still fail the mount
+	InactiveObjectsWarn = "warn"
+)
+
+// Policies for the certificates expiring within their minimum validity
+const (
+	// ValidityPolicyFail fails the mount
+	ValidityPolicyFail = "fail"
+	// ValidityPolicyWarn mounts the certificate with a warning
+	ValidityPolicyWarn = "warn"
+)
+
+// inactiveError is the error of an object disabled, expired or not yet active
+type inactiveError struct {
+	error
+}
+
+// isInactive returns true if err, or the error it wraps, is the error of an object disabled,
+// expired or not yet active
+func isInactive(err error) bool {
+	_, ok := errors.Cause(err).(inactiveError)
+	return ok
+}
+
+// isDisabledResponse returns true if err is the error of a Key Vault request for a disabled
+// object, which Key Vault refuses with a 403
+func isDisabledResponse(err error) bool {
+	detailed, ok := err.(autorest.DetailedError)
+	if !ok || detailed.StatusCode != http.StatusForbidden {
+		return false
+	}
+	requestError, ok := detailed.Original.(*azure.RequestError)
+	if !ok || requestError.ServiceError == nil {
+		return false
+	}
+	if code, ok := requestError.ServiceError.InnerError["code"].(string); ok && strings.HasSuffix(code, "Disabled") {
+		return true
+	}
+	return strings.Contains(requestError.ServiceError.Message, "disabled")
+}
+
+// checkActive returns an inactiveError if a fetched object is expired or not yet active, failing
+// its mount or skipping it depending on the policy of the volume, or logs a warning with the warn
+// policy
+func (adapter *KeyvaultFlexvolumeAdapter) checkActive(object KeyVaultObject, fetched *fetchedObject) error {
+	attributes := fetched.attributes
+	if attributes == nil {
+		return nil
+	}
+	now := time.Now()
+	var reason string
+	switch {
+	case attributes.expires != nil && now.After(time.Time(*attributes.expires)):
+		reason = "expired on " + time.Time(*attributes.expires).UTC().Format(time.RFC3339)
+	case attributes.notBefore != nil && now.Before(time.Time(*attributes.notBefore)):
+		reason = "not active before " + time.Time(*attributes.notBefore).UTC().Format(time.RFC3339)
+	default:
+		return nil
+	}
+	if adapter.options.inactiveObjects == InactiveObjectsWarn {
+		glog.Warningf("%s %s (version: %s) is %s, mounting it anyway%s", object.ObjectType, object.ObjectName, fetched.version, reason, object.ownership())
+		adapter.report.addWarning(object.ObjectType + " " + object.ObjectName + " is " + reason)
+		return nil
+	}
+	return inactiveError{errors.Errorf("%s %s (version: %s) is %s", object.ObjectType, object.ObjectName, fetched.version, reason)}
+}
+
+// skipInactiveObject records an object disabled, expired or not yet active skipped with the skip
+// policy, so the mount continues without it
+func (adapter *KeyvaultFlexvolumeAdapter) skipInactiveObject(object KeyVaultObject, err error) {
+	glog.Warningf("skipping inactive %s %s%s: %s", object.ObjectType, object.ObjectName, object.ownership(), err)
+	adapter.report.addOmission(reportOmission{
+		ObjectName: object.ObjectName,
+		ObjectType: object.ObjectType,
+		FileName:   object.fileName(),
+		Reason:     err.Error(),
+	})
+}
+
+// certificateExpiry returns the expiration of the certificate of a fetched certificate object:
+// the end of validity of the certificate when it was parsed, the expiration of the Key Vault
+// object otherwise
+func certificateExpiry(fetched *fetchedObject) (time.Time, bool) {
+	if fetched.certSecret != nil && fetched.certSecret.certificate != nil {
+		return fetched.certSecret.certificate.NotAfter, true
+	}
+	if fetched.certificate != nil {
+		if certificate, err := x509.ParseCertificate(fetched.certificate); err == nil {
+			return certificate.NotAfter, true
+		}
+	}
+	if fetched.attributes != nil && fetched.attributes.expires != nil {
+		return time.Time(*fetched.attributes.expires), true
+	}
+	return time.Time{}, false
+}
+
+// checkValidity fails the mount of a certificate expiring within its minimumValidityDays, or logs
+// a warning with the warn minimumValidityPolicy, so pods don't start with a certificate about to
+// expire
+func (adapter *KeyvaultFlexvolumeAdapter) checkValidity(object KeyVaultObject, fetched *fetchedObject) error {
+	if object.MinimumValidityDays == 0 {
+		return nil
+	}
+	expiry, ok := certificateExpiry(fetched)
+	if !ok {
+		return nil
+	}
+	minimum := time.Duration(object.MinimumValidityDays) * 24 * time.Hour
+	remaining := time.Until(expiry)
+	if remaining >= minimum {
+		return nil
+	}
+	message := fmt.Sprintf("%s %s (version: %s) expires on %s, in less than its minimumValidityDays of %d", object.ObjectType, object.ObjectName, fetched.version, expiry.UTC().Format(time.RFC3339), object.MinimumValidityDays)
+	if object.MinimumValidityPolicy == ValidityPolicyWarn {
+		glog.Warningf("%s, mounting it anyway%s", message, object.ownership())
+		adapter.report.addWarning(message)
+		return nil
+	}
+	return errors.New(message)
+}
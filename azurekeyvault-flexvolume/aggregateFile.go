@@ -0,0 +1,142 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Formats of the aggregate file
+const (
+	// AggregateFormatJSON writes the objects as a JSON object keyed by file name
+	AggregateFormatJSON string = "json"
+	// AggregateFormatYAML writes the objects as a YAML mapping keyed by file name
+	AggregateFormatYAML string = "yaml"
+)
+
+// aggregateFormat returns the format of the aggregate file: aggregateFormat if set, YAML for
+// .yaml and .yml files, JSON otherwise
+func aggregateFormat(options Option) string {
+	if options.aggregateFormat != "" {
+		return options.aggregateFormat
+	}
+	switch path.Ext(options.aggregateFile) {
+	case ".yaml", ".yml":
+		return AggregateFormatYAML
+	}
+	return AggregateFormatJSON
+}
+
+// aggregateValue returns the value of an object in the aggregate file: its content, or its
+// content in base64 if it isn't text, e.g. DER certificates
+func aggregateValue(content []byte) string {
+	if utf8.Valid(content) {
+		return string(content)
+	}
+	return base64.StdEncoding.EncodeToString(content)
+}
+
+// yamlLiteral returns whether a value can be written as a YAML literal block: multi-line text
+// without leading spaces or carriage returns, that reads back as is
+func yamlLiteral(value string) bool {
+	if !strings.Contains(value, "\n") || strings.HasPrefix(value, " ") || strings.HasPrefix(value, "\n") {
+		return false
+	}
+	for _, r := range value {
+		if r != '\n' && r != '\t' && !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	// trailing spaces on a line are kept by literal blocks, but not trailing empty lines of spaces
+	for _, line := range strings.Split(value, "\n") {
+		if line != "" && strings.TrimSpace(line) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// writeYAMLValue writes a value of the YAML aggregate file: a literal block for multi-line text
+// such as PEM files, a double quoted string otherwise
+func writeYAMLValue(buf *bytes.Buffer, value string) error {
+	if !yamlLiteral(value) {
+		// JSON strings are valid YAML double quoted strings
+		quoted, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(quoted)
+		buf.WriteByte('\n')
+		return nil
+	}
+	// the chomping indicator keeps the trailing line breaks of the value
+	trimmed := strings.TrimRight(value, "\n")
+	switch len(value) - len(trimmed) {
+	case 0:
+		buf.WriteString("|-\n")
+	case 1:
+		buf.WriteString("|\n")
+	default:
+		buf.WriteString("|+\n")
+	}
+	for _, line := range strings.Split(trimmed, "\n") {
+		if line != "" {
+			buf.WriteString("  " + line)
+		}
+		buf.WriteByte('\n')
+	}
+	for i := 1; i < len(value)-len(trimmed); i++ {
+		buf.WriteByte('\n')
+	}
+	return nil
+}
+
+// writeAggregateFile writes the objects mounted to aggregateFile as a single JSON or YAML
+// document keyed by file name, for applications loading one config document at startup
+func (adapter *KeyvaultFlexvolumeAdapter) writeAggregateFile(mounted []mountedObject) error {
+	options := adapter.options
+	values := make(map[string]string, len(mounted))
+	for _, m := range mounted {
+		values[m.fileName] = aggregateValue(m.content)
+	}
+
+	var content bytes.Buffer
+	switch aggregateFormat(options) {
+	case AggregateFormatYAML:
+		fileNames := make([]string, 0, len(values))
+		for fileName := range values {
+			fileNames = append(fileNames, fileName)
+		}
+		sort.Strings(fileNames)
+		for _, fileName := range fileNames {
+			key, err := json.Marshal(fileName)
+			if err != nil {
+				return errors.Wrapf(err, "failed to marshal %s", fileName)
+			}
+			content.Write(key)
+			content.WriteString(": ")
+			if err = writeYAMLValue(&content, values[fileName]); err != nil {
+				return errors.Wrapf(err, "failed to marshal %s", fileName)
+			}
+		}
+	default:
+		document, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal the objects")
+		}
+		content.Write(document)
+		content.WriteByte('\n')
+	}
+	return adapter.writeDerivedFile(options.aggregateFile, content.Bytes())
+}
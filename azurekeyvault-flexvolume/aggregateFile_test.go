@@ -0,0 +1,100 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAggregateFormat(t *testing.T) {
+	tests := []struct {
+		aggregateFile   string
+		aggregateFormat string
+		want            string
+	}{
+		{aggregateFile: "secrets.json", want: AggregateFormatJSON},
+		{aggregateFile: "secrets", want: AggregateFormatJSON},
+		{aggregateFile: "secrets.yaml", want: AggregateFormatYAML},
+		{aggregateFile: "config/secrets.yml", want: AggregateFormatYAML},
+		{aggregateFile: "secrets.yaml", aggregateFormat: AggregateFormatJSON, want: AggregateFormatJSON},
+		{aggregateFile: "secrets.conf", aggregateFormat: AggregateFormatYAML, want: AggregateFormatYAML},
+	}
+	for _, test := range tests {
+		options := Option{aggregateFile: test.aggregateFile, aggregateFormat: test.aggregateFormat}
+		if got := aggregateFormat(options); got != test.want {
+			t.Errorf("aggregateFormat(%q, %q) = %q, want %q", test.aggregateFile, test.aggregateFormat, got, test.want)
+		}
+	}
+}
+
+func TestWriteYAMLValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "single line", value: "s3cr3t", want: "\"s3cr3t\"\n"},
+		{name: "quotes", value: `say "hi"`, want: "\"say \\\"hi\\\"\"\n"},
+		{name: "no trailing line break", value: "a\nb", want: "|-\n  a\n  b\n"},
+		{name: "trailing line break", value: "a\nb\n", want: "|\n  a\n  b\n"},
+		{name: "trailing line breaks", value: "a\n\nb\n\n", want: "|+\n  a\n\n  b\n\n"},
+		{name: "leading space", value: " a\nb", want: "\" a\\nb\"\n"},
+		{name: "carriage returns", value: "a\r\nb", want: "\"a\\r\\nb\"\n"},
+		{name: "line of spaces", value: "a\n  \nb", want: "\"a\\n  \\nb\"\n"},
+		{name: "tabs", value: "a\tb\nc", want: "|-\n  a\tb\n  c\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := writeYAMLValue(&buf, test.value); err != nil {
+			t.Errorf("%s: writeYAMLValue() = %s", test.name, err)
+			continue
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s: writeYAMLValue(%q) = %q, want %q", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestWriteAggregateFile(t *testing.T) {
+	mounted := []mountedObject{
+		{objectType: VaultTypeSecret, fileName: "db-password", content: []byte("s3cr3t")},
+		{objectType: VaultTypeCertificate, fileName: "tls.crt", content: []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")},
+		{objectType: VaultTypeCertificate, fileName: "tls.der", content: []byte{0x30, 0x82, 0xff}},
+	}
+	tests := []struct {
+		aggregateFile string
+		want          string
+	}{
+		{
+			aggregateFile: "secrets.json",
+			want: `{
+  "db-password": "s3cr3t",
+  "tls.crt": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+  "tls.der": "MIL/"
+}
+`,
+		},
+		{
+			aggregateFile: "secrets.yaml",
+			want: `"db-password": "s3cr3t"
+"tls.crt": |
+  -----BEGIN CERTIFICATE-----
+  MIIB
+  -----END CERTIFICATE-----
+"tls.der": "MIL/"
+`,
+		},
+	}
+	for _, test := range tests {
+		adapter := testAdapter(t, "-aggregateFile="+test.aggregateFile, "-filePermission=0400")
+		if err := adapter.writeAggregateFile(mounted); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, adapter, test.aggregateFile, 0400); got != test.want {
+			t.Errorf("%s = %q, want %q", test.aggregateFile, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Like the AtomicWriter of Kubernetes secret volumes, the files of a mount are written to a
+// timestamped directory, e.g. ..2019_04_10_12_30_00.123456789, published by pointing the ..data
+// symlink at it with a rename, which is atomic. Each file or directory at the root of the volume is
+// a symlink through ..data, so consumers never see a partially written or mixed version set of files.
+const (
+	// dataDirName is the symlink to the directory of the files published
+	dataDirName = "..data"
+	// dataDirTmpName is the symlink renamed to ..data to publish a directory
+	dataDirTmpName = "..data_tmp"
+	// reservedPrefix starts the names used by atomic writes, not allowed in file names
+	reservedPrefix = ".."
+)
+
+// dataDir returns the directory the files of the mount are written to
+func (adapter *KeyvaultFlexvolumeAdapter) dataDir() string {
+	if adapter.writeDir != "" {
+		return adapter.writeDir
+	}
+	return adapter.options.dir
+}
+
+// stageData creates the timestamped directory the files of the mount are written to before being
+// published, unless -atomicWrites is disabled
+func (adapter *KeyvaultFlexvolumeAdapter) stageData() error {
+	options := adapter.options
+	if !options.atomicWrites {
+		return nil
+	}
+	dir, err := ioutil.TempDir(options.dir, time.Now().UTC().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create data directory in %s", options.dir)
+	}
+	if err = adapter.setOwnership(dir, adapter.dirMode(), 0050); err != nil {
+		os.RemoveAll(dir)
+		return errors.Wrapf(err, "failed to set permission of data directory %s", dir)
+	}
+	adapter.writeDir = dir
+	return nil
+}
+
+// discardData removes the timestamped directory of a failed mount
+func (adapter *KeyvaultFlexvolumeAdapter) discardData() {
+	if adapter.writeDir == "" {
+		return
+	}
+	if err := os.RemoveAll(adapter.writeDir); err != nil {
+		glog.Warningf("failed to remove data directory %s: %s", adapter.writeDir, err)
+	}
+	adapter.writeDir = ""
+}
+
+// publishData atomically replaces the files of the volume with the ones of the timestamped
+// directory, then removes the previous directory and the symlinks to files no longer written
+func (adapter *KeyvaultFlexvolumeAdapter) publishData() error {
+	if adapter.writeDir == "" {
+		return nil
+	}
+	dir := adapter.options.dir
+	dataDir := filepath.Join(dir, dataDirName)
+	previous, err := os.Readlink(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to read %s", dataDir)
+	}
+
+	tmpDataDir := filepath.Join(dir, dataDirTmpName)
+	os.Remove(tmpDataDir)
+	if err = os.Symlink(filepath.Base(adapter.writeDir), tmpDataDir); err != nil {
+		return errors.Wrapf(err, "failed to create %s", tmpDataDir)
+	}
+	if err = os.Rename(tmpDataDir, dataDir); err != nil {
+		os.Remove(tmpDataDir)
+		return errors.Wrapf(err, "failed to publish %s", adapter.writeDir)
+	}
+
+	names, err := topLevelNames(adapter.writeDir)
+	if err != nil {
+		return err
+	}
+	for name := range names {
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dataDirName, name), link); err != nil {
+			return errors.Wrapf(err, "failed to create %s", link)
+		}
+	}
+
+	if previous == "" || previous == filepath.Base(adapter.writeDir) {
+		return nil
+	}
+	previousNames, err := topLevelNames(filepath.Join(dir, previous))
+	if err != nil {
+		return err
+	}
+	for name := range previousNames {
+		if !names[name] {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				glog.Warningf("failed to remove %s: %s", filepath.Join(dir, name), err)
+			}
+		}
+	}
+	if err = os.RemoveAll(filepath.Join(dir, previous)); err != nil {
+		glog.Warningf("failed to remove previous data directory %s: %s", previous, err)
+	}
+	return nil
+}
+
+// topLevelNames returns the names of the files and directories at the root of dir
+func topLevelNames(dir string) (map[string]bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", dir)
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), reservedPrefix) {
+			names[entry.Name()] = true
+		}
+	}
+	return names, nil
+}
+
+// keepUnchanged returns whether the file at filePath, in the data directory, is the file already
+// published with the same content, kubelet retrying the mount of a volume. It is kept rather than
+// rewritten so its modification time doesn't change and applications watching it don't reload.
+// With atomic writes the published file is linked to the new data directory.
+func (adapter *KeyvaultFlexvolumeAdapter) keepUnchanged(filePath string, content []byte) bool {
+	fileName, err := filepath.Rel(adapter.dataDir(), filePath)
+	if err != nil {
+		return false
+	}
+	published, err := filepath.EvalSymlinks(filepath.Join(adapter.options.dir, fileName))
+	if err != nil {
+		return false
+	}
+	previous, err := ioutil.ReadFile(published)
+	if err != nil || !adapter.sameContent(fileName, previous, content) {
+		return false
+	}
+	if current, err := filepath.EvalSymlinks(filePath); err != nil || current != published {
+		if err = os.Link(published, filePath); err != nil {
+			glog.Warningf("failed to link unchanged %s: %s", published, err)
+			return false
+		}
+	}
+	glog.V(0).Infof("%s is unchanged, kept", fileName)
+	return true
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// budgetsDir holds the fetch budget of each pod, relative to stateDir
+	budgetsDir = "budgets"
+	// budgetWindow is the period fetches are counted over for maxFetchesPerHour
+	budgetWindow = time.Hour
+	// defaultMaxVolumeSize caps volumes to a few MB, enough for hundreds of secrets and
+	// certificates, so a mis-tagged blob or a whole vault can't exhaust the memory of the node
+	defaultMaxVolumeSize = 4 * 1024 * 1024
+)
+
+// podBudget is the state of the fetch budget of a pod, persisted on the node across mounts
+type podBudget struct {
+	// unix timestamps of the fetches of the last budgetWindow
+	Fetches []int64 `json:"fetches"`
+}
+
+// consumeBudget records the fetches of the mount against the budget of the pod, and fails if it
+// would exceed maxFetchesPerHour, so a pod recreated in a loop can't use the vault throughput of
+// the whole node. Mounts of the same pod are serialized by a lock on the budget file.
+func (adapter *KeyvaultFlexvolumeAdapter) consumeBudget(fetches int) error {
+	options := adapter.options
+	if options.maxFetchesPerHour == 0 {
+		return nil
+	}
+	if options.podName == "" || options.podNamespace == "" {
+		glog.Warningf("pod name or namespace is not set, -maxFetchesPerHour is not enforced")
+		return nil
+	}
+
+	dir := filepath.Join(options.stateDir, budgetsDir)
+	if err := os.MkdirAll(dir, dirPermission); err != nil {
+		return errors.Wrapf(err, "failed to create budget directory %s", dir)
+	}
+	fileName := filepath.Join(dir, options.podNamespace+"_"+options.podName+".json")
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, permission)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open budget %s", fileName)
+	}
+	defer file.Close()
+	if err = lockFile(file); err != nil {
+		return errors.Wrapf(err, "failed to lock budget %s", fileName)
+	}
+	defer unlockFile(file)
+
+	var budget podBudget
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read budget %s", fileName)
+	}
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &budget); err != nil {
+			// a corrupted budget is reset rather than blocking the pod forever
+			glog.Warningf("failed to parse budget %s, resetting it: %s", fileName, err)
+		}
+	}
+
+	now := time.Now()
+	windowStart := now.Add(-budgetWindow).Unix()
+	recent := make([]int64, 0, len(budget.Fetches)+fetches)
+	for _, fetch := range budget.Fetches {
+		if fetch > windowStart {
+			recent = append(recent, fetch)
+		}
+	}
+	if len(recent)+fetches > options.maxFetchesPerHour {
+		return errors.Errorf("pod %s/%s exceeded its budget of %d fetches per hour (%d in the last hour, %d requested)", options.podNamespace, options.podName, options.maxFetchesPerHour, len(recent), fetches)
+	}
+	for i := 0; i < fetches; i++ {
+		recent = append(recent, now.Unix())
+	}
+
+	if content, err = json.Marshal(podBudget{Fetches: recent}); err != nil {
+		return errors.Wrap(err, "failed to marshal budget")
+	}
+	if err = file.Truncate(0); err != nil {
+		return errors.Wrapf(err, "failed to write budget %s", fileName)
+	}
+	if _, err = file.WriteAt(content, 0); err != nil {
+		return errors.Wrapf(err, "failed to write budget %s", fileName)
+	}
+	glog.V(2).Infof("pod %s/%s used %d of its %d fetches per hour", options.podNamespace, options.podName, len(recent), options.maxFetchesPerHour)
+	return nil
+}
+
+// reserveSize accounts for a file of size bytes about to be written to the volume, failing if it
+// takes the volume over maxVolumeSize, so a mistakenly huge object can't exhaust the memory of the
+// node through the tmpfs of the volume
+func (adapter *KeyvaultFlexvolumeAdapter) reserveSize(fileName string, size int) error {
+	adapter.volumeSizeMu.Lock()
+	defer adapter.volumeSizeMu.Unlock()
+	maxVolumeSize := adapter.options.maxVolumeSize
+	if maxVolumeSize > 0 && adapter.volumeSize+size > maxVolumeSize {
+		return errors.Errorf("writing %s (%d bytes) takes the volume to %d bytes, more than the maximum of %d allowed by -maxVolumeSize", fileName, size, adapter.volumeSize+size, maxVolumeSize)
+	}
+	adapter.volumeSize += size
+	return nil
+}
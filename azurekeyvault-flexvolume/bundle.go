@@ -0,0 +1,78 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/pkg/errors"
+)
+
+// Parts of a PEM bundle
+const (
+	bundlePartKey   = "key"
+	bundlePartCert  = "cert"
+	bundlePartChain = "chain"
+)
+
+// defaultBundleOrder is the order of the parts of a bundle when bundleOrder is not set
+var defaultBundleOrder = []string{bundlePartKey, bundlePartCert, bundlePartChain}
+
+// fetchBundle returns the private key, certificate and chain of a certificate concatenated in a
+// single PEM file, in the configured order, as expected by HAProxy, nginx and many proxies
+func (adapter *KeyvaultFlexvolumeAdapter) fetchBundle(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*fetchedObject, error) {
+	certSecret, fetched, err := adapter.getCertificateSecret(kvClient, vaultURL, object)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := certSecret.caCerts
+	if len(chain) == 0 && object.IncludeChain {
+		// the chain wasn't imported with the certificate, e.g. issued by an integrated CA
+		if chain, err = adapter.getIssuers(certSecret.certificate); err != nil {
+			return nil, errors.Wrapf(err, "failed to get the chain of certificate %s", object.ObjectName)
+		}
+	}
+
+	order := object.BundleOrder
+	if len(order) == 0 {
+		order = defaultBundleOrder
+	}
+	var bundle bytes.Buffer
+	for _, part := range order {
+		switch part {
+		case bundlePartKey:
+			key, err := encodePrivateKey(certSecret.privateKey, ObjectEncodingPEM)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get the private key of certificate %s", object.ObjectName)
+			}
+			bundle.Write(key)
+		case bundlePartCert:
+			bundle.Write(encodeObject(certSecret.certificate.Raw, "CERTIFICATE", ObjectEncodingPEM))
+		case bundlePartChain:
+			for _, cert := range chain {
+				bundle.Write(encodeObject(cert.Raw, "CERTIFICATE", ObjectEncodingPEM))
+			}
+		}
+	}
+	fetched.content = bundle.Bytes()
+	return fetched, nil
+}
+
+// validateBundleOrder makes sure each part of a bundle is valid and appears once
+func validateBundleOrder(order []string) error {
+	seen := make(map[string]bool, len(order))
+	for _, part := range order {
+		if part != bundlePartKey && part != bundlePartCert && part != bundlePartChain {
+			return errors.Errorf("%q is not a bundle part, should be %s, %s or %s", part, bundlePartKey, bundlePartCert, bundlePartChain)
+		}
+		if seen[part] {
+			return errors.Errorf("%q appears more than once", part)
+		}
+		seen[part] = true
+	}
+	return nil
+}
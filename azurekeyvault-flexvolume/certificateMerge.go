@@ -0,0 +1,83 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// MergeCertificate merges an externally signed certificate (or chain) into the pending
+// operation of a Key Vault certificate, completing the flow started by mounting its csr.
+func (adapter *KeyvaultFlexvolumeAdapter) MergeCertificate() error {
+	options := adapter.options
+	certificateName := options.vaultObjectNames
+
+	x509Certificates, err := readCertificates(options.mergeCertificateFile)
+	if err != nil {
+		return err
+	}
+
+	vaultURL, err := adapter.getVaultURL()
+	if err != nil {
+		return errors.Wrap(err, "failed to get vault")
+	}
+
+	kvClient, err := adapter.initializeKvClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to get keyvaultClient")
+	}
+
+	glog.V(0).Infof("merging %d certificate(s) from %s into %s", len(x509Certificates), options.mergeCertificateFile, certificateName)
+	certbundle, err := kvClient.MergeCertificate(adapter.ctx, *vaultURL, certificateName, kv.CertificateMergeParameters{
+		X509Certificates: &x509Certificates,
+	})
+	if err != nil {
+		return sanitisedError(err, VaultTypeCertificate, certificateName, "")
+	}
+	if certbundle.ID != nil {
+		glog.V(0).Infof("azure KeyVault merged certificate %s", *certbundle.ID)
+	}
+	return nil
+}
+
+// readCertificates returns the DER bytes of every certificate in a PEM file,
+// or the whole file if it is not PEM encoded (a single DER certificate)
+func readCertificates(fileName string) ([][]byte, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read certificate file %s", fileName)
+	}
+
+	if len(content) == 0 {
+		return nil, errors.Errorf("certificate file %s is empty", fileName)
+	}
+
+	var certificates [][]byte
+	isPEM := false
+	rest := content
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		isPEM = true
+		if block.Type == "CERTIFICATE" {
+			certificates = append(certificates, block.Bytes)
+		}
+	}
+	if !isPEM {
+		return [][]byte{content}, nil
+	}
+	if len(certificates) == 0 {
+		return nil, errors.Errorf("certificate file %s has no CERTIFICATE PEM blocks", fileName)
+	}
+	return certificates, nil
+}
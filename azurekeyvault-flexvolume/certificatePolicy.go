@@ -0,0 +1,124 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+)
+
+// policySuffix is appended to the file name of a certificate for its policy sidecar
+const policySuffix = ".policy.json"
+
+// certificatePolicy is the policy sidecar of a certificate, so platform tooling can verify it was
+// issued with a compliant policy without calling the vault
+type certificatePolicy struct {
+	ObjectName    string `json:"objectName"`
+	ObjectVersion string `json:"objectVersion"`
+	// the issuer of the policy, e.g. Self or a certificate authority registered in the vault
+	IssuerName      string `json:"issuerName,omitempty"`
+	CertificateType string `json:"certificateType,omitempty"`
+	// the distinguished name of the issuer of the certificate mounted
+	Issuer           string           `json:"issuer,omitempty"`
+	Subject          string           `json:"subject,omitempty"`
+	DNSNames         []string         `json:"dnsNames,omitempty"`
+	Emails           []string         `json:"emails,omitempty"`
+	UPNs             []string         `json:"upns,omitempty"`
+	EKUs             []string         `json:"ekus,omitempty"`
+	KeyUsage         []string         `json:"keyUsage,omitempty"`
+	ValidityInMonths *int32           `json:"validityInMonths,omitempty"`
+	KeyType          string           `json:"keyType,omitempty"`
+	KeySize          *int32           `json:"keySize,omitempty"`
+	Exportable       *bool            `json:"exportable,omitempty"`
+	ReuseKey         *bool            `json:"reuseKey,omitempty"`
+	ContentType      string           `json:"contentType,omitempty"`
+	LifetimeActions  []lifetimeAction `json:"lifetimeActions,omitempty"`
+}
+
+// lifetimeAction is an action of the policy of a certificate, e.g. its renewal, and its trigger
+type lifetimeAction struct {
+	Action             string `json:"action"`
+	LifetimePercentage *int32 `json:"lifetimePercentage,omitempty"`
+	DaysBeforeExpiry   *int32 `json:"daysBeforeExpiry,omitempty"`
+}
+
+// newCertificatePolicy returns the policy sidecar of a certificate from its Key Vault policy and,
+// if available, its DER certificate
+func newCertificatePolicy(object KeyVaultObject, version string, policy kv.CertificatePolicy, der []byte) certificatePolicy {
+	p := certificatePolicy{ObjectName: object.ObjectName, ObjectVersion: version}
+	if issuer := policy.IssuerParameters; issuer != nil {
+		p.IssuerName = to.String(issuer.Name)
+		p.CertificateType = to.String(issuer.CertificateType)
+	}
+	if x509Props := policy.X509CertificateProperties; x509Props != nil {
+		p.Subject = to.String(x509Props.Subject)
+		if sans := x509Props.SubjectAlternativeNames; sans != nil {
+			p.DNSNames = to.StringSlice(sans.DNSNames)
+			p.Emails = to.StringSlice(sans.Emails)
+			p.UPNs = to.StringSlice(sans.Upns)
+		}
+		p.EKUs = to.StringSlice(x509Props.Ekus)
+		if x509Props.KeyUsage != nil {
+			for _, usage := range *x509Props.KeyUsage {
+				p.KeyUsage = append(p.KeyUsage, string(usage))
+			}
+		}
+		p.ValidityInMonths = x509Props.ValidityInMonths
+	}
+	if keyProps := policy.KeyProperties; keyProps != nil {
+		p.KeyType = to.String(keyProps.KeyType)
+		p.KeySize = keyProps.KeySize
+		p.Exportable = keyProps.Exportable
+		p.ReuseKey = keyProps.ReuseKey
+	}
+	if policy.SecretProperties != nil {
+		p.ContentType = to.String(policy.SecretProperties.ContentType)
+	}
+	if policy.LifetimeActions != nil {
+		for _, action := range *policy.LifetimeActions {
+			a := lifetimeAction{}
+			if action.Action != nil {
+				a.Action = string(action.Action.ActionType)
+			}
+			if action.Trigger != nil {
+				a.LifetimePercentage = action.Trigger.LifetimePercentage
+				a.DaysBeforeExpiry = action.Trigger.DaysBeforeExpiry
+			}
+			p.LifetimeActions = append(p.LifetimeActions, a)
+		}
+	}
+	if der != nil {
+		if certificate, err := x509.ParseCertificate(der); err == nil {
+			p.Issuer = certificate.Issuer.String()
+		}
+	}
+	return p
+}
+
+// addCertificatePolicy fetches the policy of a certificate and adds it to the files of the fetched
+// certificate as <file name>.policy.json
+func (adapter *KeyvaultFlexvolumeAdapter) addCertificatePolicy(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject, fetched *fetchedObject) error {
+	policy, err := kvClient.GetCertificatePolicy(adapter.ctx, vaultURL, object.ObjectName)
+	if err != nil {
+		return sanitisedError(err, object.ObjectType, object.ObjectName, "")
+	}
+	der := fetched.certificate
+	if der == nil && fetched.certSecret != nil && fetched.certSecret.certificate != nil {
+		der = fetched.certSecret.certificate.Raw
+	}
+	content, err := json.MarshalIndent(newCertificatePolicy(object, fetched.version, policy, der), "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal policy of %s", object.ObjectName)
+	}
+	if fetched.files == nil {
+		fetched.files = map[string][]byte{}
+	}
+	fetched.files[object.fileName()+policySuffix] = content
+	return nil
+}
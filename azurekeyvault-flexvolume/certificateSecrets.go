@@ -0,0 +1,125 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	// content types of the secret backing a certificate, set by the certificate policy
+	contentTypePKCS12 = "application/x-pkcs12"
+	contentTypePEM    = "application/x-pem-file"
+)
+
+// certificateSecret is the content of the secret backing a Key Vault certificate:
+// the private key, the certificate and its issuers
+type certificateSecret struct {
+	privateKey  interface{}
+	certificate *x509.Certificate
+	caCerts     []*x509.Certificate
+}
+
+// getCertificateSecret retrieves and decodes the secret backing a certificate, which holds its
+// private key when the certificate policy marks the key as exportable. It returns the fetched
+// object without content, with the version and attributes of the secret.
+func (adapter *KeyvaultFlexvolumeAdapter) getCertificateSecret(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*certificateSecret, *fetchedObject, error) {
+	secret, err := kvClient.GetSecret(adapter.ctx, vaultURL, object.ObjectName, object.ObjectVersion)
+	if err != nil {
+		return nil, nil, sanitisedError(err, object.ObjectType, object.ObjectName, object.ObjectVersion)
+	}
+	if secret.Kid == nil {
+		err = errors.Errorf("secret is not backing a certificate")
+		return nil, nil, sanitisedError(err, object.ObjectType, object.ObjectName, object.ObjectVersion)
+	}
+	parsed, err := parseCertificateSecret(to.String(secret.ContentType), to.String(secret.Value))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to decode certificate %s", object.ObjectName)
+	}
+	return parsed, &fetchedObject{version: versionFromID(secret.ID), attributes: secretAttributes(secret)}, nil
+}
+
+// parseCertificateSecret decodes the value of a certificate secret, a base64 PFX or a PEM file
+// depending on its content type
+func parseCertificateSecret(contentType string, value string) (*certificateSecret, error) {
+	switch contentType {
+	case contentTypePKCS12:
+		pfx, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode PFX")
+		}
+		// Key Vault exports PFX without password
+		privateKey, certificate, caCerts, err := pkcs12.DecodeChain(pfx, "")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse PFX")
+		}
+		return &certificateSecret{privateKey: privateKey, certificate: certificate, caCerts: caCerts}, nil
+	case contentTypePEM:
+		parsed := &certificateSecret{}
+		rest := []byte(value)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			switch block.Type {
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, errors.Wrap(err, "failed to parse certificate")
+				}
+				// the certificate comes first, followed by its issuers
+				if parsed.certificate == nil {
+					parsed.certificate = cert
+				} else {
+					parsed.caCerts = append(parsed.caCerts, cert)
+				}
+			case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+				privateKey, err := parsePrivateKey(block.Bytes)
+				if err != nil {
+					return nil, err
+				}
+				parsed.privateKey = privateKey
+			}
+		}
+		if parsed.privateKey == nil || parsed.certificate == nil {
+			return nil, errors.Errorf("PEM does not contain a private key and a certificate")
+		}
+		return parsed, nil
+	default:
+		return nil, errors.Errorf("unsupported content type %q, should be %s or %s", contentType, contentTypePKCS12, contentTypePEM)
+	}
+}
+
+// parsePrivateKey parses a DER private key in any of the encodings Key Vault may use
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.Errorf("failed to parse private key")
+}
+
+// encodePrivateKey returns a private key as PKCS#8, readable by most servers, in the given encoding
+func encodePrivateKey(privateKey interface{}, encoding string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode private key")
+	}
+	return encodeObject(der, "PRIVATE KEY", encoding), nil
+}
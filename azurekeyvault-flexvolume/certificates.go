@@ -0,0 +1,126 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maximum number of issuers retrieved for a certificate chain
+	maxChainLength = 5
+	// timeout to retrieve an issuer certificate
+	issuerRequestTimeout = 10 * time.Second
+	// maximum size of an issuer certificate, DER or PEM encoded
+	maxIssuerSize = 64 * 1024
+)
+
+// getCertificateChain returns the PEM encoded chain of a DER certificate: the certificate followed
+// by its intermediate issuers, retrieved from the Authority Information Access of each certificate.
+// The self-signed root is not included, as in the fullchain.pem expected by most servers.
+func (adapter *KeyvaultFlexvolumeAdapter) getCertificateChain(der []byte) ([]byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+	issuers, err := adapter.getIssuers(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain bytes.Buffer
+	for _, c := range append([]*x509.Certificate{cert}, issuers...) {
+		if err = pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	return chain.Bytes(), nil
+}
+
+// getIssuers returns the intermediate issuers of a certificate, retrieved from the Authority
+// Information Access of each certificate, up to but excluding the self-signed root
+func (adapter *KeyvaultFlexvolumeAdapter) getIssuers(cert *x509.Certificate) ([]*x509.Certificate, error) {
+	var issuers []*x509.Certificate
+	for len(cert.IssuingCertificateURL) > 0 && !isSelfSigned(cert) {
+		if len(issuers) == maxChainLength {
+			return nil, errors.Errorf("chain is longer than %d certificates", maxChainLength)
+		}
+		issuer, err := adapter.getIssuer(cert)
+		if err != nil {
+			return nil, err
+		}
+		if isSelfSigned(issuer) {
+			break
+		}
+		issuers = append(issuers, issuer)
+		cert = issuer
+	}
+	return issuers, nil
+}
+
+// getIssuer downloads the issuer of a certificate from its Authority Information Access URL
+func (adapter *KeyvaultFlexvolumeAdapter) getIssuer(cert *x509.Certificate) (*x509.Certificate, error) {
+	client := adapter.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// the deadline applies to the clients of the adapter too, which have no timeout of their own
+	ctx := adapter.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, issuerRequestTimeout)
+	defer cancel()
+
+	issuerURL := cert.IssuingCertificateURL[0]
+	glog.V(2).Infof("retrieving issuer of %s from %s", cert.Subject.CommonName, issuerURL)
+	req, err := http.NewRequest(http.MethodGet, issuerURL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get issuer from %s", issuerURL)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get issuer from %s", issuerURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get issuer from %s, status code: %d", issuerURL, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIssuerSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read issuer from %s", issuerURL)
+	}
+	if len(body) > maxIssuerSize {
+		return nil, errors.Errorf("issuer from %s exceeds %d bytes", issuerURL, maxIssuerSize)
+	}
+
+	// issuers are usually served DER encoded, but some CAs serve PEM
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	issuer, err := x509.ParseCertificate(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse issuer from %s", issuerURL)
+	}
+	if err = cert.CheckSignatureFrom(issuer); err != nil {
+		return nil, errors.Wrapf(err, "certificate from %s is not the issuer of %s", issuerURL, cert.Subject.CommonName)
+	}
+	return issuer, nil
+}
+
+// isSelfSigned returns true for certificates signed by their own key, i.e. roots
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
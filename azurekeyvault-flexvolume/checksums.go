@@ -0,0 +1,30 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// checksumSuffix is appended to the file name of an object for its checksum sidecar
+const checksumSuffix = ".sha256"
+
+// writeChecksum writes the SHA-256 of a file of an object to <file name>.sha256 in the format of
+// sha256sum, so sidecars can verify the file and detect rotation with sha256sum -c without
+// reading the object
+func (adapter *KeyvaultFlexvolumeAdapter) writeChecksum(object KeyVaultObject, fileName string, content []byte) error {
+	checksum := fmt.Sprintf("%x  %s\n", sha256.Sum256(content), path.Base(fileName))
+	filePath := filepath.Join(adapter.dataDir(), fileName+checksumSuffix)
+	if err := ioutil.WriteFile(filePath, []byte(checksum), permission); err != nil {
+		return errors.Wrapf(err, "failed to write checksum of %s to %s", object.ObjectName, filePath)
+	}
+	return nil
+}
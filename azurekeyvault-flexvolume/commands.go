@@ -0,0 +1,195 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FlexVolume driver statuses
+const (
+	statusSuccess = "Success"
+	statusFailure = "Failure"
+)
+
+// command is a subcommand of the driver, run with the arguments following its name
+type command struct {
+	name        string
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+// commands of the driver. Without a command name, arguments are passed to mount as in the
+// versions before commands were introduced.
+var commands = []command{
+	{"mount", "fetch the objects of a volume and write them to -dir", runMount},
+	{"unmount", "unmount the volume at -dir and remove its directory", runUnmount},
+	{"rotate", "refresh the volumes registered for rotation periodically, as a daemon of the node", runRotate},
+	{"init", "print the FlexVolume driver status and capabilities", runInit},
+	{"getvolumename", "print the name of a volume derived from its vault and objects", runGetVolumeName},
+	{"validate", "validate the options of a volume without contacting Azure", runValidate},
+	{"version", "print the driver version, git commit, build date and Go version as JSON", runVersion},
+	{"selftest", "check the node can run the driver", runSelftest},
+	{"migrate", "print the options replacing the deprecated options of a volume", runMigrate},
+	{"uninstall", "unmount the volumes of the driver and remove it from the node", runUninstall},
+	{"required-permissions", "print the minimal permissions the identity of a volume needs on its vault", runRequiredPermissions},
+}
+
+// driverStatus is the output of the FlexVolume commands, read by kubelet
+type driverStatus struct {
+	Status       string          `json:"status"`
+	Message      string          `json:"message,omitempty"`
+	VolumeName   string          `json:"volumeName,omitempty"`
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+}
+
+// capabilities of the driver returned by init, for kubelet to pick its code paths, where a
+// capability left out defaults to true
+var capabilities = map[string]bool{
+	// volumes are mounted on the node of the pod, without attach and detach
+	"attach": false,
+	// the driver labels the volume with -seLinuxContext itself, and the runtime relabeling it
+	// would fail once the volume is remounted read-only
+	"selinuxRelabel": false,
+	// the driver applies the fsGroup of the pod itself, kubelet changing the ownership of a
+	// read-only volume would fail
+	"fsGroup": false,
+	// kubelet reports the usage of the volumes with statfs
+	"supportsMetrics": volumeMetrics,
+	// the size of a volume is fixed by its objects
+	"requiresFSResize": false,
+}
+
+// runCommand runs the command named by the first argument
+func runCommand(ctx context.Context, args []string) error {
+	name := "mount"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(ctx, args); err != flag.ErrHelp {
+				return err
+			}
+			return nil
+		}
+	}
+	printUsage()
+	return errors.Errorf("unknown command %q", name)
+}
+
+// printUsage prints the commands of the driver
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", program)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-21s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", program)
+}
+
+// newFlagSet returns the flag set of a command, with the logging flags shared by all commands
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(program+" "+name, flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// printStatus prints a FlexVolume driver status to stdout
+func printStatus(status driverStatus) error {
+	content, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal status")
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// runMount fetches the objects of a volume, or merges a certificate with -mergeCertificateFile
+func runMount(ctx context.Context, args []string) error {
+	options, err := parseConfigs(newFlagSet("mount"), args)
+	if err != nil {
+		return err
+	}
+	if err = Validate(*options); err != nil {
+		return err
+	}
+	adapter := &KeyvaultFlexvolumeAdapter{ctx: ctx, options: *options}
+	if options.mergeCertificateFile != "" {
+		return adapter.MergeCertificate()
+	}
+	if err = adapter.Run(); err != nil {
+		return err
+	}
+	if options.rotation && options.refresh {
+		return touchRegistration(options.stateDir, options.dir)
+	}
+	if options.rotation {
+		return registerRotation(*options, args)
+	}
+	return nil
+}
+
+// runInit prints the capabilities of the driver
+func runInit(ctx context.Context, args []string) error {
+	if err := newFlagSet("init").Parse(args); err != nil {
+		return err
+	}
+	return printStatus(driverStatus{Status: statusSuccess, Capabilities: capabilities})
+}
+
+// runValidate validates the options of a volume, e.g. before deploying a pod spec
+func runValidate(ctx context.Context, args []string) error {
+	options, err := parseConfigs(newFlagSet("validate"), args)
+	if err != nil {
+		return err
+	}
+	if err = Validate(*options); err != nil {
+		return err
+	}
+	for _, d := range getDeprecations(*options) {
+		fmt.Printf("deprecated %s: %s\n", d.Name, d.Message)
+	}
+	fmt.Printf("%d objects, options are valid\n", len(options.objects))
+	return nil
+}
+
+// versionInfo is the output of the version command
+type versionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// runVersion prints the driver version and build metadata as JSON, for inventory tooling to tell
+// which build is installed on a node
+func runVersion(ctx context.Context, args []string) error {
+	if err := newFlagSet("version").Parse(args); err != nil {
+		return err
+	}
+	content, err := json.Marshal(versionInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal version")
+	}
+	fmt.Println(string(content))
+	return nil
+}
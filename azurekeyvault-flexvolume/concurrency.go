@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/pkg/errors"
+)
+
+// defaultConcurrency is the number of objects fetched at the same time by default
+const defaultConcurrency = 4
+
+// objectResult is the result of mounting an object
+type objectResult struct {
+	fetched *fetchedObject
+	err     error
+	// the object wasn't mounted because another object failed the mount first
+	skipped    bool
+	durationMs int64
+	// the vault of the object and when it was fetched, for the manifest
+	vaultURL  string
+	fetchTime time.Time
+}
+
+// mountConcurrently mounts the objects with up to concurrency objects fetched at the same time,
+// returning their results in the order of the objects. With the fail-fast mount policy, the
+// objects not started yet are skipped once an object failed.
+func (adapter *KeyvaultFlexvolumeAdapter) mountConcurrently(kvClient *kv.BaseClient, vaultURL string, objects []KeyVaultObject) []objectResult {
+	results := make([]objectResult, len(objects))
+	var aborted int32
+	semaphore := make(chan struct{}, adapter.options.concurrency)
+	var wg sync.WaitGroup
+	for i := range objects {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if atomic.LoadInt32(&aborted) == 1 {
+				results[i].skipped = true
+				return
+			}
+			object := objects[i]
+			start := time.Now()
+			objectVaultURL, err := adapter.getObjectVaultURL(object, vaultURL)
+			if err == nil {
+				results[i].fetched, err = adapter.mountObject(kvClient, objectVaultURL, object)
+			}
+			if err == nil {
+				err = adapter.writeSymlinks(object)
+			}
+			results[i].err = err
+			results[i].durationMs = since(start)
+			results[i].vaultURL = objectVaultURL
+			results[i].fetchTime = time.Now()
+			tolerated := (object.Optional && isNotFound(err)) || (adapter.options.inactiveObjects == InactiveObjectsSkip && isInactive(err))
+			if err != nil && adapter.options.mountPolicy == MountPolicyFailFast && !tolerated {
+				atomic.StoreInt32(&aborted, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// aggregateErrors returns the errors of the objects failing a mount as a single error
+func aggregateErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return errors.Errorf("%d objects failed: %s", len(errs), strings.Join(messages, "; "))
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/sha256"
+	"sort"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// digest returns the SHA-256 of what is written for a fetched object: its content and its
+// additional files
+func (fetched *fetchedObject) digest() [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(fetched.content)
+	fileNames := make([]string, 0, len(fetched.files))
+	for fileName := range fetched.files {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		h.Write([]byte(fileName))
+		h.Write(fetched.files[fileName])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// fetchConsistent fetches an object consistentReads times and fails unless every read returned
+// the same version and content, guarding against stale reads while the vault fails over. Objects
+// are read once by default.
+func (adapter *KeyvaultFlexvolumeAdapter) fetchConsistent(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*fetchedObject, error) {
+	fetched, err := adapter.fetchObject(kvClient, vaultURL, object)
+	if err != nil {
+		return nil, err
+	}
+	digest := fetched.digest()
+	for read := 2; read <= adapter.options.consistentReads; read++ {
+		again, err := adapter.fetchObject(kvClient, vaultURL, object)
+		if err != nil {
+			return nil, err
+		}
+		if again.version != fetched.version {
+			return nil, errors.Errorf("inconsistent reads of %s %s: read %d returned version %s, read 1 version %s", object.ObjectType, object.ObjectName, read, again.version, fetched.version)
+		}
+		// pfx are encrypted with a random salt, so only their version is compared
+		if object.ObjectFormat != ObjectFormatPFX && again.digest() != digest {
+			return nil, errors.Errorf("inconsistent reads of %s %s: read %d of version %s returned a different content than read 1", object.ObjectType, object.ObjectName, read, fetched.version)
+		}
+	}
+	if adapter.options.consistentReads > 1 {
+		glog.V(0).Infof("%d reads of %s %s returned version %s", adapter.options.consistentReads, object.ObjectType, object.ObjectName, fetched.version)
+	}
+	return fetched, nil
+}
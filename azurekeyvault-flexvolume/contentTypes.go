@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// contentTypeJSON is the content type of secrets holding JSON documents
+const contentTypeJSON = "application/json"
+
+// fetchedSecret returns what to write for a secret: its properties with objectProperty or
+// objectProperties, or depending on its content type unless ignoreContentType is set: binary secrets are decoded, PFX are also split when possible into PEM private key
+// and certificate files and JSON documents are pretty-printed if asked. PEM files are written as is.
+func fetchedSecret(object KeyVaultObject, secret kv.SecretBundle) (*fetchedObject, error) {
+	content, err := decodeSecret(object, secret)
+	if err != nil {
+		return nil, err
+	}
+	fetched := &fetchedObject{content: content, version: versionFromID(secret.ID)}
+	if object.ObjectProperty != "" || len(object.ObjectProperties) > 0 {
+		return fetchedProperties(object, fetched)
+	}
+	// secrets written as stored or hex encoded are never converted
+	if object.IgnoreContentType || object.ObjectEncoding == ObjectEncodingUTF8 || object.ObjectEncoding == ObjectEncodingHex {
+		return fetched, nil
+	}
+
+	switch to.String(secret.ContentType) {
+	case contentTypePKCS12:
+		// the secret itself is still written, so a PFX that can't be split, e.g. uploaded with a
+		// password, doesn't fail mounts that worked before splitting was supported
+		parsed, err := parseCertificateSecret(contentTypePKCS12, to.String(secret.Value))
+		if err != nil {
+			glog.Warningf("failed to split secret %s, writing it as is: %s", object.ObjectName, err)
+			return fetched, nil
+		}
+		key, err := encodePrivateKey(parsed.privateKey, ObjectEncodingPEM)
+		if err != nil {
+			glog.Warningf("failed to split secret %s, writing it as is: %s", object.ObjectName, err)
+			return fetched, nil
+		}
+		var certs bytes.Buffer
+		certs.Write(encodeObject(parsed.certificate.Raw, "CERTIFICATE", ObjectEncodingPEM))
+		for _, cert := range parsed.caCerts {
+			certs.Write(encodeObject(cert.Raw, "CERTIFICATE", ObjectEncodingPEM))
+		}
+		fetched.files = map[string][]byte{
+			object.fileName() + ".key": key,
+			object.fileName() + ".crt": certs.Bytes(),
+		}
+	case contentTypeJSON:
+		if object.PrettyPrint {
+			var indented bytes.Buffer
+			if err = json.Indent(&indented, content, "", "  "); err != nil {
+				return nil, errors.Wrapf(err, "failed to pretty-print secret %s", object.ObjectName)
+			}
+			fetched.content = indented.Bytes()
+		}
+	}
+	return fetched, nil
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"github.com/golang/glog"
+)
+
+// deprecation is the use of a legacy option or flow planned for removal
+type deprecation struct {
+	// stable identifier of the deprecated option or flow, to count its usage across mounts
+	Name string `json:"name"`
+	// what to use instead
+	Message string `json:"message"`
+}
+
+// getDeprecations returns the legacy options and flows used by a mount
+func getDeprecations(options Option) []deprecation {
+	var deprecations []deprecation
+	if options.aADClientSecret != "" {
+		deprecations = append(deprecations, deprecation{
+			Name:    "inline-client-secret",
+			Message: "the client secret is read from the clientsecret key of the secretRef and passed on the command line of the driver, use aadclientsecretfile instead",
+		})
+	}
+	if options.usePodIdentity {
+		deprecations = append(deprecations, deprecation{
+			Name:    "nmi-host-token",
+			Message: "the token is requested from the host/token endpoint of NMI, use usevmmanagedidentity or aadclientsecretfile instead",
+		})
+	}
+	return deprecations
+}
+
+// warnDeprecations logs a warning for each deprecation, prefixed with DEPRECATED so operators
+// can count them in the driver logs before legacy paths are removed
+func warnDeprecations(deprecations []deprecation) {
+	for _, d := range deprecations {
+		glog.Warningf("DEPRECATED %s: %s", d.Name, d.Message)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// protectContent returns content protected with DPAPI-NG for -dpapiProtectionDescriptor, so only
+// the principals of the descriptor, e.g. the gMSA of the pod, can read it, or content as is
+func (adapter *KeyvaultFlexvolumeAdapter) protectContent(content []byte) ([]byte, error) {
+	descriptor := adapter.options.dpapiProtectionDescriptor
+	if descriptor == "" {
+		return content, nil
+	}
+	protected, err := protectSecret(descriptor, content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to protect content for %s", descriptor)
+	}
+	return protected, nil
+}
+
+// sameContent returns whether previous, the content of fileName published by the previous mount,
+// holds content. Protected content differs on each write, so it is compared with the hashes of
+// the manifest of the previous mount instead, and only if it was protected for the same principals.
+func (adapter *KeyvaultFlexvolumeAdapter) sameContent(fileName string, previous []byte, content []byte) bool {
+	descriptor := adapter.options.dpapiProtectionDescriptor
+	if descriptor == "" {
+		return bytes.Equal(previous, content)
+	}
+	manifest, err := readManifest(adapter.options.dir)
+	if err != nil || manifest.ProtectionDescriptor != descriptor {
+		return false
+	}
+	fileName = filepath.ToSlash(fileName)
+	previousSum := sha256.Sum256(previous)
+	contentSum := sha256.Sum256(content)
+	return manifest.Files[fileName] == hex.EncodeToString(previousSum[:]) && manifest.Unprotected[fileName] == hex.EncodeToString(contentSum[:])
+}
@@ -0,0 +1,14 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// protectSecret fails, DPAPI-NG being a Windows API
+func protectSecret(descriptor string, content []byte) ([]byte, error) {
+	return nil, errors.New("-dpapiProtectionDescriptor is not supported on Linux")
+}
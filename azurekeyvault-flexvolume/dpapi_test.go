@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSameContent(t *testing.T) {
+	hash := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	const descriptor = "SID=S-1-5-21-1-2-3-1107"
+	tests := []struct {
+		name       string
+		descriptor string
+		manifest   *mountManifest
+		previous   string
+		content    string
+		want       bool
+	}{
+		{name: "unprotected same", previous: "s3cr3t", content: "s3cr3t", want: true},
+		{name: "unprotected changed", previous: "s3cr3t", content: "n3w", want: false},
+		{name: "protected same", descriptor: descriptor, manifest: &mountManifest{ProtectionDescriptor: descriptor, Files: map[string]string{"team/db-password": hash("blob")}, Unprotected: map[string]string{"team/db-password": hash("s3cr3t")}}, previous: "blob", content: "s3cr3t", want: true},
+		{name: "protected changed", descriptor: descriptor, manifest: &mountManifest{ProtectionDescriptor: descriptor, Files: map[string]string{"team/db-password": hash("blob")}, Unprotected: map[string]string{"team/db-password": hash("s3cr3t")}}, previous: "blob", content: "n3w", want: false},
+		{name: "protected file modified", descriptor: descriptor, manifest: &mountManifest{ProtectionDescriptor: descriptor, Files: map[string]string{"team/db-password": hash("blob")}, Unprotected: map[string]string{"team/db-password": hash("s3cr3t")}}, previous: "other", content: "s3cr3t", want: false},
+		{name: "other descriptor", descriptor: descriptor, manifest: &mountManifest{ProtectionDescriptor: "SID=S-1-5-21-1-2-3-1108", Files: map[string]string{"team/db-password": hash("blob")}, Unprotected: map[string]string{"team/db-password": hash("s3cr3t")}}, previous: "blob", content: "s3cr3t", want: false},
+		{name: "previously unprotected", descriptor: descriptor, manifest: &mountManifest{Files: map[string]string{"team/db-password": hash("s3cr3t")}}, previous: "s3cr3t", content: "s3cr3t", want: false},
+		{name: "no manifest", descriptor: descriptor, previous: "blob", content: "s3cr3t", want: false},
+	}
+	for _, test := range tests {
+		adapter := testAdapter(t)
+		adapter.options.dpapiProtectionDescriptor = test.descriptor
+		if test.manifest != nil {
+			content, err := json.Marshal(test.manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(filepath.Join(adapter.options.dir, manifestFileName), content, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := adapter.sameContent(filepath.FromSlash("team/db-password"), []byte(test.previous), []byte(test.content)); got != test.want {
+			t.Errorf("%s: sameContent() = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
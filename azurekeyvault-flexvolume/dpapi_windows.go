@@ -0,0 +1,51 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// ncryptSilentFlag is the NCRYPT_SILENT_FLAG of NCryptProtectSecret, the driver having no UI
+const ncryptSilentFlag = 0x40
+
+var (
+	ncrypt                               = syscall.NewLazyDLL("ncrypt.dll")
+	procNCryptCreateProtectionDescriptor = ncrypt.NewProc("NCryptCreateProtectionDescriptor")
+	procNCryptCloseProtectionDescriptor  = ncrypt.NewProc("NCryptCloseProtectionDescriptor")
+	procNCryptProtectSecret              = ncrypt.NewProc("NCryptProtectSecret")
+	procLocalFree                        = kernel32.NewProc("LocalFree")
+)
+
+// protectSecret encrypts content with DPAPI-NG to the principals of the protection descriptor,
+// e.g. SID=S-1-5-21-...-1107 for a gMSA, returning the CMS blob NCryptUnprotectSecret decrypts
+func protectSecret(descriptor string, content []byte) ([]byte, error) {
+	rule, err := syscall.UTF16PtrFromString(descriptor)
+	if err != nil {
+		return nil, err
+	}
+	var handle uintptr
+	if r, _, _ := procNCryptCreateProtectionDescriptor.Call(uintptr(unsafe.Pointer(rule)), 0, uintptr(unsafe.Pointer(&handle))); r != 0 {
+		return nil, errors.Errorf("invalid protection descriptor: 0x%x", r)
+	}
+	defer procNCryptCloseProtectionDescriptor.Call(handle)
+
+	var data *byte
+	if len(content) > 0 {
+		data = &content[0]
+	}
+	var blob *byte
+	var size uint32
+	if r, _, _ := procNCryptProtectSecret.Call(handle, ncryptSilentFlag, uintptr(unsafe.Pointer(data)), uintptr(len(content)), 0, 0, uintptr(unsafe.Pointer(&blob)), uintptr(unsafe.Pointer(&size))); r != 0 {
+		return nil, errors.Errorf("NCryptProtectSecret failed: 0x%x", r)
+	}
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(blob)))
+	protected := make([]byte, size)
+	copy(protected, (*[1 << 30]byte)(unsafe.Pointer(blob))[:size:size])
+	return protected, nil
+}
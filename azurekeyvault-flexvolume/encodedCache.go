@@ -0,0 +1,87 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// encodedCacheDir holds the pfx files and keystores encoded by the last mount of each volume,
+// encrypted with the cache key of the node, relative to stateDir
+const encodedCacheDir = "encoded"
+
+// encodedFile is a file encoded by a mount with a generated password and random salts
+type encodedFile struct {
+	// sha256 of what the content was encoded from, e.g. the versions of the objects
+	Source   string `json:"source"`
+	Password string `json:"password"`
+	Content  []byte `json:"content"`
+}
+
+// encodedCacheVolumeDir returns the directory of the files encoded for the volume at dir
+func encodedCacheVolumeDir(stateDir string, dir string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(dir)))
+	return filepath.Join(stateDir, encodedCacheDir, hex.EncodeToString(sum[:8]))
+}
+
+// encodeOnce returns the password and content of the file name of the volume encoded by the
+// previous mount from the same source, e.g. the versions of the objects and the password set, or
+// encodes them with encode. The salts and generated passwords of pfx files and keystores are
+// random, so refreshes would otherwise rewrite them on every poll, the objects being unchanged.
+// Without -stateDir, or if the cache fails, the file is encoded again.
+func (adapter *KeyvaultFlexvolumeAdapter) encodeOnce(name string, source []string, encode func() (string, []byte, error)) (string, []byte, error) {
+	stateDir := adapter.options.stateDir
+	if stateDir == "" {
+		return encode()
+	}
+	hash := sha256.New()
+	for _, value := range source {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	sourceSum := hex.EncodeToString(hash.Sum(nil))
+	nameSum := sha256.Sum256([]byte(name))
+	fileName := filepath.Join(encodedCacheVolumeDir(stateDir, adapter.options.dir), hex.EncodeToString(nameSum[:]))
+
+	var encoded encodedFile
+	plaintext, err := adapter.readSealed(fileName)
+	if err == nil {
+		err = json.Unmarshal(plaintext, &encoded)
+	}
+	if err == nil && encoded.Source == sourceSum {
+		glog.V(2).Infof("%s is unchanged, reusing its encoding", name)
+		return encoded.Password, encoded.Content, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to read the encoding of %s, encoding it again: %s", name, err)
+	}
+
+	password, content, err := encode()
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext, err = json.Marshal(encodedFile{Source: sourceSum, Password: password, Content: content})
+	if err == nil {
+		err = adapter.writeSealed(fileName, plaintext)
+	}
+	if err != nil {
+		glog.Warningf("failed to cache the encoding of %s, the next refresh encodes it again: %s", name, errors.Cause(err))
+	}
+	return password, content, nil
+}
+
+// removeEncodedCache removes the files encoded for the volume at dir, once unmounted
+func removeEncodedCache(stateDir string, dir string) {
+	if err := os.RemoveAll(encodedCacheVolumeDir(stateDir, dir)); err != nil {
+		glog.Warningf("failed to remove the encoded files of %s: %s", dir, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Encodings of the objects written to the volume
+const (
+	// ObjectEncodingPEM base64 PEM blocks
+	ObjectEncodingPEM string = "pem"
+	// ObjectEncodingDER binary DER, required by some embedded and Java clients
+	ObjectEncodingDER string = "der"
+	// ObjectEncodingBase64 binary secrets stored base64 encoded, decoded before being written
+	ObjectEncodingBase64 string = "base64"
+	// ObjectEncodingJWK public part of keys as a JSON web key, as used to verify JWTs
+	ObjectEncodingJWK string = "jwk"
+	// ObjectEncodingUTF8 secrets written as stored, never decoded, e.g. to keep binary secrets base64
+	ObjectEncodingUTF8 string = "utf-8"
+	// ObjectEncodingHex secrets written hex encoded, binary secrets being decoded first
+	ObjectEncodingHex string = "hex"
+)
+
+// contentTypeOctetStream is the content type of secrets holding base64 encoded binary data
+const contentTypeOctetStream = "application/octet-stream"
+
+// decodeSecret returns the content of a secret to write: decoded for binary secrets, so blobs such
+// as keystores or license files arrive intact instead of as base64 text, and hex encoded with the
+// hex encoding
+func decodeSecret(object KeyVaultObject, secret kv.SecretBundle) ([]byte, error) {
+	value := to.String(secret.Value)
+	content := []byte(value)
+	switch {
+	case object.ObjectEncoding == ObjectEncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode secret %s as base64", object.ObjectName)
+		}
+		return decoded, nil
+	case (object.ObjectEncoding == "" || object.ObjectEncoding == ObjectEncodingHex) && !object.IgnoreContentType && to.String(secret.ContentType) == contentTypeOctetStream:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err == nil {
+			content = decoded
+			break
+		}
+		// secrets written before decoding was supported may not be base64 encoded
+		glog.Warningf("secret %s has content type %s but is not base64 encoded, writing it as is", object.ObjectName, contentTypeOctetStream)
+	}
+	if object.ObjectEncoding == ObjectEncodingHex {
+		return []byte(hex.EncodeToString(content)), nil
+	}
+	return content, nil
+}
+
+// encodeObject returns der as is with the der encoding, or as a PEM block of blockType otherwise
+func encodeObject(der []byte, blockType string, encoding string) []byte {
+	if encoding == ObjectEncodingDER {
+		return der
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+// marshalPublicKey returns the PKIX DER encoding of the public part of a JSON web key
+func marshalPublicKey(key *kv.JSONWebKey) ([]byte, error) {
+	var publicKey interface{}
+	switch key.Kty {
+	case kv.RSA, kv.RSAHSM:
+		n, err := decodeJWKField("n", key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKField("e", key.E)
+		if err != nil {
+			return nil, err
+		}
+		publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case kv.EC, kv.ECHSM:
+		var curve elliptic.Curve
+		switch key.Crv {
+		case kv.P256:
+			curve = elliptic.P256()
+		case kv.P384:
+			curve = elliptic.P384()
+		case kv.P521:
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", key.Crv)
+		}
+		x, err := decodeJWKField("x", key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKField("y", key.Y)
+		if err != nil {
+			return nil, err
+		}
+		publicKey = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	default:
+		return nil, errors.Errorf("unsupported key type %s", key.Kty)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode public key")
+	}
+	return der, nil
+}
+
+// publicJWK is the public part of a JSON web key (RFC 7517)
+type publicJWK struct {
+	Kid string `json:"kid,omitempty"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// marshalPublicJWK returns the public part of a JSON web key, with the standard key types since
+// JWT libraries don't know the HSM ones of Key Vault
+func marshalPublicJWK(key *kv.JSONWebKey) ([]byte, error) {
+	jwk := publicJWK{Kid: to.String(key.Kid)}
+	var fields map[string]*string
+	switch key.Kty {
+	case kv.RSA, kv.RSAHSM:
+		jwk.Kty = string(kv.RSA)
+		fields = map[string]*string{"n": key.N, "e": key.E}
+	case kv.EC, kv.ECHSM:
+		jwk.Kty = string(kv.EC)
+		jwk.Crv = string(key.Crv)
+		fields = map[string]*string{"x": key.X, "y": key.Y}
+	default:
+		return nil, errors.Errorf("unsupported key type %s", key.Kty)
+	}
+	encoded := map[string]string{}
+	for name, value := range fields {
+		decoded, err := decodeJWKField(name, value)
+		if err != nil {
+			return nil, err
+		}
+		encoded[name] = base64.RawURLEncoding.EncodeToString(decoded)
+	}
+	jwk.N, jwk.E, jwk.X, jwk.Y = encoded["n"], encoded["e"], encoded["x"], encoded["y"]
+	content, err := json.MarshalIndent(jwk, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode JSON web key")
+	}
+	return append(content, '\n'), nil
+}
+
+// decodeJWKField decodes a base64url field of a JSON web key, with or without padding
+func decodeJWKField(name string, value *string) ([]byte, error) {
+	if value == nil {
+		return nil, errors.Errorf("key has no %s", name)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*value, "="))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s of key", name)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestDecodeSecret(t *testing.T) {
+	binary := base64.StdEncoding.EncodeToString([]byte{0x00, 0xff, 0x10})
+	tests := []struct {
+		name        string
+		object      KeyVaultObject
+		value       string
+		contentType string
+		want        []byte
+		wantErr     bool
+	}{
+		{name: "text", value: "s3cr3t", want: []byte("s3cr3t")},
+		{name: "binary", value: binary, contentType: contentTypeOctetStream, want: []byte{0x00, 0xff, 0x10}},
+		{name: "binary not encoded", value: "s3cr3t!", contentType: contentTypeOctetStream, want: []byte("s3cr3t!")},
+		{name: "binary content type ignored", object: KeyVaultObject{IgnoreContentType: true}, value: binary, contentType: contentTypeOctetStream, want: []byte(binary)},
+		{name: "base64", object: KeyVaultObject{ObjectEncoding: ObjectEncodingBase64}, value: binary, want: []byte{0x00, 0xff, 0x10}},
+		{name: "base64 invalid", object: KeyVaultObject{ObjectEncoding: ObjectEncodingBase64}, value: "s3cr3t!", wantErr: true},
+		{name: "utf-8", object: KeyVaultObject{ObjectEncoding: ObjectEncodingUTF8}, value: binary, contentType: contentTypeOctetStream, want: []byte(binary)},
+		{name: "hex", object: KeyVaultObject{ObjectEncoding: ObjectEncodingHex}, value: "ab", want: []byte("6162")},
+		{name: "hex binary", object: KeyVaultObject{ObjectEncoding: ObjectEncodingHex}, value: binary, contentType: contentTypeOctetStream, want: []byte("00ff10")},
+	}
+	for _, test := range tests {
+		test.object.ObjectName = "secret"
+		secret := kv.SecretBundle{Value: to.StringPtr(test.value)}
+		if test.contentType != "" {
+			secret.ContentType = to.StringPtr(test.contentType)
+		}
+		got, err := decodeSecret(test.object, secret)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: decodeSecret() error = %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: decodeSecret() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEncodeObject(t *testing.T) {
+	der := []byte{0x30, 0x03, 0x02, 0x01, 0x01}
+	if got := encodeObject(der, "CERTIFICATE", ObjectEncodingDER); !bytes.Equal(got, der) {
+		t.Errorf("encodeObject(der) = %x, want %x", got, der)
+	}
+	for _, encoding := range []string{"", ObjectEncodingPEM} {
+		block, rest := pem.Decode(encodeObject(der, "CERTIFICATE", encoding))
+		if block == nil || block.Type != "CERTIFICATE" || !bytes.Equal(block.Bytes, der) || len(rest) != 0 {
+			t.Errorf("encodeObject(%q) isn't a single CERTIFICATE PEM block of der", encoding)
+		}
+	}
+}
+
+func TestMarshalPublicKey(t *testing.T) {
+	privateKey := testCertificate(t, "key").privateKey.(*ecdsa.PrivateKey)
+	field := func(b []byte) *string {
+		return to.StringPtr(base64.RawURLEncoding.EncodeToString(b))
+	}
+	tests := []struct {
+		name    string
+		key     kv.JSONWebKey
+		wantErr bool
+	}{
+		{name: "EC", key: kv.JSONWebKey{Kty: kv.EC, Crv: kv.P256, X: field(privateKey.X.Bytes()), Y: field(privateKey.Y.Bytes())}},
+		{name: "EC-HSM padded", key: kv.JSONWebKey{Kty: kv.ECHSM, Crv: kv.P256, X: to.StringPtr(base64.URLEncoding.EncodeToString(privateKey.X.Bytes())), Y: field(privateKey.Y.Bytes())}},
+		{name: "missing field", key: kv.JSONWebKey{Kty: kv.EC, Crv: kv.P256, X: field(privateKey.X.Bytes())}, wantErr: true},
+		{name: "unsupported curve", key: kv.JSONWebKey{Kty: kv.EC, Crv: kv.SECP256K1, X: field(privateKey.X.Bytes()), Y: field(privateKey.Y.Bytes())}, wantErr: true},
+		{name: "unsupported key type", key: kv.JSONWebKey{Kty: kv.Oct}, wantErr: true},
+	}
+	for _, test := range tests {
+		der, err := marshalPublicKey(&test.key)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: marshalPublicKey() error = %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if ecKey, ok := publicKey.(*ecdsa.PublicKey); !ok || ecKey.X.Cmp(privateKey.X) != 0 || ecKey.Y.Cmp(privateKey.Y) != 0 {
+			t.Errorf("%s: marshalPublicKey() isn't the public key", test.name)
+		}
+	}
+}
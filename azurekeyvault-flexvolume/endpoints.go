@@ -0,0 +1,122 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/pkg/errors"
+)
+
+const (
+	dialTimeout         = 30 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+	maxRedirects        = 10
+)
+
+// getAllowedEndpoints returns the hostnames the driver may connect to with -restrictEndpoints:
+// the AAD and Key Vault endpoints, the endpoint of the identity in use and any configured ones
+func (adapter *KeyvaultFlexvolumeAdapter) getAllowedEndpoints() ([]string, error) {
+	options := adapter.options
+
+	env, err := ParseAzureEnvironment(options.cloudName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse Azure environment")
+	}
+	activeDirectoryEndpoint, err := GetActiveDirectoryEndpoint(env, options.aADRegion)
+	if err != nil {
+		return nil, err
+	}
+	vaultURLs, err := adapter.getVaultURLs()
+	if err != nil {
+		return nil, err
+	}
+	endpoints := append([]string{activeDirectoryEndpoint}, vaultURLs...)
+
+	if options.usePodIdentity {
+		endpoints = append(endpoints, nmibase)
+	}
+	if options.useVmManagedIdentity {
+		msiEndpoint, err := adal.GetMSIVMEndpoint()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get managed identity (MSI) endpoint")
+		}
+		endpoints = append(endpoints, msiEndpoint)
+	}
+
+	var hosts []string
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse endpoint %s", endpoint)
+		}
+		hosts = append(hosts, u.Hostname())
+	}
+	if options.allowedEndpoints != "" {
+		hosts = append(hosts, strings.Split(options.allowedEndpoints, objectsSep)...)
+	}
+	return hosts, nil
+}
+
+// newRestrictedHTTPClient returns an http client that can only connect to the allowed hosts, or to
+// any host if allowedHosts is nil, and only to private addresses if privateOnly is set.
+// Hosts are checked when dialing, so anything else, including redirects and metadata
+// endpoints, fails closed. Proxies are not used since they would hide the target host.
+func newRestrictedHTTPClient(allowedHosts []string, privateOnly bool) *http.Client {
+	allowed := make(map[string]bool, len(allowedHosts))
+	for _, host := range allowedHosts {
+		allowed[strings.ToLower(host)] = true
+	}
+	isAllowed := func(host string) error {
+		if allowedHosts != nil && !allowed[strings.ToLower(host)] {
+			return errors.Errorf("connection to %s is not allowed with -restrictEndpoints", host)
+		}
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if privateOnly {
+		// the address is checked once resolved, so the DNS answer can't change between the
+		// private link check and the connection
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPrivateIP(ip) {
+				return errors.Errorf("connection to public address %s is not allowed with -requirePrivateLink", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				if err = isAllowed(host); err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSHandshakeTimeout: tlsHandshakeTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return isAllowed(req.URL.Hostname())
+		},
+	}
+}
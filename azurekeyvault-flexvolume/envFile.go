@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// EnvKeyFormatUpperSnake writes the keys of the env file in upper snake case, e.g. DB_PASSWORD
+// for db-password or dbPassword
+const EnvKeyFormatUpperSnake = "upper-snake"
+
+var (
+	// envKeyInvalid are the characters not allowed in environment variable names
+	envKeyInvalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	// envValuePlain are the values written without quotes
+	envValuePlain = regexp.MustCompile(`^[A-Za-z0-9_./:@+=,-]*$`)
+)
+
+// envKey returns the key of a secret in the env file from its file name: characters not allowed
+// in environment variable names are replaced by _, and the key is converted to upper snake case
+// with the upper-snake format
+func envKey(fileName string, format string) string {
+	if format == EnvKeyFormatUpperSnake {
+		var snake strings.Builder
+		runes := []rune(fileName)
+		for i, r := range runes {
+			// camelCase boundaries become underscores
+			if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+				snake.WriteByte('_')
+			}
+			snake.WriteRune(r)
+		}
+		fileName = strings.ToUpper(snake.String())
+	}
+	key := envKeyInvalid.ReplaceAllString(fileName, "_")
+	if key != "" && key[0] >= '0' && key[0] <= '9' {
+		key = "_" + key
+	}
+	return key
+}
+
+// envValue returns a value of the env file: as is if it only has plain characters, double quoted
+// with escapes otherwise, so dotenv loaders read multi-line values and don't expand variables
+func envValue(content []byte) string {
+	value := string(content)
+	if envValuePlain.MatchString(value) {
+		return value
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+	return `"` + escaper.Replace(value) + `"`
+}
+
+// writeEnvFile writes the secrets mounted to envFile as KEY=value lines, for applications using
+// dotenv loaders
+func (adapter *KeyvaultFlexvolumeAdapter) writeEnvFile(secrets []mountedObject) error {
+	options := adapter.options
+	var content bytes.Buffer
+	written := map[string]string{}
+	for _, secret := range secrets {
+		key := envKey(secret.fileName, options.envKeyFormat)
+		if other, ok := written[key]; ok {
+			return errors.Errorf("secrets %s and %s have the same key %s in -envFile", other, secret.fileName, key)
+		}
+		written[key] = secret.fileName
+		content.WriteString(key + "=" + envValue(secret.content) + "\n")
+	}
+	return adapter.writeDerivedFile(options.envFile, content.Bytes())
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnvKey(t *testing.T) {
+	tests := []struct {
+		fileName string
+		format   string
+		want     string
+	}{
+		{fileName: "DB_PASSWORD", want: "DB_PASSWORD"},
+		{fileName: "db-password", want: "db_password"},
+		{fileName: "team/db.password", want: "team_db_password"},
+		{fileName: "1password", want: "_1password"},
+		{fileName: "db-password", format: EnvKeyFormatUpperSnake, want: "DB_PASSWORD"},
+		{fileName: "dbPassword", format: EnvKeyFormatUpperSnake, want: "DB_PASSWORD"},
+		{fileName: "tls2Cert", format: EnvKeyFormatUpperSnake, want: "TLS2_CERT"},
+		{fileName: "APIKey", format: EnvKeyFormatUpperSnake, want: "APIKEY"},
+		{fileName: "team/db-password", format: EnvKeyFormatUpperSnake, want: "TEAM_DB_PASSWORD"},
+	}
+	for _, test := range tests {
+		if got := envKey(test.fileName, test.format); got != test.want {
+			t.Errorf("envKey(%q, %q) = %q, want %q", test.fileName, test.format, got, test.want)
+		}
+	}
+}
+
+func TestEnvValue(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{content: "", want: ""},
+		{content: "s3cr3t", want: "s3cr3t"},
+		{content: "https://user@host:443/path=a,b", want: "https://user@host:443/path=a,b"},
+		{content: "with space", want: `"with space"`},
+		{content: "$HOME", want: `"\$HOME"`},
+		{content: `say "hi"`, want: `"say \"hi\""`},
+		{content: `C:\path`, want: `"C:\\path"`},
+		{content: "line1\nline2\r\n", want: `"line1\nline2\r\n"`},
+	}
+	for _, test := range tests {
+		if got := envValue([]byte(test.content)); got != test.want {
+			t.Errorf("envValue(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestWriteEnvFile(t *testing.T) {
+	adapter := testAdapter(t, "-envFile=secrets.env", "-envKeyFormat=upper-snake")
+	secrets := []mountedObject{
+		{objectType: VaultTypeSecret, fileName: "db-password", content: []byte("s3cr3t")},
+		{objectType: VaultTypeSecret, fileName: "apiToken", content: []byte("a b\n")},
+	}
+	if err := adapter.writeEnvFile(secrets); err != nil {
+		t.Fatal(err)
+	}
+	want := "DB_PASSWORD=s3cr3t\n" +
+		`API_TOKEN="a b\n"` + "\n"
+	if got := readTestFile(t, adapter, "secrets.env", 0644); got != want {
+		t.Errorf("secrets.env = %q, want %q", got, want)
+	}
+}
+
+func TestWriteEnvFileSameKey(t *testing.T) {
+	adapter := testAdapter(t, "-envFile=secrets.env", "-envKeyFormat=upper-snake")
+	secrets := []mountedObject{
+		{objectType: VaultTypeSecret, fileName: "db-password", content: []byte("a")},
+		{objectType: VaultTypeSecret, fileName: "dbPassword", content: []byte("b")},
+	}
+	err := adapter.writeEnvFile(secrets)
+	if err == nil || !strings.Contains(err.Error(), "secrets db-password and dbPassword have the same key DB_PASSWORD") {
+		t.Errorf("writeEnvFile() = %v, want the key collision", err)
+	}
+}
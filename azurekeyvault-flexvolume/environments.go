@@ -0,0 +1,210 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// environmentsCacheFile caches the response of the metadata endpoint, relative to stateDir
+	environmentsCacheFile = "environments.json"
+	// environmentsRefreshInterval is how long the cached environments are used before being refreshed
+	environmentsRefreshInterval = 24 * time.Hour
+	// environmentsTimeout bounds the request to the metadata endpoint, which must not hold up mounts
+	environmentsTimeout = 10 * time.Second
+	// environmentsMaxSize bounds the response of the metadata endpoint
+	environmentsMaxSize = 1 << 20
+)
+
+// metadataEnvironments are the environments loaded from the metadata endpoint by uppercase name,
+// which take precedence over the environments compiled in autorest
+var metadataEnvironments map[string]azure.Environment
+
+// metadataCloudNames maps the names of the metadata endpoint to the autorest names used by -cloudName
+var metadataCloudNames = map[string]string{
+	"AZURECLOUD":        azure.PublicCloud.Name,
+	"AZURECHINACLOUD":   azure.ChinaCloud.Name,
+	"AZUREUSGOVERNMENT": azure.USGovernmentCloud.Name,
+	"AZUREGERMANCLOUD":  azure.GermanCloud.Name,
+}
+
+// cloudMetadata is a cloud as described by the ARM metadata endpoint
+type cloudMetadata struct {
+	Name            string `json:"name"`
+	ResourceManager string `json:"resourceManager"`
+	Portal          string `json:"portal"`
+	Graph           string `json:"graph"`
+	Authentication  struct {
+		LoginEndpoint string `json:"loginEndpoint"`
+	} `json:"authentication"`
+	Suffixes struct {
+		KeyVaultDNS string `json:"keyVaultDns"`
+	} `json:"suffixes"`
+}
+
+// loadEnvironments loads the environments described by the metadata endpoint, refreshed at most
+// every environmentsRefreshInterval through a cache in stateDir, so new clouds and endpoint changes
+// don't need a new driver. Failures are not fatal: the stale cache, then the compiled-in
+// environments are used instead.
+func loadEnvironments(options Option) {
+	metadataURL := options.environmentMetadataURL
+	if metadataURL == "" {
+		return
+	}
+
+	var cacheFile string
+	var cached []byte
+	if options.stateDir != "" {
+		cacheFile = filepath.Join(options.stateDir, environmentsCacheFile)
+		if info, err := os.Stat(cacheFile); err == nil {
+			if cached, err = ioutil.ReadFile(cacheFile); err == nil && time.Since(info.ModTime()) < environmentsRefreshInterval {
+				if environments, err := parseEnvironments(cached); err == nil {
+					metadataEnvironments = environments
+					return
+				}
+			}
+		}
+	}
+
+	content, err := fetchEnvironments(metadataURL)
+	var environments map[string]azure.Environment
+	if err == nil {
+		environments, err = parseEnvironments(content)
+	}
+	if err != nil {
+		glog.Warningf("failed to refresh environments from %s: %s", metadataURL, err)
+		if cached != nil {
+			if environments, err = parseEnvironments(cached); err == nil {
+				glog.Warningf("using environments cached in %s", cacheFile)
+				metadataEnvironments = environments
+			}
+		}
+		return
+	}
+	metadataEnvironments = environments
+	glog.V(2).Infof("loaded %d environments from %s", len(environments), metadataURL)
+
+	if cacheFile != "" {
+		if err = writeEnvironmentsCache(cacheFile, content); err != nil {
+			glog.Warningf("failed to cache environments: %s", err)
+		}
+	}
+}
+
+// fetchEnvironments returns the response of the metadata endpoint
+func fetchEnvironments(metadataURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("User-Agent", GetUserAgent())
+	client := &http.Client{Timeout: environmentsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, environmentsMaxSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response")
+	}
+	return content, nil
+}
+
+// parseEnvironments parses the response of the metadata endpoint: a list of clouds, or a single
+// cloud as returned by Azure Stack
+func parseEnvironments(content []byte) (map[string]azure.Environment, error) {
+	var clouds []cloudMetadata
+	if err := json.Unmarshal(content, &clouds); err != nil {
+		var cloud cloudMetadata
+		if err = json.Unmarshal(content, &cloud); err != nil {
+			return nil, errors.Wrap(err, "failed to parse environments")
+		}
+		clouds = []cloudMetadata{cloud}
+	}
+
+	environments := map[string]azure.Environment{}
+	for _, cloud := range clouds {
+		if cloud.Name == "" || cloud.Authentication.LoginEndpoint == "" || cloud.Suffixes.KeyVaultDNS == "" {
+			continue
+		}
+		env := cloud.environment()
+		environments[strings.ToUpper(env.Name)] = env
+	}
+	if len(environments) == 0 {
+		return nil, errors.Errorf("no environment with login and Key Vault endpoints")
+	}
+	return environments, nil
+}
+
+// environment returns the cloud as an autorest environment, based on the compiled-in environment
+// of the same name for the endpoints the metadata endpoint doesn't describe
+func (cloud cloudMetadata) environment() azure.Environment {
+	name := cloud.Name
+	if autorestName, ok := metadataCloudNames[strings.ToUpper(name)]; ok {
+		name = autorestName
+	}
+	var env azure.Environment
+	if !strings.EqualFold(name, "AZURESTACKCLOUD") {
+		env, _ = azure.EnvironmentFromName(name)
+	}
+	env.Name = name
+
+	// adal resolves the token endpoint relative to the AAD endpoint
+	env.ActiveDirectoryEndpoint = strings.TrimSuffix(cloud.Authentication.LoginEndpoint, "/") + "/"
+	keyVaultDNS := strings.TrimPrefix(cloud.Suffixes.KeyVaultDNS, ".")
+	env.KeyVaultDNSSuffix = keyVaultDNS
+	env.KeyVaultEndpoint = "https://" + keyVaultDNS + "/"
+	env.ResourceIdentifiers.KeyVault = "https://" + keyVaultDNS
+	if cloud.ResourceManager != "" {
+		env.ResourceManagerEndpoint = cloud.ResourceManager
+	}
+	if cloud.Portal != "" {
+		env.ManagementPortalURL = cloud.Portal
+	}
+	if cloud.Graph != "" {
+		env.GraphEndpoint = cloud.Graph
+	}
+	return env
+}
+
+// writeEnvironmentsCache replaces the cache atomically, as concurrent mounts may read it
+func writeEnvironmentsCache(cacheFile string, content []byte) error {
+	dir := filepath.Dir(cacheFile)
+	if err := os.MkdirAll(dir, dirPermission); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", dir)
+	}
+	tmp, err := ioutil.TempFile(dir, environmentsCacheFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file in %s", dir)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp.Name())
+	}
+	if err = os.Chmod(tmp.Name(), permission); err != nil {
+		return errors.Wrapf(err, "failed to set permissions of %s", tmp.Name())
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), cacheFile), "failed to write %s", cacheFile)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// eventGridQueueSize is the number of events waiting for the rotation daemon, further events
+	// being dropped, the volumes being polled anyway
+	eventGridQueueSize = 100
+	// eventGridMaxSize bounds the body of a delivery
+	eventGridMaxSize = 1024 * 1024
+	// subscriptionValidationEvent is the event type of the handshake of a new subscription
+	subscriptionValidationEvent = "Microsoft.EventGrid.SubscriptionValidationEvent"
+)
+
+// keyVaultNewVersionEvents are the event types of new versions of Key Vault objects
+var keyVaultNewVersionEvents = map[string]bool{
+	"Microsoft.KeyVault.SecretNewVersionCreated":      true,
+	"Microsoft.KeyVault.CertificateNewVersionCreated": true,
+	"Microsoft.KeyVault.KeyNewVersionCreated":         true,
+}
+
+// eventGridEvent is an event delivered by Event Grid, in the Event Grid schema
+type eventGridEvent struct {
+	EventType string          `json:"eventType"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// keyVaultEvent is the data of a Key Vault event
+type keyVaultEvent struct {
+	VaultName  string `json:"VaultName"`
+	ObjectType string `json:"ObjectType"`
+	ObjectName string `json:"ObjectName"`
+	Version    string `json:"Version"`
+}
+
+// mountedBy returns whether the volume of registration mounts the object of the event, according
+// to the manifest published by its last mount
+func (event keyVaultEvent) mountedBy(registration rotationRegistration) bool {
+	content, err := ioutil.ReadFile(filepath.Join(registration.Dir, manifestFileName))
+	if err != nil {
+		return false
+	}
+	var manifest mountManifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return false
+	}
+	for _, object := range manifest.Objects {
+		// certificates also have a secret and a key of the same name, whatever the object type
+		if !strings.EqualFold(object.ObjectName, event.ObjectName) {
+			continue
+		}
+		if u, err := url.Parse(object.VaultURL); err == nil && strings.EqualFold(strings.SplitN(u.Hostname(), ".", 2)[0], event.VaultName) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventGridListener receives the Key Vault events of an Event Grid webhook subscription
+type eventGridListener struct {
+	address    string
+	certFile   string
+	keyFile    string
+	secretFile string
+	secret     string
+}
+
+// start listens for deliveries in the background, queuing the Key Vault events to events
+func (listener *eventGridListener) start(events chan<- keyVaultEvent) error {
+	if listener.certFile == "" || listener.keyFile == "" {
+		return errors.Errorf("-eventGridAddress requires -eventGridTLSCertFile and -eventGridTLSKeyFile")
+	}
+	if listener.secretFile == "" {
+		return errors.Errorf("-eventGridAddress requires -eventGridSecretFile")
+	}
+	secret, err := ioutil.ReadFile(listener.secretFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read -eventGridSecretFile %s", listener.secretFile)
+	}
+	if listener.secret = strings.TrimSpace(string(secret)); listener.secret == "" {
+		return errors.Errorf("-eventGridSecretFile %s is empty", listener.secretFile)
+	}
+	server := &http.Server{
+		Addr:         listener.address,
+		Handler:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { listener.serve(w, r, events) }),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	go func() {
+		glog.V(0).Infof("receiving Event Grid deliveries on %s", listener.address)
+		if err := server.ListenAndServeTLS(listener.certFile, listener.keyFile); err != nil {
+			glog.Fatalf("failed to receive Event Grid deliveries on %s: %s", listener.address, err)
+		}
+	}()
+	return nil
+}
+
+// serve handles a delivery: it answers the validation handshake of the subscription, and queues
+// the new versions of Key Vault objects
+func (listener *eventGridListener) serve(w http.ResponseWriter, r *http.Request, events chan<- keyVaultEvent) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("code")), []byte(listener.secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var delivery []eventGridEvent
+	if err := json.NewDecoder(io.LimitReader(r.Body, eventGridMaxSize)).Decode(&delivery); err != nil {
+		http.Error(w, "invalid events", http.StatusBadRequest)
+		return
+	}
+	for _, event := range delivery {
+		switch {
+		case event.EventType == subscriptionValidationEvent:
+			var data struct {
+				ValidationCode string `json:"validationCode"`
+			}
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				http.Error(w, "invalid validation event", http.StatusBadRequest)
+				return
+			}
+			glog.V(0).Infof("validated the Event Grid subscription")
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"validationResponse": data.ValidationCode})
+			return
+		case keyVaultNewVersionEvents[event.EventType]:
+			var data keyVaultEvent
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				glog.Warningf("failed to parse %s event: %s", event.EventType, err)
+				continue
+			}
+			select {
+			case events <- data:
+			default:
+				glog.Warningf("dropped the new version of %s %s, too many events waiting", data.ObjectType, data.ObjectName)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
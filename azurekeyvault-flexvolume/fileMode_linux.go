@@ -0,0 +1,14 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"os"
+)
+
+// setFileMode sets the mode of filePath, regardless of the umask of the driver
+func setFileMode(filePath string, mode os.FileMode) error {
+	return os.Chmod(filePath, mode)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// Well-known SIDs granted access to the files that aren't readable by others
+const (
+	sidLocalSystem    = "*S-1-5-18"
+	sidAdministrators = "*S-1-5-32-544"
+	sidUsers          = "*S-1-5-32-545"
+)
+
+// setFileMode sets the ACL of filePath from mode, Windows ignoring all but the write bit of chmod:
+// a file readable by others keeps the ACL inherited from the volume, otherwise only SYSTEM and
+// Administrators can read it, and Users too if it is readable by the group. Directories keep the
+// ACL inherited from the volume, the driver writing to them.
+func setFileMode(filePath string, mode os.FileMode) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	if err = os.Chmod(filePath, mode); err != nil {
+		return err
+	}
+	if mode&0004 != 0 {
+		return nil
+	}
+	grants := []string{sidLocalSystem + ":(R)", sidAdministrators + ":(R)"}
+	if mode&0040 != 0 {
+		grants = append(grants, sidUsers+":(R)")
+	}
+	args := append([]string{filePath, "/inheritance:r", "/grant:r"}, grants...)
+	if output, err := exec.Command("icacls", args...).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to set the ACL of %s: %s", filePath, output)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// updateGolden rewrites the expected file trees of the fixtures with the ones mounted, e.g. after
+// an intended change of the output: go test -run TestGolden -update
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata/golden")
+
+// goldenDir holds the fixtures <name>.yaml and their expected file trees <name>.golden.yaml
+const goldenDir = "testdata/golden"
+
+// goldenVaultURL is the vault of the fixtures, served by a goldenVault
+const goldenVaultURL = "https://myvault.vault.azure.net"
+
+// goldenFixture is a volume mounted by TestGolden: its options, as set in the pod spec, and the
+// secrets of the vault
+type goldenFixture struct {
+	Options map[string]string       `yaml:"options"`
+	Secrets map[string]goldenSecret `yaml:"secrets"`
+}
+
+// goldenSecret is a secret of the vault of a fixture, at version v1
+type goldenSecret struct {
+	Value       string            `yaml:"value"`
+	ContentType string            `yaml:"contentType,omitempty"`
+	Tags        map[string]string `yaml:"tags,omitempty"`
+}
+
+// goldenTree is the expected result of mounting a fixture: its files by path relative to the
+// volume, or the error of the mount
+type goldenTree struct {
+	Error string                `yaml:"error,omitempty"`
+	Files map[string]goldenFile `yaml:"files,omitempty"`
+}
+
+// goldenFile is a file of the volume. The content of the files whose name starts with a dot, such
+// as the manifest, isn't compared since it holds the times of the mount.
+type goldenFile struct {
+	Mode    string `yaml:"mode"`
+	Content string `yaml:"content,omitempty"`
+}
+
+// goldenOptionFlags are the flags of the volume options whose names differ from the lowercase
+// name of their flag, as mapped by kv
+var goldenOptionFlags = map[string]string{
+	"keyvaultname":           "vaultName",
+	"vaulturi":               "vaultURI",
+	"keyvaultobjectnames":    "vaultObjectNames",
+	"keyvaultobjecttypes":    "vaultObjectTypes",
+	"keyvaultobjectversions": "vaultObjectVersions",
+	"keyvaultobjectaliases":  "vaultObjectAliases",
+	"objects":                "vaultObjects",
+}
+
+// goldenArgs returns the arguments of the mount of the options of a fixture, as kv passes them
+func goldenArgs(t *testing.T, options map[string]string) []string {
+	t.Helper()
+	flags := map[string]string{}
+	fs := flag.NewFlagSet("golden", flag.ContinueOnError)
+	parseConfigs(fs, nil)
+	fs.VisitAll(func(f *flag.Flag) {
+		flags[strings.ToLower(f.Name)] = f.Name
+	})
+	for option, name := range goldenOptionFlags {
+		flags[option] = name
+	}
+	names := make([]string, 0, len(options))
+	for option := range options {
+		names = append(names, option)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, option := range names {
+		name, ok := flags[option]
+		if !ok {
+			t.Fatalf("unknown volume option %s", option)
+		}
+		args = append(args, "-"+name+"="+options[option])
+	}
+	return args
+}
+
+// goldenVault serves the secrets of a fixture as Key Vault does
+func goldenVault(t *testing.T, secrets map[string]goldenSecret) *httptest.Server {
+	bundle := func(name string, secret goldenSecret, withValue bool) map[string]interface{} {
+		item := map[string]interface{}{
+			"id":         goldenVaultURL + "/secrets/" + name,
+			"attributes": map[string]interface{}{"enabled": true, "created": 1569931200, "updated": 1569931200},
+		}
+		if withValue {
+			item["id"] = goldenVaultURL + "/secrets/" + name + "/v1"
+			item["value"] = secret.Value
+		}
+		if secret.ContentType != "" {
+			item["contentType"] = secret.ContentType
+		}
+		if len(secret.Tags) > 0 {
+			item["tags"] = secret.Tags
+		}
+		return item
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elements := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(elements) == 1 && elements[0] == "secrets":
+			names := make([]string, 0, len(secrets))
+			for name := range secrets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			items := []map[string]interface{}{}
+			for _, name := range names {
+				items = append(items, bundle(name, secrets[name], false))
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": items})
+			return
+		case len(elements) == 3 && elements[0] == "secrets" && elements[2] == "versions":
+			if secret, ok := secrets[elements[1]]; ok {
+				item := bundle(elements[1], secret, false)
+				item["id"] = goldenVaultURL + "/secrets/" + elements[1] + "/v1"
+				json.NewEncoder(w).Encode(map[string]interface{}{"value": []interface{}{item}})
+				return
+			}
+		case len(elements) >= 2 && elements[0] == "secrets" && (len(elements) == 2 || elements[2] == "" || elements[2] == "v1"):
+			if secret, ok := secrets[elements[1]]; ok {
+				json.NewEncoder(w).Encode(bundle(elements[1], secret, true))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": "SecretNotFound", "message": "A secret with (name/id) " + r.URL.Path + " was not found in this key vault."}})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// readGoldenTree returns the files of the volume at dir, following the symlinks of -atomicWrites
+// but for the timestamped directories and ..data
+func readGoldenTree(t *testing.T, dir string, prefix string, files map[string]goldenFile) {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), reservedPrefix) {
+			continue
+		}
+		fileName := path.Join(prefix, entry.Name())
+		filePath := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsDir() {
+			readGoldenTree(t, filePath, fileName, files)
+			continue
+		}
+		file := goldenFile{Mode: fmt.Sprintf("%04o", info.Mode().Perm())}
+		if !strings.HasPrefix(entry.Name(), ".") {
+			content, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.Content = string(content)
+		}
+		files[fileName] = file
+	}
+}
+
+// TestGolden mounts each fixture of testdata/golden from a vault serving its secrets, and compares
+// the files of the volume, their modes and content, with its golden file
+func TestGolden(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join(goldenDir, "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fixtureFile := range fixtures {
+		if strings.HasSuffix(fixtureFile, ".golden.yaml") {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(fixtureFile), ".yaml")
+		t.Run(name, func(t *testing.T) {
+			content, err := ioutil.ReadFile(fixtureFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fixture goldenFixture
+			if err = yaml.UnmarshalStrict(content, &fixture); err != nil {
+				t.Fatalf("failed to parse %s: %s", fixtureFile, err)
+			}
+
+			vault := goldenVault(t, fixture.Secrets)
+			kvClient := kv.New()
+			kvClient.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+				r.URL.Scheme = "http"
+				r.URL.Host = strings.TrimPrefix(vault.URL, "http://")
+				return http.DefaultClient.Do(r)
+			})
+			adapter := testAdapter(t, append([]string{"-allowPersistentDir", "-remountReadOnly=false"}, goldenArgs(t, fixture.Options)...)...)
+			adapter.ctx = context.Background()
+			adapter.kvClient = &kvClient
+
+			var got goldenTree
+			if err = Validate(adapter.options); err == nil {
+				err = adapter.Run()
+			}
+			if err != nil {
+				got.Error = err.Error()
+			} else {
+				got.Files = map[string]goldenFile{}
+				readGoldenTree(t, adapter.options.dir, "", got.Files)
+			}
+
+			goldenPath := filepath.Join(goldenDir, name+".golden.yaml")
+			if *updateGolden {
+				content, err := yaml.Marshal(got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = ioutil.WriteFile(goldenPath, content, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			content, err = ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("failed to read %s, run go test -run TestGolden -update to create it: %s", goldenPath, err)
+			}
+			var want goldenTree
+			if err = yaml.UnmarshalStrict(content, &want); err != nil {
+				t.Fatalf("failed to parse %s: %s", goldenPath, err)
+			}
+			if got.Error != want.Error {
+				t.Errorf("mount error = %q, want %q", got.Error, want.Error)
+			}
+			for fileName, file := range want.Files {
+				if gotFile, ok := got.Files[fileName]; !ok {
+					t.Errorf("%s is missing", fileName)
+				} else if gotFile != file {
+					t.Errorf("%s = %+v, want %+v", fileName, gotFile, file)
+				}
+			}
+			for fileName := range got.Files {
+				if _, ok := want.Files[fileName]; !ok {
+					t.Errorf("%s is unexpected", fileName)
+				}
+			}
+		})
+	}
+}
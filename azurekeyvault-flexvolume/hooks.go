@@ -0,0 +1,56 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// hookTimeout is the time a transform hook has to transform an object
+const hookTimeout = 30 * time.Second
+
+// transform runs the transform hook of an object, if any, with the fetched content on stdin and
+// replaces it with the stdout of the hook. Hooks are executables of hooksDir on the node, so pods
+// can only run the hooks the node operator installed.
+func (adapter *KeyvaultFlexvolumeAdapter) transform(object KeyVaultObject, fetched *fetchedObject) error {
+	if object.TransformHook == "" {
+		return nil
+	}
+	hook := path.Join(adapter.options.hooksDir, object.TransformHook)
+	ctx, cancel := context.WithTimeout(adapter.ctx, hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdin = bytes.NewReader(fetched.content)
+	cmd.Env = []string{
+		"OBJECT_NAME=" + object.ObjectName,
+		"OBJECT_TYPE=" + object.ObjectType,
+		"OBJECT_VERSION=" + fetched.version,
+		"FILE_NAME=" + object.fileName(),
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errors.Errorf("timed out after %s", hookTimeout)
+		}
+		// the stderr of the hook is logged, so hooks must never write the object to it
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return errors.Errorf("transform hook %s of %s failed: %s: %s", object.TransformHook, object.ObjectName, err, message)
+		}
+		return errors.Wrapf(err, "transform hook %s of %s failed", object.TransformHook, object.ObjectName)
+	}
+	glog.V(0).Infof("transformed %s %s with hook %s", object.ObjectType, object.ObjectName, object.TransformHook)
+	fetched.content = stdout.Bytes()
+	return nil
+}
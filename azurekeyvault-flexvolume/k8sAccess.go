@@ -0,0 +1,142 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// k8sPermission is an access to the Kubernetes API needed by a feature of the driver, in the
+// namespace of the pod
+type k8sPermission struct {
+	verb     string
+	group    string
+	resource string
+	// empty for any object of resource
+	name string
+}
+
+func (permission k8sPermission) String() string {
+	resource := permission.resource
+	if permission.group != "" {
+		resource += "." + permission.group
+	}
+	if permission.name != "" {
+		resource += "/" + permission.name
+	}
+	return permission.verb + " " + resource
+}
+
+// k8sFeature is a feature of the driver using the Kubernetes API, enabled by flag
+type k8sFeature struct {
+	flag        string
+	permissions []k8sPermission
+}
+
+// k8sFeatures returns the features of options using the Kubernetes API, with the permissions they
+// need. The workload annotated with -rotationAnnotation deployment, rollout or canary is only
+// known once the pod is, so patching it is checked when it is annotated.
+func k8sFeatures(options Option) []k8sFeature {
+	var features []k8sFeature
+	if options.syncK8sSecret != "" {
+		features = append(features, k8sFeature{flag: "syncK8sSecret", permissions: []k8sPermission{
+			{verb: "create", resource: "secrets"},
+			{verb: "get", resource: "secrets", name: options.syncK8sSecret},
+			{verb: "update", resource: "secrets", name: options.syncK8sSecret},
+		}})
+	}
+	if options.rotationAnnotation != "" {
+		permissions := []k8sPermission{
+			{verb: "get", resource: "pods", name: options.podName},
+			{verb: "patch", resource: "pods", name: options.podName},
+		}
+		if options.rotationAnnotation != RotationAnnotationPod {
+			permissions = append(permissions, k8sPermission{verb: "get", group: "apps", resource: "replicasets"})
+		}
+		if options.rotationAnnotation == RotationAnnotationCanary {
+			permissions = append(permissions,
+				k8sPermission{verb: "get", group: "apps", resource: "deployments"},
+				k8sPermission{verb: "get", group: "flagger.app", resource: "canaries"},
+			)
+		}
+		features = append(features, k8sFeature{flag: "rotationAnnotation", permissions: permissions})
+	}
+	return features
+}
+
+// k8sAccess is the result of the check of the permissions of a feature
+type k8sAccess struct {
+	feature k8sFeature
+	// the permissions denied, none if the feature is allowed
+	denied []k8sPermission
+}
+
+func (access k8sAccess) String() string {
+	if len(access.denied) == 0 {
+		return "-" + access.feature.flag + " allowed"
+	}
+	denied := make([]string, len(access.denied))
+	for i, permission := range access.denied {
+		denied[i] = permission.String()
+	}
+	return "-" + access.feature.flag + " denied " + strings.Join(denied, ", ")
+}
+
+// checkK8sAccess checks the permissions of the Kubernetes features of the volume in the namespace
+// of the pod with SelfSubjectAccessReviews, which every authenticated service account can create,
+// so features can be disabled rather than failing once used
+func (adapter *KeyvaultFlexvolumeAdapter) checkK8sAccess() ([]k8sAccess, error) {
+	features := k8sFeatures(adapter.options)
+	if len(features) == 0 {
+		return nil, nil
+	}
+	request, err := adapter.newK8sRequester()
+	if err != nil {
+		return nil, err
+	}
+	accesses := make([]k8sAccess, len(features))
+	for i, feature := range features {
+		accesses[i].feature = feature
+		for _, permission := range feature.permissions {
+			allowed, err := request.allowed(adapter.options.podNamespace, permission)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				accesses[i].denied = append(accesses[i].denied, permission)
+			}
+		}
+	}
+	return accesses, nil
+}
+
+// allowed returns whether the token of the requester is granted permission in namespace
+func (requester *k8sRequester) allowed(namespace string, permission k8sPermission) (bool, error) {
+	review := map[string]interface{}{
+		"apiVersion": "authorization.k8s.io/v1",
+		"kind":       "SelfSubjectAccessReview",
+		"spec": map[string]interface{}{
+			"resourceAttributes": map[string]string{
+				"namespace": namespace,
+				"verb":      permission.verb,
+				"group":     permission.group,
+				"resource":  permission.resource,
+				"name":      permission.name,
+			},
+		},
+	}
+	var result struct {
+		Status struct {
+			Allowed bool `json:"allowed"`
+		} `json:"status"`
+	}
+	if err := requester.expect(http.StatusCreated, http.MethodPost, requester.url("/apis/authorization.k8s.io/v1/selfsubjectaccessreviews"), review, &result); err != nil {
+		return false, errors.Wrapf(err, "failed to review %s in namespace %s", permission, namespace)
+	}
+	return result.Status.Allowed, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckK8sAccess(t *testing.T) {
+	// the permissions granted to the token, as a Role listing the Secret synced would
+	granted := map[string]bool{
+		"default/create secrets":              true,
+		"default/get secrets/testcert-tls":    true,
+		"default/update secrets/testcert-tls": true,
+		"default/get pods/nginx":              true,
+		"default/get replicasets.apps":        true,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var review struct {
+			Spec struct {
+				ResourceAttributes struct {
+					Namespace string `json:"namespace"`
+					Verb      string `json:"verb"`
+					Group     string `json:"group"`
+					Resource  string `json:"resource"`
+					Name      string `json:"name"`
+				} `json:"resourceAttributes"`
+			} `json:"spec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		attributes := review.Spec.ResourceAttributes
+		permission := k8sPermission{verb: attributes.Verb, group: attributes.Group, resource: attributes.Resource, name: attributes.Name}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]bool{"allowed": granted[attributes.Namespace+"/"+permission.String()]}})
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "no feature"},
+		{name: "secret sync", args: []string{"-syncK8sSecret=testcert-tls"}, want: []string{"-syncK8sSecret allowed"}},
+		{name: "secret not listed", args: []string{"-syncK8sSecret=other"}, want: []string{"-syncK8sSecret denied get secrets/other, update secrets/other"}},
+		{name: "other namespace", args: []string{"-syncK8sSecret=testcert-tls", "-podNamespace=prod"}, want: []string{"-syncK8sSecret denied create secrets, get secrets/testcert-tls, update secrets/testcert-tls"}},
+		{name: "rotation annotation", args: []string{"-rotationAnnotation=deployment"}, want: []string{"-rotationAnnotation denied patch pods/nginx"}},
+		{name: "canary", args: []string{"-rotationAnnotation=canary"}, want: []string{"-rotationAnnotation denied patch pods/nginx, get deployments.apps, get canaries.flagger.app"}},
+		{name: "both", args: []string{"-syncK8sSecret=testcert-tls", "-rotationAnnotation=pod"}, want: []string{"-syncK8sSecret allowed", "-rotationAnnotation denied patch pods/nginx"}},
+	}
+	for _, test := range tests {
+		args := append([]string{"-k8sAPIServer=" + server.URL + "/", "-k8sTokenFile=" + tokenFile, "-podNamespace=default", "-podName=nginx"}, test.args...)
+		adapter := testAdapter(t, args...)
+		adapter.ctx = context.Background()
+		accesses, err := adapter.checkK8sAccess()
+		if err != nil {
+			t.Errorf("%s: checkK8sAccess() = %s", test.name, err)
+			continue
+		}
+		var got []string
+		for _, access := range accesses {
+			got = append(got, access.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: checkK8sAccess() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRegistrationFlagSet(t *testing.T) {
+	logtostderr := flag.Lookup("logtostderr").Value.String()
+	options, err := parseConfigs(registrationFlagSet(), []string{"-logtostderr", "-v=5", "-vaultName=myvault", "-syncK8sSecret=testcert-tls", "-syncK8sSecret="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.vaultName != "myvault" || options.syncK8sSecret != "" {
+		t.Errorf("parseConfigs() = %q %q, want myvault and the last -syncK8sSecret", options.vaultName, options.syncK8sSecret)
+	}
+	if got := flag.Lookup("logtostderr").Value.String(); got != logtostderr {
+		t.Errorf("-logtostderr of the daemon = %s, want %s", got, logtostderr)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Types of the Kubernetes Secrets the objects are synced to
+const (
+	// SecretTypeOpaque is a Secret with a key for each file of the objects
+	SecretTypeOpaque = "Opaque"
+	// SecretTypeTLS is a Secret with tls.crt and tls.key keys, as read by ingress controllers
+	SecretTypeTLS = "kubernetes.io/tls"
+)
+
+const (
+	// managedByLabel marks the Secrets synced by the driver, the only ones it overwrites
+	managedByLabel = "app.kubernetes.io/managed-by"
+	// k8sRequestTimeout bounds each request to the Kubernetes API server
+	k8sRequestTimeout = 30 * time.Second
+)
+
+var (
+	// secretNameRegexp matches the names of Kubernetes Secrets, DNS subdomains
+	secretNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	// secretKeyRegexp matches the keys of the data of Kubernetes Secrets
+	secretKeyRegexp = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+)
+
+// k8sSecret is the subset of a Kubernetes Secret written by the driver. Its data is base64
+// encoded when marshaled, as expected by the API server.
+type k8sSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   k8sObjectMeta     `json:"metadata"`
+	Type       string            `json:"type"`
+	Data       map[string][]byte `json:"data"`
+}
+
+// k8sObjectMeta is the metadata of a Kubernetes object
+type k8sObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+// validSecretName returns whether name can be the name of a Kubernetes Secret
+func validSecretName(name string) bool {
+	return len(name) <= 253 && secretNameRegexp.MatchString(name)
+}
+
+// syncK8sSecret mirrors the objects written to the volume to the Kubernetes Secret -syncK8sSecret
+// of the namespace of the pod, a key per file name, so they can be consumed as environment
+// variables or by controllers only reading Secrets. Secrets not created by the driver are never
+// overwritten.
+func (adapter *KeyvaultFlexvolumeAdapter) syncK8sSecret(mounted []mountedObject) error {
+	options := adapter.options
+	secret := k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: k8sObjectMeta{
+			Name:      options.syncK8sSecret,
+			Namespace: options.podNamespace,
+			Labels:    map[string]string{managedByLabel: program},
+		},
+		Type: options.syncK8sSecretType,
+		Data: make(map[string][]byte, len(mounted)),
+	}
+	for _, object := range mounted {
+		if !secretKeyRegexp.MatchString(object.fileName) {
+			return errors.Errorf("%s can't be a key of Secret %s, set an objectAlias of letters, digits, -, _ and .", object.fileName, options.syncK8sSecret)
+		}
+		secret.Data[object.fileName] = object.content
+	}
+	if secret.Type == SecretTypeTLS {
+		for _, key := range []string{"tls.crt", "tls.key"} {
+			if _, ok := secret.Data[key]; !ok {
+				return errors.Errorf("Secret %s of type %s needs an object written to %s", options.syncK8sSecret, SecretTypeTLS, key)
+			}
+		}
+	}
+
+	request, err := adapter.newK8sRequester()
+	if err != nil {
+		return err
+	}
+	secretsURL := request.url("/api/v1/namespaces/%s/secrets", options.podNamespace)
+	secretName := options.podNamespace + "/" + options.syncK8sSecret
+
+	status, err := request.do(http.MethodPost, secretsURL, secret, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create Secret %s", secretName)
+	}
+	switch status {
+	case http.StatusCreated:
+		glog.V(0).Infof("created Secret %s with %d keys", secretName, len(secret.Data))
+		return nil
+	case http.StatusConflict:
+	case http.StatusForbidden:
+		return errors.Errorf("failed to create Secret %s: Secret sync isn't allowed in namespace %s, see kv-flexvol-secret-sync.yaml", secretName, options.podNamespace)
+	default:
+		return errors.Errorf("failed to create Secret %s: unexpected status %d", secretName, status)
+	}
+
+	// the Secret exists, e.g. synced by another pod of the deployment or a previous mount
+	secretURL := secretsURL + "/" + options.syncK8sSecret
+	var existing k8sSecret
+	if status, err = request.do(http.MethodGet, secretURL, nil, &existing); err != nil {
+		return errors.Wrapf(err, "failed to read Secret %s", secretName)
+	}
+	if status == http.StatusForbidden {
+		return errors.Errorf("failed to read Secret %s: %s isn't in the resourceNames of the Secret sync Role of namespace %s, see kv-flexvol-secret-sync.yaml", secretName, options.syncK8sSecret, options.podNamespace)
+	}
+	if status != http.StatusOK {
+		return errors.Errorf("failed to read Secret %s: unexpected status %d", secretName, status)
+	}
+	if existing.Metadata.Labels[managedByLabel] != program {
+		return errors.Errorf("Secret %s exists and isn't managed by %s, it isn't overwritten", secretName, program)
+	}
+	// fails with a conflict if the Secret changed since it was read, the next mount retrying
+	secret.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+	if status, err = request.do(http.MethodPut, secretURL, secret, nil); err != nil {
+		return errors.Wrapf(err, "failed to update Secret %s", secretName)
+	}
+	if status != http.StatusOK {
+		return errors.Errorf("failed to update Secret %s: unexpected status %d", secretName, status)
+	}
+	glog.V(0).Infof("updated Secret %s with %d keys", secretName, len(secret.Data))
+	return nil
+}
+
+// k8sRequester sends requests to the Kubernetes API server with a bearer token
+type k8sRequester struct {
+	ctx       context.Context
+	client    *http.Client
+	apiServer string
+	token     string
+}
+
+// newK8sRequester returns a requester of the Kubernetes API server set on the node, with the
+// token of -k8sTokenFile, read on each mount as it is refreshed
+func (adapter *KeyvaultFlexvolumeAdapter) newK8sRequester() (*k8sRequester, error) {
+	options := adapter.options
+	client, err := newK8sClient(options.k8sCAFile)
+	if err != nil {
+		return nil, err
+	}
+	token, err := ioutil.ReadFile(options.k8sTokenFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read -k8sTokenFile %s", options.k8sTokenFile)
+	}
+	return &k8sRequester{
+		ctx:       adapter.ctx,
+		client:    client,
+		apiServer: strings.TrimSuffix(options.k8sAPIServer, "/"),
+		token:     strings.TrimSpace(string(token)),
+	}, nil
+}
+
+// url returns the URL of the API server of the path formatted with args
+func (requester *k8sRequester) url(format string, args ...interface{}) string {
+	return requester.apiServer + fmt.Sprintf(format, args...)
+}
+
+// do sends a request with body marshaled as JSON, a JSON merge patch for PATCH requests, decoding
+// the response to result if the status is OK or Created, and returns the status
+func (requester *k8sRequester) do(method string, url string, body interface{}, result interface{}) (int, error) {
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return 0, errors.Wrap(err, "failed to marshal request")
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(content))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(requester.ctx)
+	req.Header.Set("Authorization", "Bearer "+requester.token)
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", GetUserAgent())
+	resp, err := requester.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if result != nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated) {
+		if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.StatusCode, errors.Wrap(err, "failed to parse response")
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// expect sends a request as do, failing if the status isn't status
+func (requester *k8sRequester) expect(status int, method string, url string, body interface{}, result interface{}) error {
+	actual, err := requester.do(method, url, body, result)
+	if err != nil {
+		return err
+	}
+	if actual != status {
+		return errors.Errorf("unexpected status %d", actual)
+	}
+	return nil
+}
+
+// newK8sClient returns a client of the Kubernetes API server trusting the CA of caFile, or the
+// CAs of the system if empty
+func newK8sClient(caFile string) (*http.Client, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read -k8sCAFile %s", caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("-k8sCAFile %s has no PEM certificate", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: k8sRequestTimeout}, nil
+}
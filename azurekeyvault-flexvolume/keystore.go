@@ -0,0 +1,246 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// Types of keystores
+const (
+	// KeystoreTypeJKS Java keystore, readable by every JVM
+	KeystoreTypeJKS string = "jks"
+	// KeystoreTypePKCS12 PKCS#12 keystore, the default keystore type since Java 9
+	KeystoreTypePKCS12 string = "pkcs12"
+)
+
+const (
+	jksMagic   = 0xfeedfeed
+	jksVersion = 2
+	// JKS entry tags
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+	// whitener appended to the password for the keystore digest, as in sun.security.provider.JavaKeyStore
+	jksDigestWhitener = "Mighty Aphrodite"
+	jksSaltLength     = 20
+)
+
+// oidJKSKeyProtector is the algorithm of sun.security.provider.KeyProtector
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// keystoreEntry is an object added to the keystore: a private key with its chain for cert-key
+// objects, or a trusted certificate for cert objects
+type keystoreEntry struct {
+	alias       string
+	certSecret  *certificateSecret
+	certificate *x509.Certificate
+}
+
+// newKeystoreEntry returns the keystore entry of a fetched object
+func newKeystoreEntry(object KeyVaultObject, fetched *fetchedObject) (keystoreEntry, error) {
+	entry := keystoreEntry{alias: object.KeystoreAlias, certSecret: fetched.certSecret}
+	if fetched.certificate != nil {
+		cert, err := x509.ParseCertificate(fetched.certificate)
+		if err != nil {
+			return entry, errors.Wrapf(err, "failed to parse certificate %s", object.ObjectName)
+		}
+		entry.certificate = cert
+	}
+	return entry, nil
+}
+
+// writeKeystore assembles the keystore entries into a keystore protected by the keystore
+// password, or a generated one written next to the keystore
+func (adapter *KeyvaultFlexvolumeAdapter) writeKeystore(entries []keystoreEntry) error {
+	options := adapter.options
+	// the keystore is encoded again only if an entry changed
+	source := []string{options.keystoreType, options.keystorePassword}
+	for _, entry := range entries {
+		source = append(source, entry.alias)
+		if entry.certSecret != nil {
+			source = append(source, "private key")
+			if entry.certSecret.certificate != nil {
+				source = append(source, hex.EncodeToString(entry.certSecret.certificate.Raw))
+			}
+			for _, caCert := range entry.certSecret.caCerts {
+				source = append(source, hex.EncodeToString(caCert.Raw))
+			}
+		} else {
+			source = append(source, "trusted", hex.EncodeToString(entry.certificate.Raw))
+		}
+	}
+	password, content, err := adapter.encodeOnce(options.keystore, source, func() (string, []byte, error) {
+		password := options.keystorePassword
+		if password == "" {
+			var err error
+			if password, err = generatePassword(); err != nil {
+				return "", nil, err
+			}
+		}
+		var content []byte
+		var err error
+		if options.keystoreType == KeystoreTypePKCS12 {
+			content, err = encodePKCS12Keystore(entries, password)
+		} else {
+			content, err = encodeJKS(entries, password, time.Now())
+		}
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "failed to encode keystore %s", options.keystore)
+		}
+		return password, content, nil
+	})
+	if err != nil {
+		return err
+	}
+	if options.keystorePassword == "" {
+		fileName := filepath.Join(adapter.dataDir(), options.keystore+".password")
+		if err = adapter.writeFile(fileName, []byte(password), KeyVaultObject{}.fileMode(options)); err != nil {
+			return errors.Wrapf(err, "failed to write keystore password to %s", fileName)
+		}
+	}
+
+	if err = adapter.reserveSize(options.keystore, len(content)); err != nil {
+		return err
+	}
+	fileName := filepath.Join(adapter.dataDir(), options.keystore)
+	if err = adapter.writeFile(fileName, content, KeyVaultObject{}.fileMode(options)); err != nil {
+		return errors.Wrapf(err, "failed to write keystore to %s", fileName)
+	}
+	glog.V(0).Infof("azure KeyVault wrote %s keystore with %d entries at %s", options.keystoreType, len(entries), fileName)
+	return nil
+}
+
+// encodePKCS12Keystore returns the entries as a PKCS#12 keystore. Only a single private key entry,
+// whose alias can't be set, or trusted certificates are supported.
+func encodePKCS12Keystore(entries []keystoreEntry, password string) ([]byte, error) {
+	var trusted []pkcs12.TrustStoreEntry
+	for _, entry := range entries {
+		if entry.certSecret != nil {
+			if len(entries) > 1 {
+				return nil, errors.Errorf("a %s keystore can only hold a single private key entry or trusted certificates, use %s", KeystoreTypePKCS12, KeystoreTypeJKS)
+			}
+			return pkcs12.Encode(rand.Reader, entry.certSecret.privateKey, entry.certSecret.certificate, entry.certSecret.caCerts, password)
+		}
+		trusted = append(trusted, pkcs12.TrustStoreEntry{Cert: entry.certificate, FriendlyName: entry.alias})
+	}
+	return pkcs12.EncodeTrustStoreEntries(rand.Reader, trusted, password)
+}
+
+// encodeJKS returns the entries as a Java keystore, private keys being protected by the
+// keystore password as keytool does
+func encodeJKS(entries []keystoreEntry, password string, created time.Time) ([]byte, error) {
+	passwordBytes := jksPassword(password)
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	writeUTF := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+	writeCertificate := func(cert *x509.Certificate) {
+		writeUTF("X.509")
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(jksVersion))
+	write(uint32(len(entries)))
+	for _, entry := range entries {
+		if entry.certSecret != nil {
+			protectedKey, err := protectJKSKey(entry.certSecret.privateKey, passwordBytes)
+			if err != nil {
+				return nil, err
+			}
+			write(uint32(jksPrivateKeyTag))
+			// the JVM lowercases aliases
+			writeUTF(strings.ToLower(entry.alias))
+			write(created.UnixNano() / int64(time.Millisecond))
+			write(uint32(len(protectedKey)))
+			buf.Write(protectedKey)
+			chain := append([]*x509.Certificate{entry.certSecret.certificate}, entry.certSecret.caCerts...)
+			write(uint32(len(chain)))
+			for _, cert := range chain {
+				writeCertificate(cert)
+			}
+		} else {
+			write(uint32(jksTrustedCertTag))
+			writeUTF(strings.ToLower(entry.alias))
+			write(created.UnixNano() / int64(time.Millisecond))
+			writeCertificate(entry.certificate)
+		}
+	}
+
+	digest := sha1.New()
+	digest.Write(passwordBytes)
+	digest.Write([]byte(jksDigestWhitener))
+	digest.Write(buf.Bytes())
+	buf.Write(digest.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// protectJKSKey encrypts a private key with the proprietary algorithm of
+// sun.security.provider.KeyProtector, and returns it as an EncryptedPrivateKeyInfo
+func protectJKSKey(privateKey interface{}, passwordBytes []byte) ([]byte, error) {
+	plainKey, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode private key")
+	}
+	salt := make([]byte, jksSaltLength)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "failed to generate salt")
+	}
+
+	// the key is xored with a keystream of chained SHA-1 digests of the password and the salt
+	encryptedKey := make([]byte, len(plainKey))
+	digest := salt
+	for i := 0; i < len(plainKey); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwordBytes)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plainKey); j++ {
+			encryptedKey[i+j] = plainKey[i+j] ^ digest[j]
+		}
+	}
+	checksum := sha1.New()
+	checksum.Write(passwordBytes)
+	checksum.Write(plainKey)
+
+	protectedKey := append(append(salt, encryptedKey...), checksum.Sum(nil)...)
+	return asn1.Marshal(struct {
+		Algorithm     pkix.AlgorithmIdentifier
+		EncryptedData []byte
+	}{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: protectedKey,
+	})
+}
+
+// jksPassword returns the password as big endian UTF-16, as Java chars
+func jksPassword(password string) []byte {
+	chars := utf16.Encode([]rune(password))
+	b := make([]byte, 2*len(chars))
+	for i, c := range chars {
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
@@ -0,0 +1,337 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// testCertificate returns a self-signed certificate of commonName with its private key
+func testCertificate(t *testing.T, commonName string) *certificateSecret {
+	t.Helper()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certificateSecret{privateKey: privateKey, certificate: cert}
+}
+
+// jksEntry is an entry read back from a Java keystore
+type jksEntry struct {
+	tag          uint32
+	alias        string
+	protectedKey []byte
+	chain        [][]byte
+}
+
+// readJKS reads the entries of a Java keystore, checking its header and its digest
+func readJKS(t *testing.T, content []byte, password string) []jksEntry {
+	t.Helper()
+	if len(content) < sha1.Size {
+		t.Fatalf("keystore of %d bytes is too short", len(content))
+	}
+	body, sum := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	digest := sha1.New()
+	digest.Write(jksPassword(password))
+	digest.Write([]byte(jksDigestWhitener))
+	digest.Write(body)
+	if !bytes.Equal(digest.Sum(nil), sum) {
+		t.Fatal("digest of the keystore doesn't match the password")
+	}
+
+	reader := bytes.NewReader(body)
+	read := func(v interface{}) {
+		if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readBytes := func(n int) []byte {
+		b := make([]byte, n)
+		read(b)
+		return b
+	}
+	readUTF := func() string {
+		var length uint16
+		read(&length)
+		return string(readBytes(int(length)))
+	}
+	readCertificate := func() []byte {
+		if certType := readUTF(); certType != "X.509" {
+			t.Fatalf("certificate type = %q, want X.509", certType)
+		}
+		var length uint32
+		read(&length)
+		return readBytes(int(length))
+	}
+
+	var magic, version, count uint32
+	read(&magic)
+	read(&version)
+	read(&count)
+	if magic != jksMagic || version != jksVersion {
+		t.Fatalf("keystore header = %x version %d, want %x version %d", magic, version, jksMagic, jksVersion)
+	}
+	entries := make([]jksEntry, count)
+	for i := range entries {
+		var created int64
+		read(&entries[i].tag)
+		entries[i].alias = readUTF()
+		read(&created)
+		switch entries[i].tag {
+		case jksPrivateKeyTag:
+			var length, chainLength uint32
+			read(&length)
+			entries[i].protectedKey = readBytes(int(length))
+			read(&chainLength)
+			for j := uint32(0); j < chainLength; j++ {
+				entries[i].chain = append(entries[i].chain, readCertificate())
+			}
+		case jksTrustedCertTag:
+			entries[i].chain = [][]byte{readCertificate()}
+		default:
+			t.Fatalf("unknown entry tag %d", entries[i].tag)
+		}
+	}
+	if reader.Len() != 0 {
+		t.Fatalf("%d bytes left after the entries", reader.Len())
+	}
+	return entries
+}
+
+// recoverJKSKey decrypts a private key protected by protectJKSKey, as KeyProtector.recover does
+func recoverJKSKey(t *testing.T, protectedKey []byte, password string) []byte {
+	t.Helper()
+	var info struct {
+		Algorithm     pkix.AlgorithmIdentifier
+		EncryptedData []byte
+	}
+	if _, err := asn1.Unmarshal(protectedKey, &info); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		t.Fatalf("key algorithm = %s, want %s", info.Algorithm.Algorithm, oidJKSKeyProtector)
+	}
+	data := info.EncryptedData
+	salt, encryptedKey, checksum := data[:jksSaltLength], data[jksSaltLength:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	passwordBytes := jksPassword(password)
+	plainKey := make([]byte, len(encryptedKey))
+	digest := salt
+	for i := 0; i < len(encryptedKey); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwordBytes)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(encryptedKey); j++ {
+			plainKey[i+j] = encryptedKey[i+j] ^ digest[j]
+		}
+	}
+	h := sha1.New()
+	h.Write(passwordBytes)
+	h.Write(plainKey)
+	if !bytes.Equal(h.Sum(nil), checksum) {
+		t.Fatal("checksum of the private key doesn't match the password")
+	}
+	return plainKey
+}
+
+func TestJKSPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		want     []byte
+	}{
+		{password: "", want: []byte{}},
+		{password: "changeit", want: []byte{0, 'c', 0, 'h', 0, 'a', 0, 'n', 0, 'g', 0, 'e', 0, 'i', 0, 't'}},
+		{password: "é€", want: []byte{0x00, 0xe9, 0x20, 0xac}},
+		{password: "\U0001F511", want: []byte{0xd8, 0x3d, 0xdd, 0x11}},
+	}
+	for _, test := range tests {
+		if got := jksPassword(test.password); !bytes.Equal(got, test.want) {
+			t.Errorf("jksPassword(%q) = %x, want %x", test.password, got, test.want)
+		}
+	}
+}
+
+func TestEncodeJKS(t *testing.T) {
+	server := testCertificate(t, "server")
+	ca := testCertificate(t, "ca")
+	server.caCerts = []*x509.Certificate{ca.certificate}
+	entries := []keystoreEntry{
+		{alias: "Server", certSecret: server},
+		{alias: "ca", certificate: ca.certificate},
+	}
+	content, err := encodeJKS(entries, "changeit", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := readJKS(t, content, "changeit")
+	if len(read) != 2 {
+		t.Fatalf("keystore has %d entries, want 2", len(read))
+	}
+	if read[0].tag != jksPrivateKeyTag || read[0].alias != "server" {
+		t.Errorf("first entry is %d %q, want a private key entry server", read[0].tag, read[0].alias)
+	}
+	if len(read[0].chain) != 2 || !bytes.Equal(read[0].chain[0], server.certificate.Raw) || !bytes.Equal(read[0].chain[1], ca.certificate.Raw) {
+		t.Errorf("chain of server isn't the certificate followed by its CA")
+	}
+	plainKey := recoverJKSKey(t, read[0].protectedKey, "changeit")
+	wantKey, err := x509.MarshalPKCS8PrivateKey(server.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainKey, wantKey) {
+		t.Errorf("private key of server doesn't match")
+	}
+	if read[1].tag != jksTrustedCertTag || read[1].alias != "ca" || !bytes.Equal(read[1].chain[0], ca.certificate.Raw) {
+		t.Errorf("second entry is %d %q, want a trusted certificate entry ca", read[1].tag, read[1].alias)
+	}
+}
+
+func TestEncodePKCS12Keystore(t *testing.T) {
+	server := testCertificate(t, "server")
+	ca := testCertificate(t, "ca")
+	other := testCertificate(t, "other")
+
+	content, err := encodePKCS12Keystore([]keystoreEntry{{alias: "server", certSecret: server}}, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cert, err := pkcs12.Decode(content, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Raw, server.certificate.Raw) {
+		t.Errorf("certificate of the keystore is %s, want server", cert.Subject.CommonName)
+	}
+
+	content, err = encodePKCS12Keystore([]keystoreEntry{{alias: "ca", certificate: ca.certificate}, {alias: "other", certificate: other.certificate}}, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := pkcs12.DecodeTrustStore(content, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !bytes.Equal(certs[0].Raw, ca.certificate.Raw) || !bytes.Equal(certs[1].Raw, other.certificate.Raw) {
+		t.Errorf("trusted certificates of the keystore aren't ca and other")
+	}
+
+	_, err = encodePKCS12Keystore([]keystoreEntry{{alias: "server", certSecret: server}, {alias: "ca", certificate: ca.certificate}}, "changeit")
+	if err == nil || !strings.Contains(err.Error(), "single private key entry") {
+		t.Errorf("encodePKCS12Keystore() = %v, want a single private key entry error", err)
+	}
+}
+
+func TestWriteKeystore(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		passwordFile bool
+	}{
+		{name: "password", args: []string{"-keystorePassword=changeit"}},
+		{name: "generated password", passwordFile: true},
+	}
+	for _, test := range tests {
+		adapter := testAdapter(t, append(test.args, "-keystore=keystore.jks", "-filePermission=0440")...)
+		entries := []keystoreEntry{{alias: "server", certSecret: testCertificate(t, "server")}}
+		if err := adapter.writeKeystore(entries); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		password := adapter.options.keystorePassword
+		if test.passwordFile {
+			password = readTestFile(t, adapter, "keystore.jks.password", 0440)
+			if password == "" {
+				t.Errorf("%s: generated password is empty", test.name)
+			}
+		}
+		readJKS(t, []byte(readTestFile(t, adapter, "keystore.jks", 0440)), password)
+	}
+}
+
+func TestWriteKeystoreRefresh(t *testing.T) {
+	adapter := testAdapter(t, "-keystore=keystore.jks")
+	server := testCertificate(t, "server")
+	write := func(entries []keystoreEntry) (string, string) {
+		t.Helper()
+		if err := adapter.writeKeystore(entries); err != nil {
+			t.Fatal(err)
+		}
+		return readTestFile(t, adapter, "keystore.jks", 0644), readTestFile(t, adapter, "keystore.jks.password", 0644)
+	}
+
+	content, password := write([]keystoreEntry{{alias: "server", certSecret: server}})
+	// a refresh of the same objects rewrites the same keystore, with the same password
+	refreshed, refreshedPassword := write([]keystoreEntry{{alias: "server", certSecret: server}})
+	if refreshed != content || refreshedPassword != password {
+		t.Errorf("refresh of unchanged entries encoded the keystore again")
+	}
+	renewed, renewedPassword := write([]keystoreEntry{{alias: "server", certSecret: testCertificate(t, "server")}})
+	if renewed == content || renewedPassword == password {
+		t.Errorf("refresh of a renewed certificate reused the previous keystore")
+	}
+	readJKS(t, []byte(renewed), renewedPassword)
+}
+
+func TestEncodeOnce(t *testing.T) {
+	encodes := 0
+	encode := func() (string, []byte, error) {
+		encodes++
+		password, err := generatePassword()
+		return password, []byte(password), err
+	}
+	adapter := testAdapter(t)
+	first, _, err := adapter.encodeOnce("tls.pfx", []string{"v1"}, encode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _, _ := adapter.encodeOnce("tls.pfx", []string{"v1"}, encode); second != first || encodes != 1 {
+		t.Errorf("encodeOnce() of the same source encoded %d times, want once", encodes)
+	}
+	if other, _, _ := adapter.encodeOnce("other.pfx", []string{"v1"}, encode); other == first || encodes != 2 {
+		t.Errorf("encodeOnce() of another file reused the encoding of tls.pfx")
+	}
+	if renewed, _, _ := adapter.encodeOnce("tls.pfx", []string{"v2"}, encode); renewed == first || encodes != 3 {
+		t.Errorf("encodeOnce() of a new version reused the previous encoding")
+	}
+
+	removeEncodedCache(adapter.options.stateDir, adapter.options.dir)
+	if _, _, _ = adapter.encodeOnce("tls.pfx", []string{"v2"}, encode); encodes != 4 {
+		t.Errorf("encodeOnce() after unmount reused the encoding of the volume")
+	}
+	adapter.options.stateDir = ""
+	adapter.encodeOnce("tls.pfx", []string{"v2"}, encode)
+	adapter.encodeOnce("tls.pfx", []string{"v2"}, encode)
+	if encodes != 6 {
+		t.Errorf("encodeOnce() without -stateDir reused an encoding")
+	}
+}
@@ -6,14 +6,19 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
@@ -23,14 +28,86 @@ import (
 type KeyvaultFlexvolumeAdapter struct {
 	ctx     context.Context
 	options Option
+	// client used for all requests, nil to use the default ones
+	httpClient *http.Client
+	// client of the vaults, nil to create one authenticated with the identity of the volume
+	kvClient *kv.BaseClient
+	// report of the mount, nil when not mounting
+	report *mountReport
+	// bytes written to the volume by the mount, for maxVolumeSize
+	volumeSize int
+	// guards volumeSize, objects being written concurrently
+	volumeSizeMu sync.Mutex
+	// timestamped directory the files are written to before being published with -atomicWrites
+	writeDir string
+	// file names of the objects whose version changed since the previous mount, none on the
+	// first mount, for -rotationSignal and -rotationGracePeriod
+	rotated map[string]bool
+	// objects whose version changed since the previous mount, notified to -rotationWebhookURL
+	rotations []rotationEvent
+	// sha256 of each file written by the mount, by file name relative to dir, for its manifest
+	fileHashes map[string]string
+	// sha256 of the content of each file before -dpapiProtectionDescriptor protected it
+	unprotectedHashes map[string]string
+	// guards fileHashes and unprotectedHashes, objects being written concurrently
+	fileHashesMu sync.Mutex
 }
 
-//Run fetches the specified objects from keyvault and writes them on dir
+// Run fetches the specified objects from keyvault and writes them on dir, followed by the mount report
 func (adapter *KeyvaultFlexvolumeAdapter) Run() error {
+	adapter.report = newMountReport(adapter.options)
+	warnDeprecations(adapter.report.Deprecations)
+	if timeout := adapter.options.mountTimeoutSeconds; timeout > 0 {
+		// covers the token, the fetches and the writes, the files written being discarded on timeout
+		ctx, cancel := context.WithTimeout(adapter.ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+		adapter.ctx = ctx
+	}
+	if adapter.options.refresh && adapter.options.rotationCheckVersions {
+		unchanged, err := adapter.unchangedVersions()
+		if err != nil {
+			glog.Warningf("failed to check the versions of the objects of %s, refreshing them: %s", adapter.options.dir, err)
+		} else if unchanged {
+			glog.V(0).Infof("the objects of %s have no new version, not refreshed", adapter.options.dir)
+			return nil
+		}
+	}
+	err := adapter.mountObjects()
+	if err == nil {
+		err = adapter.ctx.Err()
+	}
+	if err != nil && adapter.ctx.Err() == context.DeadlineExceeded {
+		err = errors.Wrapf(err, "mount timed out after %ds allowed by -mountTimeoutSeconds", adapter.options.mountTimeoutSeconds)
+	}
+	adapter.report.finish(err)
+	if err != nil {
+		adapter.logMountReport()
+		adapter.discardData()
+		return err
+	}
+	if err = adapter.writeMountReport(); err != nil {
+		adapter.discardData()
+		return err
+	}
+	if err = adapter.publishData(); err != nil {
+		return err
+	}
+	if err = adapter.labelFiles(adapter.options.dir); err != nil {
+		return err
+	}
+	if err = adapter.remountReadOnly(adapter.options.dir); err != nil {
+		return err
+	}
+	adapter.signalRotation()
+	adapter.notifyRotations()
+	return nil
+}
+
+// mountObjects fetches the specified objects from keyvault and writes them on dir
+func (adapter *KeyvaultFlexvolumeAdapter) mountObjects() error {
 	options := adapter.options
-	ctx := adapter.ctx
 	if options.showVersion {
-		glog.V(0).Infof("%s %s", program, version)
+		glog.V(0).Infof("%s %s (commit %s, built %s)", program, version, gitCommit, buildDate)
 		glog.V(2).Infof("%s", options.tenantID)
 	}
 
@@ -38,6 +115,19 @@ func (adapter *KeyvaultFlexvolumeAdapter) Run() error {
 	if err != nil {
 		return errors.Wrapf(err, "failed to get directory %s", options.dir)
 	}
+	if err = adapter.checkInMemory(options.dir); err != nil {
+		return err
+	}
+	if err = remountWritable(options.dir); err != nil {
+		return err
+	}
+	// a tmpfs is world writable by default
+	if err = adapter.setOwnership(options.dir, adapter.dirMode(), 0050); err != nil {
+		return errors.Wrapf(err, "failed to set permission of %s", options.dir)
+	}
+	if err = adapter.stageData(); err != nil {
+		return err
+	}
 
 	glog.Infof("starting the %s, %s", program, version)
 
@@ -48,71 +138,511 @@ func (adapter *KeyvaultFlexvolumeAdapter) Run() error {
 	if vaultURL == nil {
 		return fmt.Errorf("vault url is nil")
 	}
+	adapter.report.VaultURL = *vaultURL
 
 	kvClient, err := adapter.initializeKvClient()
 	if err != nil {
 		return errors.Wrap(err, "failed to get keyvaultClient")
 	}
 
-	objectTypes := strings.Split(options.vaultObjectTypes, objectsSep)
-	objectNames := strings.Split(options.vaultObjectNames, objectsSep)
-	objectAliases := strings.Split(options.vaultObjectAliases, objectsSep)
-	objectVersions := strings.Split(options.vaultObjectVersions, objectsSep)
-
-	for i := range objectNames {
-		objectType := objectTypes[i]
-		objectName := objectNames[i]
-		// default to the objectName and override if aliases are available
-		fileName := path.Join(options.dir, objectNames[i])
-		if options.vaultObjectAliases != "" && len(objectAliases) == len(objectNames) {
-			fileName = path.Join(options.dir, objectAliases[i])
-		}
-		// objectVersions are optional so we take as much as we can
-		objectVersion := ""
-		if options.vaultObjectVersions != "" && len(objectVersions) == len(objectNames) {
-			objectVersion = objectVersions[i]
-		}
-		glog.V(0).Infof("retrieving %s %s (version: %s)", objectType, objectName, objectVersion)
-		switch objectType {
-		case VaultTypeSecret:
-			secret, err := kvClient.GetSecret(ctx, *vaultURL, objectName, objectVersion)
+	objects := options.objects
+	if selectsSecrets(options) {
+		selected, err := adapter.selectSecrets(kvClient, *vaultURL, objects)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, selected...)
+		if options.maxObjects > 0 && len(objects) > options.maxObjects {
+			return errors.Errorf("volume has %d objects with the selected secrets, more than the maximum of %d allowed by -maxObjects", len(objects), options.maxObjects)
+		}
+	}
+
+	if err = adapter.consumeBudget(len(objects) * options.consistentReads); err != nil {
+		return err
+	}
+
+	previous, err := readManifest(options.dir)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to read the previous manifest of %s: %s", options.dir, err)
+	}
+	var published map[string][]byte
+	if options.rotationGracePeriod > 0 {
+		published = adapter.readPublished(objects)
+	}
+	versions := make([]objectVersion, 0, len(objects))
+	manifest := make([]manifestObject, 0, len(objects))
+	var keystoreEntries []keystoreEntry
+	contents := map[string][]byte{}
+	var mounted []mountedObject
+	failed := 0
+	var failures []error
+	results := adapter.mountConcurrently(kvClient, *vaultURL, objects)
+	for i, object := range objects {
+		if results[i].skipped {
+			continue
+		}
+		fetched, err := results[i].fetched, results[i].err
+		if err != nil && object.Optional && isNotFound(err) {
+			placeholder, err := adapter.omitObject(object, err)
 			if err != nil {
-				return sanitisedError(err, objectType, objectName, objectVersion)
+				return object.annotateError(err)
 			}
-			if err = ioutil.WriteFile(fileName, []byte(*secret.Value), permission); err != nil {
-				return errors.Wrapf(err, "azure KeyVault failed to write secret %s to %s", objectName, fileName)
+			if placeholder != nil {
+				contents[object.ObjectName] = placeholder.content
+				contents[object.fileName()] = placeholder.content
+				mounted = append(mounted, mountedObject{objectType: object.ObjectType, fileName: object.fileName(), content: placeholder.content})
 			}
-		case VaultTypeKey:
-			keybundle, err := kvClient.GetKey(ctx, *vaultURL, objectName, objectVersion)
+			continue
+		}
+		if err != nil && options.inactiveObjects == InactiveObjectsSkip && isInactive(err) {
+			adapter.skipInactiveObject(object, err)
+			continue
+		}
+		if err != nil && options.mountPolicy == MountPolicyBestEffort {
+			adapter.failObject(object, err)
+			failed++
+			continue
+		}
+		if err != nil {
+			failures = append(failures, object.annotateError(err))
+			continue
+		}
+		adapter.report.addObject(reportObject{
+			ObjectName:    object.ObjectName,
+			ObjectType:    object.ObjectType,
+			FileName:      object.fileName(),
+			ObjectVersion: fetched.version,
+			DurationMs:    results[i].durationMs,
+		})
+		versions = append(versions, objectVersion{
+			ObjectName:     object.ObjectName,
+			ObjectType:     object.ObjectType,
+			FileName:       object.fileName(),
+			ObjectVersion:  fetched.version,
+			VersionHistory: fetched.versionHistory,
+		})
+		manifest = append(manifest, adapter.newManifestObject(object, results[i].vaultURL, fetched, results[i].fetchTime))
+		if object.KeystoreAlias != "" {
+			entry, err := newKeystoreEntry(object, fetched)
 			if err != nil {
-				return sanitisedError(err, objectType, objectName, objectVersion)
+				return object.annotateError(err)
+			}
+			keystoreEntries = append(keystoreEntries, entry)
+		}
+		if !fetched.omitContent && fetched.content != nil {
+			contents[object.ObjectName] = fetched.content
+			contents[object.fileName()] = fetched.content
+			mounted = append(mounted, mountedObject{objectType: object.ObjectType, fileName: object.fileName(), content: fetched.content})
+		}
+	}
+	if len(failures) > 0 {
+		return aggregateErrors(failures)
+	}
+	if failed > 0 && len(versions) == 0 {
+		return errors.Errorf("failed to mount any object, %d objects failed", failed)
+	}
+	if options.keystore != "" {
+		if err = adapter.writeKeystore(keystoreEntries); err != nil {
+			return err
+		}
+	}
+	if options.template != "" {
+		if err = adapter.renderTemplate(contents); err != nil {
+			return err
+		}
+	}
+	if options.envFile != "" {
+		if err = adapter.writeEnvFile(mountedSecrets(mounted)); err != nil {
+			return err
+		}
+	}
+	if options.propertiesFile != "" {
+		if err = adapter.writePropertiesFile(mountedSecrets(mounted)); err != nil {
+			return err
+		}
+	}
+	if options.aggregateFile != "" {
+		if err = adapter.writeAggregateFile(mounted); err != nil {
+			return err
+		}
+	}
+	adapter.rotated = rotatedFiles(previous, manifest)
+	if options.rotationGracePeriod > 0 {
+		if err = adapter.writePrevious(published, mounted); err != nil {
+			return err
+		}
+	}
+	if options.rotationWebhookURL != "" {
+		adapter.rotations = adapter.rotationEvents(previous, manifest)
+	}
+	if err = adapter.writeManifest(manifest); err != nil {
+		return err
+	}
+	if options.syncK8sSecret != "" {
+		if err = adapter.syncK8sSecret(mounted); err != nil {
+			return err
+		}
+	}
+	if options.rotationAnnotation != "" {
+		adapter.annotateRotation(versions)
+	}
+	return adapter.writeVersions(versions)
+}
+
+// mountObject fetches a single object from keyvault and writes it on dir
+func (adapter *KeyvaultFlexvolumeAdapter) mountObject(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*fetchedObject, error) {
+	glog.V(0).Infof("retrieving %s %s (version: %s)%s", object.ObjectType, object.ObjectName, object.ObjectVersion, object.ownership())
+	if object.ObjectVersionsIndex > 0 {
+		if err := adapter.writeVersionsIndex(kvClient, vaultURL, object); err != nil {
+			return nil, err
+		}
+	}
+	if object.ObjectVersionHistory > 0 {
+		return adapter.mountVersionHistory(kvClient, vaultURL, object)
+	}
+	if object.KeyRing > 0 {
+		return adapter.mountKeyRing(kvClient, vaultURL, object)
+	}
+
+	fetched, err := adapter.fetchConsistent(kvClient, vaultURL, object)
+	if err != nil && adapter.options.allowStaleOnError && isUnavailable(err) {
+		return adapter.mountCached(vaultURL, object, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = adapter.checkActive(object, fetched); err != nil {
+		return nil, err
+	}
+	if err = adapter.checkValidity(object, fetched); err != nil {
+		return nil, err
+	}
+	if object.WritePolicy {
+		if err = adapter.addCertificatePolicy(kvClient, vaultURL, object, fetched); err != nil {
+			return nil, err
+		}
+	}
+	if err = adapter.transform(object, fetched); err != nil {
+		return nil, err
+	}
+	fetched.content = normalizeNewline(object, fetched.content)
+	if err = adapter.writeFetched(object, fetched); err != nil {
+		return nil, err
+	}
+	if adapter.options.allowStaleOnError {
+		adapter.cacheObject(vaultURL, object, fetched)
+	}
+	return fetched, nil
+}
+
+// writeFetched writes the content of a fetched object and its additional files
+func (adapter *KeyvaultFlexvolumeAdapter) writeFetched(object KeyVaultObject, fetched *fetchedObject) error {
+	if !fetched.omitContent {
+		if err := adapter.writeObject(object, object.fileName(), fetched); err != nil {
+			return err
+		}
+	}
+	for fileName, content := range fetched.files {
+		if err := adapter.writeObject(object, fileName, &fetchedObject{content: content, version: fetched.version}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeObject writes the content of a fetched object to fileName, relative to dir
+func (adapter *KeyvaultFlexvolumeAdapter) writeObject(object KeyVaultObject, fileName string, fetched *fetchedObject) error {
+	options := adapter.options
+	objectType := object.ObjectType
+	objectName := object.ObjectName
+	filePath := filepath.Join(adapter.dataDir(), fileName)
+
+	if options.maxObjectSize > 0 && len(fetched.content) > options.maxObjectSize {
+		return errors.Errorf("%s %s is %d bytes, more than the maximum of %d allowed by -maxObjectSize", objectType, objectName, len(fetched.content), options.maxObjectSize)
+	}
+	if err := adapter.reserveSize(fileName, len(fetched.content)); err != nil {
+		return err
+	}
+	if err := adapter.makeDirs(filePath); err != nil {
+		return errors.Wrapf(err, "azure KeyVault failed to create directory for %s", filePath)
+	}
+	if err := adapter.writeFile(filePath, fetched.content, object.fileMode(options)); err != nil {
+		return errors.Wrapf(err, "azure KeyVault failed to write %s %s to %s", objectType, objectName, filePath)
+	}
+	glog.V(0).Infof("azure KeyVault wrote %s %s (version: %s) at %s%s", objectType, objectName, fetched.version, filePath, object.ownership())
+	if options.debugValues == debugValuesHashed {
+		glog.V(0).Infof("azure KeyVault %s %s sha256: %x", objectType, objectName, sha256.Sum256(fetched.content))
+	}
+	if options.writeChecksums {
+		if err := adapter.writeChecksum(object, fileName, fetched.content); err != nil {
+			return err
+		}
+	}
+	if options.writeMetadata && fetched.attributes != nil {
+		return adapter.writeMetadata(object, fileName, fetched)
+	}
+	return nil
+}
+
+// writeDerivedFile writes a file derived from the objects mounted, e.g. the env file, to fileName
+// relative to dir
+func (adapter *KeyvaultFlexvolumeAdapter) writeDerivedFile(fileName string, content []byte) error {
+	return adapter.writeVolumeFile(fileName, content, true)
+}
+
+// writeVolumeFile writes a file generated by the driver to fileName relative to dir, like the
+// objects, protected with -dpapiProtectionDescriptor if protect is set
+func (adapter *KeyvaultFlexvolumeAdapter) writeVolumeFile(fileName string, content []byte, protect bool) error {
+	filePath := filepath.Join(adapter.dataDir(), fileName)
+	if err := adapter.reserveSize(fileName, len(content)); err != nil {
+		return err
+	}
+	if err := adapter.makeDirs(filePath); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %s", filePath)
+	}
+	if err := adapter.writeContent(filePath, content, KeyVaultObject{}.fileMode(adapter.options), protect); err != nil {
+		return errors.Wrapf(err, "failed to write %s", filePath)
+	}
+	glog.V(0).Infof("wrote %s", filePath)
+	return nil
+}
+
+// writeFile writes content to filePath with mode, regardless of the umask of the driver, owned by
+// -runAsUser and -runAsGroup when set so containers running as non-root can read it, or readable
+// by the fsGroup of the pod. With -dpapiProtectionDescriptor the content is protected first.
+func (adapter *KeyvaultFlexvolumeAdapter) writeFile(filePath string, content []byte, mode os.FileMode) error {
+	return adapter.writeContent(filePath, content, mode, true)
+}
+
+// writeContent writes content to filePath like writeFile, only protecting it if protect is set
+func (adapter *KeyvaultFlexvolumeAdapter) writeContent(filePath string, content []byte, mode os.FileMode, protect bool) error {
+	written := content
+	if !adapter.keepUnchanged(filePath, content) {
+		var err error
+		if protect {
+			if written, err = adapter.protectContent(content); err != nil {
+				return err
+			}
+		}
+		if err = ioutil.WriteFile(filePath, written, mode); err != nil {
+			return err
+		}
+	} else if protect && adapter.options.dpapiProtectionDescriptor != "" {
+		// kept as protected by the previous mount
+		var err error
+		if written, err = ioutil.ReadFile(filePath); err != nil {
+			return err
+		}
+	}
+	adapter.recordHash(filePath, written, content)
+	return adapter.setOwnership(filePath, mode, 0040)
+}
+
+// makeDirs creates the directories of filePath missing in the data directory with -dirPermission,
+// regardless of the umask of the driver, owned like the files
+func (adapter *KeyvaultFlexvolumeAdapter) makeDirs(filePath string) error {
+	dataDir := adapter.dataDir()
+	rel, err := filepath.Rel(dataDir, filepath.Dir(filePath))
+	if err != nil || rel == "." {
+		return err
+	}
+	dir := dataDir
+	for _, element := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, element)
+		if err = os.Mkdir(dir, dirPermission); err != nil {
+			if os.IsExist(err) {
+				continue
 			}
+			return err
+		}
+		if err = adapter.setOwnership(dir, adapter.dirMode(), 0050); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirMode returns the mode of the directories of the volume, -dirPermission
+func (adapter *KeyvaultFlexvolumeAdapter) dirMode() os.FileMode {
+	// validated with the options
+	mode, _ := parseFileMode(adapter.options.dirPermission)
+	return mode
+}
+
+// setOwnership sets the mode of filePath and its owner to -runAsUser and -runAsGroup when set.
+// Like the secret volumes of Kubernetes, with the fsGroup of the pod it is owned by the group,
+// unless -runAsGroup is set, and groupMode is added to its mode.
+func (adapter *KeyvaultFlexvolumeAdapter) setOwnership(filePath string, mode os.FileMode, groupMode os.FileMode) error {
+	options := adapter.options
+	gid := options.runAsGroup
+	if options.fsGroup != -1 {
+		mode |= groupMode
+		if gid == -1 {
+			gid = options.fsGroup
+		}
+	}
+	if err := setFileMode(filePath, mode); err != nil {
+		return err
+	}
+	if options.runAsUser == -1 && gid == -1 {
+		return nil
+	}
+	return os.Chown(filePath, options.runAsUser, gid)
+}
+
+// fetchObject returns a single object from keyvault
+func (adapter *KeyvaultFlexvolumeAdapter) fetchObject(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*fetchedObject, error) {
+	ctx := adapter.ctx
+	objectType := object.ObjectType
+	objectName := object.ObjectName
+	objectVersion := object.ObjectVersion
+
+	switch objectType {
+	case VaultTypeSecret:
+		secret, err := kvClient.GetSecret(ctx, vaultURL, objectName, objectVersion)
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
+		}
+		fetched, err := fetchedSecret(object, secret)
+		if err != nil {
+			return nil, err
+		}
+		fetched.attributes = secretAttributes(secret)
+		return fetched, nil
+	case VaultTypeKey:
+		keybundle, err := kvClient.GetKey(ctx, vaultURL, objectName, objectVersion)
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
+		}
+		fetched := &fetchedObject{version: versionFromID(keybundle.Key.Kid), attributes: keyAttributes(keybundle)}
+		switch object.ObjectEncoding {
+		case "":
 			// NOTE: we are writing the RSA modulus content of the key
-			if err = ioutil.WriteFile(fileName, []byte(*keybundle.Key.N), permission); err != nil {
-				return errors.Wrapf(err, "azure KeyVault failed to write key %s to %s", objectName, fileName)
+			fetched.content = []byte(*keybundle.Key.N)
+		case ObjectEncodingJWK:
+			if fetched.content, err = marshalPublicJWK(keybundle.Key); err != nil {
+				return nil, errors.Wrapf(err, "failed to get the public key of key %s", objectName)
 			}
-		case VaultTypeCertificate:
-			certbundle, err := kvClient.GetCertificate(ctx, *vaultURL, objectName, objectVersion)
+		default:
+			der, err := marshalPublicKey(keybundle.Key)
 			if err != nil {
-				return sanitisedError(err, objectType, objectName, objectVersion)
+				return nil, errors.Wrapf(err, "failed to get the public key of key %s", objectName)
 			}
-			if err = ioutil.WriteFile(fileName, *certbundle.Cer, permission); err != nil {
-				return errors.Wrapf(err, "azure KeyVault failed to write certificate %s to %s", objectName, fileName)
+			fetched.content = encodeObject(der, "PUBLIC KEY", object.ObjectEncoding)
+		}
+		return fetched, nil
+	case VaultTypeCertificate:
+		switch object.ObjectFormat {
+		case ObjectFormatPFX:
+			return adapter.fetchPFX(kvClient, vaultURL, object)
+		case ObjectFormatBundle:
+			return adapter.fetchBundle(kvClient, vaultURL, object)
+		}
+		certbundle, err := kvClient.GetCertificate(ctx, vaultURL, objectName, objectVersion)
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
+		}
+		content := *certbundle.Cer
+		if object.IncludeChain {
+			if content, err = adapter.getCertificateChain(content); err != nil {
+				return nil, errors.Wrapf(err, "failed to get the chain of certificate %s", objectName)
 			}
-		default:
-			err = errors.Errorf("Invalid vaultObjectTypes. Should be secret, key, or cert")
-			return sanitisedError(err, objectType, objectName, objectVersion)
+		} else if object.ObjectEncoding == ObjectEncodingPEM {
+			content = encodeObject(content, "CERTIFICATE", object.ObjectEncoding)
+		}
+		return &fetchedObject{content: content, version: versionFromID(certbundle.ID), certificate: *certbundle.Cer, attributes: certificateAttributes(certbundle)}, nil
+	case VaultTypeCertificateSigningRequest:
+		// the CSR belongs to the pending operation of the certificate, so it has no version
+		operation, err := kvClient.GetCertificateOperation(ctx, vaultURL, objectName)
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
+		}
+		if operation.Csr == nil {
+			err = errors.Errorf("certificate operation has no CSR, status: %s", to.String(operation.Status))
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
 		}
-		glog.V(0).Infof("azure KeyVault wrote %s %s at %s", objectType, objectName, fileName)
+		return &fetchedObject{content: encodeObject(*operation.Csr, "CERTIFICATE REQUEST", object.ObjectEncoding)}, nil
+	case VaultTypeCertificateKey:
+		certSecret, fetched, err := adapter.getCertificateSecret(kvClient, vaultURL, object)
+		if err != nil {
+			return nil, err
+		}
+		if fetched.content, err = encodePrivateKey(certSecret.privateKey, object.ObjectEncoding); err != nil {
+			return nil, errors.Wrapf(err, "failed to get the private key of certificate %s", objectName)
+		}
+		fetched.certSecret = certSecret
+		return fetched, nil
+	default:
+		err := errors.Errorf("Invalid vaultObjectTypes. Should be secret, key, or cert")
+		return nil, sanitisedError(err, objectType, objectName, objectVersion)
 	}
-	return nil
 }
 
 func (adapter *KeyvaultFlexvolumeAdapter) initializeKvClient() (*kv.BaseClient, error) {
+	if adapter.kvClient != nil {
+		return adapter.kvClient, nil
+	}
 	kvClient := kv.New()
 	options := adapter.options
 
-	token, err := GetKeyvaultToken(AuthGrantType(), options.cloudName, options.tenantID, options.usePodIdentity, options.useVmManagedIdentity, options.vmManagedIdentityClientID, options.aADClientSecret, options.aADClientID, options.podName, options.podNamespace, options.nmiPort)
+	aADClientSecret, err := adapter.getAADClientSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.restrictEndpoints {
+		allowedEndpoints, err := adapter.getAllowedEndpoints()
+		if err != nil {
+			return nil, err
+		}
+		glog.V(0).Infof("restricting endpoints to %s", strings.Join(allowedEndpoints, ", "))
+		adapter.httpClient = newRestrictedHTTPClient(allowedEndpoints, false)
+		kvClient.Sender = adapter.httpClient
+	}
+
+	if options.requirePrivateLink {
+		vaultURLs, err := adapter.getVaultURLs()
+		if err != nil {
+			return nil, err
+		}
+		for _, vaultURL := range vaultURLs {
+			if err = checkPrivateLink(vaultURL); err != nil {
+				return nil, err
+			}
+		}
+		// only the vault requests have to go through the private endpoint, AAD is still public
+		var allowedEndpoints []string
+		if options.restrictEndpoints {
+			if allowedEndpoints, err = adapter.getAllowedEndpoints(); err != nil {
+				return nil, err
+			}
+		}
+		kvClient.Sender = newRestrictedHTTPClient(allowedEndpoints, true)
+	}
+
+	if adapter.report != nil {
+		adapter.httpClient = adapter.recordEndpoints(adapter.httpClient)
+		kvClient.Sender = adapter.recordSender(kvClient.Sender)
+	}
+	if options.managedHSM {
+		kvClient.Sender = managedHSMSender(kvClient.Sender)
+	}
+	if options.rateLimitQPS > 0 {
+		if kvClient.Sender, err = adapter.rateLimitSender(kvClient.Sender); err != nil {
+			return nil, err
+		}
+	}
+	// requests are retried by the sender with the policy of the volume rather than by the client
+	kvClient.RetryAttempts = 0
+	kvClient.RetryDuration = 0
+	kvClient.Sender = adapter.retrySender(kvClient.Sender)
+
+	token, err := GetKeyvaultToken(AuthGrantType(), options.cloudName, options.managedHSM, options.tenantID, options.aADRegion, options.usePodIdentity, options.useVmManagedIdentity, options.vmManagedIdentityClientID, aADClientSecret, options.aADClientID, options.podName, options.podNamespace, options.nmiPort, adapter.httpClient)
+	if err != nil && options.allowStaleOnError {
+		// the requests fail as unavailable, so the objects cached on the node are mounted
+		glog.Warningf("failed to get key vault token, serving the objects cached on the node: %s", err)
+		token, err = unavailableAuthorizer{errors.Wrapf(err, "failed to get key vault token")}, nil
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get key vault token")
 	}
@@ -121,35 +651,83 @@ func (adapter *KeyvaultFlexvolumeAdapter) initializeKvClient() (*kv.BaseClient,
 	return &kvClient, nil
 }
 
+// getAADClientSecret returns the inline client secret, or reads it from aADClientSecretFile
+// so the secret doesn't have to be passed through the pod spec
+func (adapter *KeyvaultFlexvolumeAdapter) getAADClientSecret() (string, error) {
+	options := adapter.options
+	if options.aADClientSecretFile == "" {
+		return options.aADClientSecret, nil
+	}
+	content, err := ioutil.ReadFile(options.aADClientSecretFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read aADClientSecretFile %s", options.aADClientSecretFile)
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", errors.Errorf("aADClientSecretFile %s is empty", options.aADClientSecretFile)
+	}
+	return secret, nil
+}
+
 // azure-sdk-for-go returns some errors with \r\n in the body
 // kubernetes errors out with "invalid character '\r' in string literal", if we don't sanitise it first
 func sanitisedError(err error, objectType string, objectName string, objectVersion string) error {
 	sanitisedErr := strings.Replace(err.Error(), "\\", " ", -1)
-	return fmt.Errorf("failed to get objectType:%s, objectName:%s, objectVersion:%s %s", objectType, objectName, objectVersion, sanitisedErr)
+	sanitised := fmt.Errorf("failed to get objectType:%s, objectName:%s, objectVersion:%s %s", objectType, objectName, objectVersion, sanitisedErr)
+	if isNotFoundResponse(err) {
+		return notFoundError{sanitised}
+	}
+	if isDisabledResponse(err) {
+		return inactiveError{sanitised}
+	}
+	if isUnavailableResponse(err) {
+		return unavailableError{sanitised}
+	}
+	return sanitised
 }
 
 func (adapter *KeyvaultFlexvolumeAdapter) getVaultURL() (vaultURL *string, err error) {
+	if adapter.options.vaultURI != "" {
+		vaultURL, err := parseVaultURI(adapter.options.vaultURI)
+		if err != nil {
+			return nil, err
+		}
+		return &vaultURL, nil
+	}
+	return adapter.getNamedVaultURL(adapter.options.vaultName)
+}
+
+// getNamedVaultURL returns the URL of a vault of the cloud of the volume by name
+func (adapter *KeyvaultFlexvolumeAdapter) getNamedVaultURL(vaultName string) (vaultURL *string, err error) {
 	// See docs for validation spec: https://docs.microsoft.com/en-us/azure/key-vault/about-keys-secrets-and-certificates#objects-identifiers-and-versioning
-	if match, _ := regexp.MatchString("[-a-zA-Z0-9]{3,24}", adapter.options.vaultName); !match {
-		return nil, errors.Errorf("Invalid vault name: %q, must match [-a-zA-Z0-9]{3,24}")
+	if match, _ := regexp.MatchString("[-a-zA-Z0-9]{3,24}", vaultName); !match {
+		return nil, errors.Errorf("Invalid vault name: %q, must match [-a-zA-Z0-9]{3,24}", vaultName)
 	}
-	vaultDnsSuffix, err := GetVaultDNSSuffix(adapter.options.cloudName)
+	vaultDnsSuffix, err := GetVaultDNSSuffix(adapter.options.cloudName, adapter.options.managedHSM)
 	if err != nil {
 		return nil, err
 	}
 
 	vaultDnsSuffixValue := *vaultDnsSuffix
 
-	vaultUri := "https://" + adapter.options.vaultName + "." + vaultDnsSuffixValue + "/"
+	vaultUri := "https://" + vaultName + "." + vaultDnsSuffixValue + "/"
 	return &vaultUri, nil
 }
 
-func GetVaultDNSSuffix(cloudName string) (vaultTld *string, err error) {
+// GetVaultDNSSuffix returns the DNS suffix of the vaults, or of the Managed HSM pools with managedHSM
+func GetVaultDNSSuffix(cloudName string, managedHSM bool) (vaultTld *string, err error) {
 	environment, err := ParseAzureEnvironment(cloudName)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if managedHSM {
+		suffix, err := managedHSMDNSSuffix(environment)
+		if err != nil {
+			return nil, err
+		}
+		return &suffix, nil
+	}
 	return &environment.KeyVaultDNSSuffix, nil
 }
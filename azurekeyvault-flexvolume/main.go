@@ -9,18 +9,33 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
-	"strings"
+	"path"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/golang/glog"
 )
 
 const (
 	program                = "azurekeyvault-flexvolume"
-	version                = "0.0.17"
 	permission os.FileMode = 0644
-	objectsSep             = ";"
+	// permission of the subdirectories created for aliases with a path
+	dirPermission os.FileMode = 0755
+	objectsSep                = ";"
+	// debugValuesHashed logs the SHA-256 of written contents, never the contents themselves
+	debugValuesHashed = "hashed"
+)
+
+// Build metadata of the driver, set by the Makefile with -ldflags "-X main.version=..."
+var (
+	version   = "0.0.17"
+	gitCommit = "unknown"
+	buildDate = "unknown"
 )
 
 // Type of Azure Key Vault objects
@@ -31,12 +46,23 @@ const (
 	VaultTypeKey string = "key"
 	// VaultTypeCertificate certificate vault object type
 	VaultTypeCertificate string = "cert"
+	// VaultTypeCertificateSigningRequest CSR of a pending certificate operation
+	VaultTypeCertificateSigningRequest string = "csr"
+	// VaultTypeCertificateKey private key of a certificate, extracted from its backing secret
+	VaultTypeCertificateKey string = "cert-key"
+
+	// ObjectFormatPFX writes a certificate, its private key and its chain as a PKCS#12 file
+	ObjectFormatPFX string = "pfx"
+	// ObjectFormatBundle writes the private key, the certificate and its chain as a single PEM file
+	ObjectFormatBundle string = "bundle"
 )
 
 // Option is a collection of configs
 type Option struct {
 	// the name of the Azure Key Vault instance
 	vaultName string
+	// URI of the vault, instead of vaultName
+	vaultURI string
 	// the name of the Azure Key Vault objects
 	vaultObjectNames string
 	// the filenames the objects will be written to
@@ -45,6 +71,10 @@ type Option struct {
 	vaultObjectVersions string
 	// the types of the Azure Key Vault objects
 	vaultObjectTypes string
+	// JSON array of the Azure Key Vault objects, replaces the semi-colon separated lists
+	vaultObjects string
+	// the Azure Key Vault objects to write, parsed from vaultObjects or the semi-colon separated lists
+	objects []KeyVaultObject
 	// directory to save the vault objects
 	dir string
 	// version flag
@@ -53,6 +83,8 @@ type Option struct {
 	cloudName string
 	// tenantID in AAD
 	tenantID string
+	// Azure region of the regional AAD token endpoint (ESTS-R) to use
+	aADRegion string
 	// POD AAD Identity flag
 	usePodIdentity bool
 	// VM managed identity flag
@@ -63,94 +95,813 @@ type Option struct {
 	aADClientSecret string
 	// AAD app client secret id (if not using POD AAD Identity)
 	aADClientID string
+	// path to a file holding the AAD app client secret (if not using POD AAD Identity)
+	aADClientSecretFile string
 	// the name of the pod (if using POD AAD Identity)
 	podName string
 	// the namespace of the pod (if using POD AAD Identity)
 	podNamespace string
 	// the port NMI is running on (if using POD AAD Identity)
 	nmiPort string
+	// debug logging mode for object contents
+	debugValues string
+	// only allow connections to the AAD and Key Vault endpoints
+	restrictEndpoints bool
+	// additional hostnames allowed with restrictEndpoints
+	allowedEndpoints string
+	// refuse to mount unless the vault is reached through a private endpoint
+	requirePrivateLink bool
+	// format of the timestamps written to files in the volume
+	timeFormat string
+	// file the keystore of the objects with a keystoreAlias is written to
+	keystore string
+	// type of the keystore: jks or pkcs12
+	keystoreType string
+	// password of the keystore and its private keys, generated if empty
+	keystorePassword string
+	// password of the objects with objectFormat pfx, generated for each if empty
+	pfxPassword string
+	// maximum number of objects in a volume, 0 for no limit
+	maxObjects int
+	// maximum number of objects fetched by a pod per hour across its mounts, 0 for no limit
+	maxFetchesPerHour int
+	// requests per second to Key Vault of the mounts of the node, 0 for no limit
+	rateLimitQPS float64
+	// requests to Key Vault the mounts of the node can send at once above rateLimitQPS
+	rateLimitBurst int
+	// maximum size in bytes of each file of an object, 0 for no limit
+	maxObjectSize int
+	// maximum size in bytes of the files written to a volume, 0 for no limit
+	maxVolumeSize int
+	// directory of the state kept on the node across mounts
+	stateDir string
+	// ARM metadata endpoint to refresh the Azure environments from, empty to only use the compiled-in ones
+	environmentMetadataURL string
+	// write the metadata of each object to <file name>.meta.json
+	writeMetadata bool
+	// write the SHA-256 of each file of an object to <file name>.sha256
+	writeChecksums bool
+	// mount the secrets whose tags match these comma separated name=value pairs, in addition to objects
+	tagSelector string
+	// mount the secrets whose names start with this prefix, or match it if it's a glob, in addition to objects
+	objectNamePrefix string
+	// strip the prefix, up to its first wildcard, from the file names of the secrets matching objectNamePrefix
+	stripObjectNamePrefix bool
+	// mount every enabled secret of the vault, in addition to objects
+	mountAllSecrets bool
+	// maximum number of secrets mounted with mountAllSecrets, so a growing vault fails the mount
+	// rather than filling the volume
+	mountAllSecretsLimit int
+	// comma separated names or globs of the secrets never mounted by mountAllSecrets, tagSelector or objectNamePrefix
+	excludeObjectNames string
+	// retries of a failed request to Key Vault after the first attempt
+	retryAttempts int
+	// delay before the first retry, doubled for each retry
+	retryInitialBackoff time.Duration
+	// maximum delay between retries, 0 for no maximum
+	retryMaxBackoff time.Duration
+	// maximum time spent retrying a request, 0 for no deadline
+	retryDeadline time.Duration
+	// maximum seconds of a mount, including the token, fetches and writes, 0 for no limit
+	mountTimeoutSeconds int
+	// serve the objects cached on the node by previous mounts when the vault or AAD is unavailable
+	allowStaleOnError bool
+	// the key of the cache of -allowStaleOnError is sealed to the TPM of the node
+	cacheKeyTPM bool
+	// register the volume for the rotation daemon of the node, which refreshes it periodically
+	rotation bool
+	// period of the refreshes of the volume by the rotation daemon, the period of the daemon if 0
+	rotationPollInterval time.Duration
+	// certificates expiring within this window are refreshed more often by the rotation daemon,
+	// 0 to only refresh them at rotationPollInterval
+	rotationExpiryWindow time.Duration
+	// period the previous content of the objects rotated by a refresh is kept in previous/, 0 to
+	// not keep it
+	rotationGracePeriod time.Duration
+	// refreshes only download the objects when the vault lists a new version of one of them
+	rotationCheckVersions bool
+	// set by the rotation daemon when it refreshes the volume
+	refresh bool
+	// name of the Kubernetes Secret of the namespace of the pod the objects are synced to, empty
+	// to not sync them
+	syncK8sSecret string
+	// type of the synced Secret: Opaque or kubernetes.io/tls
+	syncK8sSecretType string
+	// URL of the Kubernetes API server Secrets are synced through, set on the node
+	k8sAPIServer string
+	// file of the token of the service account syncing Secrets, set on the node
+	k8sTokenFile string
+	// file of the CA of the Kubernetes API server, the CAs of the system if empty
+	k8sCAFile string
+	// annotate the pod, or its Deployment, Argo Rollout or Flagger canary Deployment, with the hash
+	// of the versions of the objects when a refresh mounts a new version: pod, deployment, rollout
+	// or canary, empty to not annotate
+	rotationAnnotation string
+	// signal sent to the processes of the pod when a refresh mounts a new version of an object,
+	// e.g. SIGHUP, empty to not signal them
+	rotationSignal string
+	// name of the processes of the pod signaled, the main process of each container if empty
+	rotationSignalProcess string
+	// URL notified of the objects rotated since the previous mount, empty to not notify
+	rotationWebhookURL string
+	// file of the key of the HMAC-SHA256 signature of the notifications, unsigned if empty
+	rotationWebhookSecretFile string
+	// Go template rendered with the objects mounted, e.g. {{ object "db-password" }}
+	template string
+	// the file the template is rendered to, relative to dir
+	templateOutput string
+	// the file the secrets are also written to as KEY=value lines, relative to dir
+	envFile string
+	// the format of the keys of envFile: the file names of the secrets by default, or upper-snake
+	envKeyFormat string
+	// the file the secrets are also written to as Java properties, relative to dir
+	propertiesFile string
+	// the file the objects are also written to as a single JSON or YAML document, relative to dir
+	aggregateFile string
+	// the format of aggregateFile: json or yaml, from its extension by default
+	aggregateFormat string
+	// directory of the executables objects can be transformed with, empty to disable transform hooks
+	hooksDir string
+	// the vault is a Managed HSM pool, which only has keys
+	managedHSM bool
+	// separator of the object names written to subdirectories, e.g. -- for team--db-password to be
+	// written to team/db-password. Empty to write objects as named
+	pathSeparator string
+	// casing of the file names of objects without alias: as-is, lowercase or upper-snake
+	fileNameCase string
+	// octal mode of the files written to the volume, unless overridden by the filePermission of an object
+	filePermission string
+	// octal mode of the directories of the volume, for object aliases with a path
+	dirPermission string
+	// write secrets to -dir even if it isn't a tmpfs, persisting them on the disk of the node
+	allowPersistentDir bool
+	// SELinux context of the files written, e.g. system_u:object_r:container_file_t:s0, empty to keep the
+	// context of -dir
+	seLinuxContext string
+	// DPAPI-NG protection descriptor the files are protected to on Windows, e.g. the SID of the gMSA
+	// of the pod, empty to write them unprotected
+	dpapiProtectionDescriptor string
+	// remount -dir read-only once the files are written
+	remountReadOnly bool
+	// write the files to a timestamped directory published atomically through the ..data symlink
+	atomicWrites bool
+	// owner and group of the files written to the volume, -1 to leave them owned by the driver
+	runAsUser  int
+	runAsGroup int
+	// fsGroup of the pod, owning the files written to the volume and allowed to read them, -1 if none
+	fsGroup int
+	// policy of the mount when an object fails: fail-fast or best-effort
+	mountPolicy string
+	// what to do with the objects disabled, expired or not yet active: fail, skip or warn
+	inactiveObjects string
+	// number of objects fetched at the same time
+	concurrency int
+	// number of reads of each object that must return the same version and content
+	consistentReads int
+	// file holding the externally signed certificate to merge into a pending certificate operation
+	mergeCertificateFile string
 }
 
 func main() {
-	ctx := context.Background()
-	options, err := parseConfigs()
-	if err != nil {
-		glog.Errorf("[error] : %s", err)
-		os.Exit(1)
-	}
-
-	adapter := &KeyvaultFlexvolumeAdapter{ctx: ctx, options: *options}
-	err = adapter.Run()
-	if err != nil {
+	// the logging flags are parsed by the flag set of each command, glog only needs to know parsing
+	// is done. Logs go to stderr, appended to the driver log by kv.
+	flag.CommandLine.Parse(nil)
+	flag.Set("logtostderr", "true")
+	if err := runCommand(context.Background(), os.Args[1:]); err != nil {
 		glog.Fatalf("[error] : %s", err)
 	}
 	glog.Flush()
 	os.Exit(0)
 }
 
-func parseConfigs() (*Option, error) {
+// parseConfigs parses the volume options of a command from args, and loads the Azure environments
+func parseConfigs(fs *flag.FlagSet, args []string) (*Option, error) {
 	var options Option
-	flag.StringVar(&options.vaultName, "vaultName", "", "Name of Azure Key Vault instance.")
-	flag.StringVar(&options.vaultObjectNames, "vaultObjectNames", "", "Names of Azure Key Vault objects, semi-colon separated.")
-	flag.StringVar(&options.vaultObjectAliases, "vaultObjectAliases", "", "Filenames to write the Azure Key Vault objects to, semi-colon separated.")
-	flag.StringVar(&options.vaultObjectTypes, "vaultObjectTypes", "", "Types of Azure Key Vault objects, semi-colon separated.")
-	flag.StringVar(&options.vaultObjectVersions, "vaultObjectVersions", "", "Versions of Azure Key Vault objects, semi-colon separated.")
-	flag.StringVar(&options.aADClientID, "aADClientID", "", "aADClientID to Azure.")
-	flag.StringVar(&options.aADClientSecret, "aADClientSecret", "", "aADClientSecret to Azure.")
-	flag.StringVar(&options.cloudName, "cloudName", "", "Type of Azure cloud")
-	flag.StringVar(&options.tenantID, "tenantId", "", "tenantId to Azure")
-	flag.BoolVar(&options.usePodIdentity, "usePodIdentity", false, "usePodIdentity for using pod identity.")
-	flag.BoolVar(&options.useVmManagedIdentity, "useVmManagedIdentity", false, "Use the VM managed identity.")
-	flag.StringVar(&options.vmManagedIdentityClientID, "vmManagedIdentityClientID", "", "The VM managed identity client ID. Empty to use the System Assigned identity.")
-	flag.StringVar(&options.dir, "dir", "", "Directory path to write data.")
-	flag.BoolVar(&options.showVersion, "version", true, "Show version.")
-	flag.StringVar(&options.podName, "podName", "", "Name of the pod")
-	flag.StringVar(&options.podNamespace, "podNamespace", "", "Namespace of the pod")
-	flag.StringVar(&options.nmiPort, "nmiPort", "2579", "NMI port number")
-
-	flag.Parse()
-
-	err := Validate(options)
-	return &options, err
+	fs.StringVar(&options.vaultName, "vaultName", "", "Name of Azure Key Vault instance.")
+	fs.StringVar(&options.vaultURI, "vaultURI", "", "URI of Azure Key Vault instance instead of -vaultName, e.g. https://myvault.privatelink.vaultcore.azure.net for a private endpoint resolved through custom DNS.")
+	fs.StringVar(&options.vaultObjectNames, "vaultObjectNames", "", "Names of Azure Key Vault objects, semi-colon separated.")
+	fs.StringVar(&options.vaultObjectAliases, "vaultObjectAliases", "", "Filenames to write the Azure Key Vault objects to, semi-colon separated.")
+	fs.StringVar(&options.vaultObjectTypes, "vaultObjectTypes", "", "Types of Azure Key Vault objects, semi-colon separated.")
+	fs.StringVar(&options.vaultObjectVersions, "vaultObjectVersions", "", "Versions of Azure Key Vault objects, semi-colon separated.")
+	fs.StringVar(&options.vaultObjects, "vaultObjects", "", "JSON array of Azure Key Vault objects, each with objectName, objectType and optional objectVersion and objectAlias. Replaces the semi-colon separated lists.")
+	fs.StringVar(&options.tagSelector, "tagSelector", "", "Mount every secret of the vault whose tags match these comma separated name=value pairs, e.g. env=prod,team=payments.")
+	fs.StringVar(&options.objectNamePrefix, "objectNamePrefix", "", "Mount every secret of the vault whose name starts with this prefix, or matches it if it has *, ? or [ wildcards.")
+	fs.StringVar(&options.template, "template", "", "Go template rendered to -templateOutput with the objects mounted, referenced by name or file name with {{ object \"name\" }}.")
+	fs.StringVar(&options.templateOutput, "templateOutput", "", "File the -template is rendered to, relative to -dir.")
+	fs.StringVar(&options.envFile, "envFile", "", "File the secrets are also written to as KEY=value lines for dotenv loaders, relative to -dir, e.g. secrets.env.")
+	fs.StringVar(&options.envKeyFormat, "envKeyFormat", "", "Format of the keys of -envFile: empty for the file names of the secrets, or upper-snake.")
+	fs.StringVar(&options.propertiesFile, "propertiesFile", "", "File the secrets are also written to as Java properties, relative to -dir, e.g. secrets.properties.")
+	fs.StringVar(&options.aggregateFile, "aggregateFile", "", "File the objects are also written to as a single document keyed by file name, relative to -dir, e.g. secrets.yaml.")
+	fs.StringVar(&options.aggregateFormat, "aggregateFormat", "", "Format of -aggregateFile: json or yaml. Empty for yaml with the .yaml and .yml extensions, json otherwise.")
+	fs.StringVar(&options.hooksDir, "hooksDir", "", "Directory of the executables objects can be transformed with by their transformHook. Empty to disable transform hooks.")
+	fs.BoolVar(&options.managedHSM, "managedHSM", false, "-vaultName is a Managed HSM pool, which only has keys. Detected from -vaultURI.")
+	fs.StringVar(&options.pathSeparator, "pathSeparator", "", "Separator of the object names replaced by / in their file names, e.g. -- to write team--db-password to team/db-password. Objects with an objectAlias are written to their alias.")
+	fs.StringVar(&options.fileNameCase, "fileNameCase", FileNameCaseAsIs, "Casing of the file names of objects without objectAlias: as-is for the names of the objects, lowercase, or upper-snake for uppercase with underscores instead of hyphens, e.g. DB_PASSWORD.")
+	fs.StringVar(&options.mountPolicy, "mountPolicy", MountPolicyFailFast, "What to do when an object fails: fail-fast to fail the mount, best-effort to mount the other objects and report the failed ones in "+mountReportFileName+".")
+	fs.StringVar(&options.inactiveObjects, "inactiveObjects", InactiveObjectsWarn, "What to do with the objects disabled, expired or not yet active: fail the mount, skip them or warn and mount expired and not yet active objects.")
+	fs.IntVar(&options.concurrency, "concurrency", defaultConcurrency, "Number of objects fetched at the same time.")
+	fs.IntVar(&options.consistentReads, "consistentReads", 1, "Number of reads of each object that must return the same version and content before it is written, to guard against stale reads while the vault fails over.")
+	fs.BoolVar(&options.mountAllSecrets, "mountAllSecrets", false, "Mount every enabled secret of the vault.")
+	fs.IntVar(&options.mountAllSecretsLimit, "mountAllSecretsLimit", defaultMountAllSecretsLimit, "Maximum number of secrets mounted with -mountAllSecrets.")
+	fs.StringVar(&options.excludeObjectNames, "excludeObjectNames", "", "Comma separated names or globs of the secrets never mounted by -mountAllSecrets, -tagSelector or -objectNamePrefix.")
+	fs.BoolVar(&options.stripObjectNamePrefix, "stripObjectNamePrefix", false, "Strip -objectNamePrefix, up to its first wildcard, from the file names of the secrets it matches.")
+	fs.StringVar(&options.aADClientID, "aADClientID", "", "aADClientID to Azure.")
+	fs.StringVar(&options.aADClientSecret, "aADClientSecret", "", "aADClientSecret to Azure.")
+	fs.StringVar(&options.aADClientSecretFile, "aADClientSecretFile", "", "Path to a file containing the aADClientSecret to Azure.")
+	fs.StringVar(&options.cloudName, "cloudName", "", "Type of Azure cloud")
+	fs.StringVar(&options.tenantID, "tenantId", "", "tenantId to Azure")
+	fs.StringVar(&options.aADRegion, "aADRegion", "", "Azure region of the regional AAD token endpoint to use. Empty to use the global endpoint.")
+	fs.BoolVar(&options.usePodIdentity, "usePodIdentity", false, "usePodIdentity for using pod identity.")
+	fs.BoolVar(&options.useVmManagedIdentity, "useVmManagedIdentity", false, "Use the VM managed identity.")
+	fs.StringVar(&options.vmManagedIdentityClientID, "vmManagedIdentityClientID", "", "The VM managed identity client ID. Empty to use the System Assigned identity.")
+	fs.StringVar(&options.dir, "dir", "", "Directory path to write data.")
+	fs.BoolVar(&options.showVersion, "version", true, "Show version.")
+	fs.StringVar(&options.podName, "podName", "", "Name of the pod")
+	fs.StringVar(&options.podNamespace, "podNamespace", "", "Namespace of the pod")
+	fs.StringVar(&options.nmiPort, "nmiPort", "2579", "NMI port number")
+	fs.StringVar(&options.mergeCertificateFile, "mergeCertificateFile", "", "Merge the signed certificate (PEM or DER) in this file into the pending certificate operation of -vaultObjectNames, instead of mounting.")
+	fs.BoolVar(&options.restrictEndpoints, "restrictEndpoints", false, "Only allow connections to the AAD and Key Vault endpoints (plus NMI or the instance metadata endpoint for the identity in use), verified at dial time.")
+	fs.StringVar(&options.allowedEndpoints, "allowedEndpoints", "", "Additional hostnames allowed with -restrictEndpoints, semi-colon separated.")
+	fs.StringVar(&options.keystore, "keystore", "", "File to write a keystore with the objects that have a keystoreAlias to.")
+	fs.StringVar(&options.keystoreType, "keystoreType", KeystoreTypeJKS, "Type of the keystore: jks or pkcs12.")
+	fs.StringVar(&options.pfxPassword, "pfxPassword", "", "Password of the objects with objectFormat pfx, generated for each and written to its pfxPasswordFile if empty.")
+	fs.StringVar(&options.keystorePassword, "keystorePassword", "", "Password of the keystore and its private keys, generated and written to <keystore>.password if empty.")
+	fs.IntVar(&options.maxObjects, "maxObjects", 0, "Maximum number of objects in a volume, 0 for no limit.")
+	fs.IntVar(&options.maxFetchesPerHour, "maxFetchesPerHour", 0, "Maximum number of objects fetched by a pod per hour across its mounts, 0 for no limit.")
+	fs.Float64Var(&options.rateLimitQPS, "rateLimitQPS", 0, "Requests per second to Key Vault of the mounts of the node, shared through -stateDir, 0 for no limit.")
+	fs.IntVar(&options.rateLimitBurst, "rateLimitBurst", 10, "Requests to Key Vault the mounts of the node can send at once above -rateLimitQPS.")
+	fs.StringVar(&options.filePermission, "filePermission", "0644", "Octal mode of the files written to the volume, overridden by the filePermission of an object.")
+	fs.StringVar(&options.dirPermission, "dirPermission", "0755", "Octal mode of the volume and of its directories, e.g. for objects with a path as alias.")
+	fs.BoolVar(&options.allowPersistentDir, "allowPersistentDir", false, "Write to -dir even if it isn't a tmpfs, persisting the secrets on the disk of the node.")
+	fs.StringVar(&options.seLinuxContext, "seLinuxContext", "", "SELinux context of the files written to the volume, e.g. system_u:object_r:container_file_t:s0, for containers of SELinux enforcing nodes to read them. Empty to keep the context of -dir.")
+	fs.StringVar(&options.dpapiProtectionDescriptor, "dpapiProtectionDescriptor", "", "DPAPI-NG protection descriptor the files written to the volume are encrypted to on Windows, e.g. SID=<SID of the gMSA of the pod>, so only its principals can read them. Empty to write them unprotected.")
+	fs.BoolVar(&options.remountReadOnly, "remountReadOnly", true, "Remount -dir read-only once the files are written, so containers can't modify or truncate them.")
+	fs.BoolVar(&options.atomicWrites, "atomicWrites", true, "Write the files to a timestamped directory published atomically through the ..data symlink, like Kubernetes secret volumes, so consumers never see a partially written set of files.")
+	fs.IntVar(&options.runAsUser, "runAsUser", -1, "Owner uid of the files written to the volume, -1 to leave them owned by root.")
+	fs.IntVar(&options.runAsGroup, "runAsGroup", -1, "Owner gid of the files written to the volume, -1 to leave them owned by root.")
+	fs.IntVar(&options.fsGroup, "fsGroup", -1, "fsGroup of the pod, passed by kubelet: the files written to the volume are owned by the group, unless -runAsGroup is set, and readable by it. -1 if the pod has no fsGroup.")
+	fs.IntVar(&options.maxObjectSize, "maxObjectSize", 0, "Maximum size in bytes of each file written for an object, 0 for no limit.")
+	fs.IntVar(&options.maxVolumeSize, "maxVolumeSize", defaultMaxVolumeSize, "Maximum size in bytes of the files written to a volume, 0 for no limit.")
+	fs.StringVar(&options.stateDir, "stateDir", defaultStateDir, "Directory of the state kept on the node across mounts.")
+	fs.StringVar(&options.environmentMetadataURL, "environmentMetadataURL", "", "ARM metadata endpoint to refresh the Azure environments from daily, cached in -stateDir. Empty to only use the environments compiled in the driver.")
+	fs.BoolVar(&options.requirePrivateLink, "requirePrivateLink", false, "Refuse to mount unless the vault resolves to a private endpoint, verified before and when connecting.")
+	fs.IntVar(&options.retryAttempts, "retryAttempts", autorest.DefaultRetryAttempts, "Retries of a request to Key Vault failed with a network error or a 408, 429 or 5xx status.")
+	fs.DurationVar(&options.retryInitialBackoff, "retryInitialBackoff", autorest.DefaultRetryDuration, "Delay before the first retry, doubled for each retry.")
+	fs.DurationVar(&options.retryMaxBackoff, "retryMaxBackoff", 0, "Maximum delay between retries, 0 for no maximum.")
+	fs.DurationVar(&options.retryDeadline, "retryDeadline", 0, "Maximum time spent retrying a request, 0 for no deadline.")
+	fs.IntVar(&options.mountTimeoutSeconds, "mountTimeoutSeconds", 0, "Maximum seconds of a mount, including the token, fetches and writes, after which it fails and the files written are discarded. 0 for no limit.")
+	fs.BoolVar(&options.allowStaleOnError, "allowStaleOnError", false, "Cache the objects mounted in -stateDir, encrypted with a key generated on the node, and serve them with a warning when Key Vault or AAD is unreachable, failing or throttling, rather than failing the mount. The objects served are listed as stale in the mount report.")
+	fs.BoolVar(&options.cacheKeyTPM, "cacheKeyTPM", false, "Seal the key of the cache of -allowStaleOnError to the TPM of the node with tpm2-tools rather than keeping it in a file of -stateDir, so the cached objects can't be decrypted from a copy of the disk of the node.")
+	fs.BoolVar(&options.rotation, "rotation", false, "Register the volume in -stateDir for the rotation daemon of the node, which refreshes its objects periodically so rotated objects reach running pods. The registration keeps the arguments of the mount, so secrets can't be passed inline.")
+	fs.DurationVar(&options.rotationPollInterval, "rotationPollInterval", 0, "Period the rotation daemon refreshes the volume at, e.g. 1m for high-sensitivity secrets or 1h for stable ones, at least 1m. 0 for the period of the daemon.")
+	fs.DurationVar(&options.rotationExpiryWindow, "rotationExpiryWindow", 0, "Certificates expiring within this window, e.g. 720h, are refreshed by the rotation daemon every "+expiryRefreshInterval.String()+" with an alert in its log until a renewed certificate is mounted, whatever -rotationPollInterval. 0 to disable.")
+	fs.DurationVar(&options.rotationGracePeriod, "rotationGracePeriod", 0, "Period the previous content of the files of the objects rotated by a refresh is kept in "+previousDirName+"/, e.g. 1h for applications needing the old and new keys during a cutover. It is removed by the first refresh after the period. 0 to not keep it.")
+	fs.BoolVar(&options.rotationCheckVersions, "rotationCheckVersions", false, "Refreshes list the versions of the objects and only download them when the latest version of one changed since the previous mount, or its enabled versions with objectVersionHistory and keyRing, rather than downloading them every time.")
+	fs.BoolVar(&options.refresh, "refresh", false, "Set by the rotation daemon when it refreshes a registered volume.")
+	fs.StringVar(&options.syncK8sSecret, "syncK8sSecret", "", "Name of a Kubernetes Secret of the namespace of the pod to mirror the objects to, a key per file name, e.g. for environment variables or ingress controllers. Empty to not sync them.")
+	fs.StringVar(&options.syncK8sSecretType, "syncK8sSecretType", SecretTypeOpaque, "Type of the -syncK8sSecret: Opaque, or kubernetes.io/tls with objects written to tls.crt and tls.key.")
+	fs.StringVar(&options.k8sAPIServer, "k8sAPIServer", "", "URL of the Kubernetes API server Secrets are synced through, e.g. https://10.0.0.1:443.")
+	fs.StringVar(&options.k8sTokenFile, "k8sTokenFile", "", "File of the token of the service account allowed to create and update Secrets.")
+	fs.StringVar(&options.k8sCAFile, "k8sCAFile", "", "File of the CA of the Kubernetes API server, the CAs of the system if empty.")
+	fs.StringVar(&options.rotationAnnotation, "rotationAnnotation", "", "Annotate the pod with the hash of the versions of the objects as "+contentHashAnnotation+", so tools such as Reloader restart it when a refresh changes them, and the versions of the objects as "+objectVersionsAnnotation+": pod, deployment to also annotate the pod template of its Deployment, rolling its pods, rollout for its Argo Rollout, or canary for the Deployment targeted by the Flagger Canary of its primary Deployment. Empty to not annotate.")
+	fs.StringVar(&options.rotationSignal, "rotationSignal", "", "Signal sent to the processes of the pod when a refresh mounts a new version of an object, e.g. SIGHUP for nginx to reload its certificates. Empty to not signal them.")
+	fs.StringVar(&options.rotationSignalProcess, "rotationSignalProcess", "", "Name of the processes of the pod sent -rotationSignal, e.g. nginx, their workers being left to them. The main process of each container if empty.")
+	fs.StringVar(&options.rotationWebhookURL, "rotationWebhookURL", "", "URL a JSON notification is posted to for each object whose version changed since the previous mount, with its vault, old and new versions and the pod. Empty to not notify.")
+	fs.StringVar(&options.rotationWebhookSecretFile, "rotationWebhookSecretFile", "", "Path to a file containing the key of the HMAC-SHA256 of the notifications, sent as "+webhookSignatureHeader+": sha256=<hex>. Unsigned if empty.")
+	fs.BoolVar(&options.writeChecksums, "writeChecksums", false, "Write the SHA-256 of each file written for an object to <file name>"+checksumSuffix+", in the format of sha256sum.")
+	fs.BoolVar(&options.writeMetadata, "writeMetadata", false, "Write the version, content type, tags, enabled flag and timestamps of each object to <file name>"+metadataSuffix+".")
+	fs.StringVar(&options.timeFormat, "timeFormat", TimeFormatRFC3339, "Format of timestamps written to files in the volume: rfc3339 (UTC) or epoch (seconds).")
+	fs.StringVar(&options.debugValues, "debugValues", "", "Debug logging of object contents. Only 'hashed' is supported, which logs the SHA-256 of each object written.")
+
+	if err := fs.Parse(args); err != nil {
+		return &options, err
+	}
+
+	objects, err := parseObjects(options)
+	if err != nil {
+		return &options, err
+	}
+	for i := range objects {
+		if fileName := objectFileName(objects[i].ObjectName, options); objects[i].ObjectAlias == "" && fileName != objects[i].ObjectName {
+			objects[i].ObjectAlias = fileName
+		}
+	}
+	options.objects = objects
+	if isManagedHSMURI(options.vaultURI) {
+		options.managedHSM = true
+	}
+
+	loadEnvironments(options)
+	return &options, nil
 }
 
 // Validate volume options
 func Validate(options Option) error {
-	if options.vaultName == "" {
-		return fmt.Errorf("-vaultName is not set")
+	if options.vaultName == "" && options.vaultURI == "" {
+		return fmt.Errorf("-vaultName or -vaultURI is not set")
+	}
+	if options.vaultName != "" && options.vaultURI != "" {
+		return fmt.Errorf("-vaultName and -vaultURI are mutually exclusive")
+	}
+	if options.vaultURI != "" {
+		if _, err := parseVaultURI(options.vaultURI); err != nil {
+			return fmt.Errorf("-vaultURI is invalid: %s", err)
+		}
 	}
 
-	if options.vaultObjectNames == "" {
-		return fmt.Errorf("-vaultObjectNames is not set")
+	if options.tenantID == "" {
+		return fmt.Errorf("-tenantId is not set")
+	}
+
+	if options.mergeCertificateFile != "" {
+		if options.vaultObjectNames == "" || strings.Contains(options.vaultObjectNames, objectsSep) {
+			return fmt.Errorf("-vaultObjectNames must be a single certificate name with -mergeCertificateFile")
+		}
+		return validateIdentity(options)
+	}
+
+	if options.vaultObjectNames == "" && options.vaultObjects == "" && !selectsSecrets(options) {
+		return fmt.Errorf("-vaultObjectNames, -vaultObjects, -tagSelector, -objectNamePrefix or -mountAllSecrets is not set")
+	}
+
+	if options.vaultObjectNames != "" && options.vaultObjects != "" {
+		return fmt.Errorf("-vaultObjectNames and -vaultObjects are mutually exclusive")
 	}
 
 	if options.dir == "" {
 		return fmt.Errorf("-dir is not set")
 	}
 
-	if options.tenantID == "" {
-		return fmt.Errorf("-tenantId is not set")
+	if options.vaultObjects == "" {
+		if strings.Count(options.vaultObjectNames, objectsSep) !=
+			strings.Count(options.vaultObjectTypes, objectsSep) {
+			return fmt.Errorf("-vaultObjectNames and -vaultObjectTypes do not have the same number of items")
+		}
+
+		if len(options.vaultObjectAliases) > 0 &&
+			(strings.Count(options.vaultObjectAliases, objectsSep) != strings.Count(options.vaultObjectAliases, objectsSep)) {
+			return fmt.Errorf("-vaultObjectNames and -vaultObjectAliases do not have the same number of items")
+		}
+	}
+
+	if len(options.objects) == 0 && !selectsSecrets(options) {
+		return fmt.Errorf("-vaultObjects is empty")
+	}
+	if options.tagSelector != "" {
+		if _, err := parseTagSelector(options.tagSelector); err != nil {
+			return fmt.Errorf("-tagSelector is invalid: %s", err)
+		}
+	}
+	if _, err := path.Match(options.objectNamePrefix, ""); err != nil {
+		return fmt.Errorf("-objectNamePrefix is invalid: %s", err)
+	}
+	if options.stripObjectNamePrefix && options.objectNamePrefix == "" {
+		return fmt.Errorf("-stripObjectNamePrefix requires -objectNamePrefix")
+	}
+	if options.mountAllSecrets && (options.tagSelector != "" || options.objectNamePrefix != "") {
+		return fmt.Errorf("-mountAllSecrets is mutually exclusive with -tagSelector and -objectNamePrefix")
+	}
+	if options.template != "" {
+		if _, err := parseTemplate(options.template, nil); err != nil {
+			return fmt.Errorf("-template is invalid: %s", err)
+		}
+		if err := validateFileName(options.templateOutput); err != nil {
+			return fmt.Errorf("-templateOutput is invalid: %s", err)
+		}
+	} else if options.templateOutput != "" {
+		return fmt.Errorf("-templateOutput requires -template")
+	}
+	if options.envFile != "" {
+		if err := validateFileName(options.envFile); err != nil {
+			return fmt.Errorf("-envFile is invalid: %s", err)
+		}
+	}
+	if options.propertiesFile != "" {
+		if err := validateFileName(options.propertiesFile); err != nil {
+			return fmt.Errorf("-propertiesFile is invalid: %s", err)
+		}
+	}
+	if options.envKeyFormat != "" && options.envKeyFormat != EnvKeyFormatUpperSnake {
+		return fmt.Errorf("-envKeyFormat is invalid, should be empty or set to %s", EnvKeyFormatUpperSnake)
+	}
+	if options.aggregateFile != "" {
+		if err := validateFileName(options.aggregateFile); err != nil {
+			return fmt.Errorf("-aggregateFile is invalid: %s", err)
+		}
+	}
+	if options.aggregateFormat != "" && options.aggregateFormat != AggregateFormatJSON && options.aggregateFormat != AggregateFormatYAML {
+		return fmt.Errorf("-aggregateFormat is invalid, should be empty or set to %s or %s", AggregateFormatJSON, AggregateFormatYAML)
+	}
+	if options.managedHSM {
+		if selectsSecrets(options) {
+			return fmt.Errorf("-managedHSM only has keys, -tagSelector, -objectNamePrefix and -mountAllSecrets are not supported")
+		}
+		for _, object := range options.objects {
+			if object.ObjectType != VaultTypeKey {
+				return fmt.Errorf("objectType of %s is invalid, -managedHSM only has keys", object.ObjectName)
+			}
+		}
+	}
+	if strings.Contains(options.pathSeparator, "/") || options.pathSeparator == "." {
+		return fmt.Errorf("-pathSeparator is invalid, must not be . or contain /")
+	}
+	if options.fileNameCase != FileNameCaseAsIs && options.fileNameCase != FileNameCaseLower && options.fileNameCase != FileNameCaseUpperSnake {
+		return fmt.Errorf("-fileNameCase is invalid, should be set to %s, %s or %s", FileNameCaseAsIs, FileNameCaseLower, FileNameCaseUpperSnake)
+	}
+	if _, err := parseFileMode(options.filePermission); err != nil {
+		return fmt.Errorf("-filePermission is invalid: %s", err)
+	}
+	if _, err := parseFileMode(options.dirPermission); err != nil {
+		return fmt.Errorf("-dirPermission is invalid: %s", err)
+	}
+	if options.seLinuxContext != "" && !validSELinuxContext(options.seLinuxContext) {
+		return fmt.Errorf("-seLinuxContext is invalid, should be user:role:type:level, e.g. system_u:object_r:container_file_t:s0")
+	}
+	if runtime.GOOS == "windows" && (options.runAsUser != -1 || options.runAsGroup != -1 || options.fsGroup != -1) {
+		return fmt.Errorf("-runAsUser, -runAsGroup and -fsGroup are not supported on Windows, use -filePermission")
+	}
+	if options.dpapiProtectionDescriptor != "" {
+		if runtime.GOOS != "windows" {
+			return fmt.Errorf("-dpapiProtectionDescriptor is only supported on Windows")
+		}
+		if options.syncK8sSecret != "" {
+			return fmt.Errorf("-dpapiProtectionDescriptor can't be used with -syncK8sSecret, which would store the objects unprotected")
+		}
+	}
+	if options.runAsUser < -1 || options.runAsGroup < -1 || options.fsGroup < -1 {
+		return fmt.Errorf("-runAsUser, -runAsGroup and -fsGroup must be positive, or -1 to leave the files owned by root")
+	}
+	if options.mountPolicy != MountPolicyFailFast && options.mountPolicy != MountPolicyBestEffort {
+		return fmt.Errorf("-mountPolicy is invalid, should be set to %s or %s", MountPolicyFailFast, MountPolicyBestEffort)
+	}
+	if options.inactiveObjects != InactiveObjectsFail && options.inactiveObjects != InactiveObjectsSkip && options.inactiveObjects != InactiveObjectsWarn {
+		return fmt.Errorf("-inactiveObjects is invalid, should be set to %s, %s or %s", InactiveObjectsFail, InactiveObjectsSkip, InactiveObjectsWarn)
+	}
+	if options.concurrency < 1 {
+		return fmt.Errorf("-concurrency is invalid, must be at least 1")
+	}
+	if options.consistentReads < 1 {
+		return fmt.Errorf("-consistentReads is invalid, must be at least 1")
+	}
+	if options.mountAllSecretsLimit <= 0 {
+		return fmt.Errorf("-mountAllSecretsLimit is invalid, must be greater than 0")
+	}
+	if options.excludeObjectNames != "" {
+		for _, exclusion := range strings.Split(options.excludeObjectNames, ",") {
+			if _, err := path.Match(strings.TrimSpace(exclusion), ""); err != nil {
+				return fmt.Errorf("-excludeObjectNames is invalid: %s", err)
+			}
+		}
 	}
 
-	if strings.Count(options.vaultObjectNames, objectsSep) !=
-		strings.Count(options.vaultObjectTypes, objectsSep) {
-		return fmt.Errorf("-vaultObjectNames and -vaultObjectTypes do not have the same number of items")
+	if options.debugValues != "" && options.debugValues != debugValuesHashed {
+		return fmt.Errorf("-debugValues is invalid, should be empty or set to %s", debugValuesHashed)
 	}
 
-	if len(options.vaultObjectAliases) > 0 &&
-		(strings.Count(options.vaultObjectAliases, objectsSep) != strings.Count(options.vaultObjectAliases, objectsSep)) {
-		return fmt.Errorf("-vaultObjectNames and -vaultObjectAliases do not have the same number of items")
+	if options.timeFormat != "" && options.timeFormat != TimeFormatRFC3339 && options.timeFormat != TimeFormatEpoch {
+		return fmt.Errorf("-timeFormat is invalid, should be set to %s or %s", TimeFormatRFC3339, TimeFormatEpoch)
 	}
 
+	if options.maxObjects < 0 || options.maxFetchesPerHour < 0 || options.maxObjectSize < 0 || options.maxVolumeSize < 0 {
+		return fmt.Errorf("-maxObjects, -maxFetchesPerHour, -maxObjectSize and -maxVolumeSize must be positive")
+	}
+	if options.maxObjects > 0 && len(options.objects) > options.maxObjects {
+		return fmt.Errorf("volume has %d objects, more than the maximum of %d allowed by -maxObjects", len(options.objects), options.maxObjects)
+	}
+	if options.rateLimitQPS < 0 || options.rateLimitBurst < 1 {
+		return fmt.Errorf("-rateLimitQPS must be positive and -rateLimitBurst at least 1")
+	}
+	if options.rotation && options.stateDir == "" {
+		return fmt.Errorf("-rotation requires -stateDir")
+	}
+	// the refreshes run the mount again with the arguments of the registration, which is kept on disk
+	if options.rotation && options.aADClientSecret != "" {
+		return fmt.Errorf("-rotation requires -aADClientSecretFile, the inline -aADClientSecret isn't kept for the refreshes")
+	}
+	if options.rotation && (options.keystorePassword != "" || options.pfxPassword != "") {
+		return fmt.Errorf("-rotation is not supported with -keystorePassword and -pfxPassword, which aren't kept for the refreshes, leave them empty to use generated passwords")
+	}
+	if options.syncK8sSecret != "" {
+		if !validSecretName(options.syncK8sSecret) {
+			return fmt.Errorf("-syncK8sSecret is invalid, should be a lowercase DNS subdomain")
+		}
+		if options.syncK8sSecretType != SecretTypeOpaque && options.syncK8sSecretType != SecretTypeTLS {
+			return fmt.Errorf("-syncK8sSecretType is invalid, should be set to %s or %s", SecretTypeOpaque, SecretTypeTLS)
+		}
+		if options.podNamespace == "" {
+			return fmt.Errorf("-syncK8sSecret requires -podNamespace")
+		}
+		if options.k8sAPIServer == "" || options.k8sTokenFile == "" {
+			return fmt.Errorf("-syncK8sSecret requires -k8sAPIServer and -k8sTokenFile, Secret sync isn't enabled on the node")
+		}
+	}
+	if options.rotationAnnotation != "" {
+		if options.rotationAnnotation != RotationAnnotationPod && options.rotationAnnotation != RotationAnnotationDeployment && options.rotationAnnotation != RotationAnnotationRollout && options.rotationAnnotation != RotationAnnotationCanary {
+			return fmt.Errorf("-rotationAnnotation is invalid, should be empty or set to %s, %s, %s or %s", RotationAnnotationPod, RotationAnnotationDeployment, RotationAnnotationRollout, RotationAnnotationCanary)
+		}
+		if !options.rotation {
+			return fmt.Errorf("-rotationAnnotation requires -rotation")
+		}
+		if options.podName == "" || options.podNamespace == "" {
+			return fmt.Errorf("-rotationAnnotation requires -podName and -podNamespace")
+		}
+		if options.k8sAPIServer == "" || options.k8sTokenFile == "" {
+			return fmt.Errorf("-rotationAnnotation requires -k8sAPIServer and -k8sTokenFile, rotation annotations aren't enabled on the node")
+		}
+	}
+	if options.rotationSignal != "" {
+		if _, err := parseSignal(options.rotationSignal); err != nil {
+			return fmt.Errorf("-rotationSignal is invalid: %s", err)
+		}
+		if !options.rotation {
+			return fmt.Errorf("-rotationSignal requires -rotation")
+		}
+	}
+	if options.rotationWebhookURL != "" {
+		if !validWebhookURL(options.rotationWebhookURL) {
+			return fmt.Errorf("-rotationWebhookURL is invalid, should be an http or https URL")
+		}
+		if !options.rotation {
+			return fmt.Errorf("-rotationWebhookURL requires -rotation")
+		}
+	}
+	if options.rotationWebhookSecretFile != "" && options.rotationWebhookURL == "" {
+		return fmt.Errorf("-rotationWebhookSecretFile requires -rotationWebhookURL")
+	}
+	if options.rotationSignalProcess != "" && options.rotationSignal == "" {
+		return fmt.Errorf("-rotationSignalProcess requires -rotationSignal")
+	}
+	if options.rotationExpiryWindow < 0 {
+		return fmt.Errorf("-rotationExpiryWindow is invalid, must be positive")
+	}
+	if options.rotationExpiryWindow != 0 && !options.rotation {
+		return fmt.Errorf("-rotationExpiryWindow requires -rotation")
+	}
+	if options.rotationGracePeriod < 0 {
+		return fmt.Errorf("-rotationGracePeriod is invalid, must be positive")
+	}
+	if options.rotationCheckVersions && !options.rotation {
+		return fmt.Errorf("-rotationCheckVersions requires -rotation")
+	}
+	if options.rotationGracePeriod != 0 && !options.rotation {
+		return fmt.Errorf("-rotationGracePeriod requires -rotation")
+	}
+	if options.rotationPollInterval != 0 && !options.rotation {
+		return fmt.Errorf("-rotationPollInterval requires -rotation")
+	}
+	if options.rotationPollInterval != 0 && options.rotationPollInterval < minRotationPollInterval {
+		return fmt.Errorf("-rotationPollInterval is invalid, must be at least %s", minRotationPollInterval)
+	}
+	if options.allowStaleOnError && options.stateDir == "" {
+		return fmt.Errorf("-allowStaleOnError requires -stateDir")
+	}
+	if options.cacheKeyTPM && options.stateDir == "" {
+		return fmt.Errorf("-cacheKeyTPM requires -stateDir")
+	}
+	if options.rateLimitQPS > 0 && options.stateDir == "" {
+		return fmt.Errorf("-rateLimitQPS requires -stateDir")
+	}
+	if options.maxFetchesPerHour > 0 && options.stateDir == "" {
+		return fmt.Errorf("-maxFetchesPerHour requires -stateDir")
+	}
+	if options.retryAttempts < 0 || options.retryInitialBackoff < 0 || options.retryMaxBackoff < 0 || options.retryDeadline < 0 || options.mountTimeoutSeconds < 0 {
+		return fmt.Errorf("-retryAttempts, -retryInitialBackoff, -retryMaxBackoff, -retryDeadline and -mountTimeoutSeconds must be positive")
+	}
+	if options.environmentMetadataURL != "" {
+		if u, err := url.Parse(options.environmentMetadataURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("-environmentMetadataURL is invalid, should be an https URL")
+		}
+	}
+
+	if options.keystore != "" {
+		if err := validateFileName(options.keystore); err != nil {
+			return fmt.Errorf("-keystore is invalid: %s", err)
+		}
+		if options.keystore == versionsFileName || options.keystore == mountReportFileName {
+			return fmt.Errorf("-keystore is invalid: %s is reserved", options.keystore)
+		}
+		if options.keystoreType != KeystoreTypeJKS && options.keystoreType != KeystoreTypePKCS12 {
+			return fmt.Errorf("-keystoreType is invalid, should be set to %s or %s", KeystoreTypeJKS, KeystoreTypePKCS12)
+		}
+	}
+	keystoreAliases := make(map[string]bool)
+	// objects are written concurrently, so each must have its own file
+	fileNames := make(map[string]string)
+
+	// validate all objects
+	for _, object := range options.objects {
+		if object.ObjectName == "" {
+			return fmt.Errorf("objectName is not set for all objects")
+		}
+		if object.ObjectType != VaultTypeSecret && object.ObjectType != VaultTypeKey && object.ObjectType != VaultTypeCertificate && object.ObjectType != VaultTypeCertificateSigningRequest && object.ObjectType != VaultTypeCertificateKey {
+			return fmt.Errorf("objectType of %s is invalid, should be set to secret, key, cert, csr or cert-key", object.ObjectName)
+		}
+		if err := validateFileName(object.fileName()); err != nil {
+			return fmt.Errorf("objectAlias of %s is invalid: %s", object.ObjectName, err)
+		}
+		if other, ok := fileNames[object.fileName()]; ok {
+			return fmt.Errorf("objects %s and %s are both written to %s, set objectAlias", other, object.ObjectName, object.fileName())
+		}
+		fileNames[object.fileName()] = object.ObjectName
+		if options.rotationGracePeriod > 0 && isPreviousFileName(object.fileName()) {
+			return fmt.Errorf("objectAlias of %s is invalid: %s is reserved with -rotationGracePeriod", object.ObjectName, previousDirName)
+		}
+		for _, symlink := range object.Symlinks {
+			if err := validateFileName(symlink); err != nil {
+				return fmt.Errorf("symlinks of %s is invalid: %s", object.ObjectName, err)
+			}
+			if other, ok := fileNames[symlink]; ok {
+				return fmt.Errorf("symlink %s of %s is already the file of %s", symlink, object.ObjectName, other)
+			}
+			fileNames[symlink] = object.ObjectName
+		}
+		if object.WritePolicy && object.ObjectType != VaultTypeCertificate && object.ObjectType != VaultTypeCertificateKey {
+			return fmt.Errorf("writePolicy of %s is only supported for cert and cert-key objects", object.ObjectName)
+		}
+		if object.MinimumValidityDays < 0 {
+			return fmt.Errorf("minimumValidityDays of %s is invalid, must be positive", object.ObjectName)
+		}
+		if object.MinimumValidityDays > 0 && object.ObjectType != VaultTypeCertificate && object.ObjectType != VaultTypeCertificateKey {
+			return fmt.Errorf("minimumValidityDays of %s is only supported for cert and cert-key objects", object.ObjectName)
+		}
+		if object.MinimumValidityPolicy != "" && object.MinimumValidityPolicy != ValidityPolicyFail && object.MinimumValidityPolicy != ValidityPolicyWarn {
+			return fmt.Errorf("minimumValidityPolicy of %s is invalid, should be empty or set to %s or %s", object.ObjectName, ValidityPolicyFail, ValidityPolicyWarn)
+		}
+		if object.WritePlaceholder && !object.Optional {
+			return fmt.Errorf("writePlaceholder of %s requires optional", object.ObjectName)
+		}
+		if object.TrimNewline && object.AppendNewline {
+			return fmt.Errorf("trimNewline and appendNewline of %s are mutually exclusive", object.ObjectName)
+		}
+		if object.KeyvaultName != "" && object.VaultURI != "" {
+			return fmt.Errorf("keyvaultName and vaultURI of %s are mutually exclusive", object.ObjectName)
+		}
+		if object.VaultURI != "" {
+			if _, err := parseVaultURI(object.VaultURI); err != nil {
+				return fmt.Errorf("vaultURI of %s is invalid: %s", object.ObjectName, err)
+			}
+		}
+		if object.ObjectVersionHistory < 0 {
+			return fmt.Errorf("objectVersionHistory of %s is invalid, must be positive", object.ObjectName)
+		}
+		if object.ObjectVersionHistory > 0 && (object.ObjectType != VaultTypeSecret || object.ObjectVersion != "") {
+			return fmt.Errorf("objectVersionHistory of %s is only supported for secrets without objectVersion", object.ObjectName)
+		}
+		if object.KeyRing < 0 {
+			return fmt.Errorf("keyRing of %s is invalid, must be positive", object.ObjectName)
+		}
+		if object.KeyRing > 0 && ((object.ObjectType != VaultTypeSecret && object.ObjectType != VaultTypeKey) || object.ObjectVersion != "") {
+			return fmt.Errorf("keyRing of %s is only supported for secrets and keys without objectVersion", object.ObjectName)
+		}
+		if object.KeyRing > 0 && object.ObjectVersionHistory > 0 {
+			return fmt.Errorf("keyRing and objectVersionHistory of %s are mutually exclusive", object.ObjectName)
+		}
+		if object.TransformHook != "" {
+			if options.hooksDir == "" {
+				return fmt.Errorf("transformHook of %s is not supported, transform hooks are disabled on the node", object.ObjectName)
+			}
+			if strings.Contains(object.TransformHook, "/") || object.TransformHook == "." || object.TransformHook == ".." {
+				return fmt.Errorf("transformHook of %s is invalid, should be the name of an executable of the hooks directory", object.ObjectName)
+			}
+			if len(object.ObjectProperties) > 0 {
+				return fmt.Errorf("transformHook and objectProperties of %s are mutually exclusive", object.ObjectName)
+			}
+		}
+		if object.FilePermission != "" {
+			if _, err := parseFileMode(object.FilePermission); err != nil {
+				return fmt.Errorf("filePermission of %s is invalid: %s", object.ObjectName, err)
+			}
+		}
+		if object.ObjectVersionsIndex < 0 {
+			return fmt.Errorf("objectVersionsIndex of %s is invalid, must be positive", object.ObjectName)
+		}
+		if object.ObjectVersionsIndex > 0 && object.ObjectType == VaultTypeCertificateSigningRequest {
+			return fmt.Errorf("objectVersionsIndex of %s is not supported for csr objects", object.ObjectName)
+		}
+		if (object.IgnoreContentType || object.PrettyPrint) && object.ObjectType != VaultTypeSecret {
+			return fmt.Errorf("ignoreContentType and prettyPrint of %s are only supported for secrets", object.ObjectName)
+		}
+		if (object.ObjectProperty != "" || len(object.ObjectProperties) > 0) && object.ObjectType != VaultTypeSecret {
+			return fmt.Errorf("objectProperty and objectProperties of %s are only supported for secrets", object.ObjectName)
+		}
+		if object.ObjectProperty != "" && len(object.ObjectProperties) > 0 {
+			return fmt.Errorf("objectProperty and objectProperties of %s are mutually exclusive", object.ObjectName)
+		}
+		if object.ObjectProperty != "" {
+			if _, err := parseProperty(object.ObjectProperty); err != nil {
+				return fmt.Errorf("objectProperty of %s is invalid: %s", object.ObjectName, err)
+			}
+		}
+		if len(object.ObjectProperties) > 0 && (object.KeyRing > 0 || object.ObjectVersionHistory > 0) {
+			return fmt.Errorf("objectProperties of %s can't be combined with keyRing or objectVersionHistory", object.ObjectName)
+		}
+		for fileName, property := range object.ObjectProperties {
+			if err := validateFileName(fileName); err != nil {
+				return fmt.Errorf("objectProperties of %s is invalid: %s", object.ObjectName, err)
+			}
+			if _, err := parseProperty(property); err != nil {
+				return fmt.Errorf("objectProperties of %s is invalid: %s", object.ObjectName, err)
+			}
+		}
+		if object.IncludeChain && object.ObjectType != VaultTypeCertificate {
+			return fmt.Errorf("includeChain of %s is only supported for certificates", object.ObjectName)
+		}
+		if object.ObjectFormat != "" && ((object.ObjectFormat != ObjectFormatPFX && object.ObjectFormat != ObjectFormatBundle) || object.ObjectType != VaultTypeCertificate) {
+			return fmt.Errorf("objectFormat of %s is invalid, only %s and %s are supported for certificates", object.ObjectName, ObjectFormatPFX, ObjectFormatBundle)
+		}
+		if object.ObjectFormat == ObjectFormatBundle {
+			if err := validateBundleOrder(object.BundleOrder); err != nil {
+				return fmt.Errorf("bundleOrder of %s is invalid: %s", object.ObjectName, err)
+			}
+		} else if len(object.BundleOrder) > 0 {
+			return fmt.Errorf("bundleOrder of %s is only supported with objectFormat %s", object.ObjectName, ObjectFormatBundle)
+		}
+		if object.ObjectEncoding != "" {
+			if object.ObjectType == VaultTypeSecret && object.ObjectEncoding != ObjectEncodingBase64 && object.ObjectEncoding != ObjectEncodingUTF8 && object.ObjectEncoding != ObjectEncodingHex {
+				return fmt.Errorf("objectEncoding of secret %s is invalid, should be set to %s, %s or %s", object.ObjectName, ObjectEncodingBase64, ObjectEncodingUTF8, ObjectEncodingHex)
+			}
+			if object.ObjectEncoding == ObjectEncodingHex && (object.ObjectProperty != "" || len(object.ObjectProperties) > 0) {
+				return fmt.Errorf("objectEncoding %s of %s is not supported with objectProperty and objectProperties", ObjectEncodingHex, object.ObjectName)
+			}
+			if object.ObjectType == VaultTypeKey && object.ObjectEncoding != ObjectEncodingPEM && object.ObjectEncoding != ObjectEncodingDER && object.ObjectEncoding != ObjectEncodingJWK {
+				return fmt.Errorf("objectEncoding of key %s is invalid, should be set to %s, %s or %s", object.ObjectName, ObjectEncodingPEM, ObjectEncodingDER, ObjectEncodingJWK)
+			}
+			if object.ObjectType != VaultTypeSecret && object.ObjectType != VaultTypeKey && object.ObjectEncoding != ObjectEncodingPEM && object.ObjectEncoding != ObjectEncodingDER {
+				return fmt.Errorf("objectEncoding of %s is invalid, should be set to %s or %s", object.ObjectName, ObjectEncodingPEM, ObjectEncodingDER)
+			}
+			if object.ObjectFormat != "" {
+				return fmt.Errorf("objectEncoding of %s is not supported with objectFormat %s", object.ObjectName, object.ObjectFormat)
+			}
+			if object.IncludeChain && object.ObjectEncoding == ObjectEncodingDER {
+				return fmt.Errorf("objectEncoding %s of %s is not supported with includeChain, a chain is written as PEM", ObjectEncodingDER, object.ObjectName)
+			}
+		}
+		if object.ObjectFormat == ObjectFormatPFX {
+			if object.IncludeChain {
+				return fmt.Errorf("includeChain of %s is not supported with objectFormat %s, the chain stored in Key Vault is included", object.ObjectName, ObjectFormatPFX)
+			}
+			if object.OmitPfxPassword && options.pfxPassword == "" {
+				return fmt.Errorf("omitPfxPassword of %s requires -pfxPassword, a generated password would be lost", object.ObjectName)
+			}
+			if err := validateFileName(object.pfxPasswordFileName()); err != nil {
+				return fmt.Errorf("pfxPasswordFile of %s is invalid: %s", object.ObjectName, err)
+			}
+			if !object.OmitPfxPassword {
+				if other, ok := fileNames[object.pfxPasswordFileName()]; ok {
+					return fmt.Errorf("pfxPasswordFile %s of %s is already the file of %s", object.pfxPasswordFileName(), object.ObjectName, other)
+				}
+				fileNames[object.pfxPasswordFileName()] = object.ObjectName
+			}
+		} else if object.PfxPasswordFile != "" || object.OmitPfxPassword {
+			return fmt.Errorf("pfx options of %s are only supported with objectFormat %s", object.ObjectName, ObjectFormatPFX)
+		}
+		if object.KeystoreAlias != "" {
+			if options.keystore == "" {
+				return fmt.Errorf("keystoreAlias of %s requires -keystore", object.ObjectName)
+			}
+			if object.ObjectType != VaultTypeCertificateKey && (object.ObjectType != VaultTypeCertificate || object.ObjectFormat != "") {
+				return fmt.Errorf("keystoreAlias of %s is only supported for cert-key and cert objects without objectFormat", object.ObjectName)
+			}
+			// the JVM lowercases aliases
+			alias := strings.ToLower(object.KeystoreAlias)
+			if keystoreAliases[alias] {
+				return fmt.Errorf("keystoreAlias of %s is invalid: %s is already used", object.ObjectName, object.KeystoreAlias)
+			}
+			keystoreAliases[alias] = true
+		}
+		if object.fileName() == options.keystore {
+			return fmt.Errorf("objectAlias of %s is invalid: %s is the keystore", object.ObjectName, options.keystore)
+		}
+		if object.fileName() == versionsFileName || object.fileName() == mountReportFileName {
+			return fmt.Errorf("objectAlias of %s is invalid: %s is reserved", object.ObjectName, object.fileName())
+		}
+	}
+
+	if options.keystore != "" && len(keystoreAliases) == 0 {
+		return fmt.Errorf("-keystore is set but no object has a keystoreAlias")
+	}
+
+	return validateIdentity(options)
+}
+
+// validateIdentity validates the options used to authenticate against Azure
+func validateIdentity(options Option) error {
 	if !options.usePodIdentity && !options.useVmManagedIdentity {
 		if options.aADClientID == "" {
 			return fmt.Errorf("-aADClientID is not set")
 		}
-		if options.aADClientSecret == "" {
-			return fmt.Errorf("-aADClientSecret is not set")
+		if options.aADClientSecret == "" && options.aADClientSecretFile == "" {
+			return fmt.Errorf("-aADClientSecret or -aADClientSecretFile is not set")
+		}
+		if options.aADClientSecret != "" && options.aADClientSecretFile != "" {
+			return fmt.Errorf("-aADClientSecret and -aADClientSecretFile are mutually exclusive")
 		}
 	}
 
+	if options.aADRegion != "" && !regionRegex.MatchString(options.aADRegion) {
+		return fmt.Errorf("-aADRegion is invalid, must match %s", regionRegex.String())
+	}
+
 	if options.usePodIdentity {
 		if options.podName == "" {
 			return fmt.Errorf("-podName is not set")
@@ -166,13 +917,6 @@ func Validate(options Option) error {
 		}
 	}
 
-	// validate all object types
-	for _, objectType := range strings.Split(options.vaultObjectTypes, objectsSep) {
-		if objectType != VaultTypeSecret && objectType != VaultTypeKey && objectType != VaultTypeCertificate {
-			return fmt.Errorf("-vaultObjectType is invalid, should be set to secret, key, or certificate")
-		}
-	}
-
 	return nil
 }
 
@@ -0,0 +1,320 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArgs are the options of a volume mounting myvault with the VM managed identity, to which
+// the options of each test are appended
+var testArgs = []string{"-vaultName=myvault", "-tenantId=tenant", "-dir=/tmp/kv", "-useVmManagedIdentity=true"}
+
+// testOptions parses the options of a volume as the driver does, with their defaults
+func testOptions(t *testing.T, args ...string) Option {
+	t.Helper()
+	options, err := parseConfigs(flag.NewFlagSet("test", flag.ContinueOnError), append(append([]string{}, testArgs...), args...))
+	if err != nil {
+		t.Fatalf("failed to parse %v: %s", args, err)
+	}
+	return *options
+}
+
+// testAdapter returns an adapter writing the files of a volume with the options to a temporary
+// directory, with its state in another, removed at the end of the test
+func testAdapter(t *testing.T, args ...string) *KeyvaultFlexvolumeAdapter {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	stateDir, err := ioutil.TempDir("", "kvstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(stateDir) })
+	return &KeyvaultFlexvolumeAdapter{options: testOptions(t, append([]string{"-dir=" + dir, "-stateDir=" + stateDir}, args...)...)}
+}
+
+// readTestFile returns the content of a file written to the volume of an adapter, checking its mode
+func readTestFile(t *testing.T, adapter *KeyvaultFlexvolumeAdapter, fileName string, mode os.FileMode) string {
+	t.Helper()
+	filePath := filepath.Join(adapter.options.dir, fileName)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("mode of %s = %s, want %s", fileName, info.Mode().Perm(), mode)
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// substring of the error, empty if the options are valid
+		err string
+	}{
+		{
+			name: "object names",
+			args: []string{"-vaultObjectNames=db-password;tls", "-vaultObjectTypes=secret;cert"},
+		},
+		{
+			name: "objects",
+			args: []string{`-vaultObjects=[{"objectName":"db-password","objectType":"secret"},{"objectName":"tls","objectType":"cert","objectAlias":"tls.crt"}]`},
+		},
+		{
+			name: "no objects",
+			err:  "-vaultObjectNames, -vaultObjects, -tagSelector, -objectNamePrefix or -mountAllSecrets is not set",
+		},
+		{
+			name: "names and types mismatch",
+			args: []string{"-vaultObjectNames=db-password;tls", "-vaultObjectTypes=secret"},
+			err:  "-vaultObjectNames and -vaultObjectTypes do not have the same number of items",
+		},
+		{
+			name: "invalid object type",
+			args: []string{`-vaultObjects=[{"objectName":"db-password","objectType":"password"}]`},
+			err:  "objectType of db-password is invalid",
+		},
+		{
+			name: "same file name",
+			args: []string{`-vaultObjects=[{"objectName":"a","objectType":"secret","objectAlias":"db"},{"objectName":"b","objectType":"secret","objectAlias":"db"}]`},
+			err:  "objects a and b are both written to db, set objectAlias",
+		},
+		{
+			name: "absolute alias",
+			args: []string{`-vaultObjects=[{"objectName":"a","objectType":"secret","objectAlias":"/etc/passwd"}]`},
+			err:  "objectAlias of a is invalid",
+		},
+		{
+			name: "alias escaping the volume",
+			args: []string{`-vaultObjects=[{"objectName":"a","objectType":"secret","objectAlias":"../a"}]`},
+			err:  "objectAlias of a is invalid",
+		},
+		{
+			name: "symlink of another object",
+			args: []string{`-vaultObjects=[{"objectName":"a","objectType":"secret"},{"objectName":"b","objectType":"secret","symlinks":["a"]}]`},
+			err:  "symlink a of b is already the file of a",
+		},
+		{
+			name: "pfx password file of another object",
+			args: []string{`-vaultObjects=[{"objectName":"a","objectType":"secret","objectAlias":"tls.pfx.password"},{"objectName":"tls","objectType":"cert","objectFormat":"pfx","objectAlias":"tls.pfx"}]`},
+			err:  "pfxPasswordFile tls.pfx.password of tls is already the file of a",
+		},
+		{
+			name: "pfx password file omitted",
+			args: []string{"-pfxPassword=changeit", `-vaultObjects=[{"objectName":"a","objectType":"secret","objectAlias":"tls.pfx.password"},{"objectName":"tls","objectType":"cert","objectFormat":"pfx","objectAlias":"tls.pfx","omitPfxPassword":true}]`},
+		},
+		{
+			name: "pfx password omitted without -pfxPassword",
+			args: []string{`-vaultObjects=[{"objectName":"tls","objectType":"cert","objectFormat":"pfx","omitPfxPassword":true}]`},
+			err:  "omitPfxPassword of tls requires -pfxPassword",
+		},
+		{
+			name: "pfx password file without pfx",
+			args: []string{`-vaultObjects=[{"objectName":"tls","objectType":"cert","pfxPasswordFile":"tls.password"}]`},
+			err:  "pfx options of tls are only supported with objectFormat pfx",
+		},
+		{
+			name: "secret encoding",
+			args: []string{`-vaultObjects=[{"objectName":"a","objectType":"secret","objectEncoding":"der"}]`},
+			err:  "objectEncoding of secret a is invalid",
+		},
+		{
+			name: "key encoding",
+			args: []string{`-vaultObjects=[{"objectName":"a","objectType":"key","objectEncoding":"jwk"}]`},
+		},
+		{
+			name: "der chain",
+			args: []string{`-vaultObjects=[{"objectName":"tls","objectType":"cert","objectEncoding":"der","includeChain":true}]`},
+			err:  "objectEncoding der of tls is not supported with includeChain",
+		},
+		{
+			name: "tag selector",
+			args: []string{"-tagSelector=env=prod,team=payments"},
+		},
+		{
+			name: "invalid tag selector",
+			args: []string{"-tagSelector=env"},
+			err:  "-tagSelector is invalid",
+		},
+		{
+			name: "mount all secrets with tag selector",
+			args: []string{"-mountAllSecrets=true", "-tagSelector=env=prod"},
+			err:  "-mountAllSecrets is mutually exclusive with -tagSelector and -objectNamePrefix",
+		},
+		{
+			name: "strip prefix without prefix",
+			args: []string{"-tagSelector=env=prod", "-stripObjectNamePrefix=true"},
+			err:  "-stripObjectNamePrefix requires -objectNamePrefix",
+		},
+		{
+			name: "env key format",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-envFile=secrets.env", "-envKeyFormat=camel"},
+			err:  "-envKeyFormat is invalid",
+		},
+		{
+			name: "aggregate format",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-aggregateFile=secrets", "-aggregateFormat=toml"},
+			err:  "-aggregateFormat is invalid",
+		},
+		{
+			name: "keystore",
+			args: []string{"-keystore=keystore.jks", `-vaultObjects=[{"objectName":"tls","objectType":"cert-key","keystoreAlias":"server"},{"objectName":"ca","objectType":"cert","keystoreAlias":"ca"}]`},
+		},
+		{
+			name: "keystore without alias",
+			args: []string{"-keystore=keystore.jks", "-vaultObjectNames=tls", "-vaultObjectTypes=cert-key"},
+			err:  "-keystore is set but no object has a keystoreAlias",
+		},
+		{
+			name: "keystore alias without keystore",
+			args: []string{`-vaultObjects=[{"objectName":"tls","objectType":"cert-key","keystoreAlias":"server"}]`},
+			err:  "keystoreAlias of tls requires -keystore",
+		},
+		{
+			name: "keystore aliases differing by case",
+			args: []string{"-keystore=keystore.jks", `-vaultObjects=[{"objectName":"a","objectType":"cert","keystoreAlias":"CA"},{"objectName":"b","objectType":"cert","keystoreAlias":"ca"}]`},
+			err:  "keystoreAlias of b is invalid: ca is already used",
+		},
+		{
+			name: "keystore type",
+			args: []string{"-keystore=keystore.p12", "-keystoreType=pem", `-vaultObjects=[{"objectName":"tls","objectType":"cert-key","keystoreAlias":"server"}]`},
+			err:  "-keystoreType is invalid",
+		},
+		{
+			name: "object written to the keystore",
+			args: []string{"-keystore=keystore.jks", `-vaultObjects=[{"objectName":"tls","objectType":"cert-key","keystoreAlias":"server"},{"objectName":"a","objectType":"secret","objectAlias":"keystore.jks"}]`},
+			err:  "objectAlias of a is invalid: keystore.jks is the keystore",
+		},
+		{
+			name: "rotation without state",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-rotation=true", "-stateDir="},
+			err:  "-rotation requires -stateDir",
+		},
+		{
+			name: "rotation with secret file",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-rotation=true", "-useVmManagedIdentity=false", "-aADClientID=client", "-aADClientSecretFile=/etc/kv/secret"},
+		},
+		{
+			name: "rotation with inline secret",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-rotation=true", "-useVmManagedIdentity=false", "-aADClientID=client", "-aADClientSecret=s3cr3t"},
+			err:  "-rotation requires -aADClientSecretFile",
+		},
+		{
+			name: "rotation with keystore password",
+			args: []string{"-rotation=true", "-keystore=keystore.jks", "-keystorePassword=changeit", `-vaultObjects=[{"objectName":"tls","objectType":"cert-key","keystoreAlias":"server"}]`},
+			err:  "-rotation is not supported with -keystorePassword and -pfxPassword",
+		},
+		{
+			name: "service principal without secret",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-useVmManagedIdentity=false", "-aADClientID=client"},
+			err:  "-aADClientSecret or -aADClientSecretFile is not set",
+		},
+		{
+			name: "rfc3339 timestamps",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-timeFormat=rfc3339"},
+		},
+		{
+			name: "epoch timestamps",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-timeFormat=epoch"},
+		},
+		{
+			name: "invalid time format",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-timeFormat=iso8601"},
+			err:  "-timeFormat is invalid, should be set to rfc3339 or epoch",
+		},
+		{
+			name: "uppercase time format",
+			args: []string{"-vaultObjectNames=a", "-vaultObjectTypes=secret", "-timeFormat=RFC3339"},
+			err:  "-timeFormat is invalid",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(testOptions(t, test.args...))
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("Validate() = %q, want no error", err)
+			case test.err != "" && err == nil:
+				t.Errorf("Validate() = nil, want %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("Validate() = %q, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	// 2019-10-01T12:00:00Z in the timezone of Paris, converted to UTC
+	paris := time.FixedZone("CEST", 2*60*60)
+	timestamp := time.Date(2019, 10, 1, 14, 0, 0, 0, paris)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "", want: `"2019-10-01T12:00:00Z"`},
+		{format: TimeFormatRFC3339, want: `"2019-10-01T12:00:00Z"`},
+		{format: TimeFormatEpoch, want: "1569931200"},
+	}
+	for _, test := range tests {
+		value := formatTimestamp(timestamp, test.format)
+		content, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.want {
+			t.Errorf("formatTimestamp(%q) = %s, want %s", test.format, content, test.want)
+		}
+		var decoded interface{}
+		if err = json.Unmarshal(content, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if parsed, ok := parseTimestamp(decoded); !ok || !parsed.Equal(timestamp) {
+			t.Errorf("parseTimestamp(%s) = %s, %t, want %s", content, parsed, ok, timestamp)
+		}
+	}
+	if _, ok := parseTimestamp("1 October 2019"); ok {
+		t.Errorf("parseTimestamp() parsed a timestamp in neither format")
+	}
+}
+
+func TestTimeFormatManifest(t *testing.T) {
+	timestamp := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: TimeFormatRFC3339, want: `"fetchTime":"2019-10-01T12:00:00Z"`},
+		{format: TimeFormatEpoch, want: `"fetchTime":1569931200`},
+	}
+	for _, test := range tests {
+		adapter := testAdapter(t, "-timeFormat="+test.format)
+		adapter.report = newMountReport(adapter.options)
+		object := KeyVaultObject{ObjectName: "db-password", ObjectType: VaultTypeSecret}
+		content, err := json.Marshal(adapter.newManifestObject(object, "https://myvault.vault.azure.net/", &fetchedObject{version: "v1"}, timestamp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), test.want) {
+			t.Errorf("%s: manifest object %s, want %s", test.format, content, test.want)
+		}
+	}
+}
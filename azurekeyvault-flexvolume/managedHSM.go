@@ -0,0 +1,44 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+// managedHSMAPIVersion is the Key Vault API version the requests to Managed HSM are sent with,
+// since Managed HSM doesn't support the version of the Key Vault client
+const managedHSMAPIVersion = "7.2"
+
+// managedHSMDNSSuffixes are the DNS suffixes of Managed HSM by cloud, which the Azure environments
+// don't have
+var managedHSMDNSSuffixes = map[string]string{
+	azure.PublicCloud.Name:       "managedhsm.azure.net",
+	azure.USGovernmentCloud.Name: "managedhsm.usgovcloudapi.net",
+	azure.ChinaCloud.Name:        "managedhsm.azure.cn",
+}
+
+// managedHSMDNSSuffix returns the DNS suffix of Managed HSM in a cloud
+func managedHSMDNSSuffix(env *azure.Environment) (string, error) {
+	suffix, ok := managedHSMDNSSuffixes[env.Name]
+	if !ok {
+		return "", errors.Errorf("Managed HSM is not available in %s", env.Name)
+	}
+	return suffix, nil
+}
+
+// managedHSMSender returns sender sending the requests with the API version of Managed HSM
+func managedHSMSender(sender autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		query.Set("api-version", managedHSMAPIVersion)
+		req.URL.RawQuery = query.Encode()
+		return sender.Do(req)
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// manifestFileName is the provenance of the objects written to the volume
+const manifestFileName = ".flexvol-manifest.json"
+
+// mountManifest records where each object written to the volume comes from and when it was
+// fetched, as an audit trail for operators and the state refreshes of the volume are diffed with
+type mountManifest struct {
+	DriverVersion string           `json:"driverVersion"`
+	VaultURL      string           `json:"vaultUrl"`
+	MountTime     interface{}      `json:"mountTime"`
+	Objects       []manifestObject `json:"objects"`
+	// the sha256 of each file written for the objects, by file name, for the rotation daemon to
+	// detect files deleted or modified on the node
+	Files map[string]string `json:"files,omitempty"`
+	// the protection descriptor of the files protected with DPAPI-NG, and the sha256 of their
+	// content before, for the next mount to keep them unchanged
+	ProtectionDescriptor string            `json:"protectionDescriptor,omitempty"`
+	Unprotected          map[string]string `json:"unprotected,omitempty"`
+}
+
+// manifestObject is an object written to the volume, never with its content
+type manifestObject struct {
+	ObjectName     string      `json:"objectName"`
+	ObjectType     string      `json:"objectType"`
+	FileName       string      `json:"fileName"`
+	VaultURL       string      `json:"vaultUrl"`
+	ObjectVersion  string      `json:"objectVersion"`
+	VersionHistory []string    `json:"versionHistory,omitempty"`
+	FetchTime      interface{} `json:"fetchTime"`
+	// the end of validity of certificates, for the rotation daemon to refresh them before
+	NotAfter interface{} `json:"notAfter,omitempty"`
+}
+
+// newManifestObject returns the manifest entry of an object fetched from vaultURL at fetchTime
+func (adapter *KeyvaultFlexvolumeAdapter) newManifestObject(object KeyVaultObject, vaultURL string, fetched *fetchedObject, fetchTime time.Time) manifestObject {
+	manifestObject := manifestObject{
+		ObjectName:     object.ObjectName,
+		ObjectType:     object.ObjectType,
+		FileName:       object.fileName(),
+		VaultURL:       vaultURL,
+		ObjectVersion:  fetched.version,
+		VersionHistory: fetched.versionHistory,
+		FetchTime:      formatTimestamp(fetchTime, adapter.report.timeFormat),
+	}
+	if object.ObjectType == VaultTypeCertificate || object.ObjectType == VaultTypeCertificateKey {
+		if expiry, ok := certificateExpiry(fetched); ok {
+			manifestObject.NotAfter = formatTimestamp(expiry, adapter.report.timeFormat)
+		}
+	}
+	return manifestObject
+}
+
+// writeManifest writes the manifest of the objects written to the volume
+func (adapter *KeyvaultFlexvolumeAdapter) writeManifest(objects []manifestObject) error {
+	manifest := mountManifest{
+		DriverVersion:        version,
+		VaultURL:             adapter.report.VaultURL,
+		MountTime:            adapter.report.StartTime,
+		Objects:              objects,
+		Files:                adapter.fileHashes,
+		ProtectionDescriptor: adapter.options.dpapiProtectionDescriptor,
+		Unprotected:          adapter.unprotectedHashes,
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+	// the driver reads the manifest of the previous mount back, and it holds no content of the
+	// objects, so it is never protected
+	return adapter.writeVolumeFile(manifestFileName, content, false)
+}
+
+// recordHash records the sha256 of a file written to filePath, in the data directory, and of its
+// content before it was protected with -dpapiProtectionDescriptor
+func (adapter *KeyvaultFlexvolumeAdapter) recordHash(filePath string, written []byte, content []byte) {
+	fileName, err := filepath.Rel(adapter.dataDir(), filePath)
+	if err != nil {
+		return
+	}
+	fileName = filepath.ToSlash(fileName)
+	sum := sha256.Sum256(written)
+	adapter.fileHashesMu.Lock()
+	defer adapter.fileHashesMu.Unlock()
+	if adapter.fileHashes == nil {
+		adapter.fileHashes = make(map[string]string)
+	}
+	adapter.fileHashes[fileName] = hex.EncodeToString(sum[:])
+	if adapter.options.dpapiProtectionDescriptor == "" {
+		return
+	}
+	sum = sha256.Sum256(content)
+	if adapter.unprotectedHashes == nil {
+		adapter.unprotectedHashes = make(map[string]string)
+	}
+	adapter.unprotectedHashes[fileName] = hex.EncodeToString(sum[:])
+}
+
+// readManifest reads the manifest published by the last mount of the volume at dir
+func readManifest(dir string) (*mountManifest, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest mountManifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the manifest of %s", dir)
+	}
+	return &manifest, nil
+}
+
+// rotatedFiles returns the file names of the objects whose version, or enabled versions, changed
+// since the previous manifest, or which it didn't have. The files regenerated with the same
+// versions, such as pfx files encoded again, aren't rotated. None on the first mount.
+func rotatedFiles(previous *mountManifest, objects []manifestObject) map[string]bool {
+	rotated := make(map[string]bool)
+	if previous == nil {
+		return rotated
+	}
+	published := make(map[string]manifestObject, len(previous.Objects))
+	for _, object := range previous.Objects {
+		published[object.ObjectType+"/"+object.ObjectName+"/"+object.FileName] = object
+	}
+	for _, object := range objects {
+		old, ok := published[object.ObjectType+"/"+object.ObjectName+"/"+object.FileName]
+		if !ok || old.ObjectVersion != object.ObjectVersion || !equalStrings(old.VersionHistory, object.VersionHistory) {
+			rotated[object.FileName] = true
+		}
+	}
+	return rotated
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+)
+
+// metadataSuffix is appended to the file name of an object for its metadata sidecar
+const metadataSuffix = ".meta.json"
+
+// objectAttributes are the attributes of the Key Vault object a fetched object comes from
+type objectAttributes struct {
+	contentType *string
+	tags        map[string]*string
+	enabled     *bool
+	notBefore   *date.UnixTime
+	expires     *date.UnixTime
+	created     *date.UnixTime
+	updated     *date.UnixTime
+}
+
+// objectMetadata is the metadata sidecar of an object, so workloads can tell what was mounted
+// without calling the vault
+type objectMetadata struct {
+	ObjectName    string            `json:"objectName"`
+	ObjectType    string            `json:"objectType"`
+	ObjectVersion string            `json:"objectVersion"`
+	ContentType   string            `json:"contentType,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Enabled       *bool             `json:"enabled,omitempty"`
+	NotBefore     interface{}       `json:"notBefore,omitempty"`
+	Expires       interface{}       `json:"expires,omitempty"`
+	Created       interface{}       `json:"created,omitempty"`
+	Updated       interface{}       `json:"updated,omitempty"`
+}
+
+// secretAttributes returns the attributes of a secret
+func secretAttributes(secret kv.SecretBundle) *objectAttributes {
+	attributes := &objectAttributes{contentType: secret.ContentType, tags: secret.Tags}
+	if a := secret.Attributes; a != nil {
+		attributes.enabled, attributes.notBefore, attributes.expires, attributes.created, attributes.updated = a.Enabled, a.NotBefore, a.Expires, a.Created, a.Updated
+	}
+	return attributes
+}
+
+// keyAttributes returns the attributes of a key
+func keyAttributes(key kv.KeyBundle) *objectAttributes {
+	attributes := &objectAttributes{tags: key.Tags}
+	if a := key.Attributes; a != nil {
+		attributes.enabled, attributes.notBefore, attributes.expires, attributes.created, attributes.updated = a.Enabled, a.NotBefore, a.Expires, a.Created, a.Updated
+	}
+	return attributes
+}
+
+// certificateAttributes returns the attributes of a certificate
+func certificateAttributes(cert kv.CertificateBundle) *objectAttributes {
+	attributes := &objectAttributes{contentType: cert.ContentType, tags: cert.Tags}
+	if a := cert.Attributes; a != nil {
+		attributes.enabled, attributes.notBefore, attributes.expires, attributes.created, attributes.updated = a.Enabled, a.NotBefore, a.Expires, a.Created, a.Updated
+	}
+	return attributes
+}
+
+// formatVaultTime formats a timestamp of the vault according to the timeFormat option, nil if unset
+func (adapter *KeyvaultFlexvolumeAdapter) formatVaultTime(t *date.UnixTime) interface{} {
+	if t == nil {
+		return nil
+	}
+	return formatTimestamp(time.Time(*t), adapter.options.timeFormat)
+}
+
+// writeMetadata writes the metadata sidecar of an object written to fileName, relative to dir
+func (adapter *KeyvaultFlexvolumeAdapter) writeMetadata(object KeyVaultObject, fileName string, fetched *fetchedObject) error {
+	attributes := fetched.attributes
+	metadata := objectMetadata{
+		ObjectName:    object.ObjectName,
+		ObjectType:    object.ObjectType,
+		ObjectVersion: fetched.version,
+		ContentType:   to.String(attributes.contentType),
+		Enabled:       attributes.enabled,
+		NotBefore:     adapter.formatVaultTime(attributes.notBefore),
+		Expires:       adapter.formatVaultTime(attributes.expires),
+		Created:       adapter.formatVaultTime(attributes.created),
+		Updated:       adapter.formatVaultTime(attributes.updated),
+	}
+	if len(attributes.tags) > 0 {
+		metadata.Tags = make(map[string]string, len(attributes.tags))
+		for name, value := range attributes.tags {
+			metadata.Tags[name] = to.String(value)
+		}
+	}
+
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal metadata of %s", object.ObjectName)
+	}
+	filePath := filepath.Join(adapter.dataDir(), fileName+metadataSuffix)
+	if err = ioutil.WriteFile(filePath, content, permission); err != nil {
+		return errors.Wrapf(err, "failed to write metadata of %s to %s", object.ObjectName, filePath)
+	}
+	return nil
+}
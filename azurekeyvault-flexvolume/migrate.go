@@ -0,0 +1,64 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// migratedObject is an object of the legacy lists, as an entry of the objects option
+type migratedObject struct {
+	ObjectName    string `json:"objectName"`
+	ObjectType    string `json:"objectType"`
+	ObjectVersion string `json:"objectVersion,omitempty"`
+	ObjectAlias   string `json:"objectAlias,omitempty"`
+}
+
+// runMigrate prints the volume options replacing the deprecated options given as flags, and the
+// objects option for the legacy -vaultObjectNames, -vaultObjectTypes, -vaultObjectVersions and
+// -vaultObjectAliases
+func runMigrate(ctx context.Context, args []string) error {
+	options, err := parseConfigs(newFlagSet("migrate"), args)
+	if err != nil {
+		return err
+	}
+	deprecations := getDeprecations(*options)
+	if len(deprecations) == 0 && options.vaultObjectNames == "" {
+		fmt.Println("no deprecated options")
+		return nil
+	}
+
+	if options.vaultObjectNames != "" {
+		objects := make([]migratedObject, 0, len(options.objects))
+		for _, object := range options.objects {
+			objects = append(objects, migratedObject{
+				ObjectName:    object.ObjectName,
+				ObjectType:    object.ObjectType,
+				ObjectVersion: object.ObjectVersion,
+				ObjectAlias:   object.ObjectAlias,
+			})
+		}
+		content, err := json.Marshal(objects)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal objects")
+		}
+		fmt.Println("# replace keyvaultobjectnames, keyvaultobjecttypes, keyvaultobjectversions and keyvaultobjectaliases with:")
+		fmt.Printf("objects: '%s'\n", content)
+	}
+	for _, d := range deprecations {
+		switch d.Name {
+		case "inline-client-secret":
+			fmt.Println("# replace the clientsecret of the kvcreds secret with a file on the node holding it:")
+			fmt.Println("aadclientsecretfile: <path of the file>")
+		default:
+			fmt.Printf("# %s: %s\n", d.Name, d.Message)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// mountReportFileName is the report of what the driver did for the volume
+const mountReportFileName = ".mount-report.json"
+
+// mountReport records the effective behavior of the driver for a mount: the options once
+// defaults are applied, the identity used, the endpoints contacted and timings.
+// It never contains secret values, so support can read it without elevated log verbosity.
+type mountReport struct {
+	mu         sync.Mutex
+	timeFormat string
+	start      time.Time
+
+	DriverVersion string                     `json:"driverVersion"`
+	StartTime     interface{}                `json:"startTime"`
+	EndTime       interface{}                `json:"endTime"`
+	DurationMs    int64                      `json:"durationMs"`
+	Options       reportOptions              `json:"options"`
+	Identity      reportIdentity             `json:"identity"`
+	VaultURL      string                     `json:"vaultUrl"`
+	Endpoints     map[string]*reportEndpoint `json:"endpoints"`
+	Objects       []reportObject             `json:"objects"`
+	Omitted       []reportOmission           `json:"omitted,omitempty"`
+	Failed        []reportFailure            `json:"failed,omitempty"`
+	Stale         []reportStale              `json:"stale,omitempty"`
+	Deprecations  []deprecation              `json:"deprecations,omitempty"`
+	Warnings      []string                   `json:"warnings,omitempty"`
+	Error         string                     `json:"error,omitempty"`
+}
+
+// reportOptions are the options of the mount, after defaults
+type reportOptions struct {
+	CloudName               string   `json:"cloudName"`
+	TenantID                string   `json:"tenantId"`
+	ActiveDirectoryEndpoint string   `json:"activeDirectoryEndpoint"`
+	AADRegion               string   `json:"aadRegion,omitempty"`
+	RestrictEndpoints       bool     `json:"restrictEndpoints"`
+	AllowedEndpoints        []string `json:"allowedEndpoints,omitempty"`
+	RequirePrivateLink      bool     `json:"requirePrivateLink"`
+	RetryAttempts           int      `json:"retryAttempts"`
+	RetryInitialBackoff     string   `json:"retryInitialBackoff"`
+	RetryMaxBackoff         string   `json:"retryMaxBackoff"`
+	RetryDeadline           string   `json:"retryDeadline"`
+	DebugValues             string   `json:"debugValues,omitempty"`
+	TimeFormat              string   `json:"timeFormat"`
+}
+
+// reportIdentity is the identity used to authenticate, without any credential
+type reportIdentity struct {
+	Type             string `json:"type"`
+	ClientID         string `json:"clientId,omitempty"`
+	ClientSecretFile string `json:"clientSecretFile,omitempty"`
+	PodName          string `json:"podName,omitempty"`
+	PodNamespace     string `json:"podNamespace,omitempty"`
+	NMIPort          string `json:"nmiPort,omitempty"`
+}
+
+// reportEndpoint counts the requests sent to a host and the time spent waiting for responses
+type reportEndpoint struct {
+	Requests   int   `json:"requests"`
+	Failures   int   `json:"failures"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// reportObject is an object written to the volume
+type reportObject struct {
+	ObjectName    string `json:"objectName"`
+	ObjectType    string `json:"objectType"`
+	FileName      string `json:"fileName"`
+	ObjectVersion string `json:"objectVersion"`
+	DurationMs    int64  `json:"durationMs"`
+}
+
+// reportOmission is an optional object missing from the vault, skipped or written as a placeholder
+type reportOmission struct {
+	ObjectName  string `json:"objectName"`
+	ObjectType  string `json:"objectType"`
+	FileName    string `json:"fileName"`
+	Placeholder bool   `json:"placeholder"`
+	Reason      string `json:"reason"`
+}
+
+// reportFailure is an object that failed with the best-effort mount policy
+type reportFailure struct {
+	ObjectName string `json:"objectName"`
+	ObjectType string `json:"objectType"`
+	FileName   string `json:"fileName"`
+	Error      string `json:"error"`
+}
+
+// reportStale is an object served from the cache of the node with -allowStaleOnError, the vault
+// being unavailable
+type reportStale struct {
+	ObjectName    string      `json:"objectName"`
+	ObjectType    string      `json:"objectType"`
+	FileName      string      `json:"fileName"`
+	ObjectVersion string      `json:"objectVersion"`
+	FetchTime     interface{} `json:"fetchTime"`
+	Reason        string      `json:"reason"`
+}
+
+// newMountReport starts the report of a mount with the given options
+func newMountReport(options Option) *mountReport {
+	timeFormat := options.timeFormat
+	if timeFormat == "" {
+		timeFormat = TimeFormatRFC3339
+	}
+	report := &mountReport{
+		timeFormat:    timeFormat,
+		start:         time.Now(),
+		DriverVersion: version,
+		Endpoints:     map[string]*reportEndpoint{},
+		Objects:       []reportObject{},
+	}
+	report.StartTime = formatTimestamp(report.start, timeFormat)
+
+	report.Options = reportOptions{
+		TenantID:            options.tenantID,
+		AADRegion:           options.aADRegion,
+		RestrictEndpoints:   options.restrictEndpoints,
+		RequirePrivateLink:  options.requirePrivateLink,
+		RetryAttempts:       options.retryAttempts,
+		RetryInitialBackoff: options.retryInitialBackoff.String(),
+		RetryMaxBackoff:     options.retryMaxBackoff.String(),
+		RetryDeadline:       options.retryDeadline.String(),
+		DebugValues:         options.debugValues,
+		TimeFormat:          timeFormat,
+	}
+	if env, err := ParseAzureEnvironment(options.cloudName); err == nil {
+		report.Options.CloudName = env.Name
+		report.Options.ActiveDirectoryEndpoint, _ = GetActiveDirectoryEndpoint(env, options.aADRegion)
+	}
+	if options.allowedEndpoints != "" {
+		report.Options.AllowedEndpoints = strings.Split(options.allowedEndpoints, objectsSep)
+	}
+
+	switch {
+	case options.usePodIdentity:
+		report.Identity = reportIdentity{Type: "podIdentity", PodName: options.podName, PodNamespace: options.podNamespace, NMIPort: options.nmiPort}
+	case options.useVmManagedIdentity:
+		report.Identity = reportIdentity{Type: "vmManagedIdentity", ClientID: options.vmManagedIdentityClientID}
+	default:
+		report.Identity = reportIdentity{Type: "servicePrincipal", ClientID: options.aADClientID, ClientSecretFile: options.aADClientSecretFile}
+	}
+	report.Deprecations = getDeprecations(options)
+	return report
+}
+
+// since returns the milliseconds elapsed since start
+func since(start time.Time) int64 {
+	return int64(time.Since(start) / time.Millisecond)
+}
+
+// addObject records an object written to the volume
+func (report *mountReport) addObject(object reportObject) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Objects = append(report.Objects, object)
+}
+
+// addOmission records an optional object missing from the vault
+func (report *mountReport) addOmission(omission reportOmission) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Omitted = append(report.Omitted, omission)
+}
+
+// addFailure records an object that failed with the best-effort mount policy
+func (report *mountReport) addFailure(failure reportFailure) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Failed = append(report.Failed, failure)
+}
+
+// addStale records an object served from the cache of the node
+func (report *mountReport) addStale(stale reportStale) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Stale = append(report.Stale, stale)
+}
+
+// addWarning records a warning about the objects mounted
+func (report *mountReport) addWarning(warning string) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Warnings = append(report.Warnings, warning)
+}
+
+// addRequest records a request sent to host at start, failed if err is set or the response is an error
+func (report *mountReport) addRequest(host string, start time.Time, resp *http.Response, err error) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	endpoint, ok := report.Endpoints[host]
+	if !ok {
+		endpoint = &reportEndpoint{}
+		report.Endpoints[host] = endpoint
+	}
+	endpoint.Requests++
+	endpoint.DurationMs += since(start)
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		endpoint.Failures++
+	}
+}
+
+// finish completes the report with the end of the mount and its error, if any
+func (report *mountReport) finish(err error) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.EndTime = formatTimestamp(time.Now(), report.timeFormat)
+	report.DurationMs = since(report.start)
+	if err != nil {
+		report.Error = err.Error()
+	}
+}
+
+// marshal returns the report as indented JSON
+func (report *mountReport) marshal() ([]byte, error) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	return json.MarshalIndent(report, "", "  ")
+}
+
+// writeMountReport writes the report to the volume
+func (adapter *KeyvaultFlexvolumeAdapter) writeMountReport() error {
+	content, err := adapter.report.marshal()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal mount report")
+	}
+	return adapter.writeDerivedFile(mountReportFileName, content)
+}
+
+// logMountReport logs the report, for failed mounts since the volume is unmounted
+func (adapter *KeyvaultFlexvolumeAdapter) logMountReport() {
+	content, err := adapter.report.marshal()
+	if err != nil {
+		glog.Errorf("failed to marshal mount report: %s", err)
+		return
+	}
+	glog.V(0).Infof("mount report: %s", content)
+}
+
+// recordingTransport records the requests sent through it in the mount report
+type recordingTransport struct {
+	base   http.RoundTripper
+	report *mountReport
+}
+
+// RoundTrip sends the request with the base transport and records it
+func (transport *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := transport.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	transport.report.addRequest(req.URL.Hostname(), start, resp, err)
+	return resp, err
+}
+
+// recordEndpoints returns a copy of client, or of a default client if nil, recording the
+// endpoints it contacts in the mount report
+func (adapter *KeyvaultFlexvolumeAdapter) recordEndpoints(client *http.Client) *http.Client {
+	if adapter.report == nil {
+		return client
+	}
+	recording := &http.Client{}
+	if client != nil {
+		*recording = *client
+	}
+	recording.Transport = &recordingTransport{base: recording.Transport, report: adapter.report}
+	return recording
+}
+
+// recordSender returns sender recording the endpoints it contacts in the mount report
+func (adapter *KeyvaultFlexvolumeAdapter) recordSender(sender autorest.Sender) autorest.Sender {
+	report := adapter.report
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := sender.Do(req)
+		report.addRequest(req.URL.Hostname(), start, resp, err)
+		return resp, err
+	})
+}
@@ -9,7 +9,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -27,10 +29,14 @@ const (
 	podnsheader                 = "podns"
 	podIdentityRetryDelay       = time.Duration(7 * time.Second)
 	podIdentityRetryMaxAttempts = 5
+	// public cloud regional token endpoints live under login.microsoft.com rather than login.microsoftonline.com
+	publicCloudLoginHost    = "login.microsoftonline.com"
+	publicCloudRegionalHost = "login.microsoft.com"
 )
 
 var (
 	oauthConfig *adal.OAuthConfig
+	regionRegex = regexp.MustCompile("^[a-z0-9]+$")
 )
 
 // OAuthGrantType specifies which grant type to use.
@@ -84,8 +90,8 @@ type NMIResponse struct {
 	ClientID string     `json:"clientid"`
 }
 
-// GetKeyvaultToken retrieves a new service principal token to access keyvault
-func GetKeyvaultToken(grantType OAuthGrantType, cloudName, tenantID string, usePodIdentity, useVmManagedIdentity bool, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport string) (authorizer autorest.Authorizer, err error) {
+// GetKeyvaultToken retrieves a new service principal token to access keyvault, or Managed HSM with managedHSM
+func GetKeyvaultToken(grantType OAuthGrantType, cloudName string, managedHSM bool, tenantID, aADRegion string, usePodIdentity, useVmManagedIdentity bool, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport string, httpClient *http.Client) (authorizer autorest.Authorizer, err error) {
 	err = adal.AddToUserAgent(GetUserAgent())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to add user agent to adal")
@@ -96,21 +102,35 @@ func GetKeyvaultToken(grantType OAuthGrantType, cloudName, tenantID string, useP
 	}
 
 	kvEndPoint := env.KeyVaultEndpoint
+	if managedHSM {
+		suffix, err := managedHSMDNSSuffix(env)
+		if err != nil {
+			return nil, err
+		}
+		kvEndPoint = "https://" + suffix
+	}
 	if '/' == kvEndPoint[len(kvEndPoint)-1] {
 		kvEndPoint = kvEndPoint[:len(kvEndPoint)-1]
 	}
-	servicePrincipalToken, err := GetServicePrincipalToken(tenantID, env, kvEndPoint, usePodIdentity, useVmManagedIdentity, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport)
+	servicePrincipalToken, err := GetServicePrincipalToken(tenantID, aADRegion, env, kvEndPoint, usePodIdentity, useVmManagedIdentity, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport, httpClient)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get service principal token")
 	}
+	if httpClient != nil {
+		servicePrincipalToken.SetSender(httpClient)
+	}
 	authorizer = autorest.NewBearerAuthorizer(servicePrincipalToken)
 	return authorizer, nil
 
 }
 
 // GetServicePrincipalToken creates a new service principal token based on the configuration
-func GetServicePrincipalToken(tenantID string, env *azure.Environment, resource string, usePodIdentity bool, useVmManagedIdentity bool, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport string) (*adal.ServicePrincipalToken, error) {
-	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+func GetServicePrincipalToken(tenantID, aADRegion string, env *azure.Environment, resource string, usePodIdentity bool, useVmManagedIdentity bool, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport string, httpClient *http.Client) (*adal.ServicePrincipalToken, error) {
+	activeDirectoryEndpoint, err := GetActiveDirectoryEndpoint(env, aADRegion)
+	if err != nil {
+		return nil, err
+	}
+	oauthConfig, err := adal.NewOAuthConfig(activeDirectoryEndpoint, tenantID)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed creating the OAuth config")
 	}
@@ -132,7 +152,7 @@ func GetServicePrincipalToken(tenantID string, env *azure.Environment, resource
 		req.Header.Add(podnsheader, podns)
 		req.Header.Add(podnameheader, podname)
 
-		resp, err := retryFetchToken(req, podIdentityRetryMaxAttempts)
+		resp, err := retryFetchToken(req, podIdentityRetryMaxAttempts, httpClient)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to query NMI")
 		}
@@ -194,7 +214,7 @@ func GetServicePrincipalToken(tenantID string, env *azure.Environment, resource
 
 	// When flexvolume driver is using a Service Principal clientid + client secret to retrieve token for resource
 	if len(aADClientSecret) > 0 {
-		glog.V(2).Infof("azure: using client_id+client_secret to retrieve access token for %s/%s", podns, podname)
+		glog.V(2).Infof("azure: using client_id+client_secret to retrieve access token for %s/%s from %s", podns, podname, activeDirectoryEndpoint)
 		return adal.NewServicePrincipalToken(
 			*oauthConfig,
 			aADClientID,
@@ -205,10 +225,12 @@ func GetServicePrincipalToken(tenantID string, env *azure.Environment, resource
 	return nil, fmt.Errorf("no credentials provided for AAD application %s", aADClientID)
 }
 
-func retryFetchToken(req *http.Request, maxAttempts int) (resp *http.Response, err error) {
+func retryFetchToken(req *http.Request, maxAttempts int, client *http.Client) (resp *http.Response, err error) {
 	attempt := 0
 
-	client := &http.Client{}
+	if client == nil {
+		client = &http.Client{}
+	}
 	for attempt < maxAttempts {
 		resp, err = client.Do(req)
 
@@ -236,8 +258,34 @@ func retryFetchToken(req *http.Request, maxAttempts int) (resp *http.Response, e
 	return
 }
 
-// ParseAzureEnvironment returns azure environment by name
+// GetActiveDirectoryEndpoint returns the AAD endpoint of the environment, or its regional (ESTS-R)
+// counterpart when a region is set. Regional endpoints are only served for the client credentials flow.
+func GetActiveDirectoryEndpoint(env *azure.Environment, region string) (string, error) {
+	if region == "" {
+		return env.ActiveDirectoryEndpoint, nil
+	}
+	u, err := url.Parse(env.ActiveDirectoryEndpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse active directory endpoint %s", env.ActiveDirectoryEndpoint)
+	}
+	host := u.Host
+	if host == publicCloudLoginHost {
+		host = publicCloudRegionalHost
+	}
+	u.Host = fmt.Sprintf("%s.%s", region, host)
+	return u.String(), nil
+}
+
+// ParseAzureEnvironment returns azure environment by name, preferring the environments loaded
+// from the metadata endpoint
 func ParseAzureEnvironment(cloudName string) (*azure.Environment, error) {
+	name := cloudName
+	if name == "" {
+		name = azure.PublicCloud.Name
+	}
+	if env, ok := metadataEnvironments[strings.ToUpper(name)]; ok {
+		return &env, nil
+	}
 	if cloudName == "" {
 		return &azure.PublicCloud, nil
 	}
@@ -0,0 +1,296 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeyVaultObject is a single Azure Key Vault object to write to the volume
+type KeyVaultObject struct {
+	// the name of the Azure Key Vault object
+	ObjectName string `json:"objectName"`
+	// the type of the Azure Key Vault object: secret, key, cert, csr or cert-key
+	ObjectType string `json:"objectType"`
+	// the version of the Azure Key Vault object, latest if empty
+	ObjectVersion string `json:"objectVersion"`
+	// the filename the object will be written to, the object name if empty.
+	// May be a relative path to write the object to a subdirectory of the volume
+	ObjectAlias string `json:"objectAlias"`
+	// other file names of the volume linked to the file of the object, e.g. tls.crt, for
+	// applications with hard-coded file names
+	Symlinks []string `json:"symlinks"`
+	// the name of the vault of the object, the vault of the volume if empty
+	KeyvaultName string `json:"keyvaultName"`
+	// the URI of the vault of the object, e.g. https://myvault.vault.azure.net, the vault of the
+	// volume if empty
+	VaultURI string `json:"vaultURI"`
+	// number of most recent enabled versions of a secret to write as <alias>/0 (most recent),
+	// <alias>/1... instead of a single version
+	ObjectVersionHistory int `json:"objectVersionHistory"`
+	// number of most recent versions, enabled or not, to list in <alias>.versions.json with their
+	// timestamps, so rotation tooling can see the versions without its own vault credentials
+	ObjectVersionsIndex int `json:"objectVersionsIndex"`
+	// number of previous enabled versions of a signing key or secret to write with the current one
+	// as <alias>/<version>, so tokens signed before a rotation can still be verified
+	KeyRing int `json:"keyRing"`
+	// write a certificate as a PEM full chain: the certificate followed by its issuers
+	IncludeChain bool `json:"includeChain"`
+	// the format a certificate is written in: DER by default, pfx for a PKCS#12 file including
+	// the private key and the chain stored in Key Vault, or bundle for a single PEM file with
+	// the private key, the certificate and the chain
+	ObjectFormat string `json:"objectFormat"`
+	// the order of the parts of a bundle: key, cert and chain, in this order by default
+	BundleOrder []string `json:"bundleOrder"`
+	// the encoding of certificates, keys and CSRs: pem or der, or jwk for keys. Certificates are
+	// written as DER, CSRs and private keys as PEM and keys as their RSA modulus by default.
+	// For secrets, base64 decodes the secret before writing it
+	ObjectEncoding string `json:"objectEncoding"`
+	// secrets only, write the secret as is whatever its content type
+	IgnoreContentType bool `json:"ignoreContentType"`
+	// secrets only, indent secrets with the application/json content type
+	PrettyPrint bool `json:"prettyPrint"`
+	// secrets only, the property of a JSON secret to write instead of the secret, e.g. .password
+	ObjectProperty string `json:"objectProperty"`
+	// secrets only, the properties of a JSON secret to write to <alias>/<file name> instead of the
+	// secret, by file name
+	ObjectProperties map[string]string `json:"objectProperties"`
+	// certificates only, write the policy of the certificate: its issuer, key type, subject
+	// alternative names and renewal settings, to <alias>.policy.json
+	WritePolicy bool `json:"writePolicy"`
+	// certificates only, fail the mount if the certificate expires within this number of days
+	MinimumValidityDays int `json:"minimumValidityDays"`
+	// what to do with a certificate expiring within minimumValidityDays: fail or warn
+	MinimumValidityPolicy string `json:"minimumValidityPolicy"`
+	// the file the pfx password is written to, <alias>.password if empty
+	PfxPasswordFile string `json:"pfxPasswordFile"`
+	// don't write the pfx password of -pfxPassword to the volume, e.g. when the workload already
+	// knows it
+	OmitPfxPassword bool `json:"omitPfxPassword"`
+	// remove the trailing newlines of the object, e.g. of a password pasted with a newline
+	TrimNewline bool `json:"trimNewline"`
+	// terminate the object with a newline if it isn't, for tools reading lines
+	AppendNewline bool `json:"appendNewline"`
+	// the name of an executable of the hooks directory of the node transforming the object before
+	// it is written: the object is written to its stdin, and replaced by its stdout
+	TransformHook string `json:"transformHook"`
+	// the alias of the object in the keystore: cert-key objects are added as private key entries
+	// with their chain and cert objects as trusted certificates. Not added if empty
+	KeystoreAlias string `json:"keystoreAlias"`
+	// don't fail the mount if the object is missing from the vault, it is skipped and recorded in
+	// the mount report
+	Optional bool `json:"optional"`
+	// write an optional object missing from the vault as an empty file instead of skipping it
+	WritePlaceholder bool `json:"writePlaceholder"`
+	// octal mode of the files of the object, e.g. 0400 for a private key, -filePermission if empty
+	FilePermission string `json:"filePermission"`
+	// the team owning the object, included in failure messages and logs
+	Owner string `json:"owner"`
+	// how to reach the owner, included in failure messages and logs
+	Contact string `json:"contact"`
+}
+
+// fileName returns the name of the file the object is written to
+func (object KeyVaultObject) fileName() string {
+	if object.ObjectAlias != "" {
+		return object.ObjectAlias
+	}
+	return object.ObjectName
+}
+
+// normalizeNewline returns the content of an object with its trailing newlines removed with
+// trimNewline, or with a terminating newline with appendNewline
+func normalizeNewline(object KeyVaultObject, content []byte) []byte {
+	switch {
+	case object.TrimNewline:
+		return bytes.TrimRight(content, "\r\n")
+	case object.AppendNewline && len(content) > 0 && content[len(content)-1] != '\n':
+		return append(content, '\n')
+	}
+	return content
+}
+
+// Transformations of the object names into the names of their files
+const (
+	// FileNameCaseAsIs writes objects to files named as the objects, in the casing of the vault
+	FileNameCaseAsIs = "as-is"
+	// FileNameCaseLower writes objects to files named as the objects in lowercase, e.g. db-password
+	FileNameCaseLower = "lowercase"
+	// FileNameCaseUpperSnake writes objects to files named as the objects in uppercase with
+	// underscores instead of hyphens, e.g. DB_PASSWORD
+	FileNameCaseUpperSnake = "upper-snake"
+)
+
+// objectFileName returns the file name of an object without alias from its name, mapped to a path
+// with -pathSeparator, then transformed with -fileNameCase
+func objectFileName(name string, options Option) string {
+	fileName := mapObjectPath(name, options.pathSeparator)
+	switch options.fileNameCase {
+	case FileNameCaseLower:
+		return strings.ToLower(fileName)
+	case FileNameCaseUpperSnake:
+		return strings.Replace(strings.ToUpper(fileName), "-", "_", -1)
+	}
+	return fileName
+}
+
+// mapObjectPath returns the file name of an object without alias from its name, with each
+// pathSeparator replaced by a /, so objects can be written to subdirectories although their names
+// can't have a /. The name as is if pathSeparator is empty.
+func mapObjectPath(name string, pathSeparator string) string {
+	if pathSeparator == "" {
+		return name
+	}
+	return strings.Replace(name, pathSeparator, "/", -1)
+}
+
+// parseFileMode returns the mode of an octal file permission such as 0400
+func parseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.Errorf("%s is not an octal file permission such as 0400", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// fileMode returns the mode of the files of the object, -filePermission if it has no filePermission
+func (object KeyVaultObject) fileMode(options Option) os.FileMode {
+	filePermission := object.FilePermission
+	if filePermission == "" {
+		filePermission = options.filePermission
+	}
+	// validated with the options
+	mode, _ := parseFileMode(filePermission)
+	return mode
+}
+
+// pfxPasswordFileName returns the name of the file the pfx password is written to
+func (object KeyVaultObject) pfxPasswordFileName() string {
+	if object.PfxPasswordFile != "" {
+		return object.PfxPasswordFile
+	}
+	return object.fileName() + ".password"
+}
+
+// ownership returns the owner and contact of the object ready to be appended to a message,
+// or an empty string if neither is set
+func (object KeyVaultObject) ownership() string {
+	var annotations []string
+	if object.Owner != "" {
+		annotations = append(annotations, "owner: "+object.Owner)
+	}
+	if object.Contact != "" {
+		annotations = append(annotations, "contact: "+object.Contact)
+	}
+	if len(annotations) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(annotations, ", ") + ")"
+}
+
+// annotateError appends the owner and contact of the object to err, so they reach
+// the failed mount event. They are appended because the driver keeps the end of the message.
+func (object KeyVaultObject) annotateError(err error) error {
+	ownership := object.ownership()
+	if ownership == "" {
+		return err
+	}
+	return fmt.Errorf("%s%s", err, ownership)
+}
+
+// validateFileName makes sure a file name stays inside the volume directory:
+// it must be a clean relative path without any ".." element
+func validateFileName(fileName string) error {
+	return validateFileNameOn(runtime.GOOS, fileName)
+}
+
+// validateFileNameOn validates fileName for the nodes of goos. On Windows, filepath.Join also
+// treats \ as a separator and C:x as relative to the current directory of drive C, and a name
+// such as x:y writes the alternate data stream y of x, so names with \ or : are rejected too.
+func validateFileNameOn(goos string, fileName string) error {
+	if fileName == "" {
+		return errors.New("file name is empty")
+	}
+	if fileName == "." {
+		return errors.New("file name must not be \".\", the root of the volume")
+	}
+	if path.IsAbs(fileName) {
+		return errors.Errorf("file name %q must be a relative path", fileName)
+	}
+	if goos == "windows" {
+		if strings.Contains(fileName, `\`) {
+			return errors.Errorf("file name %q must use / as separator", fileName)
+		}
+		if strings.Contains(fileName, ":") || filepath.VolumeName(fileName) != "" || filepath.IsAbs(fileName) {
+			return errors.Errorf("file name %q must not contain a drive or a stream name", fileName)
+		}
+	}
+	if path.Clean(fileName) != fileName {
+		return errors.Errorf("file name %q must be a clean path, e.g. %q", fileName, path.Clean(fileName))
+	}
+	for _, element := range strings.Split(fileName, "/") {
+		if strings.HasPrefix(element, reservedPrefix) {
+			return errors.Errorf("file name %q must not contain names starting with \"..\", reserved for atomic writes", fileName)
+		}
+	}
+	return nil
+}
+
+// parseObjects returns the objects to mount, either from the -vaultObjects JSON array
+// or from the semi-colon separated -vaultObject* lists
+func parseObjects(options Option) ([]KeyVaultObject, error) {
+	if options.vaultObjects != "" {
+		var objects []KeyVaultObject
+		if err := json.Unmarshal([]byte(options.vaultObjects), &objects); err != nil {
+			return nil, errors.Wrap(err, "failed to parse -vaultObjects")
+		}
+		// a password in the objects is no longer supported, rather than generating another one
+		var legacy []struct {
+			PfxPassword string `json:"pfxPassword"`
+		}
+		json.Unmarshal([]byte(options.vaultObjects), &legacy)
+		for i := range legacy {
+			if legacy[i].PfxPassword != "" {
+				return nil, errors.Errorf("pfxPassword of %s is not supported in the objects, set the pfxpassword key of the secretRef of the volume", objects[i].ObjectName)
+			}
+		}
+		return objects, nil
+	}
+
+	if options.vaultObjectNames == "" {
+		return nil, nil
+	}
+
+	objectTypes := strings.Split(options.vaultObjectTypes, objectsSep)
+	objectNames := strings.Split(options.vaultObjectNames, objectsSep)
+	objectAliases := strings.Split(options.vaultObjectAliases, objectsSep)
+	objectVersions := strings.Split(options.vaultObjectVersions, objectsSep)
+
+	objects := make([]KeyVaultObject, len(objectNames))
+	for i := range objectNames {
+		objects[i].ObjectName = objectNames[i]
+		if i < len(objectTypes) {
+			objects[i].ObjectType = objectTypes[i]
+		}
+		// aliases and versions are optional so we take them only if there is one per object
+		if options.vaultObjectAliases != "" && len(objectAliases) == len(objectNames) {
+			objects[i].ObjectAlias = objectAliases[i]
+		}
+		if options.vaultObjectVersions != "" && len(objectVersions) == len(objectNames) {
+			objects[i].ObjectVersion = objectVersions[i]
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFileName(t *testing.T) {
+	tests := []struct {
+		goos     string
+		fileName string
+		valid    bool
+	}{
+		{goos: "linux", fileName: "db-password", valid: true},
+		{goos: "linux", fileName: "team/db-password", valid: true},
+		{goos: "linux", fileName: "", valid: false},
+		{goos: "linux", fileName: ".", valid: false},
+		{goos: "linux", fileName: "..", valid: false},
+		{goos: "linux", fileName: "../x", valid: false},
+		{goos: "linux", fileName: "a/../../x", valid: false},
+		{goos: "linux", fileName: "/etc/x", valid: false},
+		{goos: "linux", fileName: "a/./x", valid: false},
+		{goos: "linux", fileName: "a/", valid: false},
+		{goos: "linux", fileName: "..data/x", valid: false},
+		// \ and : are plain characters of Linux file names
+		{goos: "linux", fileName: `a\..\..\x`, valid: true},
+		{goos: "linux", fileName: "C:x", valid: true},
+		{goos: "windows", fileName: "db-password", valid: true},
+		{goos: "windows", fileName: "team/db-password", valid: true},
+		{goos: "windows", fileName: ".", valid: false},
+		{goos: "windows", fileName: `a\..\..\x`, valid: false},
+		{goos: "windows", fileName: `team\db-password`, valid: false},
+		{goos: "windows", fileName: `\x`, valid: false},
+		{goos: "windows", fileName: `\\server\share\x`, valid: false},
+		{goos: "windows", fileName: "C:x", valid: false},
+		{goos: "windows", fileName: `C:\x`, valid: false},
+		{goos: "windows", fileName: "C:/x", valid: false},
+		{goos: "windows", fileName: "//server/share/x", valid: false},
+		{goos: "windows", fileName: "db-password:stream", valid: false},
+	}
+	for _, test := range tests {
+		err := validateFileNameOn(test.goos, test.fileName)
+		if test.valid && err != nil {
+			t.Errorf("%s: validateFileName(%q) = %s, want valid", test.goos, test.fileName, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: validateFileName(%q) is valid, want an error", test.goos, test.fileName)
+		}
+	}
+}
+
+func TestObjectFileName(t *testing.T) {
+	tests := []struct {
+		name          string
+		pathSeparator string
+		fileNameCase  string
+		want          string
+		valid         bool
+	}{
+		{name: "db-password", want: "db-password", valid: true},
+		{name: "team--db-password", pathSeparator: "--", want: "team/db-password", valid: true},
+		{name: "a--b--c", pathSeparator: "--", want: "a/b/c", valid: true},
+		{name: "Team--DB-Password", pathSeparator: "--", fileNameCase: FileNameCaseUpperSnake, want: "TEAM/DB_PASSWORD", valid: true},
+		// a separator at the start of the name makes an absolute path
+		{name: "--etc--passwd", pathSeparator: "--", want: "/etc/passwd", valid: false},
+		{name: "-etc", pathSeparator: "-", want: "/etc", valid: false},
+		// consecutive or trailing separators make empty elements
+		{name: "a----b", pathSeparator: "--", want: "a//b", valid: false},
+		{name: "a--", pathSeparator: "--", want: "a/", valid: false},
+		// names listed from a vault aren't trusted to be valid Key Vault names
+		{name: "..--..--etc", pathSeparator: "--", want: "../../etc", valid: false},
+		{name: "a--..--..--x", pathSeparator: "--", want: "a/../../x", valid: false},
+		{name: "a--.--x", pathSeparator: "--", want: "a/./x", valid: false},
+		{name: "..", want: "..", valid: false},
+		{name: ".", want: ".", valid: false},
+		{name: "..data", want: "..data", valid: false},
+		{name: "a--..data--x", pathSeparator: "--", want: "a/..data/x", valid: false},
+		// a separator matching a whole element
+		{name: "..", pathSeparator: ".", want: "//", valid: false},
+		{name: "a.b", pathSeparator: "a", want: "/.b", valid: false},
+	}
+	for _, test := range tests {
+		options := Option{pathSeparator: test.pathSeparator, fileNameCase: test.fileNameCase}
+		got := objectFileName(test.name, options)
+		if got != test.want {
+			t.Errorf("objectFileName(%q, %q) = %q, want %q", test.name, test.pathSeparator, got, test.want)
+		}
+		err := validateFileName(got)
+		if test.valid && err != nil {
+			t.Errorf("file name %q of %q is invalid: %s", got, test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("file name %q of %q is valid, want an error", got, test.name)
+		}
+	}
+}
+
+func TestValidatePathSeparator(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// substring of the error, empty if the options are valid
+		err string
+	}{
+		{
+			name: "nested names",
+			args: []string{"-pathSeparator=--", "-vaultObjectNames=team--db-password;team--api-key", "-vaultObjectTypes=secret;secret"},
+		},
+		{
+			name: "leading separator",
+			args: []string{"-pathSeparator=--", "-vaultObjectNames=--etc--passwd", "-vaultObjectTypes=secret"},
+			err:  `file name "/etc/passwd" must be a relative path`,
+		},
+		{
+			name: "empty element",
+			args: []string{"-pathSeparator=--", "-vaultObjectNames=team----db-password", "-vaultObjectTypes=secret"},
+			err:  "must be a clean path",
+		},
+		{
+			name: "mapped onto an alias",
+			args: []string{"-pathSeparator=--", `-vaultObjects=[{"objectName":"team--db-password","objectType":"secret"},{"objectName":"db","objectType":"secret","objectAlias":"team/db-password"}]`},
+			err:  "objects team--db-password and db are both written to team/db-password",
+		},
+		{
+			name: "mapped onto another name",
+			args: []string{"-pathSeparator=-", "-fileNameCase=" + FileNameCaseLower, "-vaultObjectNames=team-db;Team-DB", "-vaultObjectTypes=secret;secret"},
+			err:  "objects team-db and Team-DB are both written to team/db",
+		},
+		{
+			name: "mapped onto a symlink",
+			args: []string{"-pathSeparator=--", `-vaultObjects=[{"objectName":"db","objectType":"secret","symlinks":["team/db"]},{"objectName":"team--db","objectType":"secret"}]`},
+			err:  "objects db and team--db are both written to team/db",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(testOptions(t, test.args...))
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("Validate() = %q, want no error", err)
+			case test.err != "" && err == nil:
+				t.Errorf("Validate() = nil, want %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("Validate() = %q, want %q", err, test.err)
+			}
+		})
+	}
+}
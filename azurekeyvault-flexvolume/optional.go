@@ -0,0 +1,74 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Policies of mounts of several objects
+const (
+	// MountPolicyFailFast fails the mount as soon as an object fails
+	MountPolicyFailFast = "fail-fast"
+	// MountPolicyBestEffort mounts the objects that can be, reporting the failed ones, and only
+	// fails the mount if every object failed
+	MountPolicyBestEffort = "best-effort"
+)
+
+// notFoundError is the error of a request for an object missing from the vault
+type notFoundError struct {
+	error
+}
+
+// isNotFound returns true if err, or the error it wraps, is the error of a request for an object
+// missing from the vault
+func isNotFound(err error) bool {
+	_, ok := errors.Cause(err).(notFoundError)
+	return ok
+}
+
+// isNotFoundResponse returns true if err is the error of a Key Vault request answered with a 404
+func isNotFoundResponse(err error) bool {
+	detailed, ok := err.(autorest.DetailedError)
+	return ok && detailed.StatusCode == http.StatusNotFound
+}
+
+// omitObject records an optional object missing from the vault, written as an empty placeholder
+// with writePlaceholder, so the mount continues without it
+func (adapter *KeyvaultFlexvolumeAdapter) omitObject(object KeyVaultObject, err error) (*fetchedObject, error) {
+	glog.Warningf("optional %s %s is missing from the vault, skipping it%s: %s", object.ObjectType, object.ObjectName, object.ownership(), err)
+	adapter.report.addOmission(reportOmission{
+		ObjectName:  object.ObjectName,
+		ObjectType:  object.ObjectType,
+		FileName:    object.fileName(),
+		Placeholder: object.WritePlaceholder,
+		Reason:      err.Error(),
+	})
+	if !object.WritePlaceholder {
+		return nil, nil
+	}
+	placeholder := &fetchedObject{content: []byte{}}
+	if err = adapter.writeObject(object, object.fileName(), placeholder); err != nil {
+		return nil, err
+	}
+	return placeholder, nil
+}
+
+// failObject records an object that failed with the best-effort mount policy, so the mount
+// continues without it
+func (adapter *KeyvaultFlexvolumeAdapter) failObject(object KeyVaultObject, err error) {
+	err = object.annotateError(err)
+	glog.Warningf("failed to mount %s %s, continuing with the best-effort mount policy: %s", object.ObjectType, object.ObjectName, err)
+	adapter.report.addFailure(reportFailure{
+		ObjectName: object.ObjectName,
+		ObjectType: object.ObjectType,
+		FileName:   object.fileName(),
+		Error:      err.Error(),
+	})
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+)
+
+// maxListPages bounds the pages of a list operation, so a vault returning a nextLink loop can't
+// keep a mount listing forever. Pages have up to 25 items, so vaults with up to 250000 objects
+// can be listed.
+const maxListPages = 10000
+
+// listPage is the current page of a Key Vault list operation, e.g. *kv.SecretListResultPage
+type listPage interface {
+	NextWithContext(ctx context.Context) error
+}
+
+// listPages calls visit with each page of a Key Vault list operation, following the nextLink of
+// the pages. The iterators of the SDK stop at the first empty page, while Key Vault may return
+// empty pages with a nextLink, e.g. when the items of a page are filtered out, so pages are
+// followed as long as they have a nextLink rather than items.
+func listPages(ctx context.Context, page listPage, nextLink func() *string, visit func() error) error {
+	for pages := 1; ; pages++ {
+		if err := visit(); err != nil {
+			return err
+		}
+		if to.String(nextLink()) == "" {
+			return nil
+		}
+		if pages >= maxListPages {
+			return errors.Errorf("listed %d pages without reaching the last one", pages)
+		}
+		if err := page.NextWithContext(ctx); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+)
+
+// newPagedVault serves the pages of a list operation at path: each page lists the identifiers of
+// its items under their id key, with a nextLink to the next page but for the last one. It returns
+// the number of pages requested.
+func newPagedVault(t *testing.T, path string, idKey string, pages [][]string) (*httptest.Server, *int) {
+	requests := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		page := requests
+		requests++
+		if page >= len(pages) {
+			t.Errorf("page %d of %s requested, only %d pages", page+1, path, len(pages))
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		items := []map[string]string{}
+		for _, id := range pages[page] {
+			items = append(items, map[string]string{idKey: server.URL + id})
+		}
+		result := map[string]interface{}{"value": items}
+		if page < len(pages)-1 {
+			result["nextLink"] = server.URL + path + "?$skiptoken=" + strconv.Itoa(page+1)
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestSelectSecretsEmptyPages(t *testing.T) {
+	vault, requests := newPagedVault(t, "/secrets", "id", [][]string{
+		{},
+		{"/secrets/db-password", "/secrets/api-key"},
+		{},
+		{"/secrets/tls"},
+	})
+	adapter := testAdapter(t, "-mountAllSecrets")
+	adapter.ctx = context.Background()
+	kvClient := kv.New()
+	selected, err := adapter.selectSecrets(&kvClient, vault.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, object := range selected {
+		names = append(names, object.ObjectName)
+	}
+	if want := []string{"api-key", "db-password", "tls"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("selected secrets = %v, want %v", names, want)
+	}
+	if *requests != 4 {
+		t.Errorf("listed %d pages, want 4", *requests)
+	}
+}
+
+func TestListVersionsEmptyPages(t *testing.T) {
+	vault, requests := newPagedVault(t, "/keys/signing/versions", "kid", [][]string{
+		{},
+		{},
+		{"/keys/signing/v1", "/keys/signing/v2"},
+	})
+	adapter := testAdapter(t)
+	adapter.ctx = context.Background()
+	kvClient := kv.New()
+	versions, err := adapter.listVersions(&kvClient, vault.URL, VaultTypeKey, "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, version := range versions {
+		listed = append(listed, version.version)
+	}
+	if len(listed) != 2 {
+		t.Errorf("listed versions = %v, want v1 and v2", listed)
+	}
+	if *requests != 3 {
+		t.Errorf("listed %d pages, want 3", *requests)
+	}
+}
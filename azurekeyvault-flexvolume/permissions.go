@@ -0,0 +1,187 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Formats of the required-permissions command
+const (
+	// permissionsFormatAz prints an az keyvault set-policy command
+	permissionsFormatAz = "az"
+	// permissionsFormatRBAC prints az role assignment create commands, for vaults using Azure RBAC
+	permissionsFormatRBAC = "rbac"
+	// permissionsFormatBicep prints an access policy resource
+	permissionsFormatBicep = "bicep"
+	// permissionsFormatTerraform prints an azurerm_key_vault_access_policy resource
+	permissionsFormatTerraform = "terraform"
+)
+
+// vaultPermissions are the access policy permissions a volume needs on secrets, keys and certificates
+type vaultPermissions struct {
+	secrets      map[string]bool
+	keys         map[string]bool
+	certificates map[string]bool
+}
+
+// requiredPermissions returns the minimal permissions of the identity of a volume on its vault
+func requiredPermissions(options Option) vaultPermissions {
+	p := vaultPermissions{secrets: map[string]bool{}, keys: map[string]bool{}, certificates: map[string]bool{}}
+	if selectsSecrets(options) {
+		p.secrets["get"], p.secrets["list"] = true, true
+	}
+	for _, object := range options.objects {
+		// version histories, key rings and versions indexes list the versions of the object
+		lists := object.ObjectVersionHistory > 0 || object.KeyRing > 0 || object.ObjectVersionsIndex > 0
+		switch object.ObjectType {
+		case VaultTypeSecret:
+			p.secrets["get"] = true
+			p.secrets["list"] = p.secrets["list"] || lists
+		case VaultTypeKey:
+			p.keys["get"] = true
+			p.keys["list"] = p.keys["list"] || lists
+		case VaultTypeCertificate, VaultTypeCertificateKey:
+			p.certificates["get"] = true
+			p.certificates["list"] = p.certificates["list"] || lists
+			// the private key of a certificate is only readable from its backing secret
+			if object.ObjectType == VaultTypeCertificateKey || object.ObjectFormat != "" {
+				p.secrets["get"] = true
+			}
+		case VaultTypeCertificateSigningRequest:
+			p.certificates["get"] = true
+		}
+	}
+	return p
+}
+
+// sortedPermissions returns the permissions of a set, sorted
+func sortedPermissions(set map[string]bool) []string {
+	var permissions []string
+	for permission, granted := range set {
+		if granted {
+			permissions = append(permissions, permission)
+		}
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// quotePermissions returns permissions as a list of quoted permissions, e.g. ["Get", "List"]
+func quotePermissions(permissions []string, quote func(string) string) string {
+	quoted := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		quoted = append(quoted, quote(permission))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// principal returns how to refer to the identity of a volume in the printed snippets
+func principal(options Option) string {
+	switch {
+	case options.usePodIdentity:
+		return "<object id of the pod identity>"
+	case options.useVmManagedIdentity && options.vmManagedIdentityClientID != "":
+		return fmt.Sprintf("<object id of the managed identity %s>", options.vmManagedIdentityClientID)
+	case options.useVmManagedIdentity:
+		return "<object id of the node managed identity>"
+	case options.aADClientID != "":
+		return fmt.Sprintf("<object id of the service principal %s>", options.aADClientID)
+	}
+	return "<object id of the identity>"
+}
+
+// runRequiredPermissions prints the minimal role assignments or access policy entries the
+// identity of a volume needs, without contacting Azure
+func runRequiredPermissions(ctx context.Context, args []string) error {
+	fs := newFlagSet("required-permissions")
+	format := fs.String("format", permissionsFormatAz, "Format of the permissions: az, rbac, bicep or terraform.")
+	options, err := parseConfigs(fs, args)
+	if err != nil {
+		return err
+	}
+	if options.vaultName == "" && options.vaultURI == "" {
+		return errors.New("-vaultName or -vaultURI is not set")
+	}
+	vaultName := vaultDisplayName(*options)
+	p := requiredPermissions(*options)
+	secrets, keys, certificates := sortedPermissions(p.secrets), sortedPermissions(p.keys), sortedPermissions(p.certificates)
+	objectID := principal(*options)
+	tenantID := options.tenantID
+	if tenantID == "" {
+		tenantID = "<tenant id>"
+	}
+
+	switch *format {
+	case permissionsFormatAz:
+		cmd := fmt.Sprintf("az keyvault set-policy --name %s --object-id %q", vaultName, objectID)
+		if len(secrets) > 0 {
+			cmd += " --secret-permissions " + strings.Join(secrets, " ")
+		}
+		if len(keys) > 0 {
+			cmd += " --key-permissions " + strings.Join(keys, " ")
+		}
+		if len(certificates) > 0 {
+			cmd += " --certificate-permissions " + strings.Join(certificates, " ")
+		}
+		fmt.Println(cmd)
+	case permissionsFormatRBAC:
+		scope := fmt.Sprintf("$(az keyvault show --name %s --query id -o tsv)", vaultName)
+		// the built-in roles granting the permissions on vaults using Azure RBAC
+		grants := []struct {
+			role        string
+			permissions []string
+		}{
+			{"Key Vault Secrets User", secrets},
+			{"Key Vault Crypto User", keys},
+			{"Key Vault Certificate User", certificates},
+		}
+		for _, grant := range grants {
+			if len(grant.permissions) > 0 {
+				fmt.Printf("az role assignment create --role %q --assignee-object-id %q --scope %s\n", grant.role, objectID, scope)
+			}
+		}
+	case permissionsFormatBicep:
+		quote := func(permission string) string { return "'" + permission + "'" }
+		fmt.Printf(`resource accessPolicy 'Microsoft.KeyVault/vaults/accessPolicies@2019-09-01' = {
+  name: '%s/add'
+  properties: {
+    accessPolicies: [
+      {
+        tenantId: '%s'
+        objectId: '%s'
+        permissions: {
+          secrets: %s
+          keys: %s
+          certificates: %s
+        }
+      }
+    ]
+  }
+}
+`, vaultName, tenantID, objectID, quotePermissions(secrets, quote), quotePermissions(keys, quote), quotePermissions(certificates, quote))
+	case permissionsFormatTerraform:
+		// the azurerm provider capitalizes permissions
+		quote := func(permission string) string { return strconv.Quote(strings.Title(permission)) }
+		fmt.Printf(`resource "azurerm_key_vault_access_policy" "flexvol" {
+  key_vault_id            = "<id of the key vault %s>"
+  tenant_id               = "%s"
+  object_id               = "%s"
+  secret_permissions      = %s
+  key_permissions         = %s
+  certificate_permissions = %s
+}
+`, vaultName, tenantID, objectID, quotePermissions(secrets, quote), quotePermissions(keys, quote), quotePermissions(certificates, quote))
+	default:
+		return errors.Errorf("-format is invalid, should be set to %s, %s, %s or %s", permissionsFormatAz, permissionsFormatRBAC, permissionsFormatBicep, permissionsFormatTerraform)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/pkg/errors"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// length in bytes of generated pfx passwords, before base64 encoding
+const pfxPasswordLength = 24
+
+// fetchPFX returns a certificate, its private key and its chain as a PKCS#12 file protected by
+// -pfxPassword, or a generated password, written next to it unless omitted
+func (adapter *KeyvaultFlexvolumeAdapter) fetchPFX(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*fetchedObject, error) {
+	certSecret, fetched, err := adapter.getCertificateSecret(kvClient, vaultURL, object)
+	if err != nil {
+		return nil, err
+	}
+
+	objectJSON, err := json.Marshal(object)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal %s %s", object.ObjectType, object.ObjectName)
+	}
+	source := []string{vaultURL, string(objectJSON), fetched.version, adapter.options.pfxPassword}
+	password, content, err := adapter.encodeOnce(object.fileName(), source, func() (string, []byte, error) {
+		password := adapter.options.pfxPassword
+		if password == "" {
+			var err error
+			if password, err = generatePassword(); err != nil {
+				return "", nil, err
+			}
+		}
+		// the legacy encryption of pkcs12.Encode is the one Windows and .NET can read
+		content, err := pkcs12.Encode(rand.Reader, certSecret.privateKey, certSecret.certificate, certSecret.caCerts, password)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "failed to encode certificate %s as pfx", object.ObjectName)
+		}
+		return password, content, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fetched.content = content
+	if !object.OmitPfxPassword {
+		fetched.files = map[string][]byte{object.pfxPasswordFileName(): []byte(password)}
+	}
+	return fetched, nil
+}
+
+// generatePassword returns a random password safe to use on a command line
+func generatePassword() (string, error) {
+	b := make([]byte, pfxPasswordLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate password")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// previousDirName holds the previous content of the files changed by a refresh during
+	// -rotationGracePeriod, relative to dir
+	previousDirName = "previous"
+	// previousExpiryFileName records when each file of previousDirName is removed
+	previousExpiryFileName = ".expiry.json"
+)
+
+// isPreviousFileName returns whether fileName is in the directory of the previous versions
+func isPreviousFileName(fileName string) bool {
+	fileName = filepath.ToSlash(filepath.Clean(fileName))
+	return fileName == previousDirName || strings.HasPrefix(fileName, previousDirName+"/")
+}
+
+// readPublished returns the content of the files of objects published by the previous mount of
+// the volume, before they are replaced, none on the first mount
+func (adapter *KeyvaultFlexvolumeAdapter) readPublished(objects []KeyVaultObject) map[string][]byte {
+	published := make(map[string][]byte, len(objects))
+	for _, object := range objects {
+		content, err := ioutil.ReadFile(filepath.Join(adapter.options.dir, object.fileName()))
+		if err == nil {
+			published[object.fileName()] = content
+		}
+	}
+	return published
+}
+
+// writePrevious writes the published content of each file rotated by the mount to the previous
+// directory, where it stays for -rotationGracePeriod, so applications caching file handles or
+// accepting both the old and new keys during a cutover keep working. The previous files whose
+// grace period ended are dropped, the others kept.
+func (adapter *KeyvaultFlexvolumeAdapter) writePrevious(published map[string][]byte, mounted []mountedObject) error {
+	options := adapter.options
+	now := time.Now()
+	expiries := make(map[string]time.Time)
+	if content, err := ioutil.ReadFile(filepath.Join(options.dir, previousDirName, previousExpiryFileName)); err == nil {
+		if err = json.Unmarshal(content, &expiries); err != nil {
+			glog.Warningf("failed to parse the previous versions of %s: %s", options.dir, err)
+		}
+	}
+	contents := make(map[string][]byte, len(expiries))
+	for fileName, expiry := range expiries {
+		content, err := ioutil.ReadFile(filepath.Join(options.dir, previousDirName, fileName))
+		if err != nil || !now.Before(expiry) {
+			glog.V(0).Infof("grace period of the previous %s ended, removed", fileName)
+			delete(expiries, fileName)
+			// written in place without -atomicWrites
+			os.Remove(filepath.Join(adapter.dataDir(), previousDirName, fileName))
+			continue
+		}
+		contents[fileName] = content
+	}
+	for _, object := range mounted {
+		previous, ok := published[object.fileName]
+		if !ok || !adapter.rotated[object.fileName] {
+			continue
+		}
+		contents[object.fileName] = previous
+		expiries[object.fileName] = now.Add(options.rotationGracePeriod)
+		glog.V(0).Infof("%s was rotated, its previous content is kept in %s until %s", object.fileName, previousDirName, expiries[object.fileName].UTC().Format(time.RFC3339))
+	}
+	if len(contents) == 0 {
+		os.RemoveAll(filepath.Join(adapter.dataDir(), previousDirName))
+		return nil
+	}
+
+	fileNames := make([]string, 0, len(contents))
+	for fileName := range contents {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		if err := adapter.writeDerivedFile(filepath.Join(previousDirName, fileName), contents[fileName]); err != nil {
+			return err
+		}
+	}
+	content, err := json.Marshal(expiries)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the expiry of the previous versions")
+	}
+	return adapter.writeDerivedFile(filepath.Join(previousDirName, previousExpiryFileName), content)
+}
+
+// previousExpired returns whether the grace period of a previous file of the volume at dir ended,
+// so the next refresh removes it
+func previousExpired(dir string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(dir, previousDirName, previousExpiryFileName))
+	if err != nil {
+		return false
+	}
+	expiries := make(map[string]time.Time)
+	if err = json.Unmarshal(content, &expiries); err != nil {
+		return true
+	}
+	for _, expiry := range expiries {
+		if !time.Now().Before(expiry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRotatedFiles(t *testing.T) {
+	previous := &mountManifest{Objects: []manifestObject{
+		{ObjectName: "tls", ObjectType: VaultTypeSecret, FileName: "tls.pfx", ObjectVersion: "v1"},
+		{ObjectName: "db-password", ObjectType: VaultTypeSecret, FileName: "db-password", ObjectVersion: "v1"},
+		{ObjectName: "signing", ObjectType: VaultTypeKey, FileName: "signing", ObjectVersion: "v2", VersionHistory: []string{"v2", "v1"}},
+	}}
+	tests := []struct {
+		name     string
+		previous *mountManifest
+		objects  []manifestObject
+		want     map[string]bool
+	}{
+		{name: "first mount", objects: previous.Objects, want: map[string]bool{}},
+		{name: "same versions", previous: previous, objects: previous.Objects, want: map[string]bool{}},
+		{name: "new version", previous: previous, objects: []manifestObject{
+			{ObjectName: "tls", ObjectType: VaultTypeSecret, FileName: "tls.pfx", ObjectVersion: "v2"},
+			previous.Objects[1],
+			previous.Objects[2],
+		}, want: map[string]bool{"tls.pfx": true}},
+		{name: "new version history", previous: previous, objects: []manifestObject{
+			previous.Objects[0],
+			previous.Objects[1],
+			{ObjectName: "signing", ObjectType: VaultTypeKey, FileName: "signing", ObjectVersion: "v2", VersionHistory: []string{"v2"}},
+		}, want: map[string]bool{"signing": true}},
+		{name: "new object", previous: previous, objects: append(previous.Objects[:3:3], manifestObject{ObjectName: "api-key", ObjectType: VaultTypeSecret, FileName: "api-key", ObjectVersion: "v1"}), want: map[string]bool{"api-key": true}},
+	}
+	for _, test := range tests {
+		if got := rotatedFiles(test.previous, test.objects); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: rotatedFiles() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWritePreviousRotated(t *testing.T) {
+	adapter := testAdapter(t, "-rotation", "-rotationGracePeriod=1h")
+	published := map[string][]byte{"tls.pfx": []byte("old pfx"), "db-password": []byte("old password")}
+	// the pfx is encoded again with the same version, only the password was rotated
+	mounted := []mountedObject{
+		{objectType: VaultTypeSecret, fileName: "tls.pfx", content: []byte("new pfx")},
+		{objectType: VaultTypeSecret, fileName: "db-password", content: []byte("new password")},
+	}
+	adapter.rotated = map[string]bool{"db-password": true}
+	if err := adapter.writePrevious(published, mounted); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(adapter.options.dir, previousDirName, "db-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "old password" {
+		t.Errorf("previous db-password = %q, want %q", content, "old password")
+	}
+	if _, err = os.Stat(filepath.Join(adapter.options.dir, previousDirName, "tls.pfx")); !os.IsNotExist(err) {
+		t.Errorf("previous content of tls.pfx kept without a new version: %v", err)
+	}
+	if previousExpired(adapter.options.dir) {
+		t.Errorf("previous content expired before %s", time.Hour)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// privateNetworks are the address ranges a private endpoint can be assigned from a virtual network
+var privateNetworks = parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isPrivateIP returns true if ip belongs to a private network
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrivateLink verifies the vault resolves to a private endpoint, i.e. only to private
+// addresses, so secrets are never fetched over the public endpoint of the vault
+func checkPrivateLink(vaultURL string) error {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse vault url %s", vaultURL)
+	}
+	host := u.Hostname()
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve vault %s", host)
+	}
+	for _, ip := range ips {
+		if !isPrivateIP(ip) {
+			return errors.Errorf("vault %s resolves to public address %s, a private endpoint is required with -requirePrivateLink", host, ip)
+		}
+	}
+	// private endpoints are usually resolved through a privatelink CNAME, only logged since
+	// custom DNS may resolve the vault directly
+	cname, _ := net.LookupCNAME(host)
+	glog.V(0).Infof("vault %s resolves to private endpoint %v (canonical name: %s)", host, ips, cname)
+	return nil
+}
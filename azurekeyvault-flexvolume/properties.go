@@ -0,0 +1,126 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// propertyStep is a step of a property path: a field of an object, or an index of an array if
+// field is empty
+type propertyStep struct {
+	field string
+	index int
+}
+
+// parseProperty parses the path of a property of a JSON secret, e.g. .password, .db.hosts[0]
+// or $.password
+func parseProperty(property string) ([]propertyStep, error) {
+	p := strings.TrimPrefix(property, "$")
+	if p == "" || p == "." {
+		return nil, errors.Errorf("property %q is empty", property)
+	}
+	if p[0] != '.' && p[0] != '[' {
+		p = "." + p
+	}
+
+	var steps []propertyStep
+	for p != "" {
+		switch p[0] {
+		case '.':
+			end := strings.IndexAny(p[1:], ".[") + 1
+			if end == 0 {
+				end = len(p)
+			}
+			if end == 1 {
+				return nil, errors.Errorf("property %q has an empty field name", property)
+			}
+			steps = append(steps, propertyStep{field: p[1:end]})
+			p = p[end:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, errors.Errorf("property %q has an unterminated index", property)
+			}
+			index, err := strconv.Atoi(p[1:end])
+			if err != nil || index < 0 {
+				return nil, errors.Errorf("property %q has an invalid index %q", property, p[1:end])
+			}
+			steps = append(steps, propertyStep{index: index})
+			p = p[end+1:]
+		default:
+			return nil, errors.Errorf("property %q is invalid at %q", property, p)
+		}
+	}
+	return steps, nil
+}
+
+// extractProperty returns a property of a JSON secret: strings as is, other values as JSON
+func extractProperty(content []byte, property string) ([]byte, error) {
+	steps, err := parseProperty(property)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var value interface{}
+	if err = decoder.Decode(&value); err != nil {
+		return nil, errors.Wrap(err, "secret is not a JSON document")
+	}
+
+	for _, step := range steps {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			field, ok := v[step.field]
+			if step.field == "" || !ok {
+				return nil, errors.Errorf("property %q not found", property)
+			}
+			value = field
+		case []interface{}:
+			if step.field != "" || step.index >= len(v) {
+				return nil, errors.Errorf("property %q not found", property)
+			}
+			value = v[step.index]
+		default:
+			return nil, errors.Errorf("property %q not found", property)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(value)
+}
+
+// fetchedProperties returns what to write for a JSON secret with objectProperty, its property, or
+// with objectProperties, a file <alias>/<file name> per property instead of the secret itself
+func fetchedProperties(object KeyVaultObject, fetched *fetchedObject) (*fetchedObject, error) {
+	if object.ObjectProperty != "" {
+		content, err := extractProperty(fetched.content, object.ObjectProperty)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to extract objectProperty of secret %s", object.ObjectName)
+		}
+		fetched.content = content
+		return fetched, nil
+	}
+
+	fetched.files = make(map[string][]byte, len(object.ObjectProperties))
+	for fileName, property := range object.ObjectProperties {
+		content, err := extractProperty(fetched.content, property)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to extract objectProperties of secret %s", object.ObjectName)
+		}
+		fetched.files[path.Join(object.fileName(), fileName)] = content
+	}
+	fetched.content = nil
+	fetched.omitContent = true
+	return fetched, nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// propertiesKey returns the key of a secret in the properties file from its file name, with the
+// path separators of aliases replaced by dots, e.g. db.password for db/password
+func propertiesKey(fileName string) string {
+	return strings.Replace(fileName, "/", ".", -1)
+}
+
+// escapeProperty escapes a key or a value of a properties file as java.util.Properties reads it:
+// backslashes, line breaks, tabs and form feeds are escaped, as well as leading spaces, and the
+// separators and comment characters of keys. Characters outside ISO 8859-1 are written as \uXXXX.
+func escapeProperty(s string, isKey bool) string {
+	var escaped strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			escaped.WriteString(`\\`)
+		case r == '\n':
+			escaped.WriteString(`\n`)
+		case r == '\r':
+			escaped.WriteString(`\r`)
+		case r == '\t':
+			escaped.WriteString(`\t`)
+		case r == '\f':
+			escaped.WriteString(`\f`)
+		case r == ' ' && (isKey || i == 0):
+			escaped.WriteString(`\ `)
+		case strings.ContainsRune("=:#!", r) && (isKey || i == 0):
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			// UTF-16 code units, surrogate pairs for characters outside the basic plane
+			for _, unit := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&escaped, `\u%04X`, unit)
+			}
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+// writePropertiesFile writes the secrets mounted to propertiesFile as key=value lines, for Java
+// applications reading properties files
+func (adapter *KeyvaultFlexvolumeAdapter) writePropertiesFile(secrets []mountedObject) error {
+	var content bytes.Buffer
+	for _, secret := range secrets {
+		content.WriteString(escapeProperty(propertiesKey(secret.fileName), true) + "=" + escapeProperty(string(secret.content), false) + "\n")
+	}
+	return adapter.writeDerivedFile(adapter.options.propertiesFile, content.Bytes())
+}
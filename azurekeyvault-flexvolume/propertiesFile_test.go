@@ -0,0 +1,53 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import "testing"
+
+func TestEscapeProperty(t *testing.T) {
+	tests := []struct {
+		s     string
+		isKey bool
+		want  string
+	}{
+		{s: "db.password", isKey: true, want: "db.password"},
+		{s: "s3cr3t", want: "s3cr3t"},
+		{s: "a key", isKey: true, want: `a\ key`},
+		{s: "a value", want: "a value"},
+		{s: " leading", want: `\ leading`},
+		{s: "a=b:c", isKey: true, want: `a\=b\:c`},
+		{s: "a=b:c", want: "a=b:c"},
+		{s: "#comment", want: `\#comment`},
+		{s: "!comment", isKey: true, want: `\!comment`},
+		{s: `C:\path`, want: `C:\\path`},
+		{s: "line1\nline2\r\n", want: `line1\nline2\r\n`},
+		{s: "tab\tfeed\f", want: `tab\tfeed\f`},
+		{s: "caf\u00e9", want: `caf\u00E9`},
+		{s: "\u20ac", want: `\u20AC`},
+		{s: "\U0001F511", want: `\uD83D\uDD11`},
+		{s: "\x01", want: `\u0001`},
+	}
+	for _, test := range tests {
+		if got := escapeProperty(test.s, test.isKey); got != test.want {
+			t.Errorf("escapeProperty(%q, %t) = %q, want %q", test.s, test.isKey, got, test.want)
+		}
+	}
+}
+
+func TestWritePropertiesFile(t *testing.T) {
+	adapter := testAdapter(t, "-propertiesFile=secrets.properties", "-filePermission=0440")
+	secrets := []mountedObject{
+		{objectType: VaultTypeSecret, fileName: "db/password", content: []byte("p@ss=word")},
+		{objectType: VaultTypeSecret, fileName: "api key", content: []byte(" token\n")},
+	}
+	if err := adapter.writePropertiesFile(secrets); err != nil {
+		t.Fatal(err)
+	}
+	want := "db.password=p@ss=word\n" +
+		`api\ key=\ token\n` + "\n"
+	if got := readTestFile(t, adapter, "secrets.properties", 0440); got != want {
+		t.Errorf("secrets.properties = %q, want %q", got, want)
+	}
+}
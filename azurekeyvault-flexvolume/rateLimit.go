@@ -0,0 +1,116 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// rateLimitFileName is the token bucket shared by the mounts of the node, relative to stateDir
+const rateLimitFileName = "ratelimit.json"
+
+// tokenBucket is the state of the node rate limiter, persisted on the node so it is shared by
+// concurrent mounts
+type tokenBucket struct {
+	Tokens float64 `json:"tokens"`
+	// unix time in nanoseconds the tokens were counted at
+	Updated int64 `json:"updated"`
+}
+
+// takeToken takes a token of the node token bucket, refilled with qps tokens per second up to
+// burst tokens, and returns how long to wait for one if the bucket is empty. The bucket is locked
+// while it is updated, so concurrent mounts of the node share it.
+func takeToken(fileName string, qps float64, burst int) (time.Duration, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, permission)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open rate limiter %s", fileName)
+	}
+	defer file.Close()
+	if err = lockFile(file); err != nil {
+		return 0, errors.Wrapf(err, "failed to lock rate limiter %s", fileName)
+	}
+	defer unlockFile(file)
+
+	now := time.Now()
+	bucket := tokenBucket{Tokens: float64(burst), Updated: now.UnixNano()}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read rate limiter %s", fileName)
+	}
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &bucket); err != nil {
+			// a corrupted bucket is refilled rather than blocking the node
+			glog.Warningf("failed to parse rate limiter %s, resetting it: %s", fileName, err)
+			bucket = tokenBucket{Tokens: float64(burst), Updated: now.UnixNano()}
+		}
+	}
+	if elapsed := now.Sub(time.Unix(0, bucket.Updated)); elapsed > 0 {
+		bucket.Tokens += elapsed.Seconds() * qps
+	}
+	if bucket.Tokens > float64(burst) {
+		bucket.Tokens = float64(burst)
+	}
+	bucket.Updated = now.UnixNano()
+
+	var wait time.Duration
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+	} else {
+		wait = time.Duration((1 - bucket.Tokens) / qps * float64(time.Second))
+	}
+
+	if content, err = json.Marshal(bucket); err != nil {
+		return 0, errors.Wrap(err, "failed to marshal rate limiter")
+	}
+	if err = file.Truncate(0); err != nil {
+		return 0, errors.Wrapf(err, "failed to write rate limiter %s", fileName)
+	}
+	if _, err = file.WriteAt(content, 0); err != nil {
+		return 0, errors.Wrapf(err, "failed to write rate limiter %s", fileName)
+	}
+	return wait, nil
+}
+
+// waitToken waits for a token of the node token bucket
+func waitToken(ctx context.Context, fileName string, qps float64, burst int) error {
+	for {
+		wait, err := takeToken(fileName, qps, burst)
+		if err != nil || wait == 0 {
+			return err
+		}
+		glog.V(2).Infof("node rate limit of %g requests per second reached, waiting %s", qps, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// rateLimitSender returns sender waiting for a token of the node token bucket before each request,
+// retries included, so the mounts of a node with many pods don't trip the throttling of Key Vault
+func (adapter *KeyvaultFlexvolumeAdapter) rateLimitSender(sender autorest.Sender) (autorest.Sender, error) {
+	options := adapter.options
+	if err := os.MkdirAll(options.stateDir, dirPermission); err != nil {
+		return nil, errors.Wrapf(err, "failed to create state directory %s", options.stateDir)
+	}
+	fileName := filepath.Join(options.stateDir, rateLimitFileName)
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		if err := waitToken(req.Context(), fileName, options.rateLimitQPS, options.rateLimitBurst); err != nil {
+			return nil, err
+		}
+		return sender.Do(req)
+	}), nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// retryPolicy is the retry policy of the requests to Key Vault, overridable per volume
+type retryPolicy struct {
+	// retries after the first attempt
+	attempts int
+	// delay before the first retry, doubled for each retry
+	initialBackoff time.Duration
+	// maximum delay between retries, 0 for no maximum
+	maxBackoff time.Duration
+	// maximum time spent retrying a request, 0 for no deadline
+	deadline time.Duration
+}
+
+// retrySender returns sender retrying requests failed with a temporary network error or a
+// retriable status code according to the retry policy of the volume. The retries of the Key Vault
+// client must be disabled, and once retries are exhausted the last response is returned with an
+// error so they don't resume.
+func (adapter *KeyvaultFlexvolumeAdapter) retrySender(sender autorest.Sender) autorest.Sender {
+	options := adapter.options
+	policy := retryPolicy{
+		attempts:       options.retryAttempts,
+		initialBackoff: options.retryInitialBackoff,
+		maxBackoff:     options.retryMaxBackoff,
+		deadline:       options.retryDeadline,
+	}
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		rr := autorest.NewRetriableRequest(req)
+		start := time.Now()
+		backoff := policy.initialBackoff
+		for attempt := 0; ; attempt++ {
+			if err := rr.Prepare(); err != nil {
+				return nil, err
+			}
+			resp, err := sender.Do(rr.Request())
+			if !isRetriable(resp, err) {
+				return resp, err
+			}
+			reason := describeFailure(resp, err)
+			failed := "failed"
+			if isThrottled(resp) {
+				// throttling is reported distinctly, as it calls for spreading mounts rather than fixing them
+				failed = "throttled"
+				reason = "vault throttled the request, " + reason
+			}
+
+			delay := backoff
+			if policy.maxBackoff > 0 && delay > policy.maxBackoff {
+				delay = policy.maxBackoff
+			}
+			// the delay requested by the vault is honored over the backoff, the deadline still applies
+			requested, hasRetryAfter := retryAfter(resp)
+			if hasRetryAfter {
+				delay = requested
+			}
+			if attempt >= policy.attempts {
+				return resp, errors.Errorf("giving up on %s after %d attempts: %s", req.URL.Host, attempt+1, reason)
+			}
+			if policy.deadline > 0 && time.Since(start)+delay > policy.deadline {
+				return resp, errors.Errorf("giving up on %s after %d attempts, retry deadline of %s exceeded: %s", req.URL.Host, attempt+1, policy.deadline, reason)
+			}
+			if hasRetryAfter {
+				glog.Warningf("request to %s %s: %s, retrying in %s as requested by Retry-After (attempt %d of %d)", req.URL.Host, failed, reason, delay, attempt+1, policy.attempts+1)
+			} else {
+				glog.Warningf("request to %s %s: %s, retrying in %s (attempt %d of %d)", req.URL.Host, failed, reason, delay, attempt+1, policy.attempts+1)
+			}
+			if resp != nil {
+				autorest.Respond(resp, autorest.ByDiscardingBody(), autorest.ByClosing())
+			}
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			backoff *= 2
+		}
+	})
+}
+
+// isRetriable returns whether a request failed with a temporary network error or a status code
+// worth retrying
+func isRetriable(resp *http.Response, err error) bool {
+	if err != nil {
+		return autorest.IsTemporaryNetworkError(err)
+	}
+	return autorest.ResponseHasStatusCode(resp, autorest.StatusCodesForRetry...)
+}
+
+// isThrottled returns whether a request was throttled by the vault
+func isThrottled(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != ""))
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a throttled or unavailable
+// response, in seconds or as an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		delay := time.Until(at)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// describeFailure returns the status or the error of a failed request
+func describeFailure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
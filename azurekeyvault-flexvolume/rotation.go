@@ -0,0 +1,286 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// rotationDir holds the registration of each volume refreshed by the rotation daemon,
+	// relative to stateDir
+	rotationDir = "rotation"
+	// defaultPollInterval is the period the rotation daemon refreshes the volumes at by default
+	defaultPollInterval = 2 * time.Minute
+	// minRotationPollInterval is the shortest period a volume can be refreshed at, to protect
+	// the throughput of the vault
+	minRotationPollInterval = time.Minute
+	// rotationScanInterval is the period the rotation daemon looks for the volumes due for a
+	// refresh at, bounding how late they are refreshed
+	rotationScanInterval = 15 * time.Second
+	// expiryRefreshInterval is the period volumes with certificates expiring within their
+	// rotationExpiryWindow are refreshed at, until a renewed certificate is mounted
+	expiryRefreshInterval = 5 * time.Minute
+	// refreshTimeout bounds the refresh of a volume, so a hung vault doesn't stop the rotation of
+	// the other volumes
+	refreshTimeout = 5 * time.Minute
+	// rotationHeartbeatFile is touched by the rotation daemon as it runs, relative to rotationDir
+	rotationHeartbeatFile = ".daemon"
+	// rotationHeartbeatTimeout is the age of the heartbeat after which mounts consider the
+	// rotation daemon isn't running, longer than a refresh
+	rotationHeartbeatTimeout = 3 * refreshTimeout
+)
+
+// rotationRegistration is a volume refreshed by the rotation daemon: the mount is run again
+// with the same arguments, which keeps the unchanged files and atomically replaces the others
+type rotationRegistration struct {
+	Dir  string   `json:"dir"`
+	Args []string `json:"args"`
+	// the period of the refreshes of the volume, the -pollInterval of the daemon if 0
+	PollInterval time.Duration `json:"pollInterval,omitempty"`
+	// certificates expiring within this window are refreshed every expiryRefreshInterval
+	ExpiryWindow time.Duration `json:"expiryWindow,omitempty"`
+}
+
+// registrationFile returns the registration file of the volume at dir
+func registrationFile(stateDir string, dir string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(dir)))
+	return filepath.Join(stateDir, rotationDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// registerRotation registers the volume mounted with args for the rotation daemon. Secrets can't
+// be passed inline with -rotation, still only root can read the registration.
+func registerRotation(options Option, args []string) error {
+	dir := filepath.Join(options.stateDir, rotationDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create rotation directory %s", dir)
+	}
+	content, err := json.Marshal(rotationRegistration{Dir: options.dir, Args: args, PollInterval: options.rotationPollInterval, ExpiryWindow: options.rotationExpiryWindow})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal rotation registration")
+	}
+	fileName := registrationFile(options.stateDir, options.dir)
+	file, err := ioutil.TempFile(dir, ".registration")
+	if err != nil {
+		return errors.Wrapf(err, "failed to register %s for rotation", options.dir)
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.Wrapf(err, "failed to register %s for rotation", options.dir)
+	}
+	glog.V(2).Infof("registered %s for rotation", options.dir)
+	if !rotationDaemonRunning(options.stateDir) {
+		glog.Warningf("the rotation daemon isn't running on the node, %s won't be refreshed until it is started with systemctl enable --now azurekeyvault-flexvolume-rotation.service", options.dir)
+	}
+	return nil
+}
+
+// touchHeartbeat records that the rotation daemon is running
+func touchHeartbeat(stateDir string) {
+	dir := filepath.Join(stateDir, rotationDir)
+	fileName := filepath.Join(dir, rotationHeartbeatFile)
+	now := time.Now()
+	err := os.Chtimes(fileName, now, now)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, 0700); err == nil {
+			err = ioutil.WriteFile(fileName, nil, 0600)
+		}
+	}
+	if err != nil {
+		glog.Warningf("failed to touch the heartbeat of the rotation daemon %s: %s", fileName, err)
+	}
+}
+
+// rotationDaemonRunning returns whether the rotation daemon touched its heartbeat recently
+func rotationDaemonRunning(stateDir string) bool {
+	info, err := os.Stat(filepath.Join(stateDir, rotationDir, rotationHeartbeatFile))
+	return err == nil && time.Since(info.ModTime()) < rotationHeartbeatTimeout
+}
+
+// unregisterRotation removes the registration of the volume at dir, if any
+func unregisterRotation(stateDir string, dir string) {
+	if err := os.Remove(registrationFile(stateDir, dir)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to unregister %s from rotation: %s", dir, err)
+	}
+}
+
+// runRotate refreshes the registered volumes every -pollInterval, or their own
+// rotationPollInterval, so objects rotated in Key Vault reach running pods without restarting them.
+// With -eventGridAddress, the volumes are also refreshed as soon as Key Vault notifies a new
+// version of one of their objects, and the files deleted or modified on the node are restored
+// every -verifyInterval. It runs as a daemon on each node, or once with -once.
+func runRotate(ctx context.Context, args []string) error {
+	fs := newFlagSet("rotate")
+	stateDir := fs.String("stateDir", defaultStateDir, "Directory of the state kept on the node across mounts, holding the volumes registered for rotation.")
+	pollInterval := fs.Duration("pollInterval", defaultPollInterval, "Period the registered volumes without rotationPollInterval are refreshed at.")
+	once := fs.Bool("once", false, "Refresh the registered volumes once and exit.")
+	verifyInterval := fs.Duration("verifyInterval", defaultVerifyInterval, "Period the files of the registered volumes are checked against the sha256 of their manifest at, the volumes whose files were deleted or modified on the node being mounted again. 0 to not check them.")
+	var listener eventGridListener
+	fs.StringVar(&listener.address, "eventGridAddress", "", "Address to receive the Key Vault events of an Event Grid webhook subscription on, e.g. :8443, to refresh volumes as soon as their objects have a new version. Empty to only poll.")
+	fs.StringVar(&listener.certFile, "eventGridTLSCertFile", "", "PEM certificate of the -eventGridAddress listener, Event Grid only delivering to https endpoints.")
+	fs.StringVar(&listener.keyFile, "eventGridTLSKeyFile", "", "PEM private key of -eventGridTLSCertFile.")
+	fs.StringVar(&listener.secretFile, "eventGridSecretFile", "", "File of the secret the endpoint of the subscription must pass as its code query parameter.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *pollInterval <= 0 {
+		return errors.Errorf("-pollInterval is invalid, must be positive")
+	}
+	if *verifyInterval < 0 {
+		return errors.Errorf("-verifyInterval is invalid, must be positive")
+	}
+	events := make(chan keyVaultEvent, eventGridQueueSize)
+	if listener.address != "" && !*once {
+		if err := listener.start(events); err != nil {
+			return err
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find the driver executable")
+	}
+
+	glog.V(0).Infof("refreshing the volumes registered in %s every %s by default", filepath.Join(*stateDir, rotationDir), *pollInterval)
+	// the last refresh attempt of each registration, failed refreshes not being retried before
+	// their interval
+	attempts := make(map[string]time.Time)
+	preflights := make(map[string]volumePreflight)
+	var verified time.Time
+	for {
+		touchHeartbeat(*stateDir)
+		refreshVolumes(ctx, executable, *stateDir, *pollInterval, attempts, preflights, func(rotationRegistration) bool { return *once })
+		if *verifyInterval > 0 && time.Since(verified) >= *verifyInterval {
+			verifyVolumes(ctx, executable, *stateDir, preflights)
+			verified = time.Now()
+		}
+		if *once {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-events:
+			glog.V(0).Infof("%s %s of vault %s has a new version %s", event.ObjectType, event.ObjectName, event.VaultName, event.Version)
+			refreshVolumes(ctx, executable, *stateDir, *pollInterval, attempts, preflights, event.mountedBy)
+		case <-time.After(rotationScanInterval):
+		}
+	}
+}
+
+// refreshVolumes runs the mount of each registered volume due for a refresh again with -refresh,
+// or for which force returns true, dropping the registrations of the volumes removed without being
+// unmounted by the driver. A successful refresh touches the registration of the volume, so its
+// modification time is the time of its last refresh. The Kubernetes features the volume isn't
+// allowed are disabled for the refresh.
+func refreshVolumes(ctx context.Context, executable string, stateDir string, pollInterval time.Duration, attempts map[string]time.Time, preflights map[string]volumePreflight, force func(rotationRegistration) bool) {
+	fileNames, err := filepath.Glob(filepath.Join(stateDir, rotationDir, "*.json"))
+	if err != nil {
+		glog.Warningf("failed to list the volumes registered for rotation: %s", err)
+		return
+	}
+	for _, fileName := range fileNames {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			continue
+		}
+		registration, err := readRegistration(fileName)
+		if err != nil {
+			glog.Warningf("%s", err)
+			continue
+		}
+		if _, err := os.Stat(registration.Dir); os.IsNotExist(err) {
+			glog.V(0).Infof("%s no longer exists, unregistering it from rotation", registration.Dir)
+			os.Remove(fileName)
+			delete(attempts, fileName)
+			delete(preflights, fileName)
+			continue
+		}
+		disable := preflightVolume(ctx, preflights, fileName, registration)
+		interval := pollInterval
+		if registration.PollInterval > 0 {
+			interval = registration.PollInterval
+		}
+		last := info.ModTime()
+		if attempts[fileName].After(last) {
+			last = attempts[fileName]
+		}
+		expiring := registration.ExpiryWindow > 0 && time.Since(last) >= expiryRefreshInterval && len(expiringCertificates(registration)) > 0
+		if !force(registration) && !expiring && time.Since(last) < interval {
+			continue
+		}
+		attempts[fileName] = time.Now()
+		touchHeartbeat(stateDir)
+		args := append(append([]string{"-refresh"}, registration.Args...), disable...)
+		if err = runMountCommand(ctx, executable, args); err != nil {
+			glog.Warningf("failed to refresh %s: %s", registration.Dir, err)
+			continue
+		}
+		glog.V(2).Infof("refreshed %s", registration.Dir)
+	}
+}
+
+// readRegistration reads the rotation registration of fileName
+func readRegistration(fileName string) (rotationRegistration, error) {
+	var registration rotationRegistration
+	content, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		err = json.Unmarshal(content, &registration)
+	}
+	if err != nil {
+		return registration, errors.Wrapf(err, "failed to read rotation registration %s", fileName)
+	}
+	return registration, nil
+}
+
+// runMountCommand runs the mount command of the driver with args, within refreshTimeout
+func runMountCommand(ctx context.Context, executable string, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, executable, append([]string{"mount"}, args...)...).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// expiringCertificates returns the certificates written by the last mount of the volume of
+// registration expiring within its expiry window, according to its manifest, logging an alert for
+// each, so a certificate renewed in Key Vault reaches the pod before it expires whatever the poll
+// interval
+func expiringCertificates(registration rotationRegistration) []manifestObject {
+	manifest, err := readManifest(registration.Dir)
+	if err != nil {
+		return nil
+	}
+	var expiring []manifestObject
+	for _, object := range manifest.Objects {
+		notAfter, ok := parseTimestamp(object.NotAfter)
+		if !ok || time.Until(notAfter) >= registration.ExpiryWindow {
+			continue
+		}
+		glog.Warningf("%s %s (version: %s) of %s expires on %s, within the rotationExpiryWindow of %s, refreshing it", object.ObjectType, object.ObjectName, object.ObjectVersion, registration.Dir, notAfter.UTC().Format(time.RFC3339), registration.ExpiryWindow)
+		expiring = append(expiring, object)
+	}
+	return expiring
+}
@@ -0,0 +1,210 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Targets of the content hash annotation of rotated volumes
+const (
+	// RotationAnnotationPod annotates the pod of the volume
+	RotationAnnotationPod = "pod"
+	// RotationAnnotationDeployment annotates the pod, and the pod template of its Deployment once
+	// a rotation changes the volume, rolling the pods of the Deployment
+	RotationAnnotationDeployment = "deployment"
+	// RotationAnnotationRollout annotates the pod, and the pod template of its Argo Rollout once a
+	// rotation changes the volume, so the rotation goes through the steps and analysis of the
+	// Rollout like a release
+	RotationAnnotationRollout = "rollout"
+	// RotationAnnotationCanary annotates the pod, and the pod template of the Deployment targeted
+	// by the Flagger Canary of its primary Deployment once a rotation changes the volume, so the
+	// rotation goes through the analysis of the Canary like a release
+	RotationAnnotationCanary = "canary"
+)
+
+const (
+	// contentHashAnnotation is the annotation holding the hash of the objects of the volume
+	contentHashAnnotation = "azurekeyvault-flexvolume/content-hash"
+	// objectVersionsAnnotation is the annotation holding the versions of the objects of the
+	// volume by file name, e.g. for the analysis of a rollout to tell the rotated objects
+	objectVersionsAnnotation = "azurekeyvault-flexvolume/object-versions"
+)
+
+// k8sOwnedObject is the subset of a Kubernetes object read to annotate rotations
+type k8sOwnedObject struct {
+	Metadata struct {
+		Annotations     map[string]string `json:"annotations"`
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+}
+
+// flaggerCanary is the subset of a Flagger Canary read to find the Deployment it promotes
+type flaggerCanary struct {
+	Spec struct {
+		TargetRef struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"targetRef"`
+	} `json:"spec"`
+}
+
+// owner returns the name of the owner of kind of the object, if any
+func (object k8sOwnedObject) owner(kind string) string {
+	for _, reference := range object.Metadata.OwnerReferences {
+		if reference.Kind == kind {
+			return reference.Name
+		}
+	}
+	return ""
+}
+
+// contentHash returns the SHA-256 of the file names, names and versions of the objects of the
+// volume. Files encoded by the driver, such as pfx files, change with their random salts, so the
+// hash only changes when an object gets a new version.
+func contentHash(versions []objectVersion) string {
+	sorted := make([]objectVersion, len(versions))
+	copy(sorted, versions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].FileName < sorted[j].FileName })
+	hash := sha256.New()
+	for _, object := range sorted {
+		for _, value := range []string{object.FileName, object.ObjectType, object.ObjectName, object.ObjectVersion} {
+			hash.Write([]byte(value))
+			hash.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// objectVersions returns the versions of the objects of the volume by file name, as JSON
+func objectVersions(versions []objectVersion) string {
+	byFileName := make(map[string]string, len(versions))
+	for _, object := range versions {
+		byFileName[object.FileName] = object.ObjectVersion
+	}
+	// maps are marshaled with sorted keys
+	content, _ := json.Marshal(byFileName)
+	return string(content)
+}
+
+// annotateRotation sets the content hash and the object versions of the volume on its pod, so
+// tools watching pods such as Reloader can restart them when a refresh changes the objects. With
+// -rotationAnnotation deployment, rollout or canary, a changed hash is also set on the pod
+// template of the workload of the pod, rolling its pods. Failures are only logged: the pod keeps
+// the previous hash, so the next refresh tries again.
+func (adapter *KeyvaultFlexvolumeAdapter) annotateRotation(versions []objectVersion) {
+	if err := adapter.setContentHash(contentHash(versions), objectVersions(versions)); err != nil {
+		glog.Warningf("failed to annotate the rotation of %s: %s", adapter.options.dir, err)
+	}
+}
+
+// setContentHash sets hash and versions on the pod, and on its workload if the pod had another
+// hash
+func (adapter *KeyvaultFlexvolumeAdapter) setContentHash(hash string, versions string) error {
+	options := adapter.options
+	request, err := adapter.newK8sRequester()
+	if err != nil {
+		return err
+	}
+	podURL := request.url("/api/v1/namespaces/%s/pods/%s", options.podNamespace, options.podName)
+	var pod k8sOwnedObject
+	status, err := request.do(http.MethodGet, podURL, nil, &pod)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read pod %s/%s", options.podNamespace, options.podName)
+	}
+	if status == http.StatusForbidden {
+		return errors.Errorf("failed to read pod %s/%s: rotation annotations aren't allowed in namespace %s, see kv-flexvol-rotation-annotation.yaml", options.podNamespace, options.podName, options.podNamespace)
+	}
+	if status != http.StatusOK {
+		return errors.Errorf("failed to read pod %s/%s: unexpected status %d", options.podNamespace, options.podName, status)
+	}
+	previous := pod.Metadata.Annotations[contentHashAnnotation]
+	if previous == hash {
+		return nil
+	}
+	annotations := map[string]interface{}{"annotations": map[string]string{contentHashAnnotation: hash, objectVersionsAnnotation: versions}}
+	if err = request.expect(http.StatusOK, http.MethodPatch, podURL, map[string]interface{}{"metadata": annotations}, nil); err != nil {
+		return errors.Wrapf(err, "failed to annotate pod %s/%s", options.podNamespace, options.podName)
+	}
+	glog.V(0).Infof("annotated pod %s/%s with %s %s", options.podNamespace, options.podName, contentHashAnnotation, hash)
+	// the first mount of a pod only records the hash
+	if options.rotationAnnotation == RotationAnnotationPod || previous == "" {
+		return nil
+	}
+
+	kind, name, workloadURL, err := adapter.rotationWorkload(request, pod)
+	if err != nil {
+		return err
+	}
+	// the pods of the workload patch it with the same hash, rolling it once
+	patch := map[string]interface{}{"spec": map[string]interface{}{"template": map[string]interface{}{"metadata": annotations}}}
+	status, err = request.do(http.MethodPatch, workloadURL, patch, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to annotate %s %s/%s", kind, options.podNamespace, name)
+	}
+	if status == http.StatusForbidden {
+		return errors.Errorf("failed to annotate %s %s/%s: %s isn't in the resourceNames of the rotation annotation Role of namespace %s, see kv-flexvol-rotation-annotation.yaml", kind, options.podNamespace, name, name, options.podNamespace)
+	}
+	if status != http.StatusOK {
+		return errors.Errorf("failed to annotate %s %s/%s: unexpected status %d", kind, options.podNamespace, name, status)
+	}
+	glog.V(0).Infof("annotated the pod template of %s %s/%s with %s %s", kind, options.podNamespace, name, contentHashAnnotation, hash)
+	return nil
+}
+
+// rotationWorkload returns the kind, name and URL of the workload whose pod template is annotated
+// for the pod with -rotationAnnotation: the Deployment or the Argo Rollout owning its ReplicaSet,
+// or with canary the Deployment targeted by the Flagger Canary owning the primary Deployment of
+// the pod. The pods of the target Deployment, run by Flagger during the analysis, annotate it
+// themselves.
+func (adapter *KeyvaultFlexvolumeAdapter) rotationWorkload(request *k8sRequester, pod k8sOwnedObject) (string, string, string, error) {
+	options := adapter.options
+	replicaSetName := pod.owner("ReplicaSet")
+	if replicaSetName == "" {
+		return "", "", "", errors.Errorf("pod %s/%s isn't owned by a ReplicaSet", options.podNamespace, options.podName)
+	}
+	var replicaSet k8sOwnedObject
+	if err := request.expect(http.StatusOK, http.MethodGet, request.url("/apis/apps/v1/namespaces/%s/replicasets/%s", options.podNamespace, replicaSetName), nil, &replicaSet); err != nil {
+		return "", "", "", errors.Wrapf(err, "failed to read ReplicaSet %s/%s", options.podNamespace, replicaSetName)
+	}
+	if options.rotationAnnotation == RotationAnnotationRollout {
+		rolloutName := replicaSet.owner("Rollout")
+		if rolloutName == "" {
+			return "", "", "", errors.Errorf("ReplicaSet %s/%s isn't owned by a Rollout", options.podNamespace, replicaSetName)
+		}
+		return "Rollout", rolloutName, request.url("/apis/argoproj.io/v1alpha1/namespaces/%s/rollouts/%s", options.podNamespace, rolloutName), nil
+	}
+	deploymentName := replicaSet.owner("Deployment")
+	if deploymentName == "" {
+		return "", "", "", errors.Errorf("ReplicaSet %s/%s isn't owned by a Deployment", options.podNamespace, replicaSetName)
+	}
+	if options.rotationAnnotation == RotationAnnotationCanary {
+		var deployment k8sOwnedObject
+		if err := request.expect(http.StatusOK, http.MethodGet, request.url("/apis/apps/v1/namespaces/%s/deployments/%s", options.podNamespace, deploymentName), nil, &deployment); err != nil {
+			return "", "", "", errors.Wrapf(err, "failed to read Deployment %s/%s", options.podNamespace, deploymentName)
+		}
+		if canaryName := deployment.owner("Canary"); canaryName != "" {
+			var canary flaggerCanary
+			if err := request.expect(http.StatusOK, http.MethodGet, request.url("/apis/flagger.app/v1beta1/namespaces/%s/canaries/%s", options.podNamespace, canaryName), nil, &canary); err != nil {
+				return "", "", "", errors.Wrapf(err, "failed to read Canary %s/%s", options.podNamespace, canaryName)
+			}
+			if canary.Spec.TargetRef.Kind != "Deployment" || canary.Spec.TargetRef.Name == "" {
+				return "", "", "", errors.Errorf("Canary %s/%s doesn't target a Deployment", options.podNamespace, canaryName)
+			}
+			deploymentName = canary.Spec.TargetRef.Name
+		}
+	}
+	return "Deployment", deploymentName, request.url("/apis/apps/v1/namespaces/%s/deployments/%s", options.podNamespace, deploymentName), nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+)
+
+// testVault serves the certificate secret tls of a vault, at the version set
+type testVault struct {
+	*httptest.Server
+	version string
+	pem     string
+}
+
+func newTestVault(t *testing.T) *testVault {
+	vault := &testVault{}
+	vault.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/secrets/tls") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"value":       vault.pem,
+			"contentType": contentTypePEM,
+			"id":          vault.URL + "/secrets/tls/" + vault.version,
+			"kid":         vault.URL + "/keys/tls/" + vault.version,
+		})
+	}))
+	t.Cleanup(vault.Close)
+	return vault
+}
+
+// rotate sets a new version of tls, with a new certificate
+func (vault *testVault) rotate(t *testing.T, version string) {
+	t.Helper()
+	cert := testCertificate(t, "tls")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.version = version
+	vault.pem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.certificate.Raw})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+}
+
+func TestContentHashRefresh(t *testing.T) {
+	vault := newTestVault(t)
+	vault.rotate(t, "v1")
+	adapter := testAdapter(t, "-rotation=true")
+	adapter.ctx = context.Background()
+	kvClient := kv.New()
+	object := KeyVaultObject{ObjectName: "tls", ObjectType: VaultTypeCertificate, ObjectFormat: ObjectFormatPFX}
+	// a refresh fetches the object, and hashes the versions of the volume
+	refresh := func() (*fetchedObject, string) {
+		t.Helper()
+		fetched, err := adapter.fetchPFX(&kvClient, vault.URL, object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions := []objectVersion{{ObjectName: object.ObjectName, ObjectType: object.ObjectType, FileName: object.fileName(), ObjectVersion: fetched.version}}
+		return fetched, contentHash(versions)
+	}
+
+	first, hash := refresh()
+	second, refreshedHash := refresh()
+	if refreshedHash != hash {
+		t.Errorf("content hash changed from %s to %s without a new version", hash, refreshedHash)
+	}
+	if !bytes.Equal(second.content, first.content) || !bytes.Equal(second.files[object.pfxPasswordFileName()], first.files[object.pfxPasswordFileName()]) {
+		t.Errorf("refresh without a new version encoded the pfx again")
+	}
+
+	vault.rotate(t, "v2")
+	if _, rotatedHash := refresh(); rotatedHash == hash {
+		t.Errorf("content hash %s didn't change with a new version", hash)
+	}
+}
+
+func TestSetContentHashWorkload(t *testing.T) {
+	// the objects of the API server by path, owned as Argo Rollouts and Flagger Canaries own them
+	objects := map[string]string{
+		"/api/v1/namespaces/default/pods/nginx":                       `{"metadata":{"annotations":{"azurekeyvault-flexvolume/content-hash":"old"},"ownerReferences":[{"kind":"ReplicaSet","name":"nginx-1234"}]}}`,
+		"/apis/apps/v1/namespaces/default/replicasets/nginx-1234":     `{"metadata":{"ownerReferences":[{"kind":"Deployment","name":"nginx-primary"}]}}`,
+		"/apis/apps/v1/namespaces/default/deployments/nginx-primary":  `{"metadata":{"ownerReferences":[{"kind":"Canary","name":"nginx"}]}}`,
+		"/apis/flagger.app/v1beta1/namespaces/default/canaries/nginx": `{"spec":{"targetRef":{"apiVersion":"apps/v1","kind":"Deployment","name":"nginx"}}}`,
+		"/api/v1/namespaces/default/pods/rollout":                     `{"metadata":{"annotations":{"azurekeyvault-flexvolume/content-hash":"old"},"ownerReferences":[{"kind":"ReplicaSet","name":"rollout-1234"}]}}`,
+		"/apis/apps/v1/namespaces/default/replicasets/rollout-1234":   `{"metadata":{"ownerReferences":[{"kind":"Rollout","name":"rollout"}]}}`,
+	}
+	var patched []string
+	var annotations map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			var patch struct {
+				Metadata map[string]map[string]string `json:"metadata"`
+				Spec     struct {
+					Template struct {
+						Metadata map[string]map[string]string `json:"metadata"`
+					} `json:"template"`
+				} `json:"spec"`
+			}
+			json.NewDecoder(r.Body).Decode(&patch)
+			if patch.Metadata != nil {
+				annotations = patch.Metadata["annotations"]
+			}
+			patched = append(patched, r.URL.Path)
+			w.Write([]byte("{}"))
+			return
+		}
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(object))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	versions := objectVersions([]objectVersion{{FileName: "tls", ObjectVersion: "v2"}, {FileName: "db", ObjectVersion: "v1"}})
+
+	tests := []struct {
+		mode    string
+		pod     string
+		want    []string
+		wantErr string
+	}{
+		{mode: RotationAnnotationPod, pod: "nginx", want: []string{"/api/v1/namespaces/default/pods/nginx"}},
+		{mode: RotationAnnotationDeployment, pod: "nginx", want: []string{"/api/v1/namespaces/default/pods/nginx", "/apis/apps/v1/namespaces/default/deployments/nginx-primary"}},
+		{mode: RotationAnnotationCanary, pod: "nginx", want: []string{"/api/v1/namespaces/default/pods/nginx", "/apis/apps/v1/namespaces/default/deployments/nginx"}},
+		{mode: RotationAnnotationRollout, pod: "rollout", want: []string{"/api/v1/namespaces/default/pods/rollout", "/apis/argoproj.io/v1alpha1/namespaces/default/rollouts/rollout"}},
+		{mode: RotationAnnotationRollout, pod: "nginx", want: []string{"/api/v1/namespaces/default/pods/nginx"}, wantErr: "ReplicaSet default/nginx-1234 isn't owned by a Rollout"},
+		{mode: RotationAnnotationDeployment, pod: "rollout", want: []string{"/api/v1/namespaces/default/pods/rollout"}, wantErr: "ReplicaSet default/rollout-1234 isn't owned by a Deployment"},
+	}
+	for _, test := range tests {
+		patched, annotations = nil, nil
+		adapter := testAdapter(t, "-rotation=true", "-rotationAnnotation="+test.mode, "-k8sAPIServer="+server.URL+"/", "-k8sTokenFile="+tokenFile, "-podNamespace=default", "-podName="+test.pod)
+		adapter.ctx = context.Background()
+		err := adapter.setContentHash("new", versions)
+		if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("%s %s: setContentHash() = %v, want %q", test.mode, test.pod, err, test.wantErr)
+		}
+		if !reflect.DeepEqual(patched, test.want) {
+			t.Errorf("%s %s: patched %q, want %q", test.mode, test.pod, patched, test.want)
+		}
+		if got := annotations[objectVersionsAnnotation]; got != `{"db":"v1","tls":"v2"}` {
+			t.Errorf("%s %s: %s = %s", test.mode, test.pod, objectVersionsAnnotation, got)
+		}
+	}
+}
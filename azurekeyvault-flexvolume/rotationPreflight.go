@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// k8sPreflightInterval is the period the rotation daemon checks the Kubernetes permissions of each
+// registered volume at, so features granted since the last check are enabled again
+const k8sPreflightInterval = time.Hour
+
+// volumePreflight is the last check of the Kubernetes permissions of a registered volume
+type volumePreflight struct {
+	checked time.Time
+	// flags disabling the features denied, appended to the arguments of the refreshes
+	disable []string
+}
+
+// preflightVolume returns the flags disabling the Kubernetes features the volume of registration,
+// registered in fileName, isn't allowed, checked on its first scan by the daemon, then every
+// k8sPreflightInterval
+func preflightVolume(ctx context.Context, preflights map[string]volumePreflight, fileName string, registration rotationRegistration) []string {
+	preflight, ok := preflights[fileName]
+	if !ok || time.Since(preflight.checked) >= k8sPreflightInterval {
+		preflight = volumePreflight{checked: time.Now(), disable: checkRegistrationAccess(ctx, registration)}
+		preflights[fileName] = preflight
+	}
+	return preflight.disable
+}
+
+// checkRegistrationAccess logs whether each Kubernetes feature of the volume of registration is
+// allowed, and returns the flags disabling those denied, so the refreshes keep updating the files
+// of the volume rather than failing on a feature. Nothing is disabled if the check fails.
+func checkRegistrationAccess(ctx context.Context, registration rotationRegistration) []string {
+	options, err := parseConfigs(registrationFlagSet(), registration.Args)
+	if err != nil {
+		glog.Warningf("failed to parse the registration of %s: %s", registration.Dir, err)
+		return nil
+	}
+	adapter := &KeyvaultFlexvolumeAdapter{ctx: ctx, options: *options}
+	accesses, err := adapter.checkK8sAccess()
+	if err != nil {
+		glog.Warningf("failed to check the Kubernetes permissions of %s: %s", registration.Dir, err)
+		return nil
+	}
+	var disable []string
+	for _, access := range accesses {
+		if len(access.denied) == 0 {
+			glog.V(0).Infof("%s in namespace %s: %s", registration.Dir, options.podNamespace, access)
+			continue
+		}
+		glog.Warningf("%s in namespace %s: %s, disabled for its refreshes until it is allowed", registration.Dir, options.podNamespace, access)
+		disable = append(disable, "-"+access.feature.flag+"=")
+	}
+	return disable
+}
+
+// ignoredFlag parses and discards the value of a flag
+type ignoredFlag struct {
+	isBool bool
+}
+
+func (f ignoredFlag) String() string   { return "" }
+func (f ignoredFlag) Set(string) error { return nil }
+func (f ignoredFlag) IsBoolFlag() bool { return f.isBool }
+
+// registrationFlagSet returns a flag set for the mount arguments of a registration, ignoring the
+// logging flags of the mount, which would otherwise change those of the daemon
+func registrationFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(program+" mount", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		fs.Var(ignoredFlag{isBool: ok && boolFlag.IsBoolFlag()}, f.Name, f.Usage)
+	})
+	return fs
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// podUIDFromDir returns the UID of the pod of the volume mounted at dir, from the kubelet path
+// <kubelet dir>/pods/<pod uid>/volumes/<driver>/<volume name>, or an empty string
+func podUIDFromDir(dir string) string {
+	elements := strings.Split(filepath.ToSlash(filepath.Clean(dir)), "/")
+	n := len(elements)
+	if n >= 5 && elements[n-3] == "volumes" && elements[n-5] == "pods" {
+		return elements[n-4]
+	}
+	return ""
+}
+
+// signalRotation sends -rotationSignal to the processes of the pod once a refresh mounted a new
+// version of an object, so servers such as nginx or envoy reload their certificates without a
+// restart. Failures are only logged, the files being already published.
+func (adapter *KeyvaultFlexvolumeAdapter) signalRotation() {
+	options := adapter.options
+	if options.rotationSignal == "" || len(adapter.rotated) == 0 {
+		return
+	}
+	podUID := podUIDFromDir(options.dir)
+	if podUID == "" {
+		glog.Warningf("%s isn't a volume of a pod, -rotationSignal isn't sent", options.dir)
+		return
+	}
+	signaled, err := signalPod(podUID, options.rotationSignal, options.rotationSignalProcess)
+	if err != nil {
+		glog.Warningf("failed to send %s to the processes of pod %s: %s", options.rotationSignal, podUID, err)
+		return
+	}
+	if signaled == 0 {
+		glog.V(2).Infof("no process of pod %s to send %s to", podUID, options.rotationSignal)
+		return
+	}
+	glog.V(0).Infof("sent %s to %d processes of pod %s", options.rotationSignal, signaled, podUID)
+}
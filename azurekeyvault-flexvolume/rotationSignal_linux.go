@@ -0,0 +1,119 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// signals that can be sent on rotation, by name without the SIG prefix
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal returns the signal named name, e.g. SIGHUP or HUP
+func parseSignal(name string) (syscall.Signal, error) {
+	signal, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, errors.Errorf("%s isn't a supported signal, e.g. SIGHUP, SIGUSR1 or SIGUSR2", name)
+	}
+	return signal, nil
+}
+
+// podProcess is a process of a pod on the node
+type podProcess struct {
+	pid  int
+	ppid int
+	comm string
+}
+
+// signalPod sends signal to the topmost processes of the pod podUID named processName, or to the
+// main process of each container of the pod if processName is empty, and returns how many were
+// signaled, none on the first mount of the pod as its containers aren't started yet. The processes of a pod are found by the cgroup of the pod, the pause container being
+// skipped.
+func signalPod(podUID string, name string, processName string) (int, error) {
+	signal, err := parseSignal(name)
+	if err != nil {
+		return 0, err
+	}
+	processes, err := podProcesses(podUID)
+	if err != nil {
+		return 0, err
+	}
+	candidates := make(map[int]bool)
+	for _, process := range processes {
+		if process.comm != "pause" && (processName == "" || process.comm == processName) {
+			candidates[process.pid] = true
+		}
+	}
+	signaled := 0
+	for _, process := range processes {
+		// workers of a server are signaled by their master
+		if !candidates[process.pid] || candidates[process.ppid] {
+			continue
+		}
+		if err = syscall.Kill(process.pid, signal); err != nil {
+			return signaled, errors.Wrapf(err, "failed to signal process %d (%s)", process.pid, process.comm)
+		}
+		signaled++
+	}
+	return signaled, nil
+}
+
+// podProcesses returns the processes in the cgroup of the pod podUID: kubepods/.../pod<uid> with
+// the cgroupfs driver, kubepods-...-pod<uid with underscores>.slice with the systemd driver
+func podProcesses(podUID string) ([]podProcess, error) {
+	cgroupNames := []string{"pod" + podUID, "pod" + strings.Replace(podUID, "-", "_", -1)}
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list processes")
+	}
+	var processes []podProcess
+	for _, dir := range dirs {
+		cgroup, err := ioutil.ReadFile(filepath.Join(dir, "cgroup"))
+		if err != nil || !containsAny(string(cgroup), cgroupNames) {
+			continue
+		}
+		// the command is in parentheses and may contain spaces, the parent pid follows the state
+		stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		start, end := strings.IndexByte(string(stat), '('), strings.LastIndexByte(string(stat), ')')
+		if start < 0 || end < start {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		pid, _ := strconv.Atoi(filepath.Base(dir))
+		ppid, _ := strconv.Atoi(fields[1])
+		processes = append(processes, podProcess{pid: pid, ppid: ppid, comm: string(stat[start+1 : end])})
+	}
+	return processes, nil
+}
+
+// containsAny returns whether s contains any of substrings
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// parseSignal fails, Windows processes can't be signaled
+func parseSignal(name string) (syscall.Signal, error) {
+	return 0, errors.New("signals aren't supported on Windows")
+}
+
+// signalPod fails, Windows processes can't be signaled
+func signalPod(podUID string, name string, processName string) (int, error) {
+	return 0, errors.New("signals aren't supported on Windows")
+}
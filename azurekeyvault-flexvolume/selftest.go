@@ -0,0 +1,158 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// selftestDialTimeout bounds the connection to the identity endpoints
+const selftestDialTimeout = 5 * time.Second
+
+// selftestCheck is a check of the node run by selftest, skipped when it returns errSkipped
+type selftestCheck struct {
+	name  string
+	check func() error
+}
+
+var errSkipped = errors.New("skipped")
+
+// runSelftest checks the node can run the driver for the given volume options, without
+// authenticating or fetching objects: tmpfs support, state directory, Azure environment,
+// resolution of the endpoints and permissions of the Kubernetes features
+func runSelftest(ctx context.Context, args []string) error {
+	options, err := parseConfigs(newFlagSet("selftest"), args)
+	if err != nil {
+		return err
+	}
+
+	checks := []selftestCheck{
+		{"tmpfs", func() error {
+			if runtime.GOOS == "windows" {
+				return errSkipped
+			}
+			filesystems, err := ioutil.ReadFile("/proc/filesystems")
+			if err != nil {
+				return err
+			}
+			if !bytes.Contains(filesystems, []byte("\ttmpfs\n")) {
+				return errors.New("tmpfs is not supported by the kernel")
+			}
+			return nil
+		}},
+		{"state directory", func() error {
+			if options.stateDir == "" {
+				return errSkipped
+			}
+			if err := os.MkdirAll(options.stateDir, dirPermission); err != nil {
+				return err
+			}
+			file, err := ioutil.TempFile(options.stateDir, "selftest")
+			if err != nil {
+				return err
+			}
+			file.Close()
+			return os.Remove(file.Name())
+		}},
+		{"azure environment", func() error {
+			_, err := ParseAzureEnvironment(options.cloudName)
+			return err
+		}},
+		{"active directory endpoint", func() error {
+			env, err := ParseAzureEnvironment(options.cloudName)
+			if err != nil {
+				return errSkipped
+			}
+			endpoint, err := GetActiveDirectoryEndpoint(env, options.aADRegion)
+			if err != nil {
+				return err
+			}
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				return err
+			}
+			_, err = net.LookupHost(u.Hostname())
+			return err
+		}},
+		{"key vault endpoint", func() error {
+			if options.vaultName == "" && options.vaultURI == "" {
+				return errSkipped
+			}
+			host, err := vaultHost(*options)
+			if err != nil {
+				return errSkipped
+			}
+			_, err = net.LookupHost(host)
+			return err
+		}},
+		{"kubernetes permissions", func() error {
+			adapter := &KeyvaultFlexvolumeAdapter{ctx: ctx, options: *options}
+			accesses, err := adapter.checkK8sAccess()
+			if err != nil {
+				return err
+			}
+			if len(accesses) == 0 {
+				return errSkipped
+			}
+			var denied []string
+			for _, access := range accesses {
+				if len(access.denied) > 0 {
+					denied = append(denied, access.String())
+				}
+			}
+			if len(denied) > 0 {
+				return errors.New(strings.Join(denied, "; "))
+			}
+			return nil
+		}},
+		{"identity endpoint", func() error {
+			switch {
+			case options.usePodIdentity:
+				return dialCheck(net.JoinHostPort("127.0.0.1", options.nmiPort))
+			case options.useVmManagedIdentity:
+				return dialCheck("169.254.169.254:80")
+			default:
+				return errSkipped
+			}
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		switch err := c.check(); err {
+		case nil:
+			fmt.Printf("ok    %s\n", c.name)
+		case errSkipped:
+			fmt.Printf("skip  %s\n", c.name)
+		default:
+			failed++
+			fmt.Printf("FAIL  %s: %s\n", c.name, err)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// dialCheck checks a TCP connection can be opened to address
+func dialCheck(address string) error {
+	conn, err := net.DialTimeout("tcp", address, selftestDialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,24 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"strings"
+)
+
+// validSELinuxContext returns whether context has the user:role:type:level form of SELinux contexts,
+// the level possibly having categories, e.g. system_u:object_r:container_file_t:s0:c123,c456
+func validSELinuxContext(context string) bool {
+	parts := strings.SplitN(context, ":", 4)
+	if len(parts) != 4 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// seLinuxXattr is the extended attribute holding the SELinux context of a file
+const seLinuxXattr = "security.selinux"
+
+// labelFiles sets the SELinux context of dir and of the files and directories in it to
+// -seLinuxContext, so containers of SELinux enforcing nodes can read the files of the volume.
+// Nothing is done if dir already has the context, e.g. the tmpfs being mounted with it, which also
+// labels the symlinks of atomic writes.
+func (adapter *KeyvaultFlexvolumeAdapter) labelFiles(dir string) error {
+	context := adapter.options.seLinuxContext
+	if context == "" {
+		return nil
+	}
+	current := make([]byte, 256)
+	if size, err := syscall.Getxattr(dir, seLinuxXattr, current); err == nil && strings.TrimRight(string(current[:size]), "\x00") == context {
+		return nil
+	}
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// setting the context of a symlink would set the one of its target
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if err := syscall.Setxattr(filePath, seLinuxXattr, []byte(context), 0); err != nil {
+			return errors.Wrapf(err, "failed to set SELinux context of %s", filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	glog.V(0).Infof("set SELinux context of %s to %s", dir, context)
+	return nil
+}
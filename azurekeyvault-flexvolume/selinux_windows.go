@@ -0,0 +1,17 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// labelFiles fails with -seLinuxContext, Windows having no SELinux
+func (adapter *KeyvaultFlexvolumeAdapter) labelFiles(dir string) error {
+	if adapter.options.seLinuxContext == "" {
+		return nil
+	}
+	return errors.New("-seLinuxContext is not supported on Windows")
+}
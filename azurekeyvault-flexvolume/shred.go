@@ -0,0 +1,81 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// shredBlockSize is the size of the zeros written at once over the files shredded
+const shredBlockSize = 64 * 1024
+
+// shredFiles overwrites the content of the files in dir with zeros and removes them, so secrets
+// don't linger in memory or on disk once the volume is unmounted. Symlinks are removed without
+// following them. A missing dir, e.g. already cleaned up, isn't an error.
+func shredFiles(dir string) error {
+	var failed []string
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			if info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(filePath)
+			}
+			return nil
+		}
+		if err := shredFile(filePath, info.Size()); err != nil {
+			glog.Warningf("failed to shred %s: %s", filePath, err)
+			failed = append(failed, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to shred %s", dir)
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to shred %d files of %s", len(failed), dir)
+	}
+	return nil
+}
+
+// shredFile overwrites the size bytes of filePath with zeros, then removes it
+func shredFile(filePath string, size int64) error {
+	// the file may be read-only, e.g. with a filePermission of 0400
+	if err := os.Chmod(filePath, 0600); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, shredBlockSize)
+	for written := int64(0); written < size; {
+		n := size - written
+		if n > shredBlockSize {
+			n = shredBlockSize
+		}
+		if _, err = file.WriteAt(zeros[:n], written); err != nil {
+			file.Close()
+			return err
+		}
+		written += n
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
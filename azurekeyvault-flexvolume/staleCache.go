@@ -0,0 +1,365 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// staleCacheDir holds the last known good content of the objects mounted with
+	// -allowStaleOnError, encrypted, relative to stateDir
+	staleCacheDir = "cache"
+	// staleCacheKeyFile is the AES-256 key of the cache, generated on the node, relative to stateDir
+	staleCacheKeyFile = "cache.key"
+)
+
+// unavailableError is the error of a request that Key Vault or AAD didn't answer, answered with a
+// server error or throttled
+type unavailableError struct {
+	error
+}
+
+// isUnavailable returns true if err, or the error it wraps, is the error of a request that Key
+// Vault or AAD didn't serve
+func isUnavailable(err error) bool {
+	_, ok := errors.Cause(err).(unavailableError)
+	return ok
+}
+
+// isUnavailableResponse returns true if err is the error of a Key Vault request that got no
+// response, e.g. the vault can't be reached or no token could be requested, or a server error
+// or throttling once retries are exhausted
+func isUnavailableResponse(err error) bool {
+	detailed, ok := err.(autorest.DetailedError)
+	if !ok {
+		return false
+	}
+	status, _ := detailed.StatusCode.(int)
+	return status == autorest.UndefinedStatusCode || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// unavailableAuthorizer fails the requests of the Key Vault client with the error of the token,
+// so they are served from the cache when AAD or NMI is down
+type unavailableAuthorizer struct {
+	err error
+}
+
+// WithAuthorization returns a decorator failing the request
+func (authorizer unavailableAuthorizer) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			return r, authorizer.err
+		})
+	}
+}
+
+// cachedObject is an object as written to the volume, once transformed, cached on the node
+type cachedObject struct {
+	Content     []byte            `json:"content,omitempty"`
+	Version     string            `json:"version"`
+	Files       map[string][]byte `json:"files,omitempty"`
+	OmitContent bool              `json:"omitContent,omitempty"`
+	Certificate []byte            `json:"certificate,omitempty"`
+	// the PKCS#8 private key and DER chain of cert-key objects, for keystores
+	PrivateKey []byte            `json:"privateKey,omitempty"`
+	Chain      [][]byte          `json:"chain,omitempty"`
+	Attributes *cachedAttributes `json:"attributes,omitempty"`
+	FetchTime  time.Time         `json:"fetchTime"`
+}
+
+// cachedAttributes are the attributes of a cached object, for its metadata sidecar
+type cachedAttributes struct {
+	ContentType *string            `json:"contentType,omitempty"`
+	Tags        map[string]*string `json:"tags,omitempty"`
+	Enabled     *bool              `json:"enabled,omitempty"`
+	NotBefore   *date.UnixTime     `json:"notBefore,omitempty"`
+	Expires     *date.UnixTime     `json:"expires,omitempty"`
+	Created     *date.UnixTime     `json:"created,omitempty"`
+	Updated     *date.UnixTime     `json:"updated,omitempty"`
+}
+
+// staleCacheFile returns the cache file of object of the vault, which changes with any option of
+// the object so a cached object is always written the way it was configured
+func (adapter *KeyvaultFlexvolumeAdapter) staleCacheFile(vaultURL string, object KeyVaultObject) (string, error) {
+	content, err := json.Marshal(object)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to marshal %s %s", object.ObjectType, object.ObjectName)
+	}
+	sum := sha256.Sum256(append([]byte(vaultURL+"\x00"), content...))
+	return filepath.Join(adapter.options.stateDir, staleCacheDir, hex.EncodeToString(sum[:])), nil
+}
+
+// cacheObject caches fetched, encrypted with the key of the node, to serve it if the vault is
+// unavailable during a later mount. Failures are only logged, the object being mounted.
+func (adapter *KeyvaultFlexvolumeAdapter) cacheObject(vaultURL string, object KeyVaultObject, fetched *fetchedObject) {
+	if err := adapter.writeCachedObject(vaultURL, object, fetched); err != nil {
+		glog.Warningf("failed to cache %s %s: %s", object.ObjectType, object.ObjectName, err)
+	}
+}
+
+// writeCachedObject replaces the cache file of object atomically, as concurrent mounts may read it
+func (adapter *KeyvaultFlexvolumeAdapter) writeCachedObject(vaultURL string, object KeyVaultObject, fetched *fetchedObject) error {
+	cached := cachedObject{
+		Content:     fetched.content,
+		Version:     fetched.version,
+		Files:       fetched.files,
+		OmitContent: fetched.omitContent,
+		Certificate: fetched.certificate,
+		FetchTime:   time.Now().UTC(),
+	}
+	if secret := fetched.certSecret; secret != nil {
+		key, err := x509.MarshalPKCS8PrivateKey(secret.privateKey)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal private key")
+		}
+		cached.PrivateKey = key
+		if secret.certificate != nil {
+			cached.Chain = append(cached.Chain, secret.certificate.Raw)
+		}
+		for _, caCert := range secret.caCerts {
+			cached.Chain = append(cached.Chain, caCert.Raw)
+		}
+	}
+	if attributes := fetched.attributes; attributes != nil {
+		cached.Attributes = &cachedAttributes{
+			ContentType: attributes.contentType,
+			Tags:        attributes.tags,
+			Enabled:     attributes.enabled,
+			NotBefore:   attributes.notBefore,
+			Expires:     attributes.expires,
+			Created:     attributes.created,
+			Updated:     attributes.updated,
+		}
+	}
+	plaintext, err := json.Marshal(cached)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal cached object")
+	}
+	fileName, err := adapter.staleCacheFile(vaultURL, object)
+	if err != nil {
+		return err
+	}
+	return adapter.writeSealed(fileName, plaintext)
+}
+
+// writeSealed replaces fileName atomically with plaintext encrypted with the cache key of the
+// node, as concurrent mounts may read it
+func (adapter *KeyvaultFlexvolumeAdapter) writeSealed(fileName string, plaintext []byte) error {
+	aead, err := adapter.staleCacheCipher(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "failed to generate nonce")
+	}
+	// the name of the file is authenticated, so a file can't be swapped with another
+	ciphertext := aead.Seal(nonce, nonce, plaintext, []byte(filepath.Base(fileName)))
+
+	dir := filepath.Dir(fileName)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", dir)
+	}
+	file, err := ioutil.TempFile(dir, ".sealed")
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", fileName)
+	}
+	_, err = file.Write(ciphertext)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.Wrapf(err, "failed to write %s", fileName)
+	}
+	return nil
+}
+
+// readSealed returns the plaintext of a file written by writeSealed, the error of the read as is
+// if it doesn't exist
+func (adapter *KeyvaultFlexvolumeAdapter) readSealed(fileName string) ([]byte, error) {
+	ciphertext, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", fileName)
+	}
+	aead, err := adapter.staleCacheCipher(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.Errorf("%s is truncated", fileName)
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], []byte(filepath.Base(fileName)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt %s", fileName)
+	}
+	return plaintext, nil
+}
+
+// readCachedObject returns the object cached by the last mount that fetched it
+func (adapter *KeyvaultFlexvolumeAdapter) readCachedObject(vaultURL string, object KeyVaultObject) (*fetchedObject, time.Time, error) {
+	fileName, err := adapter.staleCacheFile(vaultURL, object)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	plaintext, err := adapter.readSealed(fileName)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, errors.New("it was never cached on the node")
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var cached cachedObject
+	if err = json.Unmarshal(plaintext, &cached); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "failed to parse %s", fileName)
+	}
+
+	fetched := &fetchedObject{
+		content:     cached.Content,
+		version:     cached.Version,
+		files:       cached.Files,
+		omitContent: cached.OmitContent,
+		certificate: cached.Certificate,
+	}
+	if cached.PrivateKey != nil {
+		secret := &certificateSecret{}
+		if secret.privateKey, err = x509.ParsePKCS8PrivateKey(cached.PrivateKey); err != nil {
+			return nil, time.Time{}, errors.Wrapf(err, "failed to parse the cached private key of %s", fileName)
+		}
+		for i, der := range cached.Chain {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, time.Time{}, errors.Wrapf(err, "failed to parse the cached chain of %s", fileName)
+			}
+			if i == 0 {
+				secret.certificate = cert
+			} else {
+				secret.caCerts = append(secret.caCerts, cert)
+			}
+		}
+		fetched.certSecret = secret
+	}
+	if attributes := cached.Attributes; attributes != nil {
+		fetched.attributes = &objectAttributes{
+			contentType: attributes.ContentType,
+			tags:        attributes.Tags,
+			enabled:     attributes.Enabled,
+			notBefore:   attributes.NotBefore,
+			expires:     attributes.Expires,
+			created:     attributes.Created,
+			updated:     attributes.Updated,
+		}
+	}
+	return fetched, cached.FetchTime, nil
+}
+
+// staleCacheCipher returns the AES-256-GCM cipher of the cache with the key of the node,
+// generated readable by root only on the first write if create is true, or sealed to the TPM of
+// the node with -cacheKeyTPM
+func (adapter *KeyvaultFlexvolumeAdapter) staleCacheCipher(create bool) (cipher.AEAD, error) {
+	var key []byte
+	var err error
+	fileName := filepath.Join(adapter.options.stateDir, staleCacheKeyFile)
+	if adapter.options.cacheKeyTPM {
+		fileName = filepath.Join(adapter.options.stateDir, staleCacheSealedKeyDir)
+		key, err = unsealStaleCacheKey(fileName)
+		if os.IsNotExist(err) && create {
+			key, err = generateSealedStaleCacheKey(adapter.options.stateDir)
+		}
+	} else {
+		key, err = ioutil.ReadFile(fileName)
+		if os.IsNotExist(err) && create {
+			key, err = generateStaleCacheKey(fileName)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read cache key %s", fileName)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cache key %s is invalid", fileName)
+	}
+	return cipher.NewGCM(block)
+}
+
+// generateStaleCacheKey writes a random AES-256 key to fileName, unless a concurrent mount did
+func generateStaleCacheKey(fileName string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(fileName), dirPermission); err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(fileName), ".cache.key")
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(key)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// fails if a concurrent mount generated the key first, whose key is used
+		err = os.Link(file.Name(), fileName)
+	}
+	os.Remove(file.Name())
+	if os.IsExist(err) {
+		return ioutil.ReadFile(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	glog.V(0).Infof("generated cache key %s", fileName)
+	return key, nil
+}
+
+// mountCached writes the object cached on the node when the vault is unavailable, cause being
+// the error of the fetch, recording it as stale in the mount report
+func (adapter *KeyvaultFlexvolumeAdapter) mountCached(vaultURL string, object KeyVaultObject, cause error) (*fetchedObject, error) {
+	fetched, fetchTime, err := adapter.readCachedObject(vaultURL, object)
+	if err != nil {
+		glog.Warningf("%s %s can't be served from the cache: %s", object.ObjectType, object.ObjectName, err)
+		return nil, cause
+	}
+	glog.Warningf("vault is unavailable, serving %s %s (version: %s) cached on %s, allowed by -allowStaleOnError: %s", object.ObjectType, object.ObjectName, fetched.version, fetchTime.Format(time.RFC3339), cause)
+	adapter.report.addStale(reportStale{
+		ObjectName:    object.ObjectName,
+		ObjectType:    object.ObjectType,
+		FileName:      object.fileName(),
+		ObjectVersion: fetched.version,
+		FetchTime:     formatTimestamp(fetchTime, adapter.report.timeFormat),
+		Reason:        cause.Error(),
+	})
+	if err = adapter.writeFetched(object, fetched); err != nil {
+		return nil, err
+	}
+	return fetched, nil
+}
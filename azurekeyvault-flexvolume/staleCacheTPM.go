@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// staleCacheSealedKeyDir holds the key of the cache sealed to the TPM of the node with
+	// -cacheKeyTPM, as the public and private parts of a TPM object, relative to stateDir
+	staleCacheSealedKeyDir = "cache.key.tpm"
+	sealedKeyPublicFile    = "key.pub"
+	sealedKeyPrivateFile   = "key.priv"
+)
+
+// runTPMTool runs a command of tpm2-tools with input on its stdin, returning its output
+func runTPMTool(name string, input []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s failed: %s", name, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// createPrimaryKey creates the primary key of the owner hierarchy of the TPM in dir, derived from
+// the seed of the TPM, so it is the same on each mount and the keys sealed under it can only be
+// loaded on this TPM
+func createPrimaryKey(dir string) (string, error) {
+	primary := filepath.Join(dir, "primary.ctx")
+	if _, err := runTPMTool("tpm2_createprimary", nil, "-Q", "-C", "o", "-c", primary); err != nil {
+		return "", err
+	}
+	return primary, nil
+}
+
+// unsealStaleCacheKey returns the key of the cache sealed in sealedDir by the TPM of the node
+func unsealStaleCacheKey(sealedDir string) ([]byte, error) {
+	if _, err := os.Stat(filepath.Join(sealedDir, sealedKeyPrivateFile)); err != nil {
+		return nil, err
+	}
+	// the contexts of the keys loaded in the TPM are only usable on the TPM
+	dir, err := ioutil.TempDir(filepath.Dir(sealedDir), ".tpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	primary, err := createPrimaryKey(dir)
+	if err != nil {
+		return nil, err
+	}
+	loaded := filepath.Join(dir, "key.ctx")
+	if _, err = runTPMTool("tpm2_load", nil, "-Q", "-C", primary, "-u", filepath.Join(sealedDir, sealedKeyPublicFile), "-r", filepath.Join(sealedDir, sealedKeyPrivateFile), "-c", loaded); err != nil {
+		return nil, err
+	}
+	return runTPMTool("tpm2_unseal", nil, "-c", loaded)
+}
+
+// generateSealedStaleCacheKey seals a random AES-256 key to the TPM of the node in the sealed key
+// directory of stateDir, unless a concurrent mount did. The key of the cache is sealed instead if
+// it was kept in a file before -cacheKeyTPM was set, so the objects cached stay readable, and
+// the file is shredded.
+func generateSealedStaleCacheKey(stateDir string) ([]byte, error) {
+	if err := os.MkdirAll(stateDir, dirPermission); err != nil {
+		return nil, err
+	}
+	keyFileName := filepath.Join(stateDir, staleCacheKeyFile)
+	key, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		key = make([]byte, 32)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir(stateDir, ".cache.key.tpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	primary, err := createPrimaryKey(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = runTPMTool("tpm2_create", key, "-Q", "-C", primary, "-i", "-", "-u", filepath.Join(dir, sealedKeyPublicFile), "-r", filepath.Join(dir, sealedKeyPrivateFile)); err != nil {
+		return nil, err
+	}
+	os.Remove(primary)
+	sealedDir := filepath.Join(stateDir, staleCacheSealedKeyDir)
+	// fails if a concurrent mount sealed the key first, whose key is used
+	err = os.Rename(dir, sealedDir)
+	if os.IsExist(err) {
+		return unsealStaleCacheKey(sealedDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(keyFileName); err == nil {
+		if err = shredFile(keyFileName, info.Size()); err != nil {
+			glog.Warningf("failed to remove the cache key %s sealed to the TPM: %s", keyFileName, err)
+		}
+	}
+	glog.V(0).Infof("sealed the cache key to the TPM in %s", sealedDir)
+	return key, nil
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// writeSymlinks links the symlinks of an object to the file it is written to, so applications
+// expecting other file names can read it without the content being written twice. The links are
+// relative, so they still resolve once the volume is published.
+func (adapter *KeyvaultFlexvolumeAdapter) writeSymlinks(object KeyVaultObject) error {
+	for _, symlink := range object.Symlinks {
+		linkPath := filepath.Join(adapter.dataDir(), symlink)
+		target, err := filepath.Rel(filepath.Dir(linkPath), filepath.Join(adapter.dataDir(), object.fileName()))
+		if err != nil {
+			return errors.Wrapf(err, "failed to link %s to %s", symlink, object.fileName())
+		}
+		if current, err := os.Readlink(linkPath); err == nil {
+			if current == target {
+				continue
+			}
+			// a symlink of a previous mount of the volume
+			if err = os.Remove(linkPath); err != nil {
+				return errors.Wrapf(err, "failed to replace symlink %s", symlink)
+			}
+		}
+		if err = adapter.makeDirs(linkPath); err != nil {
+			return err
+		}
+		if err = os.Symlink(target, linkPath); err != nil {
+			return errors.Wrapf(err, "failed to link %s to %s", symlink, object.fileName())
+		}
+		glog.V(2).Infof("linked %s to %s", symlink, object.fileName())
+	}
+	return nil
+}
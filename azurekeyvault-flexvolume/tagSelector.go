@@ -0,0 +1,162 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// parseTagSelector parses a tag selector: comma separated name=value pairs, which must all match.
+// Tag names are case insensitive in Azure, so they are returned lowercase.
+func parseTagSelector(selector string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(selector, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, errors.Errorf("%q should be name=value", pair)
+		}
+		tags[strings.ToLower(name)] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
+}
+
+// defaultMountAllSecretsLimit is the default maximum number of secrets mounted with mountAllSecrets
+const defaultMountAllSecretsLimit = 100
+
+// selectsSecrets returns whether the secrets of the vault are listed to select the secrets to mount
+func selectsSecrets(options Option) bool {
+	return options.mountAllSecrets || options.tagSelector != "" || options.objectNamePrefix != ""
+}
+
+// excludedObjectName returns whether a name is one of the comma separated names or globs of
+// excludeObjectNames
+func excludedObjectName(exclusions string, name string) bool {
+	if exclusions == "" {
+		return false
+	}
+	for _, exclusion := range strings.Split(exclusions, ",") {
+		if matched, _ := path.Match(strings.TrimSpace(exclusion), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// objectNameWildcards are the characters making objectNamePrefix a glob rather than a prefix
+const objectNameWildcards = "*?[\\"
+
+// matchObjectName returns whether a name starts with prefix or, if it has wildcards, matches it as
+// a glob
+func matchObjectName(prefix string, name string) bool {
+	if !strings.ContainsAny(prefix, objectNameWildcards) {
+		return strings.HasPrefix(name, prefix)
+	}
+	matched, _ := path.Match(prefix, name)
+	return matched
+}
+
+// literalPrefix returns the part of objectNamePrefix before its first wildcard, stripped from
+// the file names of the selected secrets with stripObjectNamePrefix
+func literalPrefix(prefix string) string {
+	if i := strings.IndexAny(prefix, objectNameWildcards); i >= 0 {
+		return prefix[:i]
+	}
+	return prefix
+}
+
+// selectSecrets lists the secrets of the vault and returns those matching the tag selector and
+// the object name prefix, or all of them with mountAllSecrets, as objects sorted by name.
+// Disabled secrets, secrets backing certificates, excluded secrets and secrets already in objects
+// are skipped.
+func (adapter *KeyvaultFlexvolumeAdapter) selectSecrets(kvClient *kv.BaseClient, vaultURL string, objects []KeyVaultObject) ([]KeyVaultObject, error) {
+	ctx := adapter.ctx
+	options := adapter.options
+	selector := map[string]string{}
+	if options.tagSelector != "" {
+		var err error
+		if selector, err = parseTagSelector(options.tagSelector); err != nil {
+			return nil, err
+		}
+	}
+	listed := map[string]bool{}
+	// the objects by file name, as the selected secrets are mapped to file names once listed
+	fileNames := map[string]string{}
+	for _, object := range objects {
+		if object.ObjectType == VaultTypeSecret {
+			listed[object.ObjectName] = true
+		}
+		fileNames[object.fileName()] = object.ObjectName
+	}
+
+	var selected []KeyVaultObject
+	page, err := kvClient.GetSecrets(ctx, vaultURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list secrets")
+	}
+	err = listPages(ctx, &page, func() *string { return page.Response().NextLink }, func() error {
+		for _, item := range page.Values() {
+			// the identifier of a listed secret has no version, its last segment is the name
+			name := versionFromID(item.ID)
+			enabled := item.Attributes == nil || item.Attributes.Enabled == nil || *item.Attributes.Enabled
+			if enabled && !to.Bool(item.Managed) && !listed[name] && !excludedObjectName(options.excludeObjectNames, name) && matchObjectName(options.objectNamePrefix, name) && matchTags(selector, item.Tags) {
+				object := KeyVaultObject{ObjectName: name, ObjectType: VaultTypeSecret}
+				fileName := name
+				if stripped := strings.TrimPrefix(name, literalPrefix(options.objectNamePrefix)); options.stripObjectNamePrefix && stripped != "" {
+					fileName = stripped
+				}
+				if fileName = objectFileName(fileName, options); fileName != name {
+					object.ObjectAlias = fileName
+				}
+				if err := validateFileName(object.fileName()); err != nil {
+					return errors.Wrapf(err, "secret %s can't be written", name)
+				}
+				if other, ok := fileNames[object.fileName()]; ok {
+					return errors.Errorf("secret %s can't be written, %s is already the file of %s", name, object.fileName(), other)
+				}
+				fileNames[object.fileName()] = name
+				selected = append(selected, object)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list secrets")
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].ObjectName < selected[j].ObjectName
+	})
+	if options.mountAllSecrets {
+		glog.V(0).Infof("vault has %d secrets to mount", len(selected))
+		if len(selected) > options.mountAllSecretsLimit {
+			return nil, errors.Errorf("vault has %d secrets to mount, more than the maximum of %d allowed by -mountAllSecretsLimit", len(selected), options.mountAllSecretsLimit)
+		}
+		return selected, nil
+	}
+	glog.V(0).Infof("tag selector %q and object name prefix %q matched %d secrets", options.tagSelector, options.objectNamePrefix, len(selected))
+	return selected, nil
+}
+
+// matchTags returns whether tags have all the name and value pairs of the selector
+func matchTags(selector map[string]string, tags map[string]*string) bool {
+	lowercase := make(map[string]string, len(tags))
+	for name, value := range tags {
+		lowercase[strings.ToLower(name)] = to.String(value)
+	}
+	for name, value := range selector {
+		if actual, ok := lowercase[name]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestParseTagSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{selector: "env=prod", want: map[string]string{"env": "prod"}},
+		{selector: "env=prod,team=payments", want: map[string]string{"env": "prod", "team": "payments"}},
+		{selector: " Env = prod , TEAM=payments", want: map[string]string{"env": "prod", "team": "payments"}},
+		{selector: "env=", want: map[string]string{"env": ""}},
+		{selector: "url=https://a?b=c", want: map[string]string{"url": "https://a?b=c"}},
+		{selector: "env", wantErr: true},
+		{selector: "=prod", wantErr: true},
+		{selector: "env=prod,", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseTagSelector(test.selector)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseTagSelector(%q) error = %v, want error %t", test.selector, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseTagSelector(%q) = %v, want %v", test.selector, got, test.want)
+		}
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	selector := map[string]string{"env": "prod", "team": "payments"}
+	tests := []struct {
+		name string
+		tags map[string]*string
+		want bool
+	}{
+		{name: "all tags", tags: map[string]*string{"env": to.StringPtr("prod"), "team": to.StringPtr("payments")}, want: true},
+		{name: "extra tags", tags: map[string]*string{"env": to.StringPtr("prod"), "team": to.StringPtr("payments"), "owner": to.StringPtr("alice")}, want: true},
+		{name: "tag names case insensitive", tags: map[string]*string{"Env": to.StringPtr("prod"), "TEAM": to.StringPtr("payments")}, want: true},
+		{name: "tag values case sensitive", tags: map[string]*string{"env": to.StringPtr("Prod"), "team": to.StringPtr("payments")}, want: false},
+		{name: "missing tag", tags: map[string]*string{"env": to.StringPtr("prod")}, want: false},
+		{name: "no tags", want: false},
+	}
+	for _, test := range tests {
+		if got := matchTags(selector, test.tags); got != test.want {
+			t.Errorf("%s: matchTags() = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchObjectName(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		name    string
+		want    bool
+		literal string
+	}{
+		{prefix: "app-", name: "app-db", want: true, literal: "app-"},
+		{prefix: "app-", name: "other-db", want: false, literal: "app-"},
+		{prefix: "app-*-password", name: "app-db-password", want: true, literal: "app-"},
+		{prefix: "app-*-password", name: "app-db-user", want: false, literal: "app-"},
+		{prefix: "app-?", name: "app-1", want: true, literal: "app-"},
+		{prefix: "[ab]-db", name: "b-db", want: true, literal: ""},
+	}
+	for _, test := range tests {
+		if got := matchObjectName(test.prefix, test.name); got != test.want {
+			t.Errorf("matchObjectName(%q, %q) = %t, want %t", test.prefix, test.name, got, test.want)
+		}
+		if got := literalPrefix(test.prefix); got != test.literal {
+			t.Errorf("literalPrefix(%q) = %q, want %q", test.prefix, got, test.literal)
+		}
+	}
+}
+
+func TestExcludedObjectName(t *testing.T) {
+	tests := []struct {
+		exclusions string
+		name       string
+		want       bool
+	}{
+		{exclusions: "", name: "db", want: false},
+		{exclusions: "db", name: "db", want: true},
+		{exclusions: "db", name: "db-password", want: false},
+		{exclusions: "legacy-*, db", name: "legacy-token", want: true},
+		{exclusions: "legacy-*, db", name: "db", want: true},
+		{exclusions: "legacy-*, db", name: "api-token", want: false},
+	}
+	for _, test := range tests {
+		if got := excludedObjectName(test.exclusions, test.name); got != test.want {
+			t.Errorf("excludedObjectName(%q, %q) = %t, want %t", test.exclusions, test.name, got, test.want)
+		}
+	}
+}
+
+func TestSelectSecretsFileNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		objects []KeyVaultObject
+		secrets []string
+		// substring of the error, empty if the secrets can be written
+		err string
+	}{
+		{
+			name:    "nested names",
+			args:    []string{"-pathSeparator=--"},
+			secrets: []string{"/secrets/team--db-password", "/secrets/team--api-key"},
+		},
+		{
+			name:    "leading separator",
+			args:    []string{"-pathSeparator=--"},
+			secrets: []string{"/secrets/--etc--passwd"},
+			err:     `secret --etc--passwd can't be written: file name "/etc/passwd" must be a relative path`,
+		},
+		{
+			name:    "parent elements",
+			args:    []string{"-pathSeparator=--"},
+			secrets: []string{"/secrets/..--..--etc"},
+			err:     "secret ..--..--etc can't be written",
+		},
+		{
+			name:    "mapped onto another secret",
+			args:    []string{"-pathSeparator=-", "-fileNameCase=" + FileNameCaseLower},
+			secrets: []string{"/secrets/team-db", "/secrets/Team-DB"},
+			err:     "secret Team-DB can't be written, team/db is already the file of team-db",
+		},
+		{
+			name:    "mapped onto an object",
+			args:    []string{"-pathSeparator=--"},
+			objects: []KeyVaultObject{{ObjectName: "tls", ObjectType: VaultTypeCertificate, ObjectAlias: "team/tls"}},
+			secrets: []string{"/secrets/team--tls"},
+			err:     "secret team--tls can't be written, team/tls is already the file of tls",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault, _ := newPagedVault(t, "/secrets", "id", [][]string{test.secrets})
+			adapter := testAdapter(t, append([]string{"-mountAllSecrets"}, test.args...)...)
+			adapter.ctx = context.Background()
+			kvClient := kv.New()
+			_, err := adapter.selectSecrets(&kvClient, vault.URL, test.objects)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("selectSecrets() = %q, want no error", err)
+			case test.err != "" && err == nil:
+				t.Errorf("selectSecrets() = nil, want %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("selectSecrets() = %q, want %q", err, test.err)
+			}
+		})
+	}
+}
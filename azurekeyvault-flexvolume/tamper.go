@@ -0,0 +1,95 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// defaultVerifyInterval is the period the rotation daemon checks the files of the volumes at by
+// default
+const defaultVerifyInterval = time.Minute
+
+// tamperedFile is a file of a volume that no longer matches its manifest
+type tamperedFile struct {
+	fileName string
+	// deleted or modified
+	change string
+}
+
+// tamperedFiles returns the files of the volume at dir deleted or modified since they were
+// written, according to the sha256 recorded in its manifest
+func tamperedFiles(dir string) ([]tamperedFile, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	fileNames := make([]string, 0, len(manifest.Files))
+	for fileName := range manifest.Files {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	var tampered []tamperedFile
+	for _, fileName := range fileNames {
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(fileName)))
+		if os.IsNotExist(err) {
+			tampered = append(tampered, tamperedFile{fileName: fileName, change: "deleted"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != manifest.Files[fileName] {
+			tampered = append(tampered, tamperedFile{fileName: fileName, change: "modified"})
+		}
+	}
+	return tampered, nil
+}
+
+// verifyVolumes checks the files of each registered volume against its manifest, and mounts the
+// volumes whose files were deleted or modified on the node again to restore them. Each file is
+// logged as a security event, as only root can change a volume. The Kubernetes features the volume
+// isn't allowed stay disabled.
+func verifyVolumes(ctx context.Context, executable string, stateDir string, preflights map[string]volumePreflight) {
+	fileNames, err := filepath.Glob(filepath.Join(stateDir, rotationDir, "*.json"))
+	if err != nil {
+		glog.Warningf("failed to list the volumes registered for rotation: %s", err)
+		return
+	}
+	for _, fileName := range fileNames {
+		registration, err := readRegistration(fileName)
+		if err != nil {
+			continue
+		}
+		tampered, err := tamperedFiles(registration.Dir)
+		if err != nil {
+			// unmounted since it was listed, or mounted by a previous driver without hashes
+			glog.V(2).Infof("failed to verify %s: %s", registration.Dir, err)
+			continue
+		}
+		if len(tampered) == 0 {
+			continue
+		}
+		for _, file := range tampered {
+			glog.Errorf("security event: %s of %s was %s on the node, restoring it", file.fileName, registration.Dir, file.change)
+		}
+		// a refresh could be skipped when the versions are unchanged, so the volume is mounted again
+		if err = runMountCommand(ctx, executable, append(registration.Args, preflights[fileName].disable...)); err != nil {
+			glog.Errorf("failed to restore %s: %s", registration.Dir, err)
+			continue
+		}
+		glog.V(0).Infof("restored %d files of %s", len(tampered), registration.Dir)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// parseTemplate parses the template of a volume, rendering the objects given by name or file name
+// with the object function
+func parseTemplate(text string, contents map[string][]byte) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"object": func(name string) (string, error) {
+			content, ok := contents[name]
+			if !ok {
+				return "", errors.Errorf("object %s is not mounted or has no single content", name)
+			}
+			return string(content), nil
+		},
+		"quote": strconv.Quote,
+	}
+	return template.New("template").Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+// renderTemplate renders the template of the volume with the contents of the objects mounted, by
+// object name and file name, and writes it to templateOutput
+func (adapter *KeyvaultFlexvolumeAdapter) renderTemplate(contents map[string][]byte) error {
+	options := adapter.options
+	tmpl, err := parseTemplate(options.template, contents)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse -template")
+	}
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, nil); err != nil {
+		return errors.Wrap(err, "failed to render -template")
+	}
+	return adapter.writeDerivedFile(options.templateOutput, rendered.Bytes())
+}
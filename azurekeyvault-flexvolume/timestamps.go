@@ -0,0 +1,40 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"time"
+)
+
+// Formats of the timestamps written to files in the volume
+const (
+	// TimeFormatRFC3339 RFC3339 in UTC, e.g. 2019-10-01T12:00:00Z
+	TimeFormatRFC3339 string = "rfc3339"
+	// TimeFormatEpoch seconds since the unix epoch
+	TimeFormatEpoch string = "epoch"
+)
+
+// formatTimestamp returns t in the given format as a value ready to be JSON encoded:
+// a string for rfc3339 (the default) or a number for epoch.
+// Timestamps are always converted to UTC so outputs don't depend on the node's locale or timezone.
+func formatTimestamp(t time.Time, format string) interface{} {
+	if format == TimeFormatEpoch {
+		return t.Unix()
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseTimestamp returns the time of a timestamp decoded from JSON, written by formatTimestamp in
+// either format
+func parseTimestamp(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
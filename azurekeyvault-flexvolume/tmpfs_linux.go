@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"path"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Magic numbers of the in-memory filesystems, from statfs(2)
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+	// stRdonly is the ST_RDONLY flag of a filesystem mounted read-only
+	stRdonly = 0x1
+)
+
+// volumeMetrics is whether kubelet can report the usage of a volume with statfs, each volume
+// being a tmpfs of its own
+const volumeMetrics = true
+
+// checkInMemory fails unless dir is backed by an in-memory filesystem, so secrets are never
+// written to the persistent disk of the node, unless -allowPersistentDir accepts it
+func (adapter *KeyvaultFlexvolumeAdapter) checkInMemory(dir string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return errors.Wrapf(err, "failed to get the filesystem of %s", dir)
+	}
+	// the type is signed on some architectures
+	if fsType := uint32(stat.Type); fsType == tmpfsMagic || fsType == ramfsMagic {
+		return nil
+	}
+	if adapter.options.allowPersistentDir {
+		glog.Warningf("%s is not a tmpfs, secrets are written to the disk of the node as allowed by -allowPersistentDir", dir)
+		return nil
+	}
+	return errors.Errorf("%s is not a tmpfs (filesystem type 0x%x), refusing to write secrets to the disk of the node. Set -allowPersistentDir to accept it", dir, uint32(stat.Type))
+}
+
+// remountReadOnly remounts dir read-only once the files are written, bind mounting it on itself
+// first if it isn't a mount point, so containers can't modify or truncate the files of the volume
+func (adapter *KeyvaultFlexvolumeAdapter) remountReadOnly(dir string) error {
+	if !adapter.options.remountReadOnly {
+		return nil
+	}
+	mountPoint, err := isMountPoint(dir)
+	if err != nil {
+		return err
+	}
+	if !mountPoint {
+		if err = syscall.Mount(dir, dir, "", syscall.MS_BIND, ""); err != nil {
+			return errors.Wrapf(err, "failed to bind mount %s", dir)
+		}
+	}
+	if err = syscall.Mount("", dir, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		return errors.Wrapf(err, "failed to remount %s read-only", dir)
+	}
+	glog.V(0).Infof("remounted %s read-only", dir)
+	return nil
+}
+
+// remountWritable remounts dir writable if it was remounted read-only by a previous mount of the
+// volume, kubelet retrying it
+func remountWritable(dir string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return errors.Wrapf(err, "failed to get the filesystem of %s", dir)
+	}
+	if stat.Flags&stRdonly == 0 {
+		return nil
+	}
+	if err := syscall.Mount("", dir, "", syscall.MS_REMOUNT|syscall.MS_BIND, ""); err != nil {
+		return errors.Wrapf(err, "failed to remount %s writable", dir)
+	}
+	glog.V(0).Infof("remounted %s writable", dir)
+	return nil
+}
+
+// isMountPoint returns whether dir is a mount point, on another device than its parent
+func isMountPoint(dir string) (bool, error) {
+	var stat, parentStat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		return false, errors.Wrapf(err, "failed to get %s", dir)
+	}
+	if err := syscall.Stat(path.Dir(path.Clean(dir)), &parentStat); err != nil {
+		return false, errors.Wrapf(err, "failed to get parent of %s", dir)
+	}
+	return stat.Dev != parentStat.Dev, nil
+}
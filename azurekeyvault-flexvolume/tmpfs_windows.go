@@ -0,0 +1,37 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// volumeMetrics is whether kubelet can report the usage of a volume, volumes being directories on
+// the disk of the node on Windows, whose usage would be the one of the disk
+const volumeMetrics = false
+
+// checkInMemory fails unless -allowPersistentDir accepts writing secrets to the disk of the node,
+// Windows having no tmpfs
+func (adapter *KeyvaultFlexvolumeAdapter) checkInMemory(dir string) error {
+	if !adapter.options.allowPersistentDir {
+		return errors.Errorf("Windows has no tmpfs, refusing to write secrets to %s on the disk of the node. Set -allowPersistentDir to accept it", dir)
+	}
+	glog.V(2).Infof("secrets are written to %s on the disk of the node as allowed by -allowPersistentDir", dir)
+	return nil
+}
+
+// remountWritable does nothing, volumes never being remounted read-only on Windows
+func remountWritable(dir string) error {
+	return nil
+}
+
+// remountReadOnly fails with -remountReadOnly, Windows having no bind mounts
+func (adapter *KeyvaultFlexvolumeAdapter) remountReadOnly(dir string) error {
+	if !adapter.options.remountReadOnly {
+		return nil
+	}
+	return errors.New("-remountReadOnly is not supported on Windows")
+}
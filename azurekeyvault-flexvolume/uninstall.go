@@ -0,0 +1,83 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// driverVolume is a volume of the driver mounted on the node
+type driverVolume struct {
+	dir    string
+	podUID string
+}
+
+// runUninstall removes the driver from the node: unmounts the volumes still mounted, removes the
+// state directory and the plugin directory so kubelet deregisters the driver. Without -yes, only
+// prints what would be done and the pods impacted.
+func runUninstall(ctx context.Context, args []string) error {
+	fs := newFlagSet("uninstall")
+	pluginDir := fs.String("pluginDir", defaultPluginDir, "Directory of the driver in the volume plugins directory of kubelet.")
+	stateDir := fs.String("stateDir", defaultStateDir, "Directory of the state kept on the node across mounts.")
+	attempts := fs.Int("attempts", defaultUnmountAttempts, "Unmount attempts of each volume before detaching it lazily.")
+	yes := fs.Bool("yes", false, "Uninstall the driver. Without it, only print what would be done.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if filepath.Base(*pluginDir) != driverName {
+		return errors.Errorf("-pluginDir %s is not a directory of the driver, it should end with %s", *pluginDir, driverName)
+	}
+
+	volumes, err := driverVolumes()
+	if err != nil {
+		return err
+	}
+	action := "would"
+	if *yes {
+		action = "will"
+	}
+	fmt.Printf("%d volumes of the driver are mounted\n", len(volumes))
+	for _, volume := range volumes {
+		fmt.Printf("%s unmount %s, impacting pod %s\n", action, volume.dir, volume.podUID)
+		for _, holder := range holders(volume.dir) {
+			fmt.Printf("  held by %s\n", holder)
+		}
+	}
+	fmt.Printf("%s remove the state directory %s\n", action, *stateDir)
+	fmt.Printf("%s remove the plugin directory %s\n", action, *pluginDir)
+	if !*yes {
+		fmt.Println("dry run, run with -yes to uninstall. Delete the installer DaemonSet first, or it installs the driver again")
+		return nil
+	}
+
+	var failed []string
+	for _, volume := range volumes {
+		if err = unmount(volume.dir, *attempts); err != nil {
+			fmt.Printf("failed to unmount %s: %s\n", volume.dir, err)
+			failed = append(failed, volume.dir)
+			continue
+		}
+		fmt.Printf("unmounted %s\n", volume.dir)
+	}
+	for _, dir := range []string{*stateDir, *pluginDir} {
+		if err = os.RemoveAll(dir); err != nil {
+			fmt.Printf("failed to remove %s: %s\n", dir, err)
+			failed = append(failed, dir)
+			continue
+		}
+		fmt.Printf("removed %s\n", dir)
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to uninstall %s", strings.Join(failed, ", "))
+	}
+	fmt.Println("uninstalled")
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// defaultUnmountAttempts is the number of unmount attempts before detaching a busy mount lazily
+const defaultUnmountAttempts = 4
+
+// runUnmount unmounts a volume, removes its directory and unregisters it from rotation. A busy
+// mount is retried with a doubling delay, then detached lazily: the tmpfs is released once the
+// processes holding it exit. Unmounting a volume already unmounted or removed succeeds, as kubelet
+// retries unmounts, and the FlexVolume status is printed whatever the outcome.
+// With -force, for pods stuck terminating, the holders are printed and the mount detached right away.
+func runUnmount(ctx context.Context, args []string) error {
+	fs := newFlagSet("unmount")
+	dir := fs.String("dir", "", "Mount directory of the volume.")
+	attempts := fs.Int("attempts", defaultUnmountAttempts, "Unmount attempts before detaching a busy mount lazily, with a doubling delay starting at 1s.")
+	force := fs.Bool("force", false, "Print the processes holding the mount, then detach it right away and remove the mount directory.")
+	stateDir := fs.String("stateDir", defaultStateDir, "Directory of the state kept on the node across mounts, the volume is unregistered from rotation.")
+	err := fs.Parse(args)
+	if err == nil && *dir == "" {
+		err = errors.Errorf("-dir is not set")
+	}
+	if err != nil {
+		if err != flag.ErrHelp && !*force {
+			printStatus(driverStatus{Status: statusFailure, Message: err.Error()})
+		}
+		return err
+	}
+	unregisterRotation(*stateDir, *dir)
+	removeEncodedCache(*stateDir, *dir)
+
+	if *force {
+		fmt.Printf("processes holding %s (pid command):\n", *dir)
+		for _, holder := range holders(*dir) {
+			fmt.Println(holder)
+		}
+		if err = unmount(*dir, 0); err != nil {
+			return err
+		}
+		fmt.Printf("cleaned up %s\n", *dir)
+		return nil
+	}
+
+	if err = unmount(*dir, *attempts); err != nil {
+		printStatus(driverStatus{Status: statusFailure, Message: err.Error()})
+		return err
+	}
+	return printStatus(driverStatus{Status: statusSuccess})
+}
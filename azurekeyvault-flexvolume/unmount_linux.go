@@ -0,0 +1,165 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// driverName is the name of the driver directory in the volume plugins directory of kubelet
+	driverName = "azure~kv"
+	// defaultPluginDir is the directory the installer copies the driver to
+	defaultPluginDir = "/etc/kubernetes/volumeplugins/" + driverName
+	// defaultStateDir is the directory of the state kept on the node across mounts
+	defaultStateDir = "/var/lib/azurekeyvault-flexvolume"
+)
+
+// driverVolumes returns the volumes of the driver mounted on the node, found in the kubelet pods
+// directory as <kubelet dir>/pods/<pod uid>/volumes/azure~kv/<volume name>
+func driverVolumes() ([]driverVolume, error) {
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read mounts")
+	}
+	var volumes []driverVolume
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= 4 {
+			continue
+		}
+		dir := unescapeMountPoint(fields[4])
+		elements := strings.Split(dir, "/")
+		n := len(elements)
+		if n >= 5 && elements[n-2] == driverName && elements[n-3] == "volumes" && elements[n-5] == "pods" {
+			volumes = append(volumes, driverVolume{dir: dir, podUID: elements[n-4]})
+		}
+	}
+	return volumes, nil
+}
+
+// unmount shreds the files of dir, unmounts it if mounted, detaching it lazily after attempts, and
+// removes it. It succeeds if dir is already partially or fully cleaned up.
+func unmount(dir string, attempts int) error {
+	mounted, err := isMounted(dir)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		// the volume is remounted read-only once written
+		if err = syscall.Mount("", dir, "", syscall.MS_REMOUNT|syscall.MS_BIND, ""); err != nil {
+			glog.Warningf("failed to remount %s writable: %s", dir, err)
+		}
+	}
+	if err = shredFiles(dir); err != nil {
+		glog.Warningf("%s, removing the remaining files", err)
+	}
+	if mounted {
+		delay := time.Second
+		for attempt := 1; ; attempt++ {
+			if attempt > attempts {
+				glog.V(0).Infof("processes holding %s: %s", dir, strings.Join(holders(dir), "; "))
+				glog.V(0).Infof("detaching %s", dir)
+				if err = syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+					return errors.Wrapf(err, "failed to unmount volume at %s", dir)
+				}
+				break
+			}
+			glog.V(0).Infof("unmounting %s, attempt %d", dir, attempt)
+			if err = syscall.Unmount(dir, 0); err == nil {
+				break
+			}
+			glog.Warningf("failed to unmount %s: %s", dir, err)
+			if attempt < attempts {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		glog.Warningf("failed to remove %s: %s", dir, err)
+	}
+	return nil
+}
+
+// isMounted returns whether dir is a mount point
+func isMounted(dir string) (bool, error) {
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read mounts")
+	}
+	dir = path.Clean(dir)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		// the mount point is the fifth field, with spaces and special characters escaped in octal
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && unescapeMountPoint(fields[4]) == dir {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unescapeMountPoint decodes the octal escapes of a mount point in /proc/self/mountinfo
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// holders returns the pid and command line of the processes using dir: working directory, root,
+// open files or memory mapped files
+func holders(dir string) []string {
+	dir = path.Clean(dir)
+	within := func(p string) bool {
+		return p == dir || strings.HasPrefix(p, dir+"/")
+	}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	var result []string
+	for _, proc := range procs {
+		holding := false
+		links := []string{path.Join(proc, "cwd"), path.Join(proc, "root")}
+		fds, _ := filepath.Glob(path.Join(proc, "fd", "*"))
+		for _, link := range append(links, fds...) {
+			if target, err := os.Readlink(link); err == nil && within(target) {
+				holding = true
+				break
+			}
+		}
+		if !holding {
+			if maps, err := ioutil.ReadFile(path.Join(proc, "maps")); err == nil {
+				holding = bytes.Contains(maps, []byte(" "+dir+"/"))
+			}
+		}
+		if holding {
+			cmdline, _ := ioutil.ReadFile(path.Join(proc, "cmdline"))
+			result = append(result, fmt.Sprintf("%s %s", path.Base(proc), strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))))
+		}
+	}
+	return result
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// driverName is the name of the driver directory in the volume plugins directory of kubelet,
+	// which runs the driver kv.cmd on Windows
+	driverName = "azure~kv.cmd"
+	// defaultPluginDir is the directory of the driver in the volume plugins directory of kubelet
+	defaultPluginDir = `C:\usr\libexec\kubernetes\kubelet-plugins\volume\exec\` + driverName
+	// defaultStateDir is the directory of the state kept on the node across mounts
+	defaultStateDir = `C:\ProgramData\azurekeyvault-flexvolume`
+	// kubeletPodsDir is the directory of the pods in the kubelet directory
+	kubeletPodsDir = `C:\var\lib\kubelet\pods`
+)
+
+// driverVolumes returns the volumes of the driver on the node, the directories
+// <kubelet dir>\pods\<pod uid>\volumes\azure~kv\<volume name>
+func driverVolumes() ([]driverVolume, error) {
+	dirs, err := filepath.Glob(filepath.Join(kubeletPodsDir, "*", "volumes", driverName, "*"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumes")
+	}
+	volumes := make([]driverVolume, 0, len(dirs))
+	for _, dir := range dirs {
+		podUID := filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(dir))))
+		volumes = append(volumes, driverVolume{dir: dir, podUID: podUID})
+	}
+	return volumes, nil
+}
+
+// unmount shreds the files of dir and removes it, Windows volumes being plain directories,
+// retrying with a doubling delay while files are in use by the containers being stopped.
+// It succeeds if dir is already partially or fully cleaned up.
+func unmount(dir string, attempts int) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := shredFiles(dir)
+		if err == nil {
+			err = os.RemoveAll(dir)
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			return errors.Wrapf(err, "failed to remove volume at %s", dir)
+		}
+		glog.Warningf("failed to remove %s, attempt %d: %s", dir, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// holders returns nothing, the processes using a directory not being listed on Windows
+func holders(dir string) []string {
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parseVaultURI returns the URL of a vault from its URI, e.g. https://myvault.vault.azure.net or
+// https://myvault.privatelink.vaultcore.azure.net. Any DNS suffix is accepted, for private
+// endpoints resolved through custom DNS zones.
+func parseVaultURI(vaultURI string) (string, error) {
+	u, err := url.Parse(vaultURI)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse vault uri %s", vaultURI)
+	}
+	if u.Scheme != "https" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return "", errors.Errorf("vault uri %s is invalid, should be https://<vault host>", vaultURI)
+	}
+	return "https://" + strings.ToLower(u.Host) + "/", nil
+}
+
+// isManagedHSMURI returns true if the host of a vault URI is a Managed HSM pool, e.g.
+// https://myhsm.managedhsm.azure.net or https://myhsm.privatelink.managedhsm.azure.net
+func isManagedHSMURI(vaultURI string) bool {
+	u, err := url.Parse(vaultURI)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(u.Hostname()), ".managedhsm.")
+}
+
+// vaultHost returns the host of the vault of a volume, from its URI or name
+func vaultHost(options Option) (string, error) {
+	if options.vaultURI != "" {
+		u, err := url.Parse(options.vaultURI)
+		if err != nil {
+			return "", err
+		}
+		return u.Hostname(), nil
+	}
+	suffix, err := GetVaultDNSSuffix(options.cloudName, options.managedHSM)
+	if err != nil {
+		return "", err
+	}
+	return options.vaultName + "." + *suffix, nil
+}
+
+// vaultDisplayName returns the name of the vault of a volume, the first label of its URI if set
+func vaultDisplayName(options Option) string {
+	if options.vaultURI == "" {
+		return options.vaultName
+	}
+	host, err := vaultHost(options)
+	if err != nil {
+		return options.vaultURI
+	}
+	return strings.SplitN(host, ".", 2)[0]
+}
+
+// getObjectVaultURL returns the URL of the vault of an object: its vaultURI or keyvaultName if set,
+// the vault of the volume otherwise
+func (adapter *KeyvaultFlexvolumeAdapter) getObjectVaultURL(object KeyVaultObject, vaultURL string) (string, error) {
+	switch {
+	case object.VaultURI != "":
+		return parseVaultURI(object.VaultURI)
+	case object.KeyvaultName != "":
+		objectVaultURL, err := adapter.getNamedVaultURL(object.KeyvaultName)
+		if err != nil {
+			return "", err
+		}
+		return *objectVaultURL, nil
+	}
+	return vaultURL, nil
+}
+
+// getVaultURLs returns the URLs of the vaults of the volume: the vault of the volume, followed by
+// the other vaults of its objects
+func (adapter *KeyvaultFlexvolumeAdapter) getVaultURLs() ([]string, error) {
+	vaultURL, err := adapter.getVaultURL()
+	if err != nil {
+		return nil, err
+	}
+	vaultURLs := []string{*vaultURL}
+	seen := map[string]bool{*vaultURL: true}
+	for _, object := range adapter.options.objects {
+		objectVaultURL, err := adapter.getObjectVaultURL(object, *vaultURL)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[objectVaultURL] {
+			seen[objectVaultURL] = true
+			vaultURLs = append(vaultURLs, objectVaultURL)
+		}
+	}
+	return vaultURLs, nil
+}
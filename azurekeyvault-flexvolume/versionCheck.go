@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// touchRegistration marks the registration of the volume at dir as refreshed, unless the volume
+// was unmounted during the refresh
+func touchRegistration(stateDir string, dir string) error {
+	now := time.Now()
+	if err := os.Chtimes(registrationFile(stateDir, dir), now, now); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to update the rotation registration of %s", dir)
+	}
+	return nil
+}
+
+// unchangedVersions returns whether the latest versions of the objects of the volume, as listed
+// by the vault, are the ones published by the previous mount according to its manifest, so a
+// refresh only downloads the content of the objects when one of them was rotated. Listing the
+// versions of an object doesn't return their content, which Key Vault can't send conditionally.
+func (adapter *KeyvaultFlexvolumeAdapter) unchangedVersions() (bool, error) {
+	options := adapter.options
+	if selectsSecrets(options) {
+		// the selected secrets can change without any version changing
+		return false, nil
+	}
+	if previousExpired(options.dir) {
+		return false, nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(options.dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read the manifest of %s", options.dir)
+	}
+	var manifest mountManifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return false, errors.Wrapf(err, "failed to parse the manifest of %s", options.dir)
+	}
+	published := make(map[string]manifestObject, len(manifest.Objects))
+	for _, object := range manifest.Objects {
+		published[object.ObjectType+"/"+object.ObjectName+"/"+object.FileName] = object
+	}
+
+	kvClient, err := adapter.initializeKvClient()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get keyvaultClient")
+	}
+	for _, object := range options.objects {
+		previous, ok := published[object.ObjectType+"/"+object.ObjectName+"/"+object.fileName()]
+		if !ok || object.ObjectType == VaultTypeCertificateSigningRequest || object.ObjectVersionsIndex > 0 {
+			// failed or skipped by the previous mount, or not versioned
+			return false, nil
+		}
+		if object.ObjectVersion != "" {
+			continue
+		}
+		if object.ObjectVersionHistory > 0 || object.KeyRing > 0 {
+			max := object.ObjectVersionHistory
+			if object.KeyRing > 0 {
+				max = object.KeyRing + 1
+			}
+			versions, err := adapter.getEnabledVersions(kvClient, previous.VaultURL, object.ObjectType, object.ObjectName, max)
+			if err != nil {
+				return false, err
+			}
+			if !equalStrings(versions, previous.VersionHistory) {
+				glog.V(0).Infof("the enabled versions of %s %s changed", object.ObjectType, object.ObjectName)
+				return false, nil
+			}
+			continue
+		}
+		versions, err := adapter.listVersions(kvClient, previous.VaultURL, object.ObjectType, object.ObjectName)
+		if err != nil {
+			return false, err
+		}
+		if len(versions) == 0 || versions[0].version != previous.ObjectVersion {
+			glog.V(0).Infof("%s %s has a new version", object.ObjectType, object.ObjectName)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// equalStrings returns whether a and b have the same strings in the same order
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"path"
+	"strconv"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+)
+
+// mountVersionHistory writes the most recent enabled versions of a secret to <alias>/0 (most recent),
+// <alias>/1..., so clients rotating keys can accept the old and new values at the same time
+func (adapter *KeyvaultFlexvolumeAdapter) mountVersionHistory(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*fetchedObject, error) {
+	versions, err := adapter.getEnabledVersions(kvClient, vaultURL, VaultTypeSecret, object.ObjectName, object.ObjectVersionHistory)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, errors.Errorf("secret %s has no enabled versions", object.ObjectName)
+	}
+
+	for i, version := range versions {
+		versionObject := object
+		versionObject.ObjectVersion = version
+		fetched, err := adapter.fetchObject(kvClient, vaultURL, versionObject)
+		if err != nil {
+			return nil, err
+		}
+		if err = adapter.transform(versionObject, fetched); err != nil {
+			return nil, err
+		}
+		fetched.content = normalizeNewline(versionObject, fetched.content)
+		if err = adapter.writeObject(versionObject, path.Join(object.fileName(), strconv.Itoa(i)), fetched); err != nil {
+			return nil, err
+		}
+	}
+	return &fetchedObject{version: versions[0], versionHistory: versions}, nil
+}
+
+// mountKeyRing writes the current version of a signing key or secret and up to keyRing previous
+// enabled versions to <alias>/<version>, so tokens signed before a rotation can still be verified
+func (adapter *KeyvaultFlexvolumeAdapter) mountKeyRing(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) (*fetchedObject, error) {
+	versions, err := adapter.getEnabledVersions(kvClient, vaultURL, object.ObjectType, object.ObjectName, object.KeyRing+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, errors.Errorf("%s %s has no enabled versions", object.ObjectType, object.ObjectName)
+	}
+
+	for _, version := range versions {
+		versionObject := object
+		versionObject.ObjectVersion = version
+		fetched, err := adapter.fetchObject(kvClient, vaultURL, versionObject)
+		if err != nil {
+			return nil, err
+		}
+		if err = adapter.transform(versionObject, fetched); err != nil {
+			return nil, err
+		}
+		fetched.content = normalizeNewline(versionObject, fetched.content)
+		if err = adapter.writeObject(versionObject, path.Join(object.fileName(), version), fetched); err != nil {
+			return nil, err
+		}
+	}
+	return &fetchedObject{version: versions[0], versionHistory: versions}, nil
+}
+
+// getEnabledVersions returns up to max enabled versions of an object, most recently created first
+func (adapter *KeyvaultFlexvolumeAdapter) getEnabledVersions(kvClient *kv.BaseClient, vaultURL, objectType, objectName string, max int) ([]string, error) {
+	listed, err := adapter.listVersions(kvClient, vaultURL, objectType, objectName)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, v := range listed {
+		if len(versions) == max {
+			break
+		}
+		if to.Bool(v.attributes.enabled) {
+			versions = append(versions, v.version)
+		}
+	}
+	return versions, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// versionsFileName is the manifest of the object versions written to the volume
+const versionsFileName = ".versions.json"
+
+// fetchedObject is an object retrieved from keyvault
+type fetchedObject struct {
+	// the content written to the volume
+	content []byte
+	// the concrete version that was fetched, even if the latest version was requested
+	version string
+	// the versions written with objectVersionHistory or keyRing, most recent first
+	versionHistory []string
+	// additional files written alongside the object, by file name relative to dir
+	files map[string][]byte
+	// only the additional files are written, e.g. the properties of a secret with objectProperties
+	omitContent bool
+	// the private key and chain of cert-key objects, to add to the keystore
+	certSecret *certificateSecret
+	// the DER certificate of cert objects, to add to the keystore
+	certificate []byte
+	// the attributes of the Key Vault object, for its metadata sidecar
+	attributes *objectAttributes
+}
+
+// mountedObject is an object written to the volume as a single file, also written to the files
+// derived from the objects such as the env file
+type mountedObject struct {
+	objectType string
+	fileName   string
+	content    []byte
+}
+
+// mountedSecrets returns the secrets of the objects written to the volume
+func mountedSecrets(mounted []mountedObject) []mountedObject {
+	var secrets []mountedObject
+	for _, m := range mounted {
+		if m.objectType == VaultTypeSecret {
+			secrets = append(secrets, m)
+		}
+	}
+	return secrets
+}
+
+// objectVersion records the version of an object written to the volume
+type objectVersion struct {
+	ObjectName     string   `json:"objectName"`
+	ObjectType     string   `json:"objectType"`
+	FileName       string   `json:"fileName"`
+	ObjectVersion  string   `json:"objectVersion"`
+	VersionHistory []string `json:"versionHistory,omitempty"`
+}
+
+// versionFromID returns the version of an object from its keyvault identifier,
+// e.g. https://myvault.vault.azure.net/secrets/mysecret/<version>
+func versionFromID(id *string) string {
+	if id == nil {
+		return ""
+	}
+	return (*id)[strings.LastIndex(*id, "/")+1:]
+}
+
+// writeVersions writes the manifest of the versions fetched so operators can audit
+// exactly which versions a pod started with
+func (adapter *KeyvaultFlexvolumeAdapter) writeVersions(versions []objectVersion) error {
+	content, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal object versions")
+	}
+	return adapter.writeDerivedFile(versionsFileName, content)
+}
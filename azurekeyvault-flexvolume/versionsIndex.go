@@ -0,0 +1,140 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/pkg/errors"
+)
+
+// versionsIndexSuffix is appended to the file name of an object for its versions index
+const versionsIndexSuffix = ".versions.json"
+
+// vaultVersion is a version of a Key Vault object as listed by the vault
+type vaultVersion struct {
+	version    string
+	attributes *objectAttributes
+}
+
+// indexedVersion is an entry of the versions index of an object
+type indexedVersion struct {
+	Version   string      `json:"version"`
+	Enabled   bool        `json:"enabled"`
+	NotBefore interface{} `json:"notBefore,omitempty"`
+	Expires   interface{} `json:"expires,omitempty"`
+	Created   interface{} `json:"created,omitempty"`
+	Updated   interface{} `json:"updated,omitempty"`
+}
+
+// listVersions returns the versions of an object, enabled or not, most recently created first.
+// Certificate keys list the versions of their certificate.
+func (adapter *KeyvaultFlexvolumeAdapter) listVersions(kvClient *kv.BaseClient, vaultURL string, objectType string, objectName string) ([]vaultVersion, error) {
+	ctx := adapter.ctx
+	var versions []vaultVersion
+	switch objectType {
+	case VaultTypeSecret:
+		page, err := kvClient.GetSecretVersions(ctx, vaultURL, objectName, nil)
+		if err == nil {
+			err = listPages(ctx, &page, func() *string { return page.Response().NextLink }, func() error {
+				for _, item := range page.Values() {
+					versions = append(versions, vaultVersion{
+						version:    versionFromID(item.ID),
+						attributes: secretAttributes(kv.SecretBundle{Attributes: item.Attributes}),
+					})
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, "")
+		}
+	case VaultTypeKey:
+		page, err := kvClient.GetKeyVersions(ctx, vaultURL, objectName, nil)
+		if err == nil {
+			err = listPages(ctx, &page, func() *string { return page.Response().NextLink }, func() error {
+				for _, item := range page.Values() {
+					versions = append(versions, vaultVersion{
+						version:    versionFromID(item.Kid),
+						attributes: keyAttributes(kv.KeyBundle{Attributes: item.Attributes}),
+					})
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, "")
+		}
+	case VaultTypeCertificate, VaultTypeCertificateKey:
+		page, err := kvClient.GetCertificateVersions(ctx, vaultURL, objectName, nil)
+		if err == nil {
+			err = listPages(ctx, &page, func() *string { return page.Response().NextLink }, func() error {
+				for _, item := range page.Values() {
+					versions = append(versions, vaultVersion{
+						version:    versionFromID(item.ID),
+						attributes: certificateAttributes(kv.CertificateBundle{Attributes: item.Attributes}),
+					})
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, "")
+		}
+	default:
+		return nil, errors.Errorf("%s objects have no versions", objectType)
+	}
+
+	created := func(v vaultVersion) time.Time {
+		if v.attributes.created == nil {
+			return time.Time{}
+		}
+		return time.Time(*v.attributes.created)
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return created(versions[i]).After(created(versions[j]))
+	})
+	return versions, nil
+}
+
+// writeVersionsIndex writes the most recent versions of an object to <file name>.versions.json,
+// so rotation tooling in the cluster can tell which versions exist without vault credentials
+func (adapter *KeyvaultFlexvolumeAdapter) writeVersionsIndex(kvClient *kv.BaseClient, vaultURL string, object KeyVaultObject) error {
+	versions, err := adapter.listVersions(kvClient, vaultURL, object.ObjectType, object.ObjectName)
+	if err != nil {
+		return err
+	}
+	index := make([]indexedVersion, 0, object.ObjectVersionsIndex)
+	for i := 0; i < len(versions) && i < object.ObjectVersionsIndex; i++ {
+		attributes := versions[i].attributes
+		index = append(index, indexedVersion{
+			Version:   versions[i].version,
+			Enabled:   to.Bool(attributes.enabled),
+			NotBefore: adapter.formatVaultTime(attributes.notBefore),
+			Expires:   adapter.formatVaultTime(attributes.expires),
+			Created:   adapter.formatVaultTime(attributes.created),
+			Updated:   adapter.formatVaultTime(attributes.updated),
+		})
+	}
+
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal versions of %s", object.ObjectName)
+	}
+	filePath := filepath.Join(adapter.dataDir(), object.fileName()+versionsIndexSuffix)
+	if err = adapter.makeDirs(filePath); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %s", filePath)
+	}
+	if err = ioutil.WriteFile(filePath, content, permission); err != nil {
+		return errors.Wrapf(err, "failed to write versions of %s to %s", object.ObjectName, filePath)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// volumeNameHashLength is the number of hex digits of the hash of the objects in a volume name
+const volumeNameHashLength = 16
+
+// volumeName returns the name of a volume derived from its vault and the set of its objects, the
+// same whatever the order of the objects, the pod or the mount directory, e.g.
+// kv-myvault-4cd8555c366c8216
+func volumeName(options Option) (string, error) {
+	if options.vaultName == "" && options.vaultURI == "" {
+		return "", errors.Errorf("-vaultName or -vaultURI is not set")
+	}
+	vault := strings.ToLower(options.vaultName)
+	if options.vaultURI != "" {
+		vaultURL, err := parseVaultURI(options.vaultURI)
+		if err != nil {
+			return "", err
+		}
+		vault = vaultURL
+	}
+
+	objects := make([]string, 0, len(options.objects))
+	for _, object := range options.objects {
+		objectVault := strings.ToLower(object.KeyvaultName)
+		if object.VaultURI != "" {
+			objectVault = strings.ToLower(object.VaultURI)
+		}
+		objects = append(objects, strings.Join([]string{objectVault, object.ObjectType, object.ObjectName, object.ObjectVersion, object.fileName()}, "\x00"))
+	}
+	sort.Strings(objects)
+	// the secrets selected from the vault are part of the set of objects too
+	selectors := []string{options.tagSelector, options.objectNamePrefix, fmt.Sprint(options.mountAllSecrets), options.excludeObjectNames}
+
+	hash := sha256.New()
+	for _, value := range append(append([]string{vault}, objects...), selectors...) {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	name := strings.ToLower(vaultDisplayName(options))
+	return "kv-" + name + "-" + hex.EncodeToString(hash.Sum(nil))[:volumeNameHashLength], nil
+}
+
+// runGetVolumeName prints the name of a volume. Kubelet only calls it for attachable drivers, so
+// not while init reports attach false, leaving it to operators finding the volumes mounting the
+// same objects
+func runGetVolumeName(ctx context.Context, args []string) error {
+	options, err := parseConfigs(newFlagSet("getvolumename"), args)
+	var name string
+	if err == nil {
+		name, err = volumeName(*options)
+	}
+	if err != nil {
+		if err != flag.ErrHelp {
+			printStatus(driverStatus{Status: statusFailure, Message: err.Error()})
+		}
+		return err
+	}
+	return printStatus(driverStatus{Status: statusSuccess, VolumeName: name})
+}
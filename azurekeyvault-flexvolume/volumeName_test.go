@@ -0,0 +1,57 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestVolumeName(t *testing.T) {
+	objects := []string{"-vaultObjectNames=db-password;tls", "-vaultObjectTypes=secret;cert"}
+	name := func(args ...string) string {
+		t.Helper()
+		got, err := volumeName(testOptions(t, args...))
+		if err != nil {
+			t.Fatalf("volumeName(%v) = %s", args, err)
+		}
+		return got
+	}
+
+	base := name(objects...)
+	if base != "kv-myvault-4cd8555c366c8216" {
+		t.Errorf("volumeName() = %s, want kv-myvault-4cd8555c366c8216", base)
+	}
+	if !regexp.MustCompile(`^kv-myvault-[0-9a-f]{16}$`).MatchString(base) {
+		t.Errorf("volumeName() = %s, want kv-<vault>-<16 hex digits>", base)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		same bool
+	}{
+		{name: "objects reordered", args: []string{"-vaultObjectNames=tls;db-password", "-vaultObjectTypes=cert;secret"}, same: true},
+		{name: "objects as JSON", args: []string{`-vaultObjects=[{"objectName": "tls", "objectType": "cert"}, {"objectName": "db-password", "objectType": "secret"}]`}, same: true},
+		{name: "vault name casing", args: append([]string{"-vaultName=MyVault"}, objects...), same: true},
+		{name: "other directory", args: append([]string{"-dir=/var/lib/kubelet/pods/other"}, objects...), same: true},
+		{name: "other vault", args: append([]string{"-vaultName=othervault"}, objects...)},
+		{name: "other version", args: append([]string{"-vaultObjectVersions=;0123456789abcdef"}, objects...)},
+		{name: "other alias", args: append([]string{"-vaultObjectAliases=db;tls.crt"}, objects...)},
+		{name: "other object", args: []string{"-vaultObjectNames=db-password", "-vaultObjectTypes=secret"}},
+		{name: "tag selector", args: append([]string{"-tagSelector=env=prod"}, objects...)},
+		{name: "all secrets", args: append([]string{"-mountAllSecrets=true"}, objects...)},
+	}
+	for _, test := range tests {
+		got := name(test.args...)
+		if (got == base) != test.same {
+			t.Errorf("%s: volumeName() = %s, base %s, want same %t", test.name, got, base, test.same)
+		}
+	}
+
+	if _, err := volumeName(Option{}); err == nil {
+		t.Errorf("volumeName() without vault = nil, want an error")
+	}
+}
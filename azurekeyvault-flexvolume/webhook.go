@@ -0,0 +1,145 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// webhookSignatureHeader holds the HMAC-SHA256 of the body with the webhook secret, as
+	// sha256=<hex>, so receivers can check the notification comes from the driver
+	webhookSignatureHeader = "X-Flexvol-Signature"
+	// webhookTimeout bounds each notification, so a slow receiver doesn't hold the mount
+	webhookTimeout = 10 * time.Second
+)
+
+// rotationEvent is the notification of an object of the volume rotated since the previous mount
+type rotationEvent struct {
+	VaultURL     string      `json:"vaultUrl"`
+	ObjectName   string      `json:"objectName"`
+	ObjectType   string      `json:"objectType"`
+	FileName     string      `json:"fileName"`
+	OldVersion   string      `json:"oldVersion"`
+	NewVersion   string      `json:"newVersion"`
+	PodNamespace string      `json:"podNamespace,omitempty"`
+	PodName      string      `json:"podName,omitempty"`
+	Time         interface{} `json:"time"`
+}
+
+// validWebhookURL returns whether value is an absolute http or https URL
+func validWebhookURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// rotationEvents returns the objects of the manifest whose version changed since the manifest
+// published by the previous mount of the volume, none on the first mount
+func (adapter *KeyvaultFlexvolumeAdapter) rotationEvents(previous *mountManifest, objects []manifestObject) []rotationEvent {
+	options := adapter.options
+	if previous == nil {
+		return nil
+	}
+	versions := make(map[string]string, len(previous.Objects))
+	for _, object := range previous.Objects {
+		versions[object.ObjectType+"/"+object.ObjectName+"/"+object.FileName] = object.ObjectVersion
+	}
+	var events []rotationEvent
+	for _, object := range objects {
+		oldVersion, ok := versions[object.ObjectType+"/"+object.ObjectName+"/"+object.FileName]
+		if !ok || oldVersion == object.ObjectVersion {
+			continue
+		}
+		events = append(events, rotationEvent{
+			VaultURL:     object.VaultURL,
+			ObjectName:   object.ObjectName,
+			ObjectType:   object.ObjectType,
+			FileName:     object.FileName,
+			OldVersion:   oldVersion,
+			NewVersion:   object.ObjectVersion,
+			PodNamespace: options.podNamespace,
+			PodName:      options.podName,
+			Time:         object.FetchTime,
+		})
+	}
+	return events
+}
+
+// notifyRotations posts each rotation of the mount to -rotationWebhookURL, signed with the key of
+// -rotationWebhookSecretFile. Failures are only logged, the files being already published.
+func (adapter *KeyvaultFlexvolumeAdapter) notifyRotations() {
+	secret, err := adapter.getWebhookSecret()
+	if err != nil {
+		glog.Warningf("failed to notify the rotations to the webhook: %s", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	for _, event := range adapter.rotations {
+		if err := adapter.postWebhook(client, event, secret); err != nil {
+			glog.Warningf("failed to notify the rotation of %s %s to the webhook: %s", event.ObjectType, event.ObjectName, err)
+			continue
+		}
+		glog.V(0).Infof("notified the rotation of %s %s from version %s to %s", event.ObjectType, event.ObjectName, event.OldVersion, event.NewVersion)
+	}
+}
+
+// getWebhookSecret reads the key signing the notifications from -rotationWebhookSecretFile, empty
+// to not sign them
+func (adapter *KeyvaultFlexvolumeAdapter) getWebhookSecret() ([]byte, error) {
+	fileName := adapter.options.rotationWebhookSecretFile
+	if fileName == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read rotationWebhookSecretFile %s", fileName)
+	}
+	secret := bytes.TrimSpace(content)
+	if len(secret) == 0 {
+		return nil, errors.Errorf("rotationWebhookSecretFile %s is empty", fileName)
+	}
+	return secret, nil
+}
+
+// postWebhook posts event to -rotationWebhookURL, signed with secret unless it is empty
+func (adapter *KeyvaultFlexvolumeAdapter) postWebhook(client *http.Client, event rotationEvent, secret []byte) error {
+	options := adapter.options
+	content, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal rotation")
+	}
+	req, err := http.NewRequest(http.MethodPost, options.rotationWebhookURL, bytes.NewReader(content))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(adapter.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", GetUserAgent())
+	if len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(content)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -15,10 +15,63 @@ mkdir -p ${kv_vol_dir}
 #copy
 cp /bin/kv ${kv_vol_dir}/kv
 cp /bin/azurekeyvault-flexvolume ${kv_vol_dir}/azurekeyvault-flexvolume #script
+# systemd unit of the rotation daemon, enabled by the node administrator
+cp /bin/azurekeyvault-flexvolume-rotation.service ${kv_vol_dir}/azurekeyvault-flexvolume-rotation.service
+
+# node level settings of the driver, read by kv: per pod budgets and the node rate limit, 0 for no limit, the ARM
+# metadata endpoint to refresh the Azure environments from, the default retry policy and the
+# directory of the transform hooks and whether the key of the cache is sealed to the TPM
+cat > ${kv_vol_dir}/kv.conf <<EOF
+MAX_OBJECTS=${KV_MAX_OBJECTS:-0}
+MAX_FETCHES_PER_HOUR=${KV_MAX_FETCHES_PER_HOUR:-0}
+MAX_OBJECT_SIZE=${KV_MAX_OBJECT_SIZE:-0}
+MAX_VOLUME_SIZE=${KV_MAX_VOLUME_SIZE:-4194304}
+RATE_LIMIT_QPS=${KV_RATE_LIMIT_QPS:-0}
+RATE_LIMIT_BURST=${KV_RATE_LIMIT_BURST:-10}
+ENVIRONMENT_METADATA_URL="${KV_ENVIRONMENT_METADATA_URL}"
+RETRY_ATTEMPTS=${KV_RETRY_ATTEMPTS:-3}
+RETRY_INITIAL_BACKOFF=${KV_RETRY_INITIAL_BACKOFF:-30s}
+RETRY_MAX_BACKOFF=${KV_RETRY_MAX_BACKOFF:-0}
+RETRY_DEADLINE=${KV_RETRY_DEADLINE:-0}
+HOOKS_DIR="${KV_HOOKS_DIR}"
+CACHE_KEY_TPM=${KV_CACHE_KEY_TPM:-false}
+EOF
+
+# Secret sync and rotation annotations: volumes with syncK8sSecret or rotationAnnotation use the
+# token of the service account of the installer, copied next to the driver and kept fresh below as
+# projected tokens expire
+k8s_dir="${kv_vol_dir}/k8s"
+sa_dir="/var/run/secrets/kubernetes.io/serviceaccount"
+copy_token() {
+  cp "${sa_dir}/token" "${k8s_dir}/token.tmp" && chmod 600 "${k8s_dir}/token.tmp" && mv "${k8s_dir}/token.tmp" "${k8s_dir}/token"
+}
+k8s_api="false"
+if [[ "${KV_SYNC_K8S_SECRETS}" == "true" || "${KV_ROTATION_ANNOTATIONS}" == "true" ]]; then
+  k8s_api="true"
+fi
+if [[ "${k8s_api}" == "true" ]]; then
+  mkdir -p "${k8s_dir}"
+  chmod 700 "${k8s_dir}"
+  cp "${sa_dir}/ca.crt" "${k8s_dir}/ca.crt"
+  copy_token
+  cat >> ${kv_vol_dir}/kv.conf <<EOF
+K8S_API_SERVER="https://${KUBERNETES_SERVICE_HOST}:${KUBERNETES_SERVICE_PORT}"
+K8S_TOKEN_FILE="${k8s_dir}/token"
+K8S_CA_FILE="${k8s_dir}/ca.crt"
+EOF
+else
+  rm -rf "${k8s_dir}"
+fi
 
 
 #https://github.com/kubernetes/kubernetes/issues/17182
 # if we are running on kubernetes cluster as a daemon set we should
 # not exit otherwise, container will restart and goes into crashloop (even if exit code is 0)
-while true; do echo "install done, daemonset sleeping" && sleep 60; done
+while true; do
+  echo "install done, daemonset sleeping"
+  if [[ "${k8s_api}" == "true" ]]; then
+    copy_token || echo "failed to refresh the service account token"
+  fi
+  sleep 60
+done
 
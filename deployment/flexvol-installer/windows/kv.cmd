@@ -0,0 +1,3 @@
+@echo off
+rem kubelet on Windows runs <driver>.cmd, the driver being implemented by kv.ps1
+powershell.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -File "%~dp0kv.ps1" %*
@@ -0,0 +1,163 @@
+# Windows FlexVolume driver of Azure Key Vault, run by kubelet through kv.cmd:
+#   kv.cmd init
+#   kv.cmd getvolumename <json params>
+#   kv.cmd mount <mount dir> <json params>
+#   kv.cmd unmount <mount dir>
+
+$ErrorActionPreference = "Stop"
+
+$Log = "C:\var\log\kv-driver.log"
+$Kvfv = Join-Path $PSScriptRoot "azurekeyvault-flexvolume.exe"
+# unmount attempts while files are in use, with a doubling delay starting at 1s
+$UnmountAttempts = 4
+# flags of the driver set by the cluster admin rather than in the volume options, e.g.
+# @{ maxObjects = 10; rateLimitQPS = 20 }, overridden in kv.conf.ps1
+$NodeFlags = @{ stateDir = "C:\ProgramData\azurekeyvault-flexvolume" }
+$Conf = Join-Path $PSScriptRoot "kv.conf.ps1"
+if (Test-Path $Conf) {
+	. $Conf
+}
+
+# volume options and the flags of the driver they set
+$VolumeFlags = [ordered]@{
+	keyvaultname = "vaultName"; vaulturi = "vaultURI"; keyvaultobjectnames = "vaultObjectNames"
+	keyvaultobjecttypes = "vaultObjectTypes"; keyvaultobjectversions = "vaultObjectVersions"
+	keyvaultobjectaliases = "vaultObjectAliases"; objects = "vaultObjects"; tenantid = "tenantId"
+	cloudname = "cloudName"; aadregion = "aADRegion"; aadclientsecretfile = "aADClientSecretFile"
+	usepodidentity = "usePodIdentity"; usevmmanagedidentity = "useVmManagedIdentity"
+	vmmanagedidentityclientid = "vmManagedIdentityClientID"; nmiport = "nmiPort"
+	tagselector = "tagSelector"; objectnameprefix = "objectNamePrefix"
+	stripobjectnameprefix = "stripObjectNamePrefix"; mountallsecrets = "mountAllSecrets"
+	mountallsecretslimit = "mountAllSecretsLimit"; excludeobjectnames = "excludeObjectNames"
+	template = "template"; templateoutput = "templateOutput"; envfile = "envFile"
+	envkeyformat = "envKeyFormat"; propertiesfile = "propertiesFile"; aggregatefile = "aggregateFile"
+	aggregateformat = "aggregateFormat"; consistentreads = "consistentReads"
+	pathseparator = "pathSeparator"; filenamecase = "fileNameCase"; mountpolicy = "mountPolicy"; inactiveobjects = "inactiveObjects"
+	concurrency = "concurrency"; managedhsm = "managedHSM"; debugvalues = "debugValues"
+	timeformat = "timeFormat"; restrictendpoints = "restrictEndpoints"
+	allowedendpoints = "allowedEndpoints"; requireprivatelink = "requirePrivateLink"
+	keystore = "keystore"; keystoretype = "keystoreType"
+	writemetadata = "writeMetadata"; writechecksums = "writeChecksums"
+	filepermission = "filePermission"; dirpermission = "dirPermission"; atomicwrites = "atomicWrites"
+	dpapiprotectiondescriptor = "dpapiProtectionDescriptor"
+	retryattempts = "retryAttempts"; retryinitialbackoff = "retryInitialBackoff"
+	retrymaxbackoff = "retryMaxBackoff"; retrydeadline = "retryDeadline"
+	mounttimeoutseconds = "mountTimeoutSeconds"; allowstaleonerror = "allowStaleOnError"; rotation = "rotation"
+	rotationpollinterval = "rotationPollInterval"; rotationexpirywindow = "rotationExpiryWindow"
+	rotationgraceperiod = "rotationGracePeriod"; rotationcheckversions = "rotationCheckVersions"
+	synck8ssecret = "syncK8sSecret"
+	synck8ssecrettype = "syncK8sSecretType"; rotationannotation = "rotationAnnotation"
+	rotationsignal = "rotationSignal"; rotationsignalprocess = "rotationSignalProcess"
+	rotationwebhookurl = "rotationWebhookURL"; rotationwebhooksecretfile = "rotationWebhookSecretFile"
+}
+
+function Write-Log($message) {
+	# RFC3339 in UTC so the log doesn't depend on the node's locale or timezone
+	$timestamp = (Get-Date).ToUniversalTime().ToString("yyyy-MM-ddTHH:mm:ssZ")
+	Add-Content -Path $Log -Value "$timestamp $message"
+}
+
+function Write-Status($status, $message) {
+	$result = @{ status = $status }
+	if ($message) {
+		$result.message = $message
+	}
+	Write-Output (ConvertTo-Json -Compress $result)
+}
+
+function ConvertFrom-Base64($value) {
+	if (-not $value) {
+		return ""
+	}
+	return [Text.Encoding]::UTF8.GetString([Convert]::FromBase64String($value.Trim()))
+}
+
+function Mount-Volume($mntPath, $json) {
+	$options = ConvertFrom-Json $json
+	if ($options.keystorepassword) {
+		# the keystore password moved to the secretRef, so it isn't passed in plain volume options
+		Write-Status "Failure" "validation failed, keystorepassword is not supported in the options, set the keystorepassword key of the secretRef of the volume"
+		exit 1
+	}
+	$flags = @{}
+	foreach ($name in $NodeFlags.Keys) {
+		$flags[$name] = $NodeFlags[$name]
+	}
+	foreach ($option in $VolumeFlags.Keys) {
+		$value = $options.$option
+		if ($null -ne $value -and "$value" -ne "") {
+			$flags[$VolumeFlags[$option]] = "$value"
+		}
+	}
+	# Windows has no tmpfs nor bind mounts: the files are written to the disk of the node
+	$flags.allowPersistentDir = "true"
+	$flags.remountReadOnly = "false"
+	$flags.aADClientID = ConvertFrom-Base64 $options."kubernetes.io/secret/clientid"
+	$flags.aADClientSecret = ConvertFrom-Base64 $options."kubernetes.io/secret/clientsecret"
+	$flags.pfxPassword = ConvertFrom-Base64 $options."kubernetes.io/secret/pfxpassword"
+	$flags.keystorePassword = ConvertFrom-Base64 $options."kubernetes.io/secret/keystorepassword"
+	$flags.podNamespace = $options."kubernetes.io/pod.namespace"
+	$flags.podName = $options."kubernetes.io/pod.name"
+
+	New-Item -ItemType Directory -Force -Path $mntPath | Out-Null
+	$arguments = @("mount", "-logtostderr=1", "-dir=$mntPath")
+	$logged = @()
+	foreach ($name in $flags.Keys) {
+		$arguments += "-$name=$($flags[$name])"
+		if ($name -eq "aADClientSecret" -or $name -eq "keystorePassword" -or $name -eq "pfxPassword") {
+			$logged += "-$name=****"
+		} elseif ($name -eq "vaultObjects") {
+			# without the pfxPassword of volumes set up before it moved to the secretRef
+			$objects = $flags[$name] -replace '"pfxPassword"\s*:\s*"(\\.|[^"\\])*"', '"pfxPassword":"****"'
+			$logged += "-$name=$objects"
+		} else {
+			$logged += "-$name=$($flags[$name])"
+		}
+	}
+	Write-Log "$Kvfv mount -dir=$mntPath $($logged -join ' ')"
+	$output = & $Kvfv @arguments 2>&1
+	$output | ForEach-Object { Write-Log "$_" }
+	if ($LASTEXITCODE -ne 0) {
+		Remove-Item -Recurse -Force -ErrorAction SilentlyContinue $mntPath
+		Write-Status "Failure" "$Kvfv failed, $($output | Select-Object -Last 1)"
+		exit 1
+	}
+	Write-Status "Success"
+	exit 0
+}
+
+function Get-VolumeName($json) {
+	$options = ConvertFrom-Json $json
+	$arguments = @("getvolumename", "-logtostderr=1")
+	foreach ($option in $VolumeFlags.Keys) {
+		$value = $options.$option
+		if ($null -ne $value -and "$value" -ne "") {
+			$arguments += "-$($VolumeFlags[$option])=$value"
+		}
+	}
+	& $Kvfv @arguments 2>> $Log
+	exit $LASTEXITCODE
+}
+
+$op = $args[0]
+switch ($op) {
+	"init" {
+		& $Kvfv init 2>> $Log
+		exit $LASTEXITCODE
+	}
+	"getvolumename" {
+		Get-VolumeName $args[1]
+	}
+	"mount" {
+		Mount-Volume $args[1] $args[2]
+	}
+	"unmount" {
+		Write-Log "$Kvfv unmount -dir=$($args[1]) -attempts=$UnmountAttempts -stateDir=$($NodeFlags.stateDir)"
+		& $Kvfv unmount -logtostderr=1 "-dir=$($args[1])" "-attempts=$UnmountAttempts" "-stateDir=$($NodeFlags.stateDir)" 2>> $Log
+		exit $LASTEXITCODE
+	}
+	default {
+		Write-Status "Not supported"
+		exit 1
+	}
+}